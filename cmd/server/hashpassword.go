@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/http-everything/httpe/pkg/share/password"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// hashPasswordCmd prompts for a password and prints the hash to be used in the auth_basic section of the rules
+func hashPasswordCmd() *cobra.Command {
+	var algorithm string
+	cmd := &cobra.Command{
+		Use:   "hash-password",
+		Short: "Hash a password for HTTP basic authentication",
+		Long: "Prompts for a password and prints its hash to be pasted into the auth_basic section of the rules file. " +
+			"If the standard input is not a terminal, the password is read from the first line of the standard input.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cmd.SilenceUsage = true
+			// Errors are printed by Execute
+			cmd.SilenceErrors = true
+			pw, err := readPassword(os.Stdin, cmd.ErrOrStderr())
+			if err != nil {
+				return err
+			}
+			hash, err := password.Hash(pw, algorithm)
+			if err != nil {
+				return fmt.Errorf("%w '%s', use one of %s, %s or %s",
+					err, algorithm, password.Argon2id, password.Bcrypt, password.Scrypt)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), hash)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&algorithm, "algorithm", password.Default, "hashing algorithm, either argon2id, bcrypt or scrypt")
+	return cmd
+}
+
+// readPassword reads the password from the terminal without echoing it. The password must be entered twice.
+func readPassword(stdin *os.File, prompt io.Writer) (string, error) {
+	fd := int(stdin.Fd()) //nolint:gosec // disable G115
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("error reading password: %w", err)
+		}
+		pw := strings.TrimRight(line, "\r\n")
+		if pw == "" {
+			return "", errors.New("password must not be empty")
+		}
+		return pw, nil
+	}
+
+	fmt.Fprint(prompt, "Password: ")
+	pw, err := term.ReadPassword(fd)
+	fmt.Fprintln(prompt)
+	if err != nil {
+		return "", fmt.Errorf("error reading password: %w", err)
+	}
+	if len(pw) == 0 {
+		return "", errors.New("password must not be empty")
+	}
+	fmt.Fprint(prompt, "Repeat password: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(prompt)
+	if err != nil {
+		return "", fmt.Errorf("error reading password: %w", err)
+	}
+	if string(pw) != string(repeated) {
+		return "", errors.New("passwords don't match")
+	}
+	return string(pw), nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/http-everything/httpe/pkg/accesslog"
 	"github.com/http-everything/httpe/pkg/config"
 
 	"github.com/spf13/cobra"
@@ -36,15 +37,22 @@ func Execute() {
 	pFlags.StringP("data-dir", "d", config.DefaultDataDir, "set the data directory")
 	pFlags.StringP("data-retention", "p", config.DefaultDataRetention, "set the data retention period")
 	pFlags.String("log-level", config.DefaultLogLevel, "specify server log level. either error, info, or debug.")
+	pFlags.String("log-format", config.DefaultLogFormat, "specify server log format. either text, json, or logfmt.")
 	pFlags.StringP("log-file", "l", "", "specify server log file")
 	pFlags.StringP("rules-file", "r", "", "specify rules to map route to actions")
-	pFlags.String("access-log-file", "", "set the access log file in the apache common log format. use '-' for writing to stdout.")
+	pFlags.String("users-file", "", "specify an htpasswd file with users shared by all rules")
+	pFlags.String("groups-file", "", "specify a file with groups of shared users")
+	pFlags.String("access-log-file", "", "set the access log file. use '-' for writing to stdout.")
+	pFlags.String("access-log-format", accesslog.Combined, "specify the access log format. either common, combined, json, or custom.")
 	pFlags.String("cert-file", "", "specify the TLS certificate file")
 	pFlags.String("key-file", "", "specify the TLS key file")
+	pFlags.String("client-ca-file", "", "specify the CA certificates for verifying TLS client certificates")
 	pFlags.Bool("validate", false, "validate configuration and rules, then exit")
 	pFlags.BoolP("version", "v", false, "print version information")
 	pFlags.Bool("dump-rules", false, "dump a json representation of the rules yaml, skips validation")
 
+	RootCmd.AddCommand(hashPasswordCmd())
+
 	if err := RootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
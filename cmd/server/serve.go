@@ -6,16 +6,20 @@ import (
 	"io"
 	"os"
 
+	"github.com/http-everything/httpe/pkg/accesslog"
+	"github.com/http-everything/httpe/pkg/health"
+	"github.com/http-everything/httpe/pkg/oidc"
+	"github.com/http-everything/httpe/pkg/reloader"
 	"github.com/http-everything/httpe/pkg/rules"
 
 	"github.com/http-everything/httpe/pkg/config"
 	"github.com/http-everything/httpe/pkg/server"
 	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/share/timeunit"
 	"github.com/http-everything/httpe/pkg/share/version"
-)
+	"github.com/http-everything/httpe/pkg/userstore"
 
-const (
-	accessLogPermissions = 0644
+	humanise "github.com/dustin/go-humanize" //nolint:misspell
 )
 
 // serve starts and runs the HTTPE server
@@ -68,7 +72,46 @@ func serve() {
 		return
 	}
 
-	svr, err := server.New(cfg, rulesCfg.Rules, baseLogger, accessLogWriter)
+	users := userstore.New(cfg.S.UsersFile, cfg.S.GroupsFile)
+	err = users.Load(rulesCfg.Users, rulesCfg.Groups)
+	if err != nil {
+		reportErrorAndExit(baseLogger, fmt.Errorf("unable to load users: %w", err))
+		return
+	}
+
+	err = checkServerRequirements(cfg, rulesCfg.Rules)
+	if err != nil {
+		reportErrorAndExit(baseLogger, err)
+		return
+	}
+
+	opts := []server.Option{server.WithUsers(users)}
+	if cfg.OIDC != nil {
+		provider, err := oidc.New(context.Background(), cfg.OIDC, baseLogger.Fork("oidc"))
+		if err != nil {
+			reportErrorAndExit(baseLogger, err)
+			return
+		}
+		opts = append(opts, server.WithOIDC(provider))
+	}
+
+	// Watch the rules file and swap in new rules without restarting the server. The reloader is created before the
+	// server, so the server isn't ready while a reload is in progress.
+	var svr *server.Server
+	rlLogger := baseLogger.Fork("reloader")
+	rl := reloader.New(cfg.S.RulesFile, cfg.SMTP, rlLogger, func(rulesCfg *rules.Rules) {
+		if err := users.Load(rulesCfg.Users, rulesCfg.Groups); err != nil {
+			rlLogger.Errorf("reloading users failed, keeping the previous users: %s", err)
+		}
+		svr.Reload(rulesCfg.Rules)
+	})
+	rl.AlsoWatch(users.Files()...)
+	rl.AlsoValidate(func(rulesCfg *rules.Rules) error {
+		return checkServerRequirements(cfg, rulesCfg.Rules)
+	})
+	opts = append(opts, server.WithReadyChecks(health.Reload(rl.InProgress)))
+
+	svr, err = server.New(cfg, rulesCfg.Rules, baseLogger, accessLogWriter, opts...)
 	if err != nil {
 		reportErrorAndExit(baseLogger, fmt.Errorf("unable to setup HTTPE server: %w", err))
 		return
@@ -79,6 +122,12 @@ func serve() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	go func() {
+		if err := rl.Watch(ctx); err != nil {
+			baseLogger.Errorf("rules will not be reloaded on changes: %s", err)
+		}
+	}()
+
 	err = svr.Serve(ctx, true)
 	if err != nil {
 		reportErrorAndExit(baseLogger, fmt.Errorf("unable to start HTTPE server: %w", err))
@@ -87,12 +136,15 @@ func serve() {
 
 	svr.Shutdown()
 
+	if f, ok := accessLogWriter.(*accesslog.File); ok {
+		_ = f.Close()
+	}
 	baseLogger.Shutdown()
 }
 
 // setupLogs sets up the regular and access logs using the config specified
 func setupLogs(cfg *config.Config) (baseLogger *logger.Logger, accessLogWriter io.Writer, err error) {
-	baseLogger, err = logger.New("serve", cfg.S.LogFile, cfg.S.LogLevel)
+	baseLogger, err = logger.NewWithFormat("serve", cfg.S.LogFile, cfg.S.LogLevel, cfg.S.LogFormat)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to open server log: %w", err)
 	}
@@ -100,7 +152,11 @@ func setupLogs(cfg *config.Config) (baseLogger *logger.Logger, accessLogWriter i
 	if cfg.S.AccessLogFile == "-" {
 		AccessLogWriter = os.Stdout
 	} else if cfg.S.AccessLogFile != "" {
-		AccessLogWriter, err = os.OpenFile(cfg.S.AccessLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, accessLogPermissions)
+		rotation, err := accessLogRotation(cfg.S)
+		if err != nil {
+			return nil, nil, err
+		}
+		AccessLogWriter, err = accesslog.OpenFile(cfg.S.AccessLogFile, rotation, baseLogger.Fork("access log"))
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to open access log: %w", err)
 		}
@@ -110,6 +166,25 @@ func setupLogs(cfg *config.Config) (baseLogger *logger.Logger, accessLogWriter i
 	return baseLogger, AccessLogWriter, nil
 }
 
+// accessLogRotation returns when the access log is rotated
+func accessLogRotation(cfg *config.SvrConfig) (rotation accesslog.Rotation, err error) {
+	if cfg.AccessLogMaxSize != "" {
+		size, err := humanise.ParseBytes(cfg.AccessLogMaxSize)
+		if err != nil {
+			return rotation, fmt.Errorf("invalid access_log_max_size: %w", err)
+		}
+		rotation.MaxSize = int64(size) //nolint:gosec // disable G115
+	}
+	if cfg.AccessLogMaxAge != "" {
+		if rotation.MaxAge, err = timeunit.ParseDuration(cfg.AccessLogMaxAge); err != nil {
+			return rotation, fmt.Errorf("invalid access_log_max_age: %w", err)
+		}
+	}
+	rotation.MaxBackups = cfg.AccessLogMaxBackups
+	rotation.Compress = cfg.AccessLogCompress
+	return rotation, nil
+}
+
 // reportErrorAndExit is a simple helper fn to log to screen and the regular log
 func reportErrorAndExit(l *logger.Logger, err error) {
 	if l != nil {
@@ -118,3 +193,20 @@ func reportErrorAndExit(l *logger.Logger, err error) {
 	fmt.Println("error: " + err.Error())
 	os.Exit(1)
 }
+
+// checkServerRequirements verifies the server configuration provides what the rules require. It runs on start and
+// before reloaded rules are applied.
+func checkServerRequirements(cfg *config.Config, ruleSet *[]rules.Rule) error {
+	for _, rule := range *ruleSet {
+		if rule.With == nil {
+			continue
+		}
+		if rule.With.OIDC != nil && cfg.OIDC == nil {
+			return fmt.Errorf("rule '%s' requires an oidc configuration in httpe configuration file", rule.Name)
+		}
+		if rule.With.AuthMTLS != nil && cfg.S.ClientCAFile == "" {
+			return fmt.Errorf("rule '%s' requires a client_ca_file in httpe configuration file", rule.Name)
+		}
+	}
+	return nil
+}
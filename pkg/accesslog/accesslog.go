@@ -0,0 +1,384 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+
+	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/share/clientcert"
+	"github.com/http-everything/httpe/pkg/share/reqctx"
+)
+
+// Names of the formats
+const (
+	Common   = "common"
+	Combined = "combined"
+	JSON     = "json"
+	Custom   = "custom"
+	// Redacted replaces the values of redacted query parameters and URL placeholders
+	Redacted = "REDACTED"
+)
+
+// Record is a line of the access log. Custom templates access its fields, e.g. {{ .Status }}.
+type Record struct {
+	Time      time.Time
+	RemoteIP  string
+	User      string
+	Method    string
+	URI       string
+	Proto     string
+	Status    int
+	Size      int
+	Referer   string
+	UserAgent string
+	Duration  time.Duration
+	RequestID string
+	// Rule and Action are empty for requests not matching any rule
+	Rule   string
+	Action string
+	// ExitCode is the exit code of the script, empty if the request hasn't run a script synchronously
+	ExitCode string
+	// ClientCertSubject and ClientCertFingerprint are empty for requests without TLS client certificate
+	ClientCertSubject     string
+	ClientCertFingerprint string
+}
+
+// Format writes a record as line of the access log
+type Format func(w io.Writer, rec Record)
+
+// NewFormat returns the format of the given name. The custom format renders the template.
+func NewFormat(name string, tmpl string) (Format, error) {
+	switch name {
+	case Common:
+		return writeCommon, nil
+	case "", Combined:
+		return writeCombined, nil
+	case JSON:
+		return writeJSON, nil
+	case Custom:
+		if tmpl == "" {
+			return nil, fmt.Errorf("access log format %s requires a template", Custom)
+		}
+		t, err := template.New("access_log").Parse(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log template: %w", err)
+		}
+		return func(w io.Writer, rec Record) {
+			var buf strings.Builder
+			if err := t.Execute(&buf, rec); err != nil {
+				buf.WriteString("error rendering access log template: " + err.Error())
+			}
+			buf.WriteByte('\n')
+			_, _ = io.WriteString(w, buf.String())
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid access log format: %q", name)
+}
+
+// Entry collects what the handlers of a request know about it, for example the rule it has been routed to. Every
+// request passing the Handler carries an entry in its context. All methods may be called on a nil *Entry.
+type Entry struct {
+	rule     string
+	action   string
+	user     string
+	uri      string
+	exitCode string
+	skip     bool
+}
+
+type ctxKey struct{}
+
+// FromRequest returns the entry of the request, nil if the request hasn't passed the Handler
+func FromRequest(r *http.Request) *Entry {
+	e, _ := r.Context().Value(ctxKey{}).(*Entry)
+	return e
+}
+
+// SetUser sets the authenticated user
+func (e *Entry) SetUser(user string) {
+	if e != nil {
+		e.user = user
+	}
+}
+
+// SetExitCode sets the exit code of the script run by the request
+func (e *Entry) SetExitCode(code int) {
+	if e != nil {
+		e.exitCode = strconv.Itoa(code)
+	}
+}
+
+// RuleHandler marks requests as handled by the rule. Depending on the access_log settings of the rule, the request
+// isn't logged or its URL is logged with the values of query parameters and URL placeholders redacted.
+func RuleHandler(rule rules.Rule, next http.Handler) http.Handler {
+	settings := Settings(rule)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e := FromRequest(r); e != nil {
+			e.rule = rule.ID()
+			e.action = rule.Action()
+			e.skip = settings.Disable
+			if len(settings.Redact) > 0 {
+				e.uri = Redact(r, settings.Redact)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Settings returns the access_log settings of the rule, the zero value if the rule doesn't have any
+func Settings(rule rules.Rule) rules.AccessLog {
+	if rule.With != nil && rule.With.AccessLog != nil {
+		return *rule.With.AccessLog
+	}
+	return rules.AccessLog{}
+}
+
+// Redact returns the request URI with the values of the named query parameters and URL placeholders replaced by
+// REDACTED
+func Redact(r *http.Request, names []string) string {
+	redact := set(names)
+	path := redactPath(r, redact)
+	if r.URL.RawQuery == "" {
+		return path
+	}
+	pairs := strings.Split(r.URL.RawQuery, "&")
+	for i, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(key); err == nil && redact[name] {
+			pairs[i] = key + "=" + Redacted
+		}
+	}
+	return path + "?" + strings.Join(pairs, "&")
+}
+
+// RedactPath returns the escaped path of the request with the values of the named URL placeholders replaced by
+// REDACTED
+func RedactPath(r *http.Request, names []string) string {
+	return redactPath(r, set(names))
+}
+
+func set(names []string) map[string]bool {
+	m := make(map[string]bool, len(names))
+	for _, name := range names {
+		m[name] = true
+	}
+	return m
+}
+
+// redactPath rebuilds the path from the template of the route, so only the values of the placeholders are replaced
+func redactPath(r *http.Request, redact map[string]bool) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return r.URL.EscapedPath()
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return r.URL.EscapedPath()
+	}
+	vars := mux.Vars(r)
+	var b strings.Builder
+	depth, start := 0, 0
+	for i, c := range tmpl {
+		switch {
+		case c == '{':
+			if depth == 0 {
+				start = i
+			}
+			depth++
+		case c == '}' && depth > 0:
+			depth--
+			if depth == 0 {
+				// Placeholders are {name} or {name:pattern}
+				name, _, _ := strings.Cut(tmpl[start+1:i], ":")
+				if redact[name] {
+					b.WriteString(Redacted)
+				} else {
+					b.WriteString(url.PathEscape(vars[name]))
+				}
+			}
+		case depth == 0:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// Handler logs every request to w in the given format. Requests to rules opting out of the access log are skipped.
+func Handler(w io.Writer, format Format, next http.Handler) http.Handler {
+	h := handlers.CustomLoggingHandler(w, next, func(w io.Writer, p handlers.LogFormatterParams) {
+		e := FromRequest(p.Request)
+		if e == nil || e.skip {
+			return
+		}
+		format(w, newRecord(p, e))
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, &Entry{})))
+	})
+}
+
+func newRecord(p handlers.LogFormatterParams, e *Entry) Record {
+	req := p.Request
+	rec := Record{
+		Time:      p.TimeStamp,
+		User:      e.user,
+		Method:    req.Method,
+		URI:       e.uri,
+		Proto:     req.Proto,
+		Status:    p.StatusCode,
+		Size:      p.Size,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+		Duration:  time.Since(p.TimeStamp),
+		RequestID: reqctx.RequestID(req),
+		Rule:      e.rule,
+		Action:    e.action,
+		ExitCode:  e.exitCode,
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	rec.RemoteIP = host
+	if cert, ok := clientcert.FromRequest(req); ok {
+		rec.ClientCertSubject = cert.Subject
+		rec.ClientCertFingerprint = cert.Fingerprint
+		if rec.User == "" {
+			rec.User = cert.CommonName
+		}
+	}
+	if rec.URI == "" {
+		rec.URI = req.RequestURI
+		if req.ProtoMajor == 2 && req.Method == http.MethodConnect {
+			rec.URI = req.Host
+		}
+		if rec.URI == "" {
+			rec.URI = p.URL.RequestURI()
+		}
+	}
+	return rec
+}
+
+// writeCommon writes the record in the Common Log Format
+func writeCommon(w io.Writer, rec Record) {
+	buf := appendCommon(make([]byte, 0, 256), rec)
+	buf = append(buf, '\n')
+	_, _ = w.Write(buf)
+}
+
+// writeCombined writes the record in the Apache Combined Log Format. For requests with a TLS client certificate, the
+// subject and the fingerprint are appended as two additional quoted fields.
+func writeCombined(w io.Writer, rec Record) {
+	buf := appendCommon(make([]byte, 0, 256), rec)
+	buf = append(buf, ` "`...)
+	buf = appendQuoted(buf, rec.Referer)
+	buf = append(buf, `" "`...)
+	buf = appendQuoted(buf, rec.UserAgent)
+	buf = append(buf, '"')
+	if rec.ClientCertFingerprint != "" {
+		buf = append(buf, ` "`...)
+		buf = appendQuoted(buf, rec.ClientCertSubject)
+		buf = append(buf, `" "`...)
+		buf = append(buf, rec.ClientCertFingerprint...)
+		buf = append(buf, '"')
+	}
+	buf = append(buf, '\n')
+	_, _ = w.Write(buf)
+}
+
+func appendCommon(buf []byte, rec Record) []byte {
+	user := rec.User
+	if user == "" {
+		user = "-"
+	}
+	buf = append(buf, rec.RemoteIP...)
+	buf = append(buf, " - "...)
+	buf = appendQuoted(buf, user)
+	buf = append(buf, " ["...)
+	buf = rec.Time.AppendFormat(buf, "02/Jan/2006:15:04:05 -0700")
+	buf = append(buf, `] "`...)
+	buf = append(buf, rec.Method...)
+	buf = append(buf, ' ')
+	buf = appendQuoted(buf, rec.URI)
+	buf = append(buf, ' ')
+	buf = append(buf, rec.Proto...)
+	buf = append(buf, `" `...)
+	buf = strconv.AppendInt(buf, int64(rec.Status), 10)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, int64(rec.Size), 10)
+	return buf
+}
+
+// jsonRecord is the JSON encoding of a record
+type jsonRecord struct {
+	Time                  string  `json:"time"`
+	RemoteIP              string  `json:"remote_ip"`
+	User                  string  `json:"user,omitempty"`
+	Method                string  `json:"method"`
+	URI                   string  `json:"uri"`
+	Proto                 string  `json:"proto"`
+	Status                int     `json:"status"`
+	Size                  int     `json:"size"`
+	Referer               string  `json:"referer,omitempty"`
+	UserAgent             string  `json:"user_agent,omitempty"`
+	Duration              float64 `json:"duration"`
+	RequestID             string  `json:"request_id,omitempty"`
+	Rule                  string  `json:"rule,omitempty"`
+	Action                string  `json:"action,omitempty"`
+	ExitCode              *int    `json:"exit_code,omitempty"`
+	ClientCertSubject     string  `json:"client_cert_subject,omitempty"`
+	ClientCertFingerprint string  `json:"client_cert_fingerprint,omitempty"`
+}
+
+// writeJSON writes the record as JSON object, the duration in seconds
+func writeJSON(w io.Writer, rec Record) {
+	jr := jsonRecord{
+		Time:                  rec.Time.Format(time.RFC3339Nano),
+		RemoteIP:              rec.RemoteIP,
+		User:                  rec.User,
+		Method:                rec.Method,
+		URI:                   rec.URI,
+		Proto:                 rec.Proto,
+		Status:                rec.Status,
+		Size:                  rec.Size,
+		Referer:               rec.Referer,
+		UserAgent:             rec.UserAgent,
+		Duration:              rec.Duration.Seconds(),
+		RequestID:             rec.RequestID,
+		Rule:                  rec.Rule,
+		Action:                rec.Action,
+		ClientCertSubject:     rec.ClientCertSubject,
+		ClientCertFingerprint: rec.ClientCertFingerprint,
+	}
+	if code, err := strconv.Atoi(rec.ExitCode); err == nil {
+		jr.ExitCode = &code
+	}
+	// Encode to a buffer first, so the line is written at once. URLs are kept readable, & isn't escaped.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(jr); err != nil {
+		return
+	}
+	_, _ = w.Write(buf.Bytes())
+}
+
+// appendQuoted appends s with quotes, backslashes and non-printable characters escaped, but without surrounding
+// quotes
+func appendQuoted(buf []byte, s string) []byte {
+	quoted := strconv.Quote(s)
+	return append(buf, quoted[1:len(quoted)-1]...)
+}
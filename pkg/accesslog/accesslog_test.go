@@ -0,0 +1,172 @@
+package accesslog_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/http-everything/httpe/pkg/accesslog"
+	"github.com/http-everything/httpe/pkg/rules"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormats(t *testing.T) {
+	rec := accesslog.Record{
+		Time:      time.Date(2026, 10, 18, 10, 21, 44, 0, time.FixedZone("CEST", 2*3600)),
+		RemoteIP:  "192.0.2.1",
+		User:      "john",
+		Method:    "POST",
+		URI:       "/deploy?env=prod&page=2",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		Size:      8,
+		Referer:   "https://example.com/",
+		UserAgent: "curl/8.0",
+		Duration:  1500 * time.Millisecond,
+		RequestID: "abc123",
+		Rule:      "Deploy",
+		Action:    rules.RunScript,
+		ExitCode:  "0",
+	}
+	cases := []struct {
+		name     string
+		format   string
+		template string
+		want     string
+		wantErr  string
+	}{
+		{
+			name:   "Common",
+			format: accesslog.Common,
+			want:   `192.0.2.1 - john [18/Oct/2026:10:21:44 +0200] "POST /deploy?env=prod&page=2 HTTP/1.1" 200 8` + "\n",
+		},
+		{
+			name:   "Combined",
+			format: accesslog.Combined,
+			want: `192.0.2.1 - john [18/Oct/2026:10:21:44 +0200] "POST /deploy?env=prod&page=2 HTTP/1.1" 200 8 ` +
+				`"https://example.com/" "curl/8.0"` + "\n",
+		},
+		{
+			name:   "Default",
+			format: "",
+			want: `192.0.2.1 - john [18/Oct/2026:10:21:44 +0200] "POST /deploy?env=prod&page=2 HTTP/1.1" 200 8 ` +
+				`"https://example.com/" "curl/8.0"` + "\n",
+		},
+		{
+			name:   "JSON",
+			format: accesslog.JSON,
+			want: `{"time":"2026-10-18T10:21:44+02:00","remote_ip":"192.0.2.1","user":"john","method":"POST",` +
+				`"uri":"/deploy?env=prod&page=2","proto":"HTTP/1.1","status":200,"size":8,"referer":"https://example.com/",` +
+				`"user_agent":"curl/8.0","duration":1.5,"request_id":"abc123","rule":"Deploy","action":"run.script",` +
+				`"exit_code":0}` + "\n",
+		},
+		{
+			name:     "Custom",
+			format:   accesslog.Custom,
+			template: `{{ .RequestID }} {{ .Rule }} {{ .Action }} {{ .Status }} exit={{ .ExitCode }} {{ .Duration }}`,
+			want:     "abc123 Deploy run.script 200 exit=0 1.5s\n",
+		},
+		{
+			name:    "Custom without template",
+			format:  accesslog.Custom,
+			wantErr: "access log format custom requires a template",
+		},
+		{
+			name:     "Invalid template",
+			format:   accesslog.Custom,
+			template: "{{ .Status",
+			wantErr:  "invalid access log template",
+		},
+		{
+			name:    "Invalid format",
+			format:  "apache",
+			wantErr: `invalid access log format: "apache"`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			format, err := accesslog.NewFormat(tc.format, tc.template)
+			if tc.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			var buf bytes.Buffer
+			format(&buf, rec)
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	router := mux.NewRouter()
+	for _, rule := range []rules.Rule{
+		{
+			Name:      "Hook",
+			On:        &rules.On{Path: "/hook/{token}/{env}"},
+			RunScript: "deploy",
+			With:      &rules.With{AccessLog: &rules.AccessLog{Redact: []string{"token", "key"}}},
+		},
+		{
+			Name:          "Health",
+			On:            &rules.On{Path: "/health"},
+			AnswerContent: "ok",
+			With:          &rules.With{AccessLog: &rules.AccessLog{Disable: true}},
+		},
+	} {
+		router.Path(rule.On.Path).Handler(accesslog.RuleHandler(rule,
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				accesslog.FromRequest(r).SetUser("john")
+				accesslog.FromRequest(r).SetExitCode(3)
+			})))
+	}
+	format, err := accesslog.NewFormat(accesslog.Custom, "{{ .User }} {{ .URI }} {{ .Rule }} {{ .ExitCode }}")
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	h := accesslog.Handler(&buf, format, router)
+
+	cases := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{
+			name: "Redacted",
+			url:  "/hook/s3cr3t/prod?key=s3cr3t&page=s3cr3t&key=other",
+			want: "john /hook/REDACTED/prod?key=REDACTED&page=s3cr3t&key=REDACTED Hook 3\n",
+		},
+		{
+			name: "Disabled",
+			url:  "/health",
+			want: "",
+		},
+		{
+			name: "No rule",
+			url:  "/unknown?key=value",
+			want: " /unknown?key=value  \n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf.Reset()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tc.url, nil))
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+func TestNilEntry(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.Nil(t, accesslog.FromRequest(r))
+	assert.NotPanics(t, func() {
+		accesslog.FromRequest(r).SetUser("john")
+		accesslog.FromRequest(r).SetExitCode(0)
+	})
+}
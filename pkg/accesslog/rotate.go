@@ -0,0 +1,224 @@
+package accesslog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/share/logger"
+)
+
+const (
+	filePermissions = 0644
+	// backupTimeFormat is inserted into the names of rotated files, it sorts in chronological order
+	backupTimeFormat = "20060102T150405.000"
+)
+
+// Rotation configures when a log file is rotated. Zero values disable the respective limit.
+type Rotation struct {
+	// MaxSize rotates the file before it exceeds the size in bytes
+	MaxSize int64
+	// MaxAge rotates the file when it has been written to for longer
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files kept, the oldest are deleted
+	MaxBackups int
+	// Compress compresses rotated files with gzip
+	Compress bool
+}
+
+// File is a log file that is rotated by size and age. Rotated files are renamed by the time of the rotation, e.g.
+// access.log becomes access-20261018T102144.120.log, and compressed in the background, if requested.
+type File struct {
+	path     string
+	rotation Rotation
+	logger   *logger.Logger
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	opened  time.Time
+	pending sync.WaitGroup
+	// cleanup serialises compressing and removing backups of consecutive rotations
+	cleanup sync.Mutex
+}
+
+// OpenFile opens the log file for appending. Errors of the rotation are logged to the logger.
+func OpenFile(path string, rotation Rotation, logger *logger.Logger) (*File, error) {
+	f := &File{path: path, rotation: rotation, logger: logger}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, filePermissions)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	// The age counts from the time httpe started writing to the file
+	f.opened = time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would exceed the size or the file is too old. Lines are never
+// split across files.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.needsRotation(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			f.logger.Errorf("error rotating %s: %s", f.path, err)
+			if f.file == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *File) needsRotation(n int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.rotation.MaxSize > 0 && f.size+n > f.rotation.MaxSize {
+		return true
+	}
+	return f.rotation.MaxAge > 0 && time.Since(f.opened) >= f.rotation.MaxAge
+}
+
+// rotate renames the current file and opens a new one. The caller must hold the lock.
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	ext := filepath.Ext(f.path)
+	backup := strings.TrimSuffix(f.path, ext) + "-" + time.Now().Format(backupTimeFormat) + ext
+	if err := os.Rename(f.path, backup); err != nil {
+		// Keep writing to the current file rather than losing lines
+		if openErr := f.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.pending.Add(1)
+	go func() {
+		defer f.pending.Done()
+		f.cleanup.Lock()
+		defer f.cleanup.Unlock()
+		if f.rotation.Compress {
+			if err := compress(backup); err != nil {
+				f.logger.Errorf("error compressing %s: %s", backup, err)
+			}
+		}
+		if err := f.removeBackups(); err != nil {
+			f.logger.Errorf("error removing old access logs: %s", err)
+		}
+	}()
+	return nil
+}
+
+// removeBackups deletes the oldest rotated files exceeding MaxBackups
+func (f *File) removeBackups() error {
+	if f.rotation.MaxBackups == 0 {
+		return nil
+	}
+	backups, err := f.Backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > f.rotation.MaxBackups {
+		if err = os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Backups returns the rotated files, the oldest first
+func (f *File) Backups() ([]string, error) {
+	ext := filepath.Ext(f.path)
+	matches, err := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, m := range matches {
+		// Skip files being compressed, they are renamed when done
+		if !strings.HasSuffix(m, ".tmp") {
+			backups = append(backups, m)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return strings.TrimSuffix(backups[i], ".gz") < strings.TrimSuffix(backups[j], ".gz")
+	})
+	return backups, nil
+}
+
+// compress replaces the file by its gzip compressed copy
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePermissions)
+	if err != nil {
+		_ = src.Close()
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	// Windows can't remove open files
+	_ = src.Close()
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("error writing %s: %w", tmp, err)
+	}
+	if err = os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close closes the file after the compression of rotated files has finished
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending.Wait()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,101 @@
+package accesslog_test
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/accesslog"
+	"github.com/http-everything/httpe/pkg/share/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFile(t *testing.T, rotation accesslog.Rotation) (*accesslog.File, string) {
+	t.Helper()
+	dir := t.TempDir()
+	l, err := logger.New("test", filepath.Join(dir, "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	path := filepath.Join(dir, "access.log")
+	f, err := accesslog.OpenFile(path, rotation, l)
+	require.NoError(t, err)
+	return f, path
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	r, err := os.Open(path)
+	require.NoError(t, err)
+	defer r.Close()
+	var content io.Reader = r
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(r)
+		require.NoError(t, err)
+		content = zr
+	}
+	b, err := io.ReadAll(content)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestRotateBySize(t *testing.T) {
+	cases := []struct {
+		name     string
+		compress bool
+	}{
+		{name: "Uncompressed"},
+		{name: "Compressed", compress: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, path := newFile(t, accesslog.Rotation{MaxSize: 10, MaxBackups: 2, Compress: tc.compress})
+			for _, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+				_, err := f.Write([]byte(line))
+				require.NoError(t, err)
+				// Backups are named by the time of the rotation in milliseconds
+				time.Sleep(2 * time.Millisecond)
+			}
+			require.NoError(t, f.Close())
+
+			assert.Equal(t, "line 4\n", readFile(t, path))
+			backups, err := f.Backups()
+			require.NoError(t, err)
+			// The backup of line 1 has been deleted
+			require.Len(t, backups, 2)
+			for i, want := range []string{"line 2\n", "line 3\n"} {
+				assert.Equal(t, tc.compress, strings.HasSuffix(backups[i], ".log.gz"), backups[i])
+				assert.Equal(t, want, readFile(t, backups[i]))
+			}
+		})
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	f, path := newFile(t, accesslog.Rotation{MaxAge: 50 * time.Millisecond})
+	_, err := f.Write([]byte("line 1\n"))
+	require.NoError(t, err)
+	_, err = f.Write([]byte("line 2\n"))
+	require.NoError(t, err)
+	time.Sleep(60 * time.Millisecond)
+	_, err = f.Write([]byte("line 3\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, "line 3\n", readFile(t, path))
+	backups, err := f.Backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "line 1\nline 2\n", readFile(t, backups[0]))
+}
+
+func TestWriteClosed(t *testing.T) {
+	f, _ := newFile(t, accesslog.Rotation{})
+	require.NoError(t, f.Close())
+	_, err := f.Write([]byte("line\n"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
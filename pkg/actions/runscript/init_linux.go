@@ -0,0 +1,100 @@
+package runscript
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// scriptInit is the name the httpe binary is started with to prepare the process of a script, i.e. to set up
+	// the sandbox and the limits, before executing the interpreter
+	scriptInit = "httpe-script-init"
+	// scriptInitEnv hands over the initSpec to the script init
+	scriptInitEnv = "HTTPE_SCRIPT_INIT"
+)
+
+// initSpec describes how the script init prepares the process and the interpreter executed thereafter
+type initSpec struct {
+	Rlimits []rlimit     `json:"rlimits,omitempty"`
+	Sandbox *sandboxSpec `json:"sandbox,omitempty"`
+	Path    string       `json:"path"`
+	Args    []string     `json:"args"`
+}
+
+// rlimit is a resource limit set by the script init
+type rlimit struct {
+	Resource int    `json:"resource"`
+	Value    uint64 `json:"value"`
+}
+
+func init() {
+	if len(os.Args) == 0 || os.Args[0] != scriptInit {
+		return
+	}
+	// Capabilities are a property of the thread, the interpreter must be executed by the thread dropping them
+	runtime.LockOSThread()
+	err := enterInit()
+	fmt.Fprintf(os.Stderr, "error preparing the script: %s\n", err)
+	os.Exit(127)
+}
+
+// setupInit starts the httpe binary as script init, if the script is sandboxed or limited. The init applies the
+// limits in the process of the script, so they are in place before the interpreter reads the first instruction.
+func (p *process) setupInit(cmd *exec.Cmd) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	rlimits, err := p.rlimits()
+	if err != nil {
+		return err
+	}
+	if len(rlimits) == 0 && p.sandbox == nil {
+		return nil
+	}
+	spec := initSpec{Rlimits: rlimits, Path: cmd.Path, Args: cmd.Args}
+	if p.sandbox != nil {
+		if spec.Sandbox, err = p.setupSandbox(cmd); err != nil {
+			return err
+		}
+	}
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env, scriptInitEnv+"="+string(specJSON))
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = []string{scriptInit}
+	return nil
+}
+
+// enterInit sets up the sandbox, if any, sets the limits and executes the interpreter. It only returns on errors.
+func enterInit() error {
+	var spec initSpec
+	if err := json.Unmarshal([]byte(os.Getenv(scriptInitEnv)), &spec); err != nil {
+		return fmt.Errorf("invalid spec: %w", err)
+	}
+	if err := os.Unsetenv(scriptInitEnv); err != nil {
+		return err
+	}
+	if spec.Sandbox != nil {
+		if err := enterSandbox(spec.Sandbox); err != nil {
+			return fmt.Errorf("error setting up the sandbox: %w", err)
+		}
+	}
+	// The limits are set last, so they don't restrict setting up the sandbox. The interpreter inherits them.
+	for _, l := range spec.Rlimits {
+		if err := unix.Setrlimit(l.Resource, &unix.Rlimit{Cur: l.Value, Max: l.Value}); err != nil {
+			return fmt.Errorf("error limiting %s: %w", rlimitNames[l.Resource], err)
+		}
+	}
+	return unix.Exec(spec.Path, spec.Args, os.Environ())
+}
@@ -0,0 +1,50 @@
+package runscript
+
+import (
+	"fmt"
+	"syscall"
+
+	humanise "github.com/dustin/go-humanize" //nolint:misspell
+	"golang.org/x/sys/unix"
+)
+
+// rlimitNames are the names of the resources in error messages
+var rlimitNames = map[int]string{
+	unix.RLIMIT_CPU:    "cpu",
+	unix.RLIMIT_AS:     "memory",
+	unix.RLIMIT_NOFILE: "open files",
+	unix.RLIMIT_NPROC:  "processes",
+}
+
+// setupCgroup places the script in the cgroup while it's created, so no process of the script escapes the cgroup
+func (p *process) setupCgroup(attr *syscall.SysProcAttr) {
+	if p.cgroup == nil {
+		return
+	}
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(p.cgroup.Fd())
+}
+
+// rlimits returns the resource limits of the script, they are set by the script init. Processes started by the
+// script inherit them.
+func (p *process) rlimits() (rlimits []rlimit, err error) {
+	if p.limits == nil {
+		return nil, nil
+	}
+	add := func(resource int, value uint64) {
+		if value > 0 {
+			rlimits = append(rlimits, rlimit{Resource: resource, Value: value})
+		}
+	}
+	add(unix.RLIMIT_CPU, uint64(p.limits.CPU)) // #nosec G115
+	if p.limits.Memory != "" {
+		memory, err := humanise.ParseBytes(p.limits.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory limit: %w", err)
+		}
+		add(unix.RLIMIT_AS, memory)
+	}
+	add(unix.RLIMIT_NOFILE, uint64(p.limits.OpenFiles)) // #nosec G115
+	add(unix.RLIMIT_NPROC, uint64(p.limits.Processes))  // #nosec G115
+	return rlimits, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+
+package runscript
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setupCgroup does nothing, cgroups are specific to Linux. newProcess rejects limits and the sandbox on other
+// systems.
+func (p *process) setupCgroup(_ *syscall.SysProcAttr) {}
+
+func (p *process) setupInit(_ *exec.Cmd) error {
+	return nil
+}
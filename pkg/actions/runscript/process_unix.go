@@ -0,0 +1,127 @@
+//go:build !windows
+
+package runscript
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"github.com/http-everything/httpe/pkg/rules"
+)
+
+// process prepares the operating system process of a script
+type process struct {
+	cred    *syscall.Credential
+	limits  *rules.Limits
+	cgroup  *os.File
+	sandbox *rules.Sandbox
+	cwd     string
+	// files are read by the interpreter, they are made available in the sandbox
+	files []string
+}
+
+func newProcess(args rules.Args, cwd string) (p *process, err error) {
+	p = &process{limits: args.Limits, sandbox: args.Sandbox, cwd: cwd}
+	if args.RunAs != "" {
+		if p.cred, err = credential(args.RunAs); err != nil {
+			return nil, err
+		}
+	}
+	if args.Limits != nil && runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("limits are not supported on %s", runtime.GOOS)
+	}
+	if args.Sandbox != nil && runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("sandbox is not supported on %s", runtime.GOOS)
+	}
+	if args.Limits != nil && args.Limits.Cgroup != "" {
+		if p.cgroup, err = os.Open(args.Limits.Cgroup); err != nil {
+			return nil, fmt.Errorf("error opening cgroup: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// setup starts the script in its own process group, so the script and all processes started by it can be killed
+// at once. It must be called after the environment of the command has been set.
+func (p *process) setup(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    true,
+		Credential: p.cred,
+	}
+	p.setupCgroup(cmd.SysProcAttr)
+	cmd.Cancel = func() error {
+		return p.kill(cmd.Process)
+	}
+	return p.setupInit(cmd)
+}
+
+// kill kills the process group of the script
+func (p *process) kill(proc *os.Process) error {
+	err := syscall.Kill(-proc.Pid, syscall.SIGKILL)
+	if errors.Is(err, syscall.ESRCH) {
+		return os.ErrProcessDone
+	}
+	return err
+}
+
+// prepareFile hands over a file read by the interpreter to the user the script is executed as
+func (p *process) prepareFile(file string) error {
+	p.files = append(p.files, file)
+	if p.cred == nil {
+		return nil
+	}
+	return os.Chown(file, int(p.cred.Uid), int(p.cred.Gid))
+}
+
+func (p *process) release() {
+	if p.cgroup != nil {
+		p.cgroup.Close()
+	}
+}
+
+// credential looks up the user and group of the run_as argument. Without a group, the primary group of the user is
+// used. Numeric IDs are accepted for users and groups unknown to the system.
+func credential(runAs string) (*syscall.Credential, error) {
+	userName, groupName, err := rules.ParseRunAs(runAs)
+	if err != nil {
+		return nil, err
+	}
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return nil, fmt.Errorf("unknown user '%s'", userName)
+		}
+	}
+	gid := u.Gid
+	var groups []uint32
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return nil, fmt.Errorf("unknown group '%s'", groupName)
+			}
+		}
+		gid = g.Gid
+	} else if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if n, err := strconv.ParseUint(id, 10, 32); err == nil {
+				groups = append(groups, uint32(n))
+			}
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid of user '%s': %w", userName, err)
+	}
+	g, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid of user '%s': %w", userName, err)
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(g), Groups: groups}, nil
+}
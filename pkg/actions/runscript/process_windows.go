@@ -0,0 +1,40 @@
+package runscript
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+
+	"github.com/http-everything/httpe/pkg/rules"
+)
+
+// process prepares the operating system process of a script
+type process struct{}
+
+func newProcess(args rules.Args, _ string) (*process, error) {
+	if args.RunAs != "" {
+		return nil, errors.New("run_as is not supported on windows")
+	}
+	if args.Limits != nil {
+		return nil, errors.New("limits are not supported on windows")
+	}
+	if args.Sandbox != nil {
+		return nil, errors.New("sandbox is not supported on windows")
+	}
+	return &process{}, nil
+}
+
+func (p *process) setup(_ *exec.Cmd) error {
+	return nil
+}
+
+// kill kills the interpreter. Processes started by the script keep running.
+func (p *process) kill(proc *os.Process) error {
+	return proc.Kill()
+}
+
+func (p *process) prepareFile(_ string) error {
+	return nil
+}
+
+func (p *process) release() {}
@@ -2,12 +2,16 @@ package runscript
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,43 +21,120 @@ import (
 	"github.com/http-everything/httpe/pkg/share/buffer"
 	"github.com/http-everything/httpe/pkg/share/firstof"
 	"github.com/http-everything/httpe/pkg/share/remove"
+	"github.com/http-everything/httpe/pkg/signature"
 	"github.com/http-everything/httpe/pkg/templating"
+	"github.com/http-everything/httpe/pkg/tracing"
 
 	"github.com/lithammer/shortuuid/v4"
 )
 
 const (
 	DefaultTimeoutSecs = 30
+	// defaultPath is the search path of scripts with a clean environment
+	defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
 )
 
-type Script struct{}
+var (
+	// ErrTimeout is wrapped by the error of a script killed because it exceeded its timeout
+	ErrTimeout = errors.New("timeout exceeded")
+	// ErrKilled is wrapped by the error of a script terminated by a signal not sent by httpe, e.g. by the OOM
+	// killer or on exceeding the cpu limit
+	ErrKilled = errors.New("script killed")
+)
+
+// scriptError is returned for scripts terminated without exit code. The message keeps the details collected while
+// terminating the script, kind tells why it has been terminated.
+type scriptError struct {
+	msg  string
+	kind error
+}
+
+func (e scriptError) Error() string {
+	return e.msg
+}
+
+func (e scriptError) Unwrap() error {
+	return e.kind
+}
+
+// Script executes scripts. If Stdout or Stderr are set, the output of the script is copied to them while the
+// script is running, in addition to being collected for the action response. A TraceParent is passed to the
+// script as TRACEPARENT environment variable.
+type Script struct {
+	Stdout      io.Writer
+	Stderr      io.Writer
+	TraceParent string
+}
 
 func (s Script) Execute(rule rules.Rule, reqData requestdata.Data) (response actions.ActionResponse, err error) {
 	var exitCode = -1
 	timeoutSec := firstof.Int(rule.Args.Timeout, DefaultTimeoutSecs)
-	script, err := templating.RenderString(rule.RunScript, reqData)
-	if err != nil {
-		return actions.ActionResponse{}, fmt.Errorf("error rendering script: %w", err)
+	interpreter := firstof.String(rule.Args.Interpreter, defaultInterpreter())
+
+	script := rule.RunScript
+	switch {
+	case rule.Args.DisableTemplating:
+	case rule.Args.AutoQuote:
+		quoteFunc, err := interpreterQuoteFunc(interpreter)
+		if err != nil {
+			return actions.ActionResponse{}, err
+		}
+		script, err = templating.RenderStringAutoQuoted(rule.RunScript, reqData, quoteFunc)
+		if err != nil {
+			return actions.ActionResponse{}, fmt.Errorf("error rendering script: %w", err)
+		}
+	default:
+		script, err = templating.RenderString(rule.RunScript, reqData)
+		if err != nil {
+			return actions.ActionResponse{}, fmt.Errorf("error rendering script: %w", err)
+		}
 	}
 
-	interpreter := firstof.String(rule.Args.Interpreter, defaultInterpreter())
+	// The working directory only applies to the script, scripts of concurrent requests must not share it
+	cwd := firstof.String(rule.Args.Cwd, os.TempDir())
+	env, err := environ(rule, reqData, s.TraceParent)
+	if err != nil {
+		return actions.ActionResponse{}, err
+	}
 
-	// Change to the working directory if specified by the rule.
-	err = os.Chdir(firstof.String(rule.Args.Cwd, os.TempDir()))
+	proc, err := newProcess(rule.Args, cwd)
 	if err != nil {
-		return actions.ActionResponse{}, fmt.Errorf("error changing to directory '%s': %w", rule.Args.Cwd, err)
+		return actions.ActionResponse{}, fmt.Errorf("error preparing the script: %w", err)
 	}
+	defer proc.release()
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSec)*time.Second)
 	defer cancel()
 
-	args, cleanupFn, err := defaultInterpreterArgs(interpreter, script)
-	if err != nil {
-		return actions.ActionResponse{}, fmt.Errorf("error preparing interpreter: %w", err)
+	// By default, the script is piped to the interpreter. If stdin is reserved for the request data, the script
+	// is handed over as file.
+	stdinContent := script
+	var args []string
+	var cleanupFn func()
+	if rule.Args.RequestStdin {
+		reqJSON, err := json.Marshal(reqData)
+		if err != nil {
+			return actions.ActionResponse{}, fmt.Errorf("error encoding request data: %w", err)
+		}
+		stdinContent = string(reqJSON)
+		args, cleanupFn, err = scriptFileInterpreterArgs(interpreter, script, proc.prepareFile)
+		if err != nil {
+			return actions.ActionResponse{}, fmt.Errorf("error preparing interpreter: %w", err)
+		}
+	} else {
+		args, cleanupFn, err = defaultInterpreterArgs(interpreter, script, proc.prepareFile)
+		if err != nil {
+			return actions.ActionResponse{}, fmt.Errorf("error preparing interpreter: %w", err)
+		}
 	}
 	defer cleanupFn()
 
 	cmd := exec.CommandContext(ctx, interpreter, args...)
+	cmd.Dir = cwd
+	cmd.Env = env
+	if err = proc.setup(cmd); err != nil {
+		return actions.ActionResponse{}, fmt.Errorf("error preparing the script: %w", err)
+	}
 
 	// Create a stdin pipe to the script
 	stdin, err := cmd.StdinPipe()
@@ -63,18 +144,18 @@ func (s Script) Execute(rule rules.Rule, reqData requestdata.Data) (response act
 
 	var stdinBu buffer.Buffer
 	defer stdinBu.CollectingDone()
-	cmd.Stdout = &stdinBu
+	cmd.Stdout = teeWriter(&stdinBu, s.Stdout)
 
 	var stderrBu buffer.Buffer
 	defer stderrBu.CollectingDone()
-	cmd.Stderr = &stderrBu
+	cmd.Stderr = teeWriter(&stderrBu, s.Stderr)
 
 	if err = cmd.Start(); err != nil { // Use start, not run
 		return actions.ActionResponse{}, fmt.Errorf("error starting the script: %w", err)
 	}
 
-	// Write the script to stdin of the interpreter
-	_, err = io.WriteString(stdin, script)
+	// Write the script or the request data to stdin of the interpreter
+	_, err = io.WriteString(stdin, stdinContent)
 	if err != nil {
 		return actions.ActionResponse{}, fmt.Errorf("error writing to stdin pipe: %w", err)
 	}
@@ -94,9 +175,10 @@ func (s Script) Execute(rule rules.Rule, reqData requestdata.Data) (response act
 	go func() {
 		select {
 		case <-ctx.Done():
-			err := cmd.Process.Kill()
+			// Kill the script and all processes started by it
+			err := proc.kill(cmd.Process)
 
-			if err != nil {
+			if err != nil && !errors.Is(err, os.ErrProcessDone) {
 				killCh <- fmt.Errorf("killing the script with pid %d failed: %w", cmd.Process.Pid, err)
 			} else {
 				killCh <- errors.New("script killed")
@@ -125,17 +207,15 @@ func (s Script) Execute(rule rules.Rule, reqData requestdata.Data) (response act
 
 	select {
 	case <-ctx.Done():
+		// Give the killed processes a moment to terminate
 		select {
 		case <-process.Done():
-			for err := range doneCh {
-				errs = append(errs, err.Error())
-			}
 		case <-time.After(time.Millisecond * 200):
-			for err := range killCh {
-				errs = append(errs, err.Error())
-			}
-			errs = append(errs, fmt.Errorf("timeout %d sec exceeded", timeoutSec).Error())
 		}
+		for err := range killCh {
+			errs = append(errs, err.Error())
+		}
+		errs = append(errs, fmt.Errorf("timeout %d sec exceeded", timeoutSec).Error())
 	case <-process.Done():
 		for err := range doneCh {
 			errs = append(errs, err.Error())
@@ -149,7 +229,12 @@ func (s Script) Execute(rule rules.Rule, reqData requestdata.Data) (response act
 		errs = append(errs, stderrBu.String())
 	}
 	if exitCode < 0 {
-		return actions.ActionResponse{}, errors.New(strings.Join(errs, ", "))
+		// The script has been terminated by a signal, either by httpe on timeout or by someone else
+		kind := ErrKilled
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			kind = ErrTimeout
+		}
+		return actions.ActionResponse{}, scriptError{msg: strings.Join(errs, ", "), kind: kind}
 	}
 
 	return actions.ActionResponse{
@@ -159,6 +244,75 @@ func (s Script) Execute(rule rules.Rule, reqData requestdata.Data) (response act
 	}, nil
 }
 
+// environ returns the environment of the script. The script inherits the environment of httpe, with clean_env
+// only the variables listed by env_passthrough. The request data, the trace context and the variables of args.env
+// are added on top, later variables override earlier ones.
+func environ(rule rules.Rule, reqData requestdata.Data, traceParent string) ([]string, error) {
+	args := rule.Args
+	var env []string
+	if args.CleanEnv {
+		for _, name := range args.EnvPassthrough {
+			if value, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+		if _, ok := args.Env["PATH"]; !ok && !slices.Contains(args.EnvPassthrough, "PATH") &&
+			runtime.GOOS != "windows" {
+			env = append(env, "PATH="+defaultPath)
+		}
+	} else {
+		env = os.Environ()
+	}
+	if args.RequestEnv {
+		env = append(env, reqData.Environ(secretHeaders(rule.With)...)...)
+	}
+	// IDs correlating the script with the logs and the trace of the request are always passed
+	if reqData.Meta.RequestID != "" {
+		env = append(env, requestdata.RequestIDEnvName+"="+reqData.Meta.RequestID)
+	}
+	if traceParent != "" {
+		env = append(env, tracing.EnvName+"="+traceParent)
+	}
+	names := make([]string, 0, len(args.Env))
+	for name := range args.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := args.Env[name]
+		if !args.DisableTemplating {
+			var err error
+			if value, err = templating.RenderString(value, reqData); err != nil {
+				return nil, fmt.Errorf("error rendering env %s: %w", name, err)
+			}
+		}
+		env = append(env, name+"="+value)
+	}
+	return env, nil
+}
+
+// teeWriter returns a writer duplicating writes to the optional stream writer
+// secretHeaders returns the headers carrying the API key or the signature configured for the rule
+func secretHeaders(with *rules.With) (headers []string) {
+	if with == nil {
+		return nil
+	}
+	if with.AuthAPIKey != nil && with.AuthAPIKey.Header != "" {
+		headers = append(headers, with.AuthAPIKey.Header)
+	}
+	if with.HMAC != nil {
+		headers = append(headers, signature.Header(with.HMAC))
+	}
+	return headers
+}
+
+func teeWriter(bu *buffer.Buffer, stream io.Writer) io.Writer {
+	if stream == nil {
+		return bu
+	}
+	return io.MultiWriter(bu, stream)
+}
+
 func defaultInterpreter() string {
 	switch runtime.GOOS {
 	case "windows":
@@ -168,36 +322,83 @@ func defaultInterpreter() string {
 	}
 }
 
-func defaultInterpreterArgs(interpreter string, script string) (args []string, cleanupFn func(), err error) {
-	interpreter = strings.ToLower(remove.FileExtension(interpreter, "exe"))
-	noCleanup := func() {
-		// Empty function when no clean up is required
-	}
+func defaultInterpreterArgs(interpreter string, script string, prepareFile func(string) error) (args []string,
+	cleanupFn func(), err error) {
+	interpreter = normalizeInterpreter(interpreter)
 	switch interpreter {
 	case "powershell", "pwsh":
 		return []string{"-NoProfile", "-NonInteractive", "-Command", "-"}, noCleanup, nil
 	case "cmd":
 		//storing the script in a file and appending the script file to the command line appears to be the only
 		//solution for cmd.exe because the /Q/C switches cause cmd.exe to ignore the stdin pipe.
-		bat, err := scriptToBat(script)
-		if err != nil {
-			return []string{}, noCleanup, err
-		}
-		fn := func() {
-			os.Remove(bat)
-		}
-		return []string{"/Q/C", bat}, fn, nil
+		return scriptFileInterpreterArgs(interpreter, script, prepareFile)
 	default:
 		return []string{}, noCleanup, nil
 	}
 }
 
-func scriptToBat(script string) (filepath string, err error) {
-	filepath = os.TempDir() + "/httpe_" + shortuuid.New() + ".bat"
-	err = os.WriteFile(filepath, []byte(script), 0600)
+// scriptFileInterpreterArgs stores the script in a temporary file and returns the args to make the interpreter
+// execute the file. This keeps stdin of the interpreter free for other purposes. The file is handed over to the
+// process of the script by prepareFile.
+func scriptFileInterpreterArgs(interpreter string, script string, prepareFile func(string) error) (args []string,
+	cleanupFn func(), err error) {
+	interpreter = normalizeInterpreter(interpreter)
+	var ext string
+	switch interpreter {
+	case "powershell", "pwsh":
+		ext = ".ps1"
+	case "cmd":
+		ext = ".bat"
+	}
+	file, err := scriptToFile(script, ext)
+	if err != nil {
+		return []string{}, noCleanup, err
+	}
+	cleanupFn = func() {
+		os.Remove(file)
+	}
+	if err = prepareFile(file); err != nil {
+		cleanupFn()
+		return []string{}, noCleanup, fmt.Errorf("error handing over script file: %w", err)
+	}
+	switch interpreter {
+	case "powershell", "pwsh":
+		return []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File", file}, cleanupFn, nil
+	case "cmd":
+		return []string{"/Q/C", file}, cleanupFn, nil
+	default:
+		return []string{file}, cleanupFn, nil
+	}
+}
+
+// interpreterQuoteFunc returns the name of the template function quoting values for the interpreter
+func interpreterQuoteFunc(interpreter string) (string, error) {
+	switch normalizeInterpreter(interpreter) {
+	case "sh", "bash", "dash", "ash", "ksh", "mksh", "zsh":
+		return templating.ShellQuote, nil
+	case "powershell", "pwsh":
+		return templating.PowerShellQuote, nil
+	case "cmd":
+		return templating.CmdEscape, nil
+	default:
+		return "", fmt.Errorf("auto_quote is not supported for interpreter '%s'", interpreter)
+	}
+}
+
+func normalizeInterpreter(interpreter string) string {
+	return strings.ToLower(remove.FileExtension(filepath.Base(interpreter), "exe"))
+}
+
+func noCleanup() {
+	// Empty function when no clean up is required
+}
+
+func scriptToFile(script string, ext string) (file string, err error) {
+	file = os.TempDir() + "/httpe_" + shortuuid.New() + ext
+	err = os.WriteFile(file, []byte(script), 0600)
 	if err != nil {
-		return "", fmt.Errorf("error saving script to temporary file %s: %w", filepath, err)
+		return "", fmt.Errorf("error saving script to temporary file %s: %w", file, err)
 	}
 
-	return filepath, nil
+	return file, nil
 }
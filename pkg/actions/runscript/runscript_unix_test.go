@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -125,13 +128,245 @@ func TestScriptExecuteUnix(t *testing.T) {
 	}
 }
 
-// Todo: improve script killing so child processes are killed. The below test shall pass by
-// verifying the started LongRunningCommand is no longer running.
+func TestScriptRequestDataUnix(t *testing.T) {
+	t.Setenv("HTTPE_TEST_SECRET", "secret")
+	t.Setenv("HTTPE_TEST_PASSED", "passed")
+	reqData := requestdata.Data{
+		Meta: requestdata.MetaData{
+			RequestID: "abc123",
+			Method:    "POST",
+			Headers: map[string]string{
+				"Authorization":       "Bearer s3cr3t",
+				"X-Hub-Signature-256": "sha256=0123",
+				"X-Source":            "ci",
+			},
+		},
+		Input: requestdata.Input{
+			Params: requestdata.Params{"name": "$(touch /tmp/httpe-pwned); John"},
+			Form:   requestdata.Form{"first-name": "Jane"},
+		},
+	}
+	cases := []struct {
+		name            string
+		script          string
+		args            rules.Args
+		with            *rules.With
+		wantSuccessBody string
+	}{
+		{
+			name:            "Environment variables",
+			script:          `echo "$HTTPE_META_METHOD $HTTPE_PARAM_NAME $HTTPE_FORM_FIRST_NAME"`,
+			args:            rules.Args{RequestEnv: true, DisableTemplating: true},
+			wantSuccessBody: "POST $(touch /tmp/httpe-pwned); John Jane\n",
+		},
+		{
+			name: "Credential headers omitted",
+			script: `echo "${HTTPE_HEADER_AUTHORIZATION:-unset} ${HTTPE_HEADER_X_HUB_SIGNATURE_256:-unset} ` +
+				`$HTTPE_HEADER_X_SOURCE"`,
+			args:            rules.Args{RequestEnv: true, DisableTemplating: true},
+			with:            &rules.With{HMAC: &rules.HMAC{Type: rules.HMACGitHub}},
+			wantSuccessBody: "unset unset ci\n",
+		},
+		{
+			name:            "No environment variables by default",
+			script:          `echo "${HTTPE_PARAM_NAME:-unset}"`,
+			args:            rules.Args{DisableTemplating: true},
+			wantSuccessBody: "unset\n",
+		},
+		{
+			name:            "Request ID",
+			script:          `echo "$HTTPE_REQUEST_ID {{ .Meta.RequestID }}"`,
+			wantSuccessBody: "abc123 abc123\n",
+		},
+		{
+			name:            "JSON on stdin",
+			script:          `cat`,
+			args:            rules.Args{RequestStdin: true, Interpreter: Bash},
+			wantSuccessBody: `"params":{"name":"$(touch /tmp/httpe-pwned); John"}`,
+		},
+		{
+			name:            "JSON on stdin with python",
+			script:          "import json, sys\nprint(json.load(sys.stdin)['input']['form']['first-name'])",
+			args:            rules.Args{RequestStdin: true, Interpreter: "python3"},
+			wantSuccessBody: "Jane\n",
+		},
+		{
+			name:            "Templating disabled",
+			script:          `echo '{{ .Input.Params.name }}'`,
+			args:            rules.Args{DisableTemplating: true},
+			wantSuccessBody: "{{ .Input.Params.name }}\n",
+		},
+		{
+			name:            "Env",
+			script:          `echo "$NAME"`,
+			args:            rules.Args{Env: map[string]string{"NAME": "{{ .Input.Params.name }}"}},
+			wantSuccessBody: "$(touch /tmp/httpe-pwned); John\n",
+		},
+		{
+			name:            "Env overrides request env",
+			script:          `echo "$HTTPE_META_METHOD"`,
+			args:            rules.Args{RequestEnv: true, Env: map[string]string{"HTTPE_META_METHOD": "GET"}},
+			wantSuccessBody: "GET\n",
+		},
+		{
+			name:            "Inherited environment",
+			script:          `echo "$HTTPE_TEST_SECRET"`,
+			wantSuccessBody: "secret\n",
+		},
+		{
+			name:   "Clean environment",
+			script: `echo "${HTTPE_TEST_SECRET:-unset} $HTTPE_TEST_PASSED"; command -v id`,
+			args: rules.Args{
+				CleanEnv:       true,
+				EnvPassthrough: []string{"HTTPE_TEST_PASSED"},
+			},
+			wantSuccessBody: "unset passed\n/",
+		},
+		{
+			name:            "Auto quote",
+			script:          `echo {{ .Input.Params.name }} {{ .Input.Form | len }}`,
+			args:            rules.Args{AutoQuote: true, Interpreter: Bash},
+			wantSuccessBody: "$(touch /tmp/httpe-pwned); John 1\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := rules.Rule{
+				RunScript: tc.script,
+				Args:      tc.args,
+				With:      tc.with,
+			}
+			actionResp, err := runscript.Script{}.Execute(rule, reqData)
+			require.NoError(t, err)
+			assert.Equal(t, 0, actionResp.Code, actionResp.ErrorBody)
+			assert.Contains(t, actionResp.SuccessBody, tc.wantSuccessBody)
+		})
+	}
+}
+
+// Scripts terminated by a signal report whether httpe has killed them on timeout
+func TestScriptTerminated(t *testing.T) {
+	_, err := runscript.Script{}.Execute(rules.Rule{RunScript: "sleep 5", Args: rules.Args{Timeout: 1}},
+		requestdata.Data{})
+	assert.ErrorIs(t, err, runscript.ErrTimeout)
+	assert.ErrorContains(t, err, "timeout 1 sec exceeded")
+
+	_, err = runscript.Script{}.Execute(rules.Rule{RunScript: "kill -KILL $$"}, requestdata.Data{})
+	assert.ErrorIs(t, err, runscript.ErrKilled)
+	assert.ErrorContains(t, err, "signal: killed")
+}
+
+// Scripts of concurrent requests each run in their own working directory, the one of httpe stays untouched
+func TestScriptCwdConcurrent(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	dirs := make([]string, 8)
+	for i := range dirs {
+		// On macOS the temp dir is below a symlink, pwd prints the resolved path
+		dirs[i], err = filepath.EvalSymlinks(t.TempDir())
+		require.NoError(t, err)
+	}
+	var wg sync.WaitGroup
+	for _, dir := range dirs {
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				rule := rules.Rule{RunScript: "pwd", Args: rules.Args{Cwd: dir}}
+				actionResp, err := runscript.Script{}.Execute(rule, requestdata.Data{})
+				if assert.NoError(t, err) {
+					assert.Equal(t, dir+"\n", actionResp.SuccessBody)
+				}
+			}
+		}(dir)
+	}
+	wg.Wait()
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, wd, cwd)
+}
+
+// The LongRunningCommand started by the timed out scripts above must have been killed along with the interpreter
 func TestProcessKilledDueToTimeout(t *testing.T) {
 	time.Sleep(5 * time.Second)
-	_, err := isProcessRunning(t, LongRunningCommand)
+	running, err := isProcessRunning(t, LongRunningCommand)
 	require.NoError(t, err)
-	//assert.False(t, running, "process not killed")
+	assert.False(t, running, "process not killed")
+}
+
+func TestProcessGroupKilled(t *testing.T) {
+	rule := rules.Rule{
+		RunScript: "sleep 61 & sleep 62; wait",
+		Args:      rules.Args{Timeout: 1},
+	}
+	_, err := runscript.Script{}.Execute(rule, requestdata.Data{})
+	assert.ErrorContains(t, err, "timeout 1 sec exceeded")
+	for _, cmd := range []string{"sleep 61", "sleep 62"} {
+		running, err := isProcessRunning(t, cmd)
+		require.NoError(t, err)
+		assert.False(t, running, cmd+" not killed")
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("limits are supported on linux only")
+	}
+	rule := rules.Rule{
+		RunScript: "ulimit -t; ulimit -n; ulimit -u",
+		Args: rules.Args{
+			Interpreter: Bash,
+			Limits:      &rules.Limits{CPU: 5, OpenFiles: 64, Processes: 4096, Memory: "1GB"},
+		},
+	}
+	actionResp, err := runscript.Script{}.Execute(rule, requestdata.Data{})
+	require.NoError(t, err)
+	assert.Equal(t, "5\n64\n4096\n", actionResp.SuccessBody)
+
+	rule = rules.Rule{
+		RunScript: "ulimit -v",
+		Args:      rules.Args{Interpreter: Bash, Limits: &rules.Limits{Memory: "1GB"}},
+	}
+	actionResp, err = runscript.Script{}.Execute(rule, requestdata.Data{})
+	require.NoError(t, err)
+	assert.Equal(t, "976562\n", actionResp.SuccessBody, "ulimit reports kilobytes")
+
+	// Scripts handed over as file are limited from the first instruction, too
+	rule = rules.Rule{
+		RunScript: "ulimit -n",
+		Args:      rules.Args{Interpreter: Bash, RequestStdin: true, Limits: &rules.Limits{OpenFiles: 64}},
+	}
+	actionResp, err = runscript.Script{}.Execute(rule, requestdata.Data{})
+	require.NoError(t, err)
+	assert.Equal(t, "64\n", actionResp.SuccessBody)
+
+	rule = rules.Rule{
+		RunScript: "true",
+		Args:      rules.Args{Interpreter: Bash, Limits: &rules.Limits{Memory: "lots"}},
+	}
+	_, err = runscript.Script{}.Execute(rule, requestdata.Data{})
+	assert.ErrorContains(t, err, "invalid memory limit")
+}
+
+func TestScriptRunAs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching the user requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("user nobody doesn't exist")
+	}
+	rule := rules.Rule{
+		RunScript: "id -u",
+		Args:      rules.Args{RunAs: "nobody", RequestStdin: true},
+	}
+	actionResp, err := runscript.Script{}.Execute(rule, requestdata.Data{})
+	require.NoError(t, err)
+	assert.Equal(t, nobody.Uid+"\n", actionResp.SuccessBody, actionResp.ErrorBody)
+
+	rule.Args.RunAs = "no-such-user-4711"
+	_, err = runscript.Script{}.Execute(rule, requestdata.Data{})
+	assert.EqualError(t, err, "error preparing the script: unknown user 'no-such-user-4711'")
 }
 
 func isProcessRunning(t *testing.T, search string) (bool, error) {
@@ -158,7 +393,8 @@ func isProcessRunning(t *testing.T, search string) (bool, error) {
 				return false, err
 			}
 
-			cmdline := string(cmdBytes)
+			// Arguments are terminated by NUL bytes
+			cmdline := strings.TrimRight(string(cmdBytes), string(byte(0)))
 			cmdline = strings.ReplaceAll(cmdline, string(byte(0)), " ")
 
 			if p.Executable() == execName && cmdline == search {
@@ -182,3 +418,91 @@ func isProcessRunning(t *testing.T, search string) (bool, error) {
 
 	return false, nil
 }
+
+func TestScriptSandbox(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the sandbox is supported on linux only")
+	}
+	data := t.TempDir()
+	require.NoError(t, os.WriteFile(data+"/in.txt", []byte("hello"), 0600))
+	cases := []struct {
+		name            string
+		script          string
+		args            rules.Args
+		wantSuccessBody string
+	}{
+		{
+			name:            "PID namespace",
+			script:          "echo $$",
+			wantSuccessBody: "1\n",
+		},
+		{
+			name:            "Read-only root",
+			script:          "touch /usr/httpe-test || echo read-only",
+			wantSuccessBody: "read-only\n",
+		},
+		{
+			name:            "Private tmp",
+			script:          "ls /tmp | wc -l; touch /tmp/x && echo writable",
+			wantSuccessBody: "0\nwritable\n",
+		},
+		{
+			name:            "Host is hidden",
+			script:          "test -e " + data + " || echo hidden",
+			wantSuccessBody: "hidden\n",
+		},
+		{
+			name:            "Binds",
+			script:          "cat /ro/in.txt; echo written > /rw/out.txt; touch /ro/x 2>/dev/null || echo read-only",
+			args:            rules.Args{Sandbox: &rules.Sandbox{Binds: []string{data + ":/ro", data + ":/rw:rw"}}},
+			wantSuccessBody: "helloread-only\n",
+		},
+		{
+			name:            "No network",
+			script:          "grep -c : /proc/net/dev",
+			args:            rules.Args{Sandbox: &rules.Sandbox{NoNetwork: true}},
+			wantSuccessBody: "1\n",
+		},
+		{
+			name:            "Script file",
+			script:          "cat",
+			args:            rules.Args{RequestStdin: true, Interpreter: Bash},
+			wantSuccessBody: `"meta"`,
+		},
+		{
+			name:            "Cwd in the sandbox",
+			script:          "pwd",
+			args:            rules.Args{Cwd: "/rw", Sandbox: &rules.Sandbox{Binds: []string{data + ":/rw:rw"}}},
+			wantSuccessBody: "/rw\n",
+		},
+		{
+			name:            "Limits",
+			script:          "ulimit -n",
+			args:            rules.Args{Interpreter: Bash, Sandbox: &rules.Sandbox{}, Limits: &rules.Limits{OpenFiles: 32}},
+			wantSuccessBody: "32\n",
+		},
+		{
+			name:            "No capabilities",
+			script:          "grep CapEff /proc/self/status",
+			wantSuccessBody: "CapEff:\t0000000000000000\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.args.Sandbox == nil {
+				tc.args.Sandbox = &rules.Sandbox{}
+			}
+			rule := rules.Rule{RunScript: tc.script, Args: tc.args}
+			actionResp, err := runscript.Script{}.Execute(rule, requestdata.Data{})
+			if err != nil && strings.Contains(err.Error(), "operation not permitted") {
+				t.Skip("user namespaces are not available: ", err)
+			}
+			require.NoError(t, err)
+			assert.Equal(t, 0, actionResp.Code, actionResp.ErrorBody)
+			assert.Contains(t, actionResp.SuccessBody, tc.wantSuccessBody)
+		})
+	}
+	out, err := os.ReadFile(data + "/out.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "written\n", string(out))
+}
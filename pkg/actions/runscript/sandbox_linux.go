@@ -0,0 +1,283 @@
+package runscript
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/http-everything/httpe/pkg/rules"
+
+	"golang.org/x/sys/unix"
+)
+
+// systemDirs are mounted read-only into every sandbox, if they exist
+var systemDirs = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/libx32", "/etc"}
+
+// devices are the device files available in the sandbox
+var devices = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom", "/dev/tty"}
+
+// sandboxSpec describes the sandbox the script init sets up
+type sandboxSpec struct {
+	Binds []rules.Bind `json:"binds"`
+	Files []string     `json:"files"`
+	Cwd   string       `json:"cwd"`
+}
+
+// setupSandbox makes the script init start in new user, mount, PID and optionally network namespaces. The script
+// init prepares the file system described by the returned spec.
+func (p *process) setupSandbox(cmd *exec.Cmd) (*sandboxSpec, error) {
+	spec := &sandboxSpec{
+		Files: p.files,
+		Cwd:   p.cwd,
+	}
+	for _, bind := range p.sandbox.Binds {
+		b, err := rules.ParseBind(bind)
+		if err != nil {
+			return nil, err
+		}
+		spec.Binds = append(spec.Binds, b)
+	}
+	// The working directory may only exist in the sandbox, the script init changes to it
+	cmd.Dir = ""
+
+	// The script keeps its user, only the user itself is mapped into the namespace
+	uid, gid := os.Getuid(), os.Getgid()
+	attr := cmd.SysProcAttr
+	if attr.Credential != nil {
+		uid, gid = int(attr.Credential.Uid), int(attr.Credential.Gid)
+		attr.Credential.NoSetGroups = true
+	}
+	attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	if p.sandbox.NoNetwork {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	attr.GidMappingsEnableSetgroups = false
+	// Keep the capabilities required for mounting across the execution of the script init
+	attr.AmbientCaps = []uintptr{unix.CAP_SYS_ADMIN, unix.CAP_SETPCAP}
+	return spec, nil
+}
+
+// enterSandbox builds the file system of the sandbox and drops all capabilities
+func enterSandbox(spec *sandboxSpec) error {
+	// Keep mounts from propagating to the host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("error making mounts private: %w", err)
+	}
+
+	// Open all sources before the new root hides /tmp, the script files are usually stored there
+	sources := make(map[string]*os.File)
+	open := func(path string) error {
+		if _, ok := sources[path]; ok {
+			return nil
+		}
+		f, err := os.OpenFile(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		sources[path] = f
+		return nil
+	}
+	for _, dir := range systemDirs {
+		if fi, err := os.Lstat(dir); err == nil && fi.IsDir() {
+			if err = open(dir); err != nil {
+				return err
+			}
+		}
+	}
+	for _, path := range spec.Files {
+		if err := open(path); err != nil {
+			return err
+		}
+	}
+	for _, b := range spec.Binds {
+		if err := open(b.Source); err != nil {
+			return fmt.Errorf("error opening bind: %w", err)
+		}
+	}
+
+	root := os.TempDir()
+	if err := unix.Mount("tmpfs", root, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("error mounting root: %w", err)
+	}
+	for _, dir := range systemDirs {
+		target, err := os.Readlink(dir)
+		if err == nil {
+			// Merged /usr, e.g. /bin -> usr/bin
+			if err = os.Symlink(target, filepath.Join(root, dir)); err != nil {
+				return err
+			}
+			continue
+		}
+		if f, ok := sources[dir]; ok {
+			if err = bindMount(f, root, dir, false); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "dev"), 0755); err != nil {
+		return err
+	}
+	for _, dev := range devices {
+		if _, err := os.Stat(dev); err != nil {
+			continue
+		}
+		if err := bindMount(nil, root, dev, true); err != nil {
+			return err
+		}
+	}
+	for name, target := range map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2"} {
+		if err := os.Symlink(target, filepath.Join(root, "dev", name)); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "proc"), 0555); err != nil {
+		return err
+	}
+	if err := unix.Mount("proc", filepath.Join(root, "proc"), "proc",
+		unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("error mounting /proc: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "tmp"), 01777); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", filepath.Join(root, "tmp"), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV,
+		"mode=1777"); err != nil {
+		return fmt.Errorf("error mounting /tmp: %w", err)
+	}
+	for _, b := range spec.Binds {
+		if err := bindMountTo(sources[b.Source], filepath.Join(root, b.Target), b.Writable); err != nil {
+			return fmt.Errorf("error mounting bind %s: %w", b.Source, err)
+		}
+	}
+	for _, path := range spec.Files {
+		if err := bindMount(sources[path], root, path, false); err != nil {
+			return err
+		}
+	}
+
+	// Replace the root of the host by the sandbox
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("error changing root: %w", err)
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("error detaching root of the host: %w", err)
+	}
+	if err := remountReadOnly("/"); err != nil {
+		return err
+	}
+	if err := os.Chdir(spec.Cwd); err != nil {
+		return fmt.Errorf("cwd %s doesn't exist in the sandbox: %w", spec.Cwd, err)
+	}
+	for _, f := range sources {
+		f.Close()
+	}
+
+	return dropCapabilities()
+}
+
+// bindMount mounts the source at the same path below the root. If source is nil, the path is opened.
+func bindMount(source *os.File, root string, path string, writable bool) error {
+	if source == nil {
+		f, err := os.OpenFile(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		source = f
+	}
+	return bindMountTo(source, filepath.Join(root, path), writable)
+}
+
+// bindMountTo mounts the opened source at the target, creating the target if needed
+func bindMountTo(source *os.File, target string, writable bool) error {
+	fi, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else if _, err = os.Stat(target); errors.Is(err, os.ErrNotExist) {
+		err = os.WriteFile(target, nil, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if err = unix.Mount("/proc/self/fd/"+strconv.Itoa(int(source.Fd())), target, "", unix.MS_BIND|unix.MS_REC,
+		""); err != nil {
+		return fmt.Errorf("error mounting %s: %w", target, err)
+	}
+	if writable {
+		return nil
+	}
+	return remountReadOnly(target)
+}
+
+// remountReadOnly makes the mount at the path read-only. Flags locked by the host, like nosuid, must be kept.
+func remountReadOnly(path string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return err
+	}
+	flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND | unix.MS_RDONLY)
+	for _, f := range []struct{ st, ms uintptr }{
+		{unix.ST_NOSUID, unix.MS_NOSUID},
+		{unix.ST_NODEV, unix.MS_NODEV},
+		{unix.ST_NOEXEC, unix.MS_NOEXEC},
+		{unix.ST_NOATIME, unix.MS_NOATIME},
+		{unix.ST_NODIRATIME, unix.MS_NODIRATIME},
+		{unix.ST_RELATIME, unix.MS_RELATIME},
+	} {
+		if uintptr(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	if err := unix.Mount("", path, "", flags, ""); err != nil {
+		return fmt.Errorf("error making %s read-only: %w", path, err)
+	}
+	return nil
+}
+
+// dropCapabilities removes all capabilities, so the script can't undo the sandbox. Without capabilities in the
+// bounding and inheritable sets, the interpreter doesn't regain them even if executed as root of the namespace.
+func dropCapabilities() error {
+	content, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return err
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return err
+	}
+	for c := 0; c <= last; c++ {
+		if err = unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil {
+			return fmt.Errorf("error dropping capability %d: %w", c, err)
+		}
+	}
+	if err = unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("error clearing ambient capabilities: %w", err)
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err = unix.Capget(&hdr, &data[0]); err != nil {
+		return err
+	}
+	data[0].Inheritable, data[1].Inheritable = 0, 0
+	if err = unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("error clearing inheritable capabilities: %w", err)
+	}
+	return unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+}
@@ -11,11 +11,15 @@ import (
 	"github.com/http-everything/httpe/pkg/requestdata"
 	"github.com/http-everything/httpe/pkg/rules"
 	"github.com/http-everything/httpe/pkg/templating"
+	"github.com/http-everything/httpe/pkg/tracing"
 	"gopkg.in/gomail.v2"
 )
 
+// Email sends emails. A TraceParent is added as traceparent header, so the email can be correlated with the
+// trace of the request.
 type Email struct {
-	SMTPConfig *config.SMTPConfig
+	SMTPConfig  *config.SMTPConfig
+	TraceParent string
 }
 
 // Execute implements the actioner interface, being the final method executed by the action
@@ -105,6 +109,10 @@ func (e Email) sendEmail(from, to, subject, body, cc, bcc string) error {
 	// Set E-Mail subject
 	m.SetHeader("Subject", subject)
 
+	if e.TraceParent != "" {
+		m.SetHeader(http.CanonicalHeaderKey(tracing.Header), e.TraceParent)
+	}
+
 	// Set E-Mail body. You can set plain text or html with text/html
 	m.SetBody("text/plain", body)
 
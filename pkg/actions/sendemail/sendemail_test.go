@@ -85,6 +85,7 @@ func TestSendEmailShouldSucceed(t *testing.T) {
 	cases := []struct {
 		name          string
 		email         *rules.Email
+		traceParent   string
 		wantErrorBody string
 	}{
 		{
@@ -116,6 +117,16 @@ func TestSendEmailShouldSucceed(t *testing.T) {
 				From:    "sender3@example.com",
 			},
 		},
+		{
+			name: "Good Email with traceparent",
+			email: &rules.Email{
+				To:      "to4@example.com",
+				Subject: "Test",
+				Body:    "4",
+				From:    "sender4@example.com",
+			},
+			traceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
 	}
 	// Start smtpmock server
 	smtpServer := smtpmock.New(smtpmock.ConfigurationAttr{
@@ -140,7 +151,7 @@ func TestSendEmailShouldSucceed(t *testing.T) {
 			SendEmail: tc.email,
 		}
 		//Create the actioner that implements the action interface
-		var actioner actions.Actioner = sendemail.Email{SMTPConfig: smtpConfig}
+		var actioner actions.Actioner = sendemail.Email{SMTPConfig: smtpConfig, TraceParent: tc.traceParent}
 
 		// Execute the action by calling the mandatory function Execute()
 		actionResp, err := actioner.Execute(rule, reqData)
@@ -160,6 +171,11 @@ func TestSendEmailShouldSucceed(t *testing.T) {
 			assert.Contains(t, msg, fmt.Sprintf("Cc: %s\r\n", rule.SendEmail.Cc))
 		}
 		assert.Contains(t, msg, fmt.Sprintf("Subject: %s\r\n", rule.SendEmail.Subject))
+		if tc.traceParent != "" {
+			assert.Contains(t, msg, fmt.Sprintf("Traceparent: %s\r\n", tc.traceParent))
+		} else {
+			assert.NotContains(t, msg, "Traceparent")
+		}
 		assert.Contains(t, msg, fmt.Sprintf("\r\n\r\n%s\r\n", rule.SendEmail.Body))
 	}
 }
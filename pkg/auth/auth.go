@@ -1,61 +1,164 @@
 package auth
 
 import (
-	"crypto/sha256"
-	"crypto/sha512"
-	"encoding/hex"
+	"crypto/subtle"
 	"errors"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/share/password"
+	"github.com/http-everything/httpe/pkg/share/tokens"
 )
 
-// IsRequestAuthenticated checks if the request is authenticated based on the provided list of users, hashing algorithm,
-// and the request's basic authentication credentials.
-// If the list of users is empty, the request is considered authenticated.
-// If the request is missing basic authentication credentials, the request is considered unauthenticated.
-// For each user in the list, the request password is hashed using the specified algorithm and compared with the user's stored password.
-// If a matching user and password is found, the request is considered authenticated.
-// Returns a boolean indicating if the request is authenticated and any error that occurred during the authentication process.
-func IsRequestAuthenticated(users []rules.User, hashing string, r *http.Request) (ok bool, err error) {
-	if len(users) == 0 {
+const (
+	SchemeBasic  = "Basic"
+	SchemeBearer = "Bearer"
+)
+
+var (
+	// ErrUnauthenticated is returned by Authenticate if none of the configured authentication methods accepts the
+	// request
+	ErrUnauthenticated = errors.New("request not authenticated")
+	// ErrForbidden is returned by Authenticate if the authenticated user is not listed by with.allow
+	ErrForbidden = errors.New("user not allowed")
+)
+
+// Directory resolves the users and groups shared by all rules
+type Directory interface {
+	Verify(username string, password string) (bool, error)
+	IsMember(username string, group string) bool
+}
+
+// Authenticate checks the request against all authentication methods configured by the rule. The request is
+// authenticated if any of the methods accepts it. Rules without authentication accept all requests anonymously.
+// If the rule lists users and groups in with.allow, HTTP basic auth credentials are also checked against the
+// directory and the authenticated user must be listed or be a member of a listed group.
+// Returns the name of the authenticated user and the schemes to be announced in the WWW-Authenticate header of
+// the 401 response if the request is rejected.
+func Authenticate(with *rules.With, dir Directory, r *http.Request, now time.Time) (
+	user string, schemes []string, err error) {
+	if with == nil || (len(with.AuthBasic) == 0 && with.AuthBearer == nil && with.AuthAPIKey == nil &&
+		len(with.Allow) == 0) {
 		// The rule doesn't require the request to be authenticated
-		return true, nil
+		return "", nil, nil
+	}
+	user, schemes, err = authenticate(with, dir, r, now)
+	if err != nil || user == "" {
+		return "", schemes, err
 	}
+	if len(with.Allow) > 0 && !isAllowed(with.Allow, dir, user) {
+		return user, nil, ErrForbidden
+	}
+	return user, nil, nil
+}
+
+func authenticate(with *rules.With, dir Directory, r *http.Request, now time.Time) (
+	user string, schemes []string, err error) {
+	if len(with.AuthBasic) > 0 || len(with.Allow) > 0 {
+		schemes = append(schemes, SchemeBasic)
+		user, err = basicUser(with.AuthBasic, with.AuthHashing, r)
+		if user != "" || err != nil {
+			return user, nil, err
+		}
+	}
+	if len(with.Allow) > 0 && dir != nil {
+		if u, p, ok := r.BasicAuth(); ok {
+			ok, err = dir.Verify(u, p)
+			if ok || err != nil {
+				return u, nil, err
+			}
+		}
+	}
+	if with.AuthBearer != nil {
+		schemes = append(schemes, SchemeBearer)
+		token, ok := bearerToken(r)
+		if ok {
+			user, err = lookup(with.AuthBearer.TokensFile, with.AuthBearer.TokensEnv, token, now)
+			if user != "" || err != nil {
+				return user, nil, err
+			}
+		}
+	}
+	if with.AuthAPIKey != nil {
+		// API keys don't have a registered authentication scheme
+		key := r.Header.Get(with.AuthAPIKey.Header)
+		if with.AuthAPIKey.Param != "" {
+			key = r.URL.Query().Get(with.AuthAPIKey.Param)
+		}
+		user, err = lookup(with.AuthAPIKey.TokensFile, with.AuthAPIKey.TokensEnv, key, now)
+		if user != "" || err != nil {
+			return user, nil, err
+		}
+	}
+	return "", schemes, ErrUnauthenticated
+}
+
+// isAllowed reports whether the user is listed by an allow entry like user:alice or is a member of a group listed
+// by an entry like group:ops
+func isAllowed(allow []string, dir Directory, user string) bool {
+	for _, entry := range allow {
+		kind, name, err := rules.ParseAllow(entry)
+		if err != nil {
+			continue
+		}
+		switch {
+		case kind == rules.AllowUser && name == user:
+			return true
+		case kind == rules.AllowGroup && dir != nil && dir.IsMember(user, name):
+			return true
+		}
+	}
+	return false
+}
+
+// basicUser returns the name of the user authenticated by HTTP basic auth or an empty string.
+// The algorithm of each password is detected from the prefix of the stored hash. Passwords without a known prefix
+// are hashed with the rule's hashing algorithm, if any.
+func basicUser(users []rules.User, hashing string, r *http.Request) (string, error) {
 	u, p, ok := r.BasicAuth()
 	if !ok {
 		// The request is missing basic authentication credentials
-		return false, nil
+		return "", nil
 	}
 	for _, user := range users {
-		password, err := hashPassword(p, hashing)
+		if subtle.ConstantTimeCompare([]byte(user.Username), []byte(u)) != 1 {
+			continue
+		}
+		ok, err := password.Verify(user.Password, p, hashing)
 		if err != nil {
-			return false, err
+			return "", err
 		}
-		if user.Username == u && user.Password == password {
-			return true, nil
+		if ok {
+			return u, nil
 		}
 	}
-	return false, nil
+	return "", nil
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, SchemeBearer) {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
 }
 
-// hashPassword hashes the given password using the specified algorithm.
-// If the algorithm is an empty string, the password is returned as is.
-// If the algorithm is "sha256", the password is hashed using the SHA-256 algorithm.
-// If the algorithm is "sha512", the password is hashed using the SHA-512 algorithm.
-// Returns the hashed password as a hexadecimal string and any error that occurred during hashing.
-// If an unknown hashing algorithm is specified, returns an error.
-func hashPassword(password string, algorithm string) (hash string, err error) {
-	switch algorithm {
-	case "":
-		return password, nil
-	case "sha256":
-		h := sha256.Sum256([]byte(password))
-		return hex.EncodeToString(h[:]), nil
-	case "sha512":
-		h := sha512.Sum512([]byte(password))
-		return hex.EncodeToString(h[:]), nil
-	default:
-		return hash, errors.New("unknown hashing algorithm")
+// tokenFiles keeps the token lists read from files until the files are modified
+var tokenFiles tokens.Cache
+
+// lookup loads the token list and returns the user of the token. A file is read again once it has been modified, so
+// tokens can be added and revoked without restarting the server.
+func lookup(file string, env string, token string, now time.Time) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	list, err := tokenFiles.Load(file, env)
+	if err != nil {
+		return "", err
 	}
+	user, _ := list.Lookup(token, now)
+	return user, nil
 }
@@ -4,19 +4,24 @@ import (
 	"errors"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/http-everything/httpe/pkg/auth"
 	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/userstore"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestIsRequestAuthenticated(t *testing.T) {
+func TestAuthenticate(t *testing.T) {
 	users := []rules.User{
 		{Username: "user", Password: "password"},
 		{Username: "user2", Password: "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"},
 		{Username: "user3", Password: "b109f3bbbc244eb82441917ed06d618b9008dd09b3befd1b5e07394c706a8bb" +
 			"980b1d7785e5976ec049b46df5f1326af5a2ea6d103fd07c95385ffab0cacbc86"},
+		{Username: "user4", Password: "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"},
+		{Username: "user5", Password: "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$TJqEe8os/EHZfL3Vapc59ET5wfcEzIeGVsEYtgkuoKw"},
 	}
 	cases := []struct {
 		name     string
@@ -24,7 +29,7 @@ func TestIsRequestAuthenticated(t *testing.T) {
 		hashing  string
 		username string
 		password string
-		wantOk   bool
+		wantUser string
 		wantErr  error
 	}{
 		{
@@ -33,7 +38,7 @@ func TestIsRequestAuthenticated(t *testing.T) {
 			hashing:  "",
 			username: "user",
 			password: "password",
-			wantOk:   true,
+			wantUser: "",
 			wantErr:  nil,
 		},
 		{
@@ -42,8 +47,8 @@ func TestIsRequestAuthenticated(t *testing.T) {
 			hashing:  "",
 			username: "",
 			password: "",
-			wantOk:   false,
-			wantErr:  nil,
+			wantUser: "",
+			wantErr:  auth.ErrUnauthenticated,
 		},
 		{
 			name:     "Incorrect User",
@@ -51,8 +56,8 @@ func TestIsRequestAuthenticated(t *testing.T) {
 			hashing:  "",
 			username: "wrongUser",
 			password: "password",
-			wantOk:   false,
-			wantErr:  nil,
+			wantUser: "",
+			wantErr:  auth.ErrUnauthenticated,
 		},
 		{
 			name:     "Incorrect Password",
@@ -60,8 +65,8 @@ func TestIsRequestAuthenticated(t *testing.T) {
 			hashing:  "",
 			username: "user",
 			password: "wrongPassword",
-			wantOk:   false,
-			wantErr:  nil,
+			wantUser: "",
+			wantErr:  auth.ErrUnauthenticated,
 		},
 		{
 			name:     "Correct User and Clear-Text-Password",
@@ -69,7 +74,7 @@ func TestIsRequestAuthenticated(t *testing.T) {
 			hashing:  "",
 			username: "user",
 			password: "password",
-			wantOk:   true,
+			wantUser: "user",
 			wantErr:  nil,
 		},
 		{
@@ -78,7 +83,7 @@ func TestIsRequestAuthenticated(t *testing.T) {
 			hashing:  "sha256",
 			username: "user2",
 			password: "password",
-			wantOk:   true,
+			wantUser: "user2",
 			wantErr:  nil,
 		},
 		{
@@ -87,16 +92,43 @@ func TestIsRequestAuthenticated(t *testing.T) {
 			hashing:  "sha512",
 			username: "user3",
 			password: "password",
-			wantOk:   true,
+			wantUser: "user3",
+			wantErr:  nil,
+		},
+		{
+			name:     "Correct User and bcrypt-Password",
+			users:    users,
+			hashing:  "",
+			username: "user4",
+			password: "U*U",
+			wantUser: "user4",
+			wantErr:  nil,
+		},
+		{
+			name:     "Correct User and argon2id-Password detected despite hashing",
+			users:    users,
+			hashing:  "sha256",
+			username: "user5",
+			password: "password",
+			wantUser: "user5",
 			wantErr:  nil,
 		},
+		{
+			name:     "Incorrect argon2id-Password",
+			users:    users,
+			hashing:  "",
+			username: "user5",
+			password: "wrongPassword",
+			wantUser: "",
+			wantErr:  auth.ErrUnauthenticated,
+		},
 		{
 			name:     "Wrong Algorithm",
 			users:    users,
 			hashing:  "wrong-algorithm",
 			username: "user",
 			password: "password",
-			wantOk:   false,
+			wantUser: "",
 			wantErr:  errors.New("unknown hashing algorithm"),
 		},
 	}
@@ -109,10 +141,54 @@ func TestIsRequestAuthenticated(t *testing.T) {
 				r.SetBasicAuth(tc.username, tc.password)
 			}
 
-			ok, err := auth.IsRequestAuthenticated(tc.users, tc.hashing, r)
+			user, _, err := auth.Authenticate(&rules.With{AuthBasic: tc.users, AuthHashing: tc.hashing}, nil, r, time.Now())
 
-			assert.Equal(t, tc.wantOk, ok)
+			assert.Equal(t, tc.wantUser, user)
 			assert.Equal(t, tc.wantErr, err)
 		})
 	}
 }
+
+func TestAuthenticateAllow(t *testing.T) {
+	users := userstore.New("", "")
+	require.NoError(t, users.Load(
+		[]rules.User{{Username: "alice", Password: "a"}, {Username: "bob", Password: "b"}, {Username: "carol", Password: "c"}},
+		map[string][]string{"ops": {"alice"}},
+	))
+	with := &rules.With{
+		Allow:     []string{"group:ops", "user:bob", "invalid"},
+		AuthBasic: []rules.User{{Username: "dave", Password: "d"}},
+	}
+	cases := []struct {
+		name     string
+		dir      auth.Directory
+		username string
+		password string
+		wantUser string
+		wantErr  error
+	}{
+		{name: "Group member", dir: users, username: "alice", password: "a", wantUser: "alice"},
+		{name: "Listed user", dir: users, username: "bob", password: "b", wantUser: "bob"},
+		{name: "Not allowed", dir: users, username: "carol", password: "c", wantUser: "carol", wantErr: auth.ErrForbidden},
+		{name: "Inline user not allowed", dir: users, username: "dave", password: "d", wantUser: "dave", wantErr: auth.ErrForbidden},
+		{name: "Wrong password", dir: users, username: "alice", password: "b", wantErr: auth.ErrUnauthenticated},
+		{name: "No credentials", dir: users, wantErr: auth.ErrUnauthenticated},
+		{name: "No directory", username: "alice", password: "a", wantErr: auth.ErrUnauthenticated},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/", nil)
+			if tc.username != "" {
+				r.SetBasicAuth(tc.username, tc.password)
+			}
+
+			user, schemes, err := auth.Authenticate(with, tc.dir, r, time.Now())
+
+			assert.Equal(t, tc.wantUser, user)
+			assert.ErrorIs(t, err, tc.wantErr)
+			if errors.Is(err, auth.ErrUnauthenticated) {
+				assert.Equal(t, []string{auth.SchemeBasic}, schemes)
+			}
+		})
+	}
+}
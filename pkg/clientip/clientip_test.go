@@ -0,0 +1,111 @@
+package clientip_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/clientip"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := clientip.NewProxies([]string{"10.0.0.0/8", "::1"})
+	require.NoError(t, err)
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:4711", want: "192.0.2.1"},
+		{name: "untrusted peer", remoteAddr: "192.0.2.1:4711", headers: map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			want: "192.0.2.1"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.5:4711", headers: map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			want: "198.51.100.7"},
+		{name: "chain of proxies", remoteAddr: "10.0.0.5:4711",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.7, 10.1.1.1,10.2.2.2"}, want: "198.51.100.7"},
+		{name: "forged by client", remoteAddr: "10.0.0.5:4711",
+			headers: map[string]string{"X-Forwarded-For": "10.9.9.9, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "only proxies", remoteAddr: "10.0.0.5:4711", headers: map[string]string{"X-Forwarded-For": "10.1.1.1"},
+			want: "10.1.1.1"},
+		{name: "no header", remoteAddr: "10.0.0.5:4711", want: "10.0.0.5"},
+		{name: "forwarded", remoteAddr: "[::1]:4711",
+			headers: map[string]string{"Forwarded": `for="[2001:db8::7]:1234";proto=https, for=10.1.1.1`}, want: "2001:db8::7"},
+		{name: "forwarded wins", remoteAddr: "10.0.0.5:4711",
+			headers: map[string]string{"Forwarded": "for=198.51.100.7", "X-Forwarded-For": "203.0.113.9"}, want: "198.51.100.7"},
+		{name: "unknown hop", remoteAddr: "10.0.0.5:4711",
+			headers: map[string]string{"Forwarded": "for=198.51.100.7, for=unknown"}, want: "10.0.0.5"},
+		{name: "ipv4 mapped", remoteAddr: "[::ffff:192.0.2.1]:4711", want: "192.0.2.1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			addr, ok := proxies.ClientIP(req)
+			require.True(t, ok)
+			assert.Equal(t, tc.want, addr.String())
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	proxies, err := clientip.NewProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	var remoteAddr string
+	h := proxies.Handler(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.5:4711"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "198.51.100.7", remoteAddr)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:4711"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "192.0.2.1:4711", remoteAddr, "direct clients keep their address")
+}
+
+func TestFilter(t *testing.T) {
+	filter, err := clientip.NewFilter([]string{"10.0.0.0/8", "192.0.2.1"}, []string{"10.66.0.0/16"})
+	require.NoError(t, err)
+	denyOnly, err := clientip.NewFilter(nil, []string{"203.0.113.0/24"})
+	require.NoError(t, err)
+	none, err := clientip.NewFilter(nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, none)
+
+	cases := []struct {
+		name   string
+		filter *clientip.Filter
+		addr   string
+		want   bool
+	}{
+		{name: "allowed network", filter: filter, addr: "10.1.2.3", want: true},
+		{name: "allowed address", filter: filter, addr: "192.0.2.1", want: true},
+		{name: "not allowed", filter: filter, addr: "192.0.2.2"},
+		{name: "deny wins", filter: filter, addr: "10.66.1.1"},
+		{name: "deny only", filter: denyOnly, addr: "203.0.113.5"},
+		{name: "not denied", filter: denyOnly, addr: "192.0.2.2", want: true},
+		{name: "no filter", filter: none, addr: "192.0.2.2", want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.filter.Allows(netip.MustParseAddr(tc.addr)))
+		})
+	}
+
+	_, err = clientip.NewFilter([]string{"10.0.0.0/33"}, nil)
+	assert.ErrorContains(t, err, "invalid network '10.0.0.0/33'")
+}
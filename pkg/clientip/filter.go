@@ -0,0 +1,39 @@
+package clientip
+
+import (
+	"net/netip"
+)
+
+// Filter decides by the client IP whether a request is accepted
+type Filter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewFilter creates a filter from lists of IP addresses and networks. Returns nil, if both lists are empty.
+func NewFilter(allow []string, deny []string) (*Filter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f := &Filter{}
+	var err error
+	if f.allow, err = ParsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = ParsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Allows reports whether the address is not denied and, if there is an allow list, allowed. Deny wins over
+// allow. A nil filter allows every address.
+func (f *Filter) Allows(addr netip.Addr) bool {
+	if f == nil {
+		return true
+	}
+	if Contains(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || Contains(f.allow, addr)
+}
@@ -0,0 +1,92 @@
+package clientip
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Proxies derives the address of the client from the headers added by trusted reverse proxies
+type Proxies struct {
+	trusted []netip.Prefix
+}
+
+// NewProxies creates Proxies trusting the given IP addresses and networks
+func NewProxies(trusted []string) (*Proxies, error) {
+	prefixes, err := ParsePrefixes(trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &Proxies{trusted: prefixes}, nil
+}
+
+// Handler replaces the remote address of requests received from a trusted proxy by the address of the client,
+// before next is called. Only the IP address is kept, the port of the client isn't known. Requests received
+// directly from clients keep their remote address unchanged.
+func (p *Proxies) Handler(next http.Handler) http.Handler {
+	if len(p.trusted) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peer, ok := FromRequest(r); ok && Contains(p.trusted, peer) {
+			client, _ := p.ClientIP(r)
+			r.RemoteAddr = client.String()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientIP returns the address of the client. If the request has been received from a trusted proxy, the
+// Forwarded header (RFC 7239) or, if missing, the X-Forwarded-For header is evaluated from right to left. The
+// first address not belonging to a trusted proxy is the client. Values before it may have been forged by the
+// client and are ignored.
+func (p *Proxies) ClientIP(r *http.Request) (netip.Addr, bool) {
+	peer, ok := FromRequest(r)
+	if !ok || !Contains(p.trusted, peer) {
+		return peer, ok
+	}
+	var hops []string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		hops = forwardedFor(values)
+	} else {
+		hops = splitList(r.Header.Values("X-Forwarded-For"))
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseAddr(hops[i])
+		if !ok {
+			// An obfuscated or unknown hop, e.g. for=unknown, hides the client
+			break
+		}
+		client = addr
+		if !Contains(p.trusted, addr) {
+			break
+		}
+	}
+	return client, true
+}
+
+// forwardedFor returns the for parameters of the Forwarded headers, e.g. 'for=192.0.2.60;proto=http'
+func forwardedFor(values []string) (hops []string) {
+	for _, element := range splitList(values) {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				hops = append(hops, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return hops
+}
+
+func splitList(values []string) (items []string) {
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
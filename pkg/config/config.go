@@ -7,11 +7,16 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"text/template"
 
+	"github.com/http-everything/httpe/pkg/clientip"
+	"github.com/http-everything/httpe/pkg/share/logger"
 	"github.com/http-everything/httpe/pkg/share/timeunit"
 
 	"github.com/asaskevich/govalidator"
+	humanise "github.com/dustin/go-humanize" //nolint:misspell
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -21,6 +26,7 @@ const (
 	DefaultDataDir        = "./"
 	DefaultDataRetention  = "1d"
 	DefaultLogLevel       = "info"
+	DefaultLogFormat      = "text"
 	DefaultConfigFilename = "httpe.conf"
 	EnvPrefix             = "httpe"
 )
@@ -30,24 +36,51 @@ var (
 	ErrUnableToAccessCertFile = errors.New("failed to open/access cert_file")
 	ErrUnableToAccessKeyFile  = errors.New("failed to open/access key_file")
 	ErrCertOrKeyMissing       = errors.New("to activate TLS you must provide cert AND key")
+	ErrUnableToAccessClientCA = errors.New("failed to open/access client_ca_file")
+	ErrClientCARequiresTLS    = errors.New("client_ca_file requires cert_file and key_file")
 	ErrNoRulesFile            = errors.New("no rules file specified")
 	ErrRulesFileNotReadable   = errors.New("rules file not found or not readable")
+	ErrUsersFileNotReadable   = errors.New("users file not found or not readable")
+	ErrGroupsFileNotReadable  = errors.New("groups file not found or not readable")
 	ErrBadSMTPServer          = errors.New("SMTP server is not a valid hostname or IP address")
+	ErrOIDCIncomplete         = errors.New("oidc requires issuer, client_id and redirect_url")
+	ErrNegativeMaxScripts     = errors.New("max_scripts must not be negative")
+	ErrMetricsAuthMissing     = errors.New("metrics requires a token or a username and password")
+	ErrBadTracingEndpoint     = errors.New("tracing endpoint must be an http or https URL")
+	ErrBadAccessLogFormat     = errors.New("access_log_format must be common, combined, json or custom")
+	ErrAccessLogTemplate      = errors.New("access_log_format custom requires access_log_template")
+	ErrNegativeMaxBackups     = errors.New("access_log_max_backups must not be negative")
+	ErrInfoAuthMissing        = errors.New("info requires a token or a username and password")
 )
 
 // SvrConfig represents the config settings for the server
 type SvrConfig struct {
-	Address       string `mapstructure:"address"`
-	DataDir       string `mapstructure:"data_dir"`
-	DataRetention string `mapstructure:"data_retention"`
-	CertFile      string `mapstructure:"cert_file"`
-	KeyFile       string `mapstructure:"key_file"`
-	AccessLogFile string `mapstructure:"access_log_file"`
-	LogFile       string `mapstructure:"log_file"`
-	LogLevel      string `mapstructure:"log_level"`
-	RulesFile     string `mapstructure:"rules_file"`
-	ValidateOnly  bool   `mapstructure:"validate"`
-	DumpRules     bool   `mapstructure:"dump_rules"`
+	Address             string   `mapstructure:"address"`
+	DataDir             string   `mapstructure:"data_dir"`
+	DataRetention       string   `mapstructure:"data_retention"`
+	CertFile            string   `mapstructure:"cert_file"`
+	KeyFile             string   `mapstructure:"key_file"`
+	ClientCAFile        string   `mapstructure:"client_ca_file"`
+	AccessLogFile       string   `mapstructure:"access_log_file"`
+	AccessLogFormat     string   `mapstructure:"access_log_format"`
+	AccessLogTemplate   string   `mapstructure:"access_log_template"`
+	AccessLogMaxSize    string   `mapstructure:"access_log_max_size"`
+	AccessLogMaxAge     string   `mapstructure:"access_log_max_age"`
+	AccessLogMaxBackups int      `mapstructure:"access_log_max_backups"`
+	AccessLogCompress   bool     `mapstructure:"access_log_compress"`
+	LogFile             string   `mapstructure:"log_file"`
+	LogLevel            string   `mapstructure:"log_level"`
+	LogFormat           string   `mapstructure:"log_format"`
+	RulesFile           string   `mapstructure:"rules_file"`
+	UsersFile           string   `mapstructure:"users_file"`
+	GroupsFile          string   `mapstructure:"groups_file"`
+	TrustedProxies      []string `mapstructure:"trusted_proxies"`
+	AllowCIDRs          []string `mapstructure:"allow_cidrs"`
+	DenyCIDRs           []string `mapstructure:"deny_cidrs"`
+	PersistRateLimits   bool     `mapstructure:"persist_rate_limits"`
+	MaxScripts          int      `mapstructure:"max_scripts"`
+	ValidateOnly        bool     `mapstructure:"validate"`
+	DumpRules           bool     `mapstructure:"dump_rules"`
 }
 
 type SMTPConfig struct {
@@ -58,10 +91,51 @@ type SMTPConfig struct {
 	From     string `mapstructure:"from"`
 }
 
+type OIDCConfig struct {
+	Issuer            string   `mapstructure:"issuer"`
+	ClientID          string   `mapstructure:"client_id"`
+	ClientSecret      string   `mapstructure:"client_secret"`
+	ClientSecretFile  string   `mapstructure:"client_secret_file"`
+	RedirectURL       string   `mapstructure:"redirect_url"`
+	Scopes            []string `mapstructure:"scopes"`
+	SessionSecret     string   `mapstructure:"session_secret"`
+	SessionSecretFile string   `mapstructure:"session_secret_file"`
+	SessionLifetime   string   `mapstructure:"session_lifetime"`
+}
+
+// EndpointAuthConfig holds the credentials protecting a built-in endpoint, like the metrics or the info endpoint
+type EndpointAuthConfig struct {
+	Token        string `mapstructure:"token"`
+	TokenFile    string `mapstructure:"token_file"`
+	Username     string `mapstructure:"username"`
+	Password     string `mapstructure:"password"`
+	PasswordFile string `mapstructure:"password_file"`
+}
+
+// hasCredentials reports whether a token or a username and password are set
+func (e *EndpointAuthConfig) hasCredentials() bool {
+	hasToken := e.Token != "" || e.TokenFile != ""
+	hasPassword := e.Password != "" || e.PasswordFile != ""
+	return hasToken || (hasPassword && e.Username != "")
+}
+
+type TracingConfig struct {
+	Endpoint    string            `mapstructure:"endpoint"`
+	ServiceName string            `mapstructure:"service_name"`
+	Headers     map[string]string `mapstructure:"headers"`
+}
+
 // Config is used for managing the license server config values
 type Config struct {
 	S    *SvrConfig  `mapstructure:"server"`
 	SMTP *SMTPConfig `mapstructure:"smtp"`
+	OIDC *OIDCConfig `mapstructure:"oidc"`
+	// Metrics enables the metrics endpoint, if set
+	Metrics *EndpointAuthConfig `mapstructure:"metrics"`
+	// Tracing enables the export of traces, if set
+	Tracing *TracingConfig `mapstructure:"tracing"`
+	// Info enables the info endpoint, if set
+	Info *EndpointAuthConfig `mapstructure:"info"`
 
 	pFlags *pflag.FlagSet
 	v      *viper.Viper
@@ -101,6 +175,7 @@ func (c *Config) Setup() {
 	viperCfg.SetDefault("server.data_dir", DefaultDataDir)
 	viperCfg.SetDefault("server.data_retention", DefaultDataRetention)
 	viperCfg.SetDefault("server.log_level", DefaultLogLevel)
+	viperCfg.SetDefault("server.log_format", DefaultLogFormat)
 
 	if c.pFlags != nil {
 		_ = viperCfg.BindPFlag("server.address", c.pFlags.Lookup("address"))
@@ -108,10 +183,15 @@ func (c *Config) Setup() {
 		_ = viperCfg.BindPFlag("server.data_retention", c.pFlags.Lookup("data-retention"))
 		_ = viperCfg.BindPFlag("server.cert_file", c.pFlags.Lookup("cert-file"))
 		_ = viperCfg.BindPFlag("server.key_file", c.pFlags.Lookup("key-file"))
+		_ = viperCfg.BindPFlag("server.client_ca_file", c.pFlags.Lookup("client-ca-file"))
 		_ = viperCfg.BindPFlag("server.access_log_file", c.pFlags.Lookup("access-log-file"))
+		_ = viperCfg.BindPFlag("server.access_log_format", c.pFlags.Lookup("access-log-format"))
 		_ = viperCfg.BindPFlag("server.log_file", c.pFlags.Lookup("log-file"))
 		_ = viperCfg.BindPFlag("server.log_level", c.pFlags.Lookup("log-level"))
+		_ = viperCfg.BindPFlag("server.log_format", c.pFlags.Lookup("log-format"))
 		_ = viperCfg.BindPFlag("server.rules_file", c.pFlags.Lookup("rules-file"))
+		_ = viperCfg.BindPFlag("server.users_file", c.pFlags.Lookup("users-file"))
+		_ = viperCfg.BindPFlag("server.groups_file", c.pFlags.Lookup("groups-file"))
 		_ = viperCfg.BindPFlag("server.dump_rules", c.pFlags.Lookup("dump-rules"))
 		_ = viperCfg.BindPFlag("server.validate", c.pFlags.Lookup("validate"))
 	}
@@ -154,6 +234,48 @@ func (c *Config) Load(cfgPath *string, cfgReader io.Reader) (cfg *Config, err er
 	return cfg, nil
 }
 
+// Source returns the path of the config file the config has been loaded from, empty if no file has been read
+func (c *Config) Source() string {
+	if c.v == nil || c.v.ConfigFileUsed() == "" {
+		return ""
+	}
+	path, err := filepath.Abs(c.v.ConfigFileUsed())
+	if err != nil {
+		return c.v.ConfigFileUsed()
+	}
+	return path
+}
+
+// validateAccessLog validates the format and the rotation of the access log
+func (c *Config) validateAccessLog() error {
+	switch c.S.AccessLogFormat {
+	case "", "common", "combined", "json":
+	case "custom":
+		if c.S.AccessLogTemplate == "" {
+			return ErrAccessLogTemplate
+		}
+		if _, err := template.New("access_log").Parse(c.S.AccessLogTemplate); err != nil {
+			return fmt.Errorf("invalid access_log_template: %w", err)
+		}
+	default:
+		return ErrBadAccessLogFormat
+	}
+	if c.S.AccessLogMaxSize != "" {
+		if _, err := humanise.ParseBytes(c.S.AccessLogMaxSize); err != nil {
+			return fmt.Errorf("invalid access_log_max_size: %w", err)
+		}
+	}
+	if c.S.AccessLogMaxAge != "" {
+		if _, err := timeunit.ParseDuration(c.S.AccessLogMaxAge); err != nil {
+			return fmt.Errorf("invalid access_log_max_age: %w", err)
+		}
+	}
+	if c.S.AccessLogMaxBackups < 0 {
+		return ErrNegativeMaxBackups
+	}
+	return nil
+}
+
 // Validate validates the loaded config
 func (c *Config) Validate() (err error) {
 	address := c.S.Address
@@ -182,6 +304,14 @@ func (c *Config) Validate() (err error) {
 			return ErrUnableToAccessKeyFile
 		}
 	}
+	if c.S.ClientCAFile != "" {
+		if c.S.CertFile == "" {
+			return ErrClientCARequiresTLS
+		}
+		if !available(c.S.ClientCAFile) {
+			return ErrUnableToAccessClientCA
+		}
+	}
 
 	if c.S.RulesFile == "" {
 		return ErrNoRulesFile
@@ -191,6 +321,14 @@ func (c *Config) Validate() (err error) {
 		return ErrRulesFileNotReadable
 	}
 
+	if c.S.UsersFile != "" && !available(c.S.UsersFile) {
+		return ErrUsersFileNotReadable
+	}
+
+	if c.S.GroupsFile != "" && !available(c.S.GroupsFile) {
+		return ErrGroupsFileNotReadable
+	}
+
 	if c.SMTP != nil {
 		if !isValidHostOrIPAddress(c.SMTP.Server) {
 			return ErrBadSMTPServer
@@ -202,6 +340,50 @@ func (c *Config) Validate() (err error) {
 		return err
 	}
 
+	if _, err = logger.ParseLogFormat(c.S.LogFormat); err != nil {
+		return err
+	}
+
+	if err = c.validateAccessLog(); err != nil {
+		return err
+	}
+
+	if _, err = clientip.ParsePrefixes(c.S.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+	if _, err = clientip.NewFilter(c.S.AllowCIDRs, c.S.DenyCIDRs); err != nil {
+		return fmt.Errorf("invalid allow_cidrs or deny_cidrs: %w", err)
+	}
+
+	if c.S.MaxScripts < 0 {
+		return ErrNegativeMaxScripts
+	}
+
+	if c.Metrics != nil && !c.Metrics.hasCredentials() {
+		return ErrMetricsAuthMissing
+	}
+	if c.Info != nil && !c.Info.hasCredentials() {
+		return ErrInfoAuthMissing
+	}
+
+	if c.Tracing != nil {
+		u, err := url.Parse(c.Tracing.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ErrBadTracingEndpoint
+		}
+	}
+
+	if c.OIDC != nil {
+		if c.OIDC.Issuer == "" || c.OIDC.ClientID == "" || c.OIDC.RedirectURL == "" {
+			return ErrOIDCIncomplete
+		}
+		if c.OIDC.SessionLifetime != "" {
+			if _, err = timeunit.ParseDuration(c.OIDC.SessionLifetime); err != nil {
+				return fmt.Errorf("invalid oidc session_lifetime: %w", err)
+			}
+		}
+	}
+
 	return nil
 }
 
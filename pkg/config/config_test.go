@@ -3,6 +3,7 @@ package config_test
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -97,6 +98,53 @@ func TestShouldValidateConfig(t *testing.T) {
 			},
 			wantError: config.ErrCertOrKeyMissing,
 		},
+		{
+			name: "client ca without tls",
+			cfg: &config.Config{
+				S: &config.SvrConfig{
+					Address:      Address,
+					ClientCAFile: CertFile,
+				},
+			},
+			wantError: config.ErrClientCARequiresTLS,
+		},
+		{
+			name: "client ca file inaccessible",
+			cfg: &config.Config{
+				S: &config.SvrConfig{
+					Address:      Address,
+					CertFile:     CertFile,
+					KeyFile:      KeyFile,
+					ClientCAFile: NonExistingFile,
+				},
+			},
+			wantError: config.ErrUnableToAccessClientCA,
+		},
+		{
+			name: "invalid trusted proxy",
+			cfg: &config.Config{
+				S: &config.SvrConfig{
+					Address:        Address,
+					RulesFile:      "../../testdata/rules/good/all.yaml",
+					DataRetention:  "1d",
+					TrustedProxies: []string{"10.0.0.0/8", "proxy.example.com"},
+				},
+			},
+			wantError: fmt.Errorf(`invalid trusted_proxies: invalid IP address 'proxy.example.com': ` +
+				`ParseAddr("proxy.example.com"): unexpected character (at "proxy.example.com")`),
+		},
+		{
+			name: "negative max scripts",
+			cfg: &config.Config{
+				S: &config.SvrConfig{
+					Address:       Address,
+					RulesFile:     "../../testdata/rules/good/all.yaml",
+					DataRetention: "1d",
+					MaxScripts:    -1,
+				},
+			},
+			wantError: config.ErrNegativeMaxScripts,
+		},
 		{
 			name: "bad smtp server",
 			cfg: &config.Config{
@@ -109,6 +157,50 @@ func TestShouldValidateConfig(t *testing.T) {
 			},
 			wantError: config.ErrBadSMTPServer,
 		},
+		{
+			name: "users file inaccessible",
+			cfg: &config.Config{
+				S: &config.SvrConfig{
+					Address:       Address,
+					RulesFile:     "../../testdata/rules/good/all.yaml",
+					UsersFile:     NonExistingFile,
+					DataRetention: "1d",
+				},
+			},
+			wantError: config.ErrUsersFileNotReadable,
+		},
+		{
+			name: "incomplete oidc",
+			cfg: &config.Config{
+				S:    validServerConfig,
+				OIDC: &config.OIDCConfig{Issuer: "https://idp.example.com", ClientID: "httpe"},
+			},
+			wantError: config.ErrOIDCIncomplete,
+		},
+		{
+			name: "metrics without auth",
+			cfg: &config.Config{
+				S:       validServerConfig,
+				Metrics: &config.EndpointAuthConfig{Username: "prometheus"},
+			},
+			wantError: config.ErrMetricsAuthMissing,
+		},
+		{
+			name: "info without auth",
+			cfg: &config.Config{
+				S:    validServerConfig,
+				Info: &config.EndpointAuthConfig{Password: "secret"},
+			},
+			wantError: config.ErrInfoAuthMissing,
+		},
+		{
+			name: "bad tracing endpoint",
+			cfg: &config.Config{
+				S:       validServerConfig,
+				Tracing: &config.TracingConfig{Endpoint: "localhost:4318"},
+			},
+			wantError: config.ErrBadTracingEndpoint,
+		},
 		{
 			name: "bad retention time unit",
 			cfg: &config.Config{
@@ -122,6 +214,54 @@ func TestShouldValidateConfig(t *testing.T) {
 			},
 			wantError: fmt.Errorf("1p: invalid duration format or unsupported unit"),
 		},
+		{
+			name: "bad log format",
+			cfg: &config.Config{
+				S: &config.SvrConfig{
+					Address:       Address,
+					RulesFile:     "../../testdata/rules/good/all.yaml",
+					DataRetention: "1d",
+					LogFormat:     "xml",
+				},
+			},
+			wantError: fmt.Errorf(`invalid log format: "xml"`),
+		},
+		{
+			name: "bad access log format",
+			cfg: &config.Config{
+				S: &config.SvrConfig{
+					Address:         Address,
+					RulesFile:       "../../testdata/rules/good/all.yaml",
+					DataRetention:   "1d",
+					AccessLogFormat: "apache",
+				},
+			},
+			wantError: config.ErrBadAccessLogFormat,
+		},
+		{
+			name: "custom access log format without template",
+			cfg: &config.Config{
+				S: &config.SvrConfig{
+					Address:         Address,
+					RulesFile:       "../../testdata/rules/good/all.yaml",
+					DataRetention:   "1d",
+					AccessLogFormat: "custom",
+				},
+			},
+			wantError: config.ErrAccessLogTemplate,
+		},
+		{
+			name: "bad access log max size",
+			cfg: &config.Config{
+				S: &config.SvrConfig{
+					Address:          Address,
+					RulesFile:        "../../testdata/rules/good/all.yaml",
+					DataRetention:    "1d",
+					AccessLogMaxSize: "big",
+				},
+			},
+			wantError: fmt.Errorf(`invalid access_log_max_size: strconv.ParseFloat: parsing "": invalid syntax`),
+		},
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -154,6 +294,11 @@ func TestShouldVerifyDefaults(t *testing.T) {
 	assert.Equal(t, "/var/log/httpe/access.log", cfg.S.AccessLogFile)
 	assert.Equal(t, "/var/log/httpe/server.log", cfg.S.LogFile)
 	assert.Equal(t, "info", cfg.S.LogLevel)
+	assert.Equal(t, "text", cfg.S.LogFormat)
+
+	source, err := filepath.Abs(cfgPath)
+	require.NoError(t, err)
+	assert.Equal(t, source, cfg.Source())
 }
 
 func TestShouldVerifyEnvVars(t *testing.T) {
@@ -0,0 +1,215 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/share/logger"
+)
+
+const (
+	// HealthPath answers as long as the server is running
+	HealthPath = "/_health"
+	// ReadyPath answers 200 OK if all readiness checks pass, 503 Service Unavailable otherwise
+	ReadyPath = "/_ready"
+	// InfoPath reports the version, the uptime and the loaded rules
+	InfoPath = "/_info"
+
+	// CheckTimeout limits the time a single readiness check may take
+	CheckTimeout = 5 * time.Second
+	// CacheTTL is the time the results of cached readiness checks are reused for, so frequent probes don't hammer
+	// the SMTP server
+	CacheTTL = 10 * time.Second
+
+	statusOK     = "ok"
+	statusFailed = "failed"
+	// smtpsPort is the port of SMTP with implicit TLS, on which the server expects the TLS handshake first
+	smtpsPort = 465
+)
+
+// ErrReloading is returned by the reload check while the rules are being reloaded
+var ErrReloading = errors.New("rules are being reloaded")
+
+// Check verifies something the server depends on, returning an error if it isn't usable
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+	// Cache allows the result to be reused for the ttl of the ReadyHandler. It's meant for checks contacting other
+	// services, cheap local checks should reflect the current state.
+	Cache bool
+}
+
+// response is the JSON body of the health and the readiness endpoint
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Handler answers 200 OK to every request. It tells that the server is alive, not that it is able to serve.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, response{Status: statusOK})
+	})
+}
+
+// ReadyHandler runs the checks concurrently and answers 503 Service Unavailable if any fails. The results of checks
+// allowing it are reused for the ttl, so frequent probes don't run them over and over. The body tells which checks
+// have failed, the reason is only logged, so it doesn't leak to the client.
+func ReadyHandler(checks []Check, ttl time.Duration, logger *logger.Logger) http.Handler {
+	var mu sync.Mutex
+	cached := make(map[string]result)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Concurrent requests wait for the checks in progress rather than running them once more
+		mu.Lock()
+		results := runChecks(checks, cached, ttl, logger)
+		mu.Unlock()
+
+		resp := response{Status: "ready", Checks: make(map[string]string, len(checks))}
+		for _, check := range checks {
+			resp.Checks[check.Name] = statusOK
+			if results[check.Name].err != nil {
+				resp.Checks[check.Name] = statusFailed
+				resp.Status = "not ready"
+			}
+		}
+		code := http.StatusOK
+		if resp.Status != "ready" {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, resp)
+	})
+}
+
+// result is the outcome of a check
+type result struct {
+	err     error
+	checked time.Time
+}
+
+// runChecks runs the checks concurrently, except cached checks whose result is younger than the ttl. The checks
+// don't depend on the request triggering them, as their results are shared with other requests.
+func runChecks(checks []Check, cached map[string]result, ttl time.Duration, logger *logger.Logger) map[string]result {
+	ctx, cancel := context.WithTimeout(context.Background(), CheckTimeout)
+	defer cancel()
+
+	results := make(map[string]result, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		if res, ok := cached[check.Name]; ok && check.Cache && time.Since(res.checked) < ttl {
+			results[check.Name] = res
+			continue
+		}
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+			res := result{err: check.Run(ctx), checked: time.Now()}
+			if res.err != nil {
+				logger.Errorf("readiness check %s failed: %s", check.Name, res.err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results[check.Name] = res
+		}(check)
+	}
+	wg.Wait()
+	for _, check := range checks {
+		if check.Cache {
+			cached[check.Name] = results[check.Name]
+		}
+	}
+	return results
+}
+
+// Reload fails while the rules are being reloaded
+func Reload(inProgress func() bool) Check {
+	return Check{Name: "reload", Run: func(context.Context) error {
+		if inProgress() {
+			return ErrReloading
+		}
+		return nil
+	}}
+}
+
+// SMTP fails unless the SMTP server greets within the timeout. The connection is closed with QUIT, so the server
+// doesn't log an aborted session.
+func SMTP(server string, port int) Check {
+	return Check{Name: "smtp", Cache: true, Run: func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(server, strconv.Itoa(port)))
+		if err != nil {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		if port == smtpsPort {
+			conn = tls.Client(conn, &tls.Config{ServerName: server, MinVersion: tls.VersionTLS12})
+		}
+		c, err := smtp.NewClient(conn, server)
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		defer c.Close()
+		return c.Quit()
+	}}
+}
+
+// Writable fails unless a file can be created in the directory
+func Writable(name string, dir string) Check {
+	return Check{Name: name, Run: func(context.Context) error {
+		f, err := os.CreateTemp(dir, ".httpe-ready-*")
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteString("ready\n")
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if removeErr := os.Remove(f.Name()); err == nil {
+			err = removeErr
+		}
+		return err
+	}}
+}
+
+// Info describes the running server
+type Info struct {
+	Version string    `json:"version"`
+	Started time.Time `json:"started"`
+	// Uptime is a duration like 26h3m12s
+	Uptime string `json:"uptime"`
+	// Rules is the number of rules currently served
+	Rules     int    `json:"rules"`
+	RulesFile string `json:"rules_file"`
+	// Config is the config file, empty if the config has been taken from flags and the environment only
+	Config string `json:"config"`
+}
+
+// InfoHandler reports the info returned by the function. Wrap it in an authentication, it discloses details of the
+// setup.
+func InfoHandler(info func() Info) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := info()
+		i.Uptime = time.Since(i.Started).Round(time.Second).String()
+		writeJSON(w, http.StatusOK, i)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	// Probes must not see a cached answer
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,195 @@
+package health_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/health"
+	"github.com/http-everything/httpe/pkg/share/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	health.Handler().ServeHTTP(w, httptest.NewRequest("GET", health.HealthPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+}
+
+func TestReadyHandler(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "test.log")
+	l, err := logger.New("test", logFile, logger.DEBUG)
+	require.NoError(t, err)
+	passing := health.Check{Name: "passing", Run: func(context.Context) error { return nil }}
+	failing := health.Check{Name: "failing", Run: func(context.Context) error { return errors.New("secret details") }}
+
+	cases := []struct {
+		name       string
+		checks     []health.Check
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "No checks",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"status":"ready"}`,
+		},
+		{
+			name:       "Passing",
+			checks:     []health.Check{passing},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"status":"ready","checks":{"passing":"ok"}}`,
+		},
+		{
+			name:       "Failing",
+			checks:     []health.Check{passing, failing},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   `{"status":"not ready","checks":{"passing":"ok","failing":"failed"}}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			health.ReadyHandler(tc.checks, 0, l).ServeHTTP(w, httptest.NewRequest("GET", health.ReadyPath, nil))
+			assert.Equal(t, tc.wantStatus, w.Code)
+			assert.JSONEq(t, tc.wantBody, w.Body.String())
+			assert.NotContains(t, w.Body.String(), "secret details")
+		})
+	}
+	log, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(log), "readiness check failing failed: secret details")
+}
+
+func TestReadyHandlerCaches(t *testing.T) {
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	var runs atomic.Int32
+	check := health.Check{Name: "counting", Cache: true, Run: func(context.Context) error {
+		runs.Add(1)
+		return nil
+	}}
+	var uncachedRuns atomic.Int32
+	uncached := health.Check{Name: "uncached", Run: func(context.Context) error {
+		uncachedRuns.Add(1)
+		return nil
+	}}
+
+	ready := func(h http.Handler) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", health.ReadyPath, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	h := health.ReadyHandler([]health.Check{check, uncached}, time.Hour, l)
+	ready(h)
+	ready(h)
+	assert.Equal(t, int32(1), runs.Load(), "the result is reused within the ttl")
+	assert.Equal(t, int32(2), uncachedRuns.Load())
+
+	h = health.ReadyHandler([]health.Check{check}, 0, l)
+	ready(h)
+	ready(h)
+	assert.Equal(t, int32(3), runs.Load())
+}
+
+func TestReload(t *testing.T) {
+	inProgress := true
+	check := health.Reload(func() bool { return inProgress })
+	assert.ErrorIs(t, check.Run(context.Background()), health.ErrReloading)
+	inProgress = false
+	assert.NoError(t, check.Run(context.Background()))
+}
+
+func TestWritable(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, health.Writable("data_dir", dir).Run(context.Background()))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "the probe file must be removed")
+
+	assert.Error(t, health.Writable("data_dir", filepath.Join(dir, "missing")).Run(context.Background()))
+}
+
+// smtpServer is a stand-in for an SMTP server, greeting clients and accepting every command until QUIT
+func smtpServer(t *testing.T, greeting string) (host string, port int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				_, _ = conn.Write([]byte(greeting + "\r\n"))
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.HasPrefix(line, "QUIT") {
+						_, _ = conn.Write([]byte("221 bye\r\n"))
+						return
+					}
+					_, _ = conn.Write([]byte("250 ok\r\n"))
+				}
+			}(conn)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestSMTP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	host, port := smtpServer(t, "220 mail.example.com ESMTP")
+	assert.NoError(t, health.SMTP(host, port).Run(ctx))
+
+	host, port = smtpServer(t, "554 no service")
+	assert.Error(t, health.SMTP(host, port).Run(ctx))
+
+	// Nothing listens on the port of a closed listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port = ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+	assert.Error(t, health.SMTP("127.0.0.1", port).Run(ctx))
+}
+
+func TestInfoHandler(t *testing.T) {
+	started := time.Now().Add(-90 * time.Minute)
+	h := health.InfoHandler(func() health.Info {
+		return health.Info{Version: "1.2.3", Started: started, Rules: 4, RulesFile: "/etc/httpe/rules.yaml"}
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", health.InfoPath, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var info health.Info
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, "1.2.3", info.Version)
+	assert.Equal(t, "1h30m0s", info.Uptime)
+	assert.Equal(t, 4, info.Rules)
+	assert.Equal(t, "/etc/httpe/rules.yaml", info.RulesFile)
+	assert.True(t, started.Equal(info.Started))
+}
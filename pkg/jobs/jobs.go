@@ -0,0 +1,213 @@
+package jobs
+
+import (
+	json2 "encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/actions"
+	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/share/timeunit"
+
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+const (
+	FilePrefix = "httpe-job"
+	// URLPrefix is the path of the built-in endpoint reporting the status of a job
+	URLPrefix = "/_jobs/"
+
+	StatusRunning  = "running"
+	StatusFinished = "finished"
+	StatusFailed   = "failed"
+
+	idAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	idLength   = 24
+)
+
+var (
+	ErrNotFound  = errors.New("job not found")
+	ErrInvalidID = errors.New("invalid job id")
+
+	validID = regexp.MustCompile(`^[0-9a-zA-Z]+$`)
+)
+
+// Job is the state of an asynchronously executed action as stored in the data directory
+type Job struct {
+	ID            string     `json:"id"`
+	Rule          string     `json:"rule"`
+	Status        string     `json:"status"`
+	Started       time.Time  `json:"started"`
+	Finished      *time.Time `json:"finished,omitempty"`
+	ExitCode      *int       `json:"exit_code"`
+	Stdout        string     `json:"stdout"`
+	Stderr        string     `json:"stderr"`
+	InternalError string     `json:"internal_error,omitempty"`
+}
+
+// RunFunc performs the actual work of a job
+type RunFunc func() (actions.ActionResponse, error)
+
+// Store keeps jobs as JSON files in the data directory. The store doesn't hold any state in memory, so the
+// status of a job can be read from any Store created for the same data directory.
+type Store struct {
+	dataDir   string
+	retention string
+	logger    *logger.Logger
+}
+
+func New(conf *config.Config, logger *logger.Logger) *Store {
+	return &Store{
+		dataDir:   conf.S.DataDir,
+		retention: conf.S.DataRetention,
+		logger:    logger,
+	}
+}
+
+// Start stores a new job of the rule with the given ID with status running and executes the run function in the
+// background. Once the run function returns, the job is updated with the results.
+func (s *Store) Start(ruleID string, run RunFunc) (job Job, err error) {
+	id, err := gonanoid.Generate(idAlphabet, idLength)
+	if err != nil {
+		return Job{}, fmt.Errorf("error generating job id: %w", err)
+	}
+	job = Job{
+		ID:      id,
+		Rule:    ruleID,
+		Status:  StatusRunning,
+		Started: time.Now(),
+	}
+	if err = s.write(job); err != nil {
+		return Job{}, err
+	}
+	s.logger.Debugf("job %s of rule '%s' started", job.ID, ruleID)
+
+	go s.finish(job, run)
+
+	return job, nil
+}
+
+// Get reads the job with the given id from the data directory
+func (s *Store) Get(id string) (job Job, err error) {
+	if !validID.MatchString(id) {
+		return Job{}, ErrInvalidID
+	}
+	content, err := os.ReadFile(s.fileName(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Job{}, ErrNotFound
+		}
+		return Job{}, fmt.Errorf("error reading job %s: %w", id, err)
+	}
+	err = json2.Unmarshal(content, &job)
+	if err != nil {
+		return Job{}, fmt.Errorf("error parsing job %s: %w", id, err)
+	}
+	return job, nil
+}
+
+// URL returns the URL path of the status endpoint of the job
+func (job Job) URL() string {
+	return URLPrefix + job.ID
+}
+
+// StatusHandler returns a handler responding with the JSON representation of the job
+func StatusHandler(job Job) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		encoder := json2.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(job)
+	})
+}
+
+func (s *Store) finish(job Job, run RunFunc) {
+	resp, err := run()
+	now := time.Now()
+	job.Finished = &now
+	if err != nil {
+		job.Status = StatusFailed
+		job.InternalError = err.Error()
+	} else {
+		job.Status = StatusFinished
+		job.ExitCode = &resp.Code
+		job.Stdout = resp.SuccessBody
+		job.Stderr = resp.ErrorBody
+	}
+	if err := s.write(job); err != nil {
+		s.logger.Errorf("Failed to store result of job %s: %v", job.ID, err)
+	}
+	s.logger.Debugf("job %s of rule '%s' %s", job.ID, job.Rule, job.Status)
+
+	deleted, err := s.dataDirCleanup()
+	if err != nil {
+		s.logger.Errorf("Failed to cleanup data directory %s: %v", s.dataDir, err)
+	}
+	s.logger.Debugf("Deleted %d job files from data directory", deleted)
+}
+
+// write stores the job. The content is written to a temporary file first and renamed afterward, so readers never
+// see a partially written job.
+func (s *Store) write(job Job) error {
+	content, err := json2.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding job %s: %w", job.ID, err)
+	}
+	fileName := s.fileName(job.ID)
+	tmpFile := fileName + ".tmp"
+	if err = os.WriteFile(tmpFile, content, 0600); err != nil {
+		return fmt.Errorf("error writing job file %s: %w", tmpFile, err)
+	}
+	if err = os.Rename(tmpFile, fileName); err != nil {
+		return fmt.Errorf("error writing job file %s: %w", fileName, err)
+	}
+	return nil
+}
+
+func (s *Store) fileName(id string) string {
+	return filepath.Join(s.dataDir, fmt.Sprintf("%s-%s.json", FilePrefix, id))
+}
+
+// dataDirCleanup deletes job files older than the data retention period. A job still running when its file
+// is deleted stores its results again once it has finished.
+func (s *Store) dataDirCleanup() (int, error) {
+	retention, err := timeunit.ParseDuration(s.retention)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	deletedFilesCount := 0
+
+	dirEntries, err := os.ReadDir(s.dataDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	for _, entry := range dirEntries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), FilePrefix+"-") || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get file info for %s: %w", entry.Name(), err)
+		}
+		if now.Sub(info.ModTime()) <= retention {
+			continue
+		}
+		filePath := filepath.Join(s.dataDir, entry.Name())
+		if err := os.Remove(filePath); err != nil {
+			return 0, fmt.Errorf("failed to delete file %s: %w", filePath, err)
+		}
+		deletedFilesCount++
+	}
+
+	return deletedFilesCount, nil
+}
@@ -0,0 +1,136 @@
+package jobs_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/actions"
+	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/jobs"
+	"github.com/http-everything/httpe/pkg/share/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobs(t *testing.T) {
+	cases := []struct {
+		name              string
+		resp              actions.ActionResponse
+		err               error
+		wantStatus        string
+		wantExitCode      int
+		wantStdout        string
+		wantStderr        string
+		wantInternalError string
+	}{
+		{
+			name:         "succeeded",
+			resp:         actions.ActionResponse{SuccessBody: "out", ErrorBody: "err", Code: 0},
+			wantStatus:   jobs.StatusFinished,
+			wantExitCode: 0,
+			wantStdout:   "out",
+			wantStderr:   "err",
+		},
+		{
+			name:         "exit code",
+			resp:         actions.ActionResponse{ErrorBody: "failed", Code: 2},
+			wantStatus:   jobs.StatusFinished,
+			wantExitCode: 2,
+			wantStderr:   "failed",
+		},
+		{
+			name:              "internal error",
+			err:               errors.New("script killed"),
+			wantStatus:        jobs.StatusFailed,
+			wantInternalError: "script killed",
+		},
+	}
+	store, dataDir := makeTestStore(t, "1d")
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			job, err := store.Start("test", func() (actions.ActionResponse, error) {
+				<-release
+				return tc.resp, tc.err
+			})
+			require.NoError(t, err)
+			assert.Equal(t, jobs.URLPrefix+job.ID, job.URL())
+
+			running, err := store.Get(job.ID)
+			require.NoError(t, err)
+			assert.Equal(t, jobs.StatusRunning, running.Status)
+			assert.Nil(t, running.ExitCode)
+			assert.Equal(t, "test", running.Rule)
+
+			close(release)
+			var finished jobs.Job
+			require.Eventually(t, func() bool {
+				finished, err = store.Get(job.ID)
+				return err == nil && finished.Status != jobs.StatusRunning
+			}, 2*time.Second, 10*time.Millisecond)
+
+			assert.Equal(t, tc.wantStatus, finished.Status)
+			assert.NotNil(t, finished.Finished)
+			assert.Equal(t, tc.wantStdout, finished.Stdout)
+			assert.Equal(t, tc.wantStderr, finished.Stderr)
+			assert.Equal(t, tc.wantInternalError, finished.InternalError)
+			if tc.err == nil {
+				require.NotNil(t, finished.ExitCode)
+				assert.Equal(t, tc.wantExitCode, *finished.ExitCode)
+			}
+		})
+	}
+	files, err := filepath.Glob(filepath.Join(dataDir, jobs.FilePrefix+"-*.json"))
+	require.NoError(t, err)
+	assert.Len(t, files, len(cases))
+}
+
+func TestGetUnknownJob(t *testing.T) {
+	store, _ := makeTestStore(t, "1d")
+
+	_, err := store.Get("doesnotexist")
+	assert.ErrorIs(t, err, jobs.ErrNotFound)
+
+	_, err = store.Get("../../etc/passwd")
+	assert.ErrorIs(t, err, jobs.ErrInvalidID)
+}
+
+func TestJobsExpire(t *testing.T) {
+	store, dataDir := makeTestStore(t, "1s")
+
+	expired := filepath.Join(dataDir, jobs.FilePrefix+"-expired.json")
+	require.NoError(t, os.WriteFile(expired, []byte("{}"), 0600))
+	old := time.Now().Add(-time.Minute)
+	require.NoError(t, os.Chtimes(expired, old, old))
+	other := filepath.Join(dataDir, "other.json")
+	require.NoError(t, os.WriteFile(other, []byte("{}"), 0600))
+	require.NoError(t, os.Chtimes(other, old, old))
+
+	job, err := store.Start("test", func() (actions.ActionResponse, error) {
+		return actions.ActionResponse{}, nil
+	})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(expired)
+		return errors.Is(err, os.ErrNotExist)
+	}, 2*time.Second, 10*time.Millisecond, "expired job not deleted")
+	assert.FileExists(t, other)
+	_, err = store.Get(job.ID)
+	assert.NoError(t, err)
+}
+
+func makeTestStore(t *testing.T, retention string) (store *jobs.Store, dataDir string) {
+	t.Helper()
+	dataDir = t.TempDir()
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	t.Cleanup(l.Shutdown)
+	conf := config.Config{S: &config.SvrConfig{DataDir: dataDir, DataRetention: retention}}
+
+	return jobs.New(&conf, l), dataDir
+}
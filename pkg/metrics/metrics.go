@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/actions"
+	"github.com/http-everything/httpe/pkg/actions/runscript"
+	"github.com/http-everything/httpe/pkg/scriptqueue"
+	"github.com/http-everything/httpe/pkg/share/endpointauth"
+	"github.com/http-everything/httpe/pkg/share/logger"
+)
+
+const (
+	// URLPath is the path the metrics are served at
+	URLPath = "/_metrics"
+	// ContentType is the content type of the Prometheus text format
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+	// DurationBuckets are the upper bounds of the request latency histogram in seconds
+	DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+	// SizeBuckets are the upper bounds of the request body size histogram in bytes
+	SizeBuckets = []float64{0, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216, 67108864}
+)
+
+// Metrics collects metrics of the requests handled by rules. All methods may be called on a nil *Metrics, so
+// collecting metrics is optional.
+type Metrics struct {
+	requests    *family
+	duration    *family
+	bodySize    *family
+	uploadBytes *family
+	exits       *family
+	timeouts    *family
+	kills       *family
+	inFlight    *family
+	postActions *family
+
+	queues *scriptqueue.Queues
+}
+
+// New creates the metrics. If queues are given, the number of requests waiting for a script slot is exported, too.
+func New(queues *scriptqueue.Queues) *Metrics {
+	return &Metrics{
+		requests: newFamily("httpe_requests_total",
+			"Requests handled by the rule by HTTP status code.", counter, []string{"rule", "code"}, nil),
+		duration: newFamily("httpe_request_duration_seconds",
+			"Time taken to handle the request, including the action.", histogram, []string{"rule"},
+			DurationBuckets),
+		bodySize: newFamily("httpe_request_body_bytes",
+			"Size of the request bodies read.", histogram, []string{"rule"}, SizeBuckets),
+		uploadBytes: newFamily("httpe_upload_bytes_total",
+			"Bytes of uploaded files.", counter, []string{"rule"}, nil),
+		exits: newFamily("httpe_script_exits_total",
+			"Scripts terminated by exit code.", counter, []string{"rule", "code"}, nil),
+		timeouts: newFamily("httpe_script_timeouts_total",
+			"Scripts killed because they exceeded their timeout.", counter, []string{"rule"}, nil),
+		kills: newFamily("httpe_script_kills_total",
+			"Scripts terminated by a signal not sent by httpe.", counter, []string{"rule"}, nil),
+		inFlight: newFamily("httpe_scripts_in_flight",
+			"Scripts currently running.", gauge, []string{"rule"}, nil),
+		postActions: newFamily("httpe_post_actions_total",
+			"Post actions by outcome.", counter, []string{"rule", "action", "outcome"}, nil),
+		queues: queues,
+	}
+}
+
+// Request records a request handled by the rule
+func (m *Metrics) Request(rule string, code int, duration time.Duration, bodySize int64) {
+	if m == nil {
+		return
+	}
+	m.requests.add(1, rule, strconv.Itoa(code))
+	m.duration.observe(duration.Seconds(), rule)
+	m.bodySize.observe(float64(bodySize), rule)
+}
+
+// Uploaded records the size of the files uploaded with a request
+func (m *Metrics) Uploaded(rule string, size int64) {
+	if m == nil {
+		return
+	}
+	m.uploadBytes.add(float64(size), rule)
+}
+
+// ScriptStarted records a script being started. The returned function must be called with the result of the
+// script once it has terminated.
+func (m *Metrics) ScriptStarted(rule string) (done func(resp actions.ActionResponse, err error)) {
+	if m == nil {
+		return func(actions.ActionResponse, error) {}
+	}
+	m.inFlight.add(1, rule)
+	return func(resp actions.ActionResponse, err error) {
+		m.inFlight.add(-1, rule)
+		switch {
+		case errors.Is(err, runscript.ErrTimeout):
+			m.timeouts.add(1, rule)
+		case errors.Is(err, runscript.ErrKilled):
+			m.kills.add(1, rule)
+		case err == nil:
+			m.exits.add(1, rule, strconv.Itoa(resp.Code))
+		}
+	}
+}
+
+// PostAction records the outcome of a post action. Scripts exiting with a code other than 0 count as error.
+func (m *Metrics) PostAction(rule string, action string, resp actions.ActionResponse, err error) {
+	if m == nil {
+		return
+	}
+	outcome := "success"
+	if err != nil || resp.Code != 0 {
+		outcome = "error"
+	}
+	m.postActions.add(1, rule, action, outcome)
+}
+
+// Handler serves the metrics in the Prometheus text format to clients passing the authentication
+func (m *Metrics) Handler(auth endpointauth.Auth, logger *logger.Logger) http.Handler {
+	return auth.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := m.write(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		_, _ = w.Write(buf.Bytes())
+	}), logger)
+}
+
+func (m *Metrics) write(buf *bytes.Buffer) error {
+	for _, f := range []*family{m.requests, m.duration, m.bodySize, m.uploadBytes, m.exits, m.timeouts, m.kills,
+		m.inFlight, m.postActions} {
+		if err := f.write(buf); err != nil {
+			return err
+		}
+	}
+	if m.queues == nil {
+		return nil
+	}
+	// Queues are read at the time of the scrape
+	waiting := newFamily("httpe_script_queue_waiting", "Requests waiting for a free script slot.", gauge,
+		[]string{"rule"}, nil)
+	_, rules := m.queues.Stats()
+	for rule, stats := range rules {
+		waiting.add(float64(stats.Waiting), rule)
+	}
+	return waiting.write(buf)
+}
@@ -0,0 +1,101 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/actions"
+	"github.com/http-everything/httpe/pkg/actions/runscript"
+	"github.com/http-everything/httpe/pkg/metrics"
+	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/scriptqueue"
+	"github.com/http-everything/httpe/pkg/share/endpointauth"
+	"github.com/http-everything/httpe/pkg/share/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	queues := scriptqueue.New(0, l)
+	release, err := queues.Acquire(context.Background(), "busy", scriptqueue.Limit{MaxConcurrency: 1})
+	require.NoError(t, err)
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_, _ = queues.Acquire(ctx, "busy", scriptqueue.Limit{MaxConcurrency: 1,
+			Mode: scriptqueue.Wait, Timeout: time.Minute})
+	}()
+
+	m := metrics.New(queues)
+	m.Request("deploy", 200, 30*time.Millisecond, 100)
+	m.Request("deploy", 200, 2*time.Second, 2000)
+	m.Request(`say "hi"`, 500, time.Millisecond, 0)
+	m.Uploaded("deploy", 1234)
+	m.ScriptStarted("deploy")(actions.ActionResponse{Code: 0}, nil)
+	m.ScriptStarted("deploy")(actions.ActionResponse{Code: 2}, nil)
+	m.ScriptStarted("deploy")(actions.ActionResponse{}, fmt.Errorf("script killed: %w", runscript.ErrTimeout))
+	m.ScriptStarted("deploy")(actions.ActionResponse{}, runscript.ErrKilled)
+	m.ScriptStarted("deploy")(actions.ActionResponse{}, errors.New("error starting the script"))
+	m.ScriptStarted("long")
+	m.PostAction("deploy", rules.SendEmail, actions.ActionResponse{}, nil)
+	m.PostAction("deploy", rules.RunScript, actions.ActionResponse{Code: 1}, nil)
+	require.Eventually(t, func() bool {
+		_, stats := queues.Stats()
+		return stats["busy"].Waiting == 1
+	}, time.Second, 10*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", metrics.URLPath, nil)
+	req.Header.Set("Authorization", "Bearer token")
+	m.Handler(endpointauth.Auth{Token: "token"}, l).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, metrics.ContentType, w.Header().Get("Content-Type"))
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE httpe_requests_total counter\n",
+		`httpe_requests_total{rule="deploy",code="200"} 2` + "\n",
+		`httpe_requests_total{rule="say \"hi\"",code="500"} 1` + "\n",
+		"# TYPE httpe_request_duration_seconds histogram\n",
+		`httpe_request_duration_seconds_bucket{rule="deploy",le="0.025"} 0` + "\n",
+		`httpe_request_duration_seconds_bucket{rule="deploy",le="0.05"} 1` + "\n",
+		`httpe_request_duration_seconds_bucket{rule="deploy",le="2.5"} 2` + "\n",
+		`httpe_request_duration_seconds_bucket{rule="deploy",le="+Inf"} 2` + "\n",
+		`httpe_request_duration_seconds_sum{rule="deploy"} 2.03` + "\n",
+		`httpe_request_duration_seconds_count{rule="deploy"} 2` + "\n",
+		`httpe_request_body_bytes_bucket{rule="deploy",le="256"} 1` + "\n",
+		`httpe_request_body_bytes_sum{rule="deploy"} 2100` + "\n",
+		`httpe_upload_bytes_total{rule="deploy"} 1234` + "\n",
+		`httpe_script_exits_total{rule="deploy",code="0"} 1` + "\n",
+		`httpe_script_exits_total{rule="deploy",code="2"} 1` + "\n",
+		`httpe_script_timeouts_total{rule="deploy"} 1` + "\n",
+		`httpe_script_kills_total{rule="deploy"} 1` + "\n",
+		`httpe_scripts_in_flight{rule="deploy"} 0` + "\n",
+		`httpe_scripts_in_flight{rule="long"} 1` + "\n",
+		`httpe_post_actions_total{rule="deploy",action="send.email",outcome="success"} 1` + "\n",
+		`httpe_post_actions_total{rule="deploy",action="run.script",outcome="error"} 1` + "\n",
+		`httpe_script_queue_waiting{rule="busy"} 1` + "\n",
+	} {
+		assert.Contains(t, body, want)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *metrics.Metrics
+	assert.NotPanics(t, func() {
+		m.Request("rule", 200, time.Second, 0)
+		m.Uploaded("rule", 1)
+		m.ScriptStarted("rule")(actions.ActionResponse{}, nil)
+		m.PostAction("rule", rules.RunScript, actions.ActionResponse{}, nil)
+	})
+}
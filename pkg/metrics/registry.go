@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	counter   = "counter"
+	gauge     = "gauge"
+	histogram = "histogram"
+)
+
+// family is a metric with all its series, written in the Prometheus text format
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series holds the value of a family for one combination of label values
+type series struct {
+	labelValues []string
+	value       float64
+	// counts, sum and count are used by histograms only, counts are not cumulative
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newFamily(name string, help string, kind string, labels []string, buckets []float64) *family {
+	return &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+// get returns the series of the label values, the caller must hold the lock
+func (f *family) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		if f.kind == histogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// add adds the value to a counter or gauge
+func (f *family) add(value float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labelValues).value += value
+}
+
+// observe counts the value in the matching bucket of a histogram
+func (f *family) observe(value float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.get(labelValues)
+	if i := sort.SearchFloat64s(f.buckets, value); i < len(f.buckets) {
+		s.counts[i]++
+	}
+	s.sum += value
+	s.count++
+}
+
+// write writes the family in the Prometheus text format. Series are sorted, so the output is stable.
+func (f *family) write(w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		labels := formatLabels(f.labels, s.labelValues)
+		if f.kind != histogram {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", f.name, labels, formatValue(s.value)); err != nil {
+				return err
+			}
+			continue
+		}
+		var cumulative uint64
+		for i, le := range f.buckets {
+			cumulative += s.counts[i]
+			bucketLabels := formatLabels(f.labels, s.labelValues, "le", formatValue(le))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, bucketLabels, cumulative); err != nil {
+				return err
+			}
+		}
+		infLabels := formatLabels(f.labels, s.labelValues, "le", "+Inf")
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n", f.name, infLabels, s.count,
+			f.name, labels, formatValue(s.sum), f.name, labels, s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatLabels returns the labels in curly braces, followed by an optional extra label given as name and value.
+// Label values are escaped as required by the text format.
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+extra[1]+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
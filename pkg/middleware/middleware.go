@@ -1,13 +1,27 @@
 package middleware
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/http-everything/httpe/pkg/accesslog"
 	"github.com/http-everything/httpe/pkg/auth"
+	"github.com/http-everything/httpe/pkg/clientip"
+	"github.com/http-everything/httpe/pkg/oidc"
+	"github.com/http-everything/httpe/pkg/ratelimit"
+	"github.com/http-everything/httpe/pkg/requestdata"
 	"github.com/http-everything/httpe/pkg/response"
 	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/share/clientcert"
 	"github.com/http-everything/httpe/pkg/share/firstof"
 	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/share/reqctx"
+	"github.com/http-everything/httpe/pkg/signature"
+	"github.com/http-everything/httpe/pkg/templating"
 
 	humanise "github.com/dustin/go-humanize" //nolint:misspell
 )
@@ -17,19 +31,64 @@ const DefaultMaxRequestBody = "512KB"
 type Middleware struct {
 	rule   rules.Rule
 	logger *logger.Logger
+	users  auth.Directory
+	oidc   *oidc.Provider
+	ips    *clientip.Filter
+	limits *ratelimit.Limiter
 }
 
-func New(rule rules.Rule, logger *logger.Logger) Middleware {
-	return Middleware{
+// Option configures optional dependencies of the middleware
+type Option func(m *Middleware)
+
+// WithUsers sets the directory of users and groups shared by all rules, required by rules using with.allow
+func WithUsers(users auth.Directory) Option {
+	return func(m *Middleware) {
+		m.users = users
+	}
+}
+
+// WithOIDC sets the OpenID Connect provider, required by rules using with.oidc
+func WithOIDC(provider *oidc.Provider) Option {
+	return func(m *Middleware) {
+		m.oidc = provider
+	}
+}
+
+// WithIPFilter sets the allow and deny lists of client IPs applying to all rules
+func WithIPFilter(filter *clientip.Filter) Option {
+	return func(m *Middleware) {
+		m.ips = filter
+	}
+}
+
+// WithRateLimiter sets the limiter counting the requests, required by rules using with.rate_limit
+func WithRateLimiter(limiter *ratelimit.Limiter) Option {
+	return func(m *Middleware) {
+		m.limits = limiter
+	}
+}
+
+func New(rule rules.Rule, logger *logger.Logger, opts ...Option) Middleware {
+	m := Middleware{
 		rule:   rule,
 		logger: logger,
 	}
+	for _, opt := range opts {
+		opt(&m)
+	}
+	return m
 }
 
 func (m Middleware) Collection(next http.Handler) http.Handler {
+	allowsIP := m.ipFilter()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Initialise a new http response writer.
-		respWriter := response.New(w, m.rule.Respond, m.logger)
+		respWriter := response.New(w, m.rule.Respond, m.requestLogger(r))
+
+		// Reject clients not allowed by the global or the rule's IP filter
+		if !allowsIP(r, respWriter) {
+			return
+		}
 
 		// Reject requests exceeding the max request body limit
 		lim, err := humanise.ParseBytes(firstof.String(m.rule.MaxRequestBody(), DefaultMaxRequestBody))
@@ -47,20 +106,226 @@ func (m Middleware) Collection(next http.Handler) http.Handler {
 			return
 		}
 
-		// Authenticate, if requested by the rule
-		if m.rule.With != nil {
-			ok, err := auth.IsRequestAuthenticated(m.rule.With.AuthBasic, m.rule.With.AuthHashing, r)
+		// Require the client certificate, the login and the credentials requested by the rule
+		r, ok := m.authenticate(w, r, respWriter)
+		if !ok {
+			return
+		}
+
+		// Limit the requests per client, if requested by the rule
+		if m.rule.With != nil && m.rule.With.RateLimit != nil {
+			if !m.takeToken(w, r, respWriter) {
+				return
+			}
+		}
+
+		// Verify the signature of the request body, if requested by the rule
+		if m.rule.With != nil && m.rule.With.HMAC != nil {
+			body, err := io.ReadAll(io.LimitReader(r.Body, int64(lim)+1)) //nolint:gosec // disable G115
 			if err != nil {
-				respWriter.InternalServerError(err)
+				respWriter.InternalServerErrorf("error reading request body: %s", err)
 				return
 			}
-			if !ok {
-				respWriter.Unauthorised()
+			if len(body) > int(lim) { //nolint:gosec // disable G115
+				respWriter.RequestEntityTooLarge(len(body), int(lim)) //nolint:gosec // disable G115
+				return
+			}
+			// Hand over the body to the next handler
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			err = signature.Verify(m.rule.With.HMAC, r, body, time.Now())
+			if errors.Is(err, signature.ErrInvalid) {
+				if m.logger != nil {
+					m.requestLogger(r).Infof("rejecting request to %s from %s: %s", r.URL.Path, r.RemoteAddr, err)
+				}
+				respWriter.InvalidSignature()
+				return
+			}
+			if err != nil {
+				respWriter.InternalServerError(err)
 				return
 			}
 		}
 
+		accesslog.FromRequest(r).SetUser(reqctx.User(r))
 		// Call the next handler, which can be another middleware in the chain, or the final handler.
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Authentication applies only the IP filters and the authentication of the rule, but neither the rate limit nor the
+// signature check. It protects endpoints serving data of the rule, like the status of its jobs, which are requested
+// without the body the signature is computed over and must not count against the rate limit.
+func (m Middleware) Authentication(next http.Handler) http.Handler {
+	allowsIP := m.ipFilter()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respWriter := response.New(w, m.rule.Respond, m.requestLogger(r))
+		if !allowsIP(r, respWriter) {
+			return
+		}
+		r, ok := m.authenticate(w, r, respWriter)
+		if !ok {
+			return
+		}
+		accesslog.FromRequest(r).SetUser(reqctx.User(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ipFilter returns a function rejecting clients not allowed by the global or the rule's IP filter. It returns false,
+// if the request has been answered.
+func (m Middleware) ipFilter() func(r *http.Request, respWriter *response.Response) bool {
+	var ruleIPs *clientip.Filter
+	var ruleIPsErr error
+	if m.rule.With != nil {
+		ruleIPs, ruleIPsErr = clientip.NewFilter(m.rule.With.AllowCIDRs, m.rule.With.DenyCIDRs)
+	}
+	return func(r *http.Request, respWriter *response.Response) bool {
+		if ruleIPsErr != nil {
+			respWriter.InternalServerErrorf("error parsing allow_cidrs or deny_cidrs: %s", ruleIPsErr)
+			return false
+		}
+		if m.ips != nil || ruleIPs != nil {
+			addr, ok := clientip.FromRequest(r)
+			if !ok || !m.ips.Allows(addr) || !ruleIPs.Allows(addr) {
+				if m.logger != nil {
+					m.requestLogger(r).Infof("rejecting request to %s from %s: client IP not allowed", r.URL.Path, r.RemoteAddr)
+				}
+				respWriter.Forbidden()
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// authenticate requires the client certificate, the OpenID Connect login and the credentials requested by the rule.
+// It returns the request carrying the user, and false, if the request has been answered.
+func (m Middleware) authenticate(w http.ResponseWriter, r *http.Request, respWriter *response.Response) (*http.Request, bool) {
+	// Require a verified TLS client certificate, if requested by the rule
+	if m.rule.With != nil && m.rule.With.AuthMTLS != nil {
+		cert, ok := clientcert.FromRequest(r)
+		if !ok {
+			respWriter.ClientCertificateRequired()
+			return r, false
+		}
+		if !cert.Matches(m.rule.With.AuthMTLS.Allow) {
+			if m.logger != nil {
+				m.requestLogger(r).Infof("client certificate '%s' not allowed to access %s", cert.Subject, r.URL.Path)
+			}
+			respWriter.Forbidden()
+			return r, false
+		}
+		r = reqctx.WithUser(r, cert.CommonName)
+	}
+
+	// Require an OpenID Connect login, if requested by the rule
+	if m.rule.With != nil && m.rule.With.OIDC != nil {
+		if m.oidc == nil {
+			respWriter.InternalServerErrorf("rule '%s' requires oidc, but oidc is not configured", m.rule.Name)
+			return r, false
+		}
+		session, err := m.oidc.Session(r)
+		if err != nil {
+			m.oidc.RequireLogin(w, r)
+			return r, false
+		}
+		if !session.Satisfies(m.rule.With.OIDC.RequireClaims) {
+			if m.logger != nil {
+				m.requestLogger(r).Infof("user '%s' lacks the claims required to access %s", session.User(), r.URL.Path)
+			}
+			respWriter.Forbidden()
+			return r, false
+		}
+		r = reqctx.WithClaims(reqctx.WithUser(r, session.User()), session.Claims)
+	}
+
+	// Authenticate, if requested by the rule
+	user, schemes, err := auth.Authenticate(m.rule.With, m.users, r, time.Now())
+	if errors.Is(err, auth.ErrUnauthenticated) {
+		respWriter.Unauthorised(schemes...)
+		return r, false
+	}
+	if errors.Is(err, auth.ErrForbidden) {
+		if m.logger != nil {
+			m.requestLogger(r).Infof("user '%s' not allowed to access %s", user, r.URL.Path)
+		}
+		respWriter.Forbidden()
+		return r, false
+	}
+	if err != nil {
+		respWriter.InternalServerError(err)
+		return r, false
+	}
+	if user != "" {
+		r = reqctx.WithUser(r, user)
+	}
+	return r, true
+}
+
+// requestLogger returns the logger adding the ID and the client of the request and the rule to every line, nil
+// without logger
+func (m Middleware) requestLogger(r *http.Request) *logger.Logger {
+	if m.logger == nil {
+		return nil
+	}
+	return reqctx.Logger(r, m.logger).With("rule", m.rule.ID())
+}
+
+// takeToken counts the request against the rate limit of the rule and sets the RateLimit headers. Returns false,
+// if the request has been answered because the limit is exceeded or an error occurred.
+func (m Middleware) takeToken(w http.ResponseWriter, r *http.Request, respWriter *response.Response) bool {
+	rl := m.rule.With.RateLimit
+	if m.limits == nil {
+		respWriter.InternalServerErrorf("rule '%s' requires a rate limiter, but none is configured", m.rule.Name)
+		return false
+	}
+	limit, err := ratelimit.ParseLimit(rl.Rate, rl.Burst)
+	if err != nil {
+		respWriter.InternalServerErrorf("error parsing rate_limit: %s", err)
+		return false
+	}
+	key, err := m.rateLimitKey(r)
+	if err != nil {
+		respWriter.InternalServerErrorf("error rendering rate_limit key: %s", err)
+		return false
+	}
+	res := m.limits.Take(key, limit, time.Now())
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(res.Reset.Seconds())))
+	w.Header().Set("RateLimit-Policy", limit.String())
+	if !res.Allowed {
+		if m.logger != nil {
+			m.requestLogger(r).Infof("rate limit of rule '%s' exceeded by %s", m.rule.Name, key)
+		}
+		respWriter.TooManyRequests(res.RetryAfter)
+		return false
+	}
+	return true
+}
+
+// rateLimitKey returns the key requests are counted by. The key is prefixed by the rule, so each rule has its
+// own limits. Anonymous requests to rules limited per user are counted by IP.
+func (m Middleware) rateLimitKey(r *http.Request) (string, error) {
+	rule := m.rule.ID()
+	switch key := m.rule.With.RateLimit.Key; key {
+	case "", ratelimit.KeyIP:
+	case ratelimit.KeyUser:
+		if user := reqctx.User(r); user != "" {
+			return rule + "|user:" + user, nil
+		}
+	default:
+		data, err := requestdata.CollectMeta(r)
+		if err != nil {
+			return "", err
+		}
+		value, err := templating.RenderString(key, data)
+		if err != nil {
+			return "", err
+		}
+		return rule + "|key:" + value, nil
+	}
+	addr, _ := clientip.FromRequest(r)
+	return rule + "|ip:" + addr.String(), nil
+}
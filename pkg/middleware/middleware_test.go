@@ -2,13 +2,29 @@ package middleware_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"mime/multipart"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/http-everything/httpe/pkg/clientip"
+	"github.com/http-everything/httpe/pkg/config"
 	"github.com/http-everything/httpe/pkg/middleware"
+	"github.com/http-everything/httpe/pkg/oidc"
+	"github.com/http-everything/httpe/pkg/oidc/mockidp"
+	"github.com/http-everything/httpe/pkg/ratelimit"
 	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/share/firstof"
+	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/share/reqctx"
+	"github.com/http-everything/httpe/pkg/userstore"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -64,6 +80,326 @@ func TestRequestHandlerWithAuth(t *testing.T) {
 	})
 }
 
+func TestRequestHandlerWithTokens(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cr3t"))
+	t.Setenv("HTTPE_TEST_TOKENS", "deploy sha256:"+hex.EncodeToString(sum[:]))
+	cases := []struct {
+		name          string
+		with          *rules.With
+		header        string
+		value         string
+		url           string
+		wantCode      int
+		wantUser      string
+		wantChallenge []string
+	}{
+		{
+			name:     "bearer",
+			with:     &rules.With{AuthBearer: &rules.AuthTokens{TokensEnv: "HTTPE_TEST_TOKENS"}},
+			header:   "Authorization",
+			value:    "Bearer s3cr3t",
+			wantCode: http.StatusOK,
+			wantUser: "deploy",
+		},
+		{
+			name:          "wrong bearer",
+			with:          &rules.With{AuthBearer: &rules.AuthTokens{TokensEnv: "HTTPE_TEST_TOKENS"}},
+			header:        "Authorization",
+			value:         "Bearer wrong",
+			wantCode:      http.StatusUnauthorized,
+			wantChallenge: []string{"Bearer realm='Authorization required'"},
+		},
+		{
+			name:     "api key header",
+			with:     &rules.With{AuthAPIKey: &rules.AuthAPIKey{Header: "X-API-Key", TokensEnv: "HTTPE_TEST_TOKENS"}},
+			header:   "X-API-Key",
+			value:    "s3cr3t",
+			wantCode: http.StatusOK,
+			wantUser: "deploy",
+		},
+		{
+			name:     "api key param",
+			with:     &rules.With{AuthAPIKey: &rules.AuthAPIKey{Param: "key", TokensEnv: "HTTPE_TEST_TOKENS"}},
+			url:      "/?key=s3cr3t",
+			wantCode: http.StatusOK,
+			wantUser: "deploy",
+		},
+		{
+			name:     "api key missing",
+			with:     &rules.With{AuthAPIKey: &rules.AuthAPIKey{Param: "key", TokensEnv: "HTTPE_TEST_TOKENS"}},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name: "basic",
+			with: &rules.With{
+				AuthBasic:  []rules.User{{Username: "john.doe", Password: "1234abc"}},
+				AuthBearer: &rules.AuthTokens{TokensEnv: "HTTPE_TEST_TOKENS"},
+			},
+			header:   "Authorization",
+			value:    "Basic am9obi5kb2U6MTIzNGFiYw==",
+			wantCode: http.StatusOK,
+			wantUser: "john.doe",
+		},
+		{
+			name: "basic or bearer",
+			with: &rules.With{
+				AuthBasic:  []rules.User{{Username: "john.doe", Password: "1234abc"}},
+				AuthBearer: &rules.AuthTokens{TokensEnv: "HTTPE_TEST_TOKENS"},
+			},
+			wantCode: http.StatusUnauthorized,
+			wantChallenge: []string{
+				"Basic realm='Authorization required'",
+				"Bearer realm='Authorization required'",
+			},
+		},
+		{
+			name:     "tokens missing",
+			with:     &rules.With{AuthBearer: &rules.AuthTokens{TokensEnv: "HTTPE_TEST_UNSET"}},
+			header:   "Authorization",
+			value:    "Bearer s3cr3t",
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", firstof.String(tc.url, "/"), nil)
+			if tc.header != "" {
+				req.Header.Set(tc.header, tc.value)
+			}
+			var user string
+			next := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				user = reqctx.User(r)
+			})
+			rec := httptest.NewRecorder()
+			middleware.New(rules.Rule{AnswerContent: "foo", With: tc.with}, nil).Collection(next).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantCode, rec.Code)
+			assert.Equal(t, tc.wantUser, user)
+			if tc.wantChallenge != nil {
+				assert.Equal(t, tc.wantChallenge, rec.Header().Values("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestRequestHandlerWithAllow(t *testing.T) {
+	users := userstore.New("", "")
+	require.NoError(t, users.Load(
+		[]rules.User{{Username: "alice", Password: "a"}, {Username: "bob", Password: "b"}, {Username: "carol", Password: "c"}},
+		map[string][]string{"ops": {"alice"}},
+	))
+	with := &rules.With{
+		Allow:     []string{"group:ops", "user:bob"},
+		AuthBasic: []rules.User{{Username: "dave", Password: "d"}},
+	}
+	cases := []struct {
+		name     string
+		username string
+		password string
+		wantCode int
+		wantUser string
+	}{
+		{name: "group member", username: "alice", password: "a", wantCode: http.StatusOK, wantUser: "alice"},
+		{name: "listed user", username: "bob", password: "b", wantCode: http.StatusOK, wantUser: "bob"},
+		{name: "not allowed", username: "carol", password: "c", wantCode: http.StatusForbidden},
+		{name: "inline user not allowed", username: "dave", password: "d", wantCode: http.StatusForbidden},
+		{name: "wrong password", username: "alice", password: "b", wantCode: http.StatusUnauthorized},
+		{name: "no credentials", wantCode: http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tc.username != "" {
+				req.SetBasicAuth(tc.username, tc.password)
+			}
+			var user string
+			next := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				user = reqctx.User(r)
+			})
+			rec := httptest.NewRecorder()
+			m := middleware.New(rules.Rule{AnswerContent: "foo", With: with}, nil, middleware.WithUsers(users))
+			m.Collection(next).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantCode, rec.Code)
+			assert.Equal(t, tc.wantUser, user)
+		})
+	}
+}
+
+func TestRequestHandlerWithOIDC(t *testing.T) {
+	idp, err := mockidp.New("httpe")
+	require.NoError(t, err)
+	defer idp.Close()
+	idp.SetClaims(map[string]interface{}{"sub": "1234", "preferred_username": "alice", "groups": []string{"ops"}})
+
+	// Log in once through the provider's endpoints to obtain a session cookie
+	app := httptest.NewUnstartedServer(nil)
+	app.Start()
+	defer app.Close()
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	defer l.Shutdown()
+	provider, err := oidc.New(context.Background(), &config.OIDCConfig{
+		Issuer:        idp.Issuer(),
+		ClientID:      idp.ClientID,
+		RedirectURL:   app.URL + oidc.CallbackPath,
+		SessionSecret: "s3cr3t",
+	}, l)
+	require.NoError(t, err)
+	app.Config.Handler = provider.Handler()
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	res, err := (&http.Client{Jar: jar}).Get(app.URL + oidc.LoginPath)
+	require.NoError(t, err)
+	res.Body.Close()
+	var session *http.Cookie
+	for _, c := range jar.Cookies(res.Request.URL) {
+		if c.Name == oidc.SessionCookie {
+			session = c
+		}
+	}
+	require.NotNil(t, session)
+
+	cases := []struct {
+		name       string
+		method     string
+		claims     map[string]string
+		session    bool
+		noProvider bool
+		wantCode   int
+		wantUser   string
+	}{
+		{name: "login required", method: "GET", wantCode: http.StatusFound},
+		{name: "post without session", method: "POST", wantCode: http.StatusUnauthorized},
+		{name: "session", method: "GET", session: true, wantCode: http.StatusOK, wantUser: "alice"},
+		{name: "required claims", method: "POST", claims: map[string]string{"groups": "ops"}, session: true,
+			wantCode: http.StatusOK, wantUser: "alice"},
+		{name: "missing claims", method: "GET", claims: map[string]string{"groups": "admin"}, session: true,
+			wantCode: http.StatusForbidden},
+		{name: "not configured", method: "GET", session: true, noProvider: true, wantCode: http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/protected", nil)
+			if tc.session {
+				req.AddCookie(session)
+			}
+			var user string
+			var claims map[string]interface{}
+			next := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				user = reqctx.User(r)
+				claims = reqctx.Claims(r)
+			})
+			opts := []middleware.Option{middleware.WithOIDC(provider)}
+			if tc.noProvider {
+				opts = nil
+			}
+			rule := rules.Rule{AnswerContent: "foo", With: &rules.With{OIDC: &rules.OIDC{RequireClaims: tc.claims}}}
+			rec := httptest.NewRecorder()
+			middleware.New(rule, nil, opts...).Collection(next).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantCode, rec.Code)
+			assert.Equal(t, tc.wantUser, user)
+			if tc.wantUser != "" {
+				assert.Equal(t, "1234", claims["sub"])
+			}
+			if tc.wantCode == http.StatusFound {
+				assert.Equal(t, oidc.LoginPath+"?redirect=%2Fprotected", rec.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestRequestHandlerWithIPFilter(t *testing.T) {
+	global, err := clientip.NewFilter(nil, []string{"10.66.0.0/16"})
+	require.NoError(t, err)
+	rule := rules.Rule{
+		AnswerContent: "foo",
+		With:          &rules.With{AllowCIDRs: []string{"10.0.0.0/8"}, DenyCIDRs: []string{"10.99.0.0/16"}},
+	}
+	cases := []struct {
+		name       string
+		remoteAddr string
+		wantCode   int
+	}{
+		{name: "allowed", remoteAddr: "10.1.1.1:4711", wantCode: http.StatusOK},
+		{name: "not in rule allow list", remoteAddr: "192.0.2.1:4711", wantCode: http.StatusForbidden},
+		{name: "denied by rule", remoteAddr: "10.99.1.1:4711", wantCode: http.StatusForbidden},
+		{name: "denied globally", remoteAddr: "10.66.1.1:4711", wantCode: http.StatusForbidden},
+		{name: "address without port", remoteAddr: "10.1.1.1", wantCode: http.StatusOK},
+		{name: "invalid address", remoteAddr: "pipe", wantCode: http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			rec := httptest.NewRecorder()
+			m := middleware.New(rule, nil, middleware.WithIPFilter(global))
+			m.Collection(DummyRequestHandler(t)).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantCode, rec.Code)
+		})
+	}
+}
+
+func TestRequestHandlerWithRateLimit(t *testing.T) {
+	cases := []struct {
+		name      string
+		key       string
+		requests  func(i int) *http.Request
+		wantCodes []int
+	}{
+		{
+			name: "per ip",
+			requests: func(_ int) *http.Request {
+				return httptest.NewRequest("GET", "/", nil)
+			},
+			wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name: "per user",
+			key:  "user",
+			requests: func(i int) *http.Request {
+				// Both users share the same IP address
+				return reqctx.WithUser(httptest.NewRequest("GET", "/", nil), []string{"alice", "alice", "bob", "alice"}[i])
+			},
+			wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name: "templated key",
+			key:  "{{ .Input.Params.tenant }}",
+			requests: func(i int) *http.Request {
+				return httptest.NewRequest("GET", "/?tenant="+[]string{"a", "b", "b", "b"}[i], nil)
+			},
+			wantCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter, err := ratelimit.New("", nil)
+			require.NoError(t, err)
+			rule := rules.Rule{
+				Name:          "limited",
+				AnswerContent: "foo",
+				With:          &rules.With{RateLimit: &rules.RateLimit{Rate: "2/h", Key: tc.key}},
+			}
+			m := middleware.New(rule, nil, middleware.WithRateLimiter(limiter))
+			for i, wantCode := range tc.wantCodes {
+				rec := httptest.NewRecorder()
+				m.Collection(DummyRequestHandler(t)).ServeHTTP(rec, tc.requests(i))
+				require.Equal(t, wantCode, rec.Code, "request %d", i)
+				assert.Equal(t, "2", rec.Header().Get("RateLimit-Limit"))
+				assert.Equal(t, "2;w=3600;burst=2", rec.Header().Get("RateLimit-Policy"))
+				if wantCode == http.StatusTooManyRequests {
+					assert.Equal(t, "1800", rec.Header().Get("Retry-After"))
+					assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+					assert.Equal(t, "3600", rec.Header().Get("RateLimit-Reset"))
+				}
+			}
+		})
+	}
+}
+
 func TestRequestHandlerBodyTooLarge(t *testing.T) {
 	rule := rules.Rule{
 		On: &rules.On{
@@ -94,3 +430,76 @@ func TestRequestHandlerBodyTooLarge(t *testing.T) {
 	assert.Equal(t, "Request entity too large. 116 B sent exceeds limit of 4 B\n", rec.Body.String())
 	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
 }
+
+func TestRequestHandlerWithHMAC(t *testing.T) {
+	rule := rules.Rule{
+		On:            &rules.On{Path: "/"},
+		AnswerContent: "foo",
+		With: &rules.With{
+			HMAC: &rules.HMAC{Type: rules.HMACGitHub, Secret: "It's a Secret to Everybody"},
+		},
+	}
+	// Reads the body to verify it's handed over to the next handler
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	})
+	cases := []struct {
+		name       string
+		signature  string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "valid signature",
+			signature:  "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17",
+			wantStatus: http.StatusOK,
+			wantBody:   "Hello, World!",
+		},
+		{
+			name:       "invalid signature",
+			signature:  "sha256=0000",
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "Invalid signature\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/", strings.NewReader("Hello, World!"))
+			require.NoError(t, err)
+			req.Header.Set("X-Hub-Signature-256", tc.signature)
+			rec := httptest.NewRecorder()
+			middleware.New(rule, nil).Collection(echo).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			assert.Equal(t, tc.wantBody, rec.Body.String())
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	limiter, err := ratelimit.New("", nil)
+	require.NoError(t, err)
+	rule := rules.Rule{
+		On:            &rules.On{Path: "/"},
+		AnswerContent: "foo",
+		With: &rules.With{
+			AuthBasic: []rules.User{{Username: "john", Password: "secret"}},
+			RateLimit: &rules.RateLimit{Rate: "1/h"},
+			HMAC:      &rules.HMAC{Type: rules.HMACGitHub, Secret: "It's a Secret to Everybody"},
+		},
+	}
+	m := middleware.New(rule, nil, middleware.WithRateLimiter(limiter))
+
+	rec := httptest.NewRecorder()
+	m.Authentication(DummyRequestHandler(t)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Neither the missing signature nor the rate limit reject authenticated requests
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetBasicAuth("john", "secret")
+		rec = httptest.NewRecorder()
+		m.Authentication(DummyRequestHandler(t)).ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, "request %d", i)
+	}
+}
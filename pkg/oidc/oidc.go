@@ -0,0 +1,378 @@
+package oidc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/share/firstof"
+	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/share/secret"
+	"github.com/http-everything/httpe/pkg/share/timeunit"
+
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// URLPrefix is the path of the built-in login, callback and logout endpoints
+	URLPrefix    = "/_oidc/"
+	LoginPath    = URLPrefix + "login"
+	CallbackPath = URLPrefix + "callback"
+	LogoutPath   = URLPrefix + "logout"
+
+	SessionCookie = "httpe_session"
+	StateCookie   = "httpe_oidc_state"
+
+	DefaultSessionLifetime = "8h"
+	// stateLifetime limits the time a user may take to log in at the identity provider
+	stateLifetime = 10 * time.Minute
+
+	// The purpose of a cookie is part of its signature, so a cookie of one kind isn't accepted as another. Anyone
+	// may obtain a signed state cookie from the login endpoint.
+	purposeSession = "session"
+	purposeState   = "state"
+)
+
+var (
+	ErrNoSession      = errors.New("no valid session")
+	ErrInvalidCookie  = errors.New("invalid cookie")
+	DefaultScopes     = []string{"profile", "email"}
+	cookieEncoding    = base64.RawURLEncoding
+	userClaimsInOrder = []string{"preferred_username", "email", "sub"}
+)
+
+// Provider logs in users with the OpenID Connect authorization code flow using PKCE. After the login, the claims of
+// the ID token are kept in a signed session cookie, so the server doesn't need to store sessions.
+type Provider struct {
+	oauth2   oauth2.Config
+	verifier *gooidc.IDTokenVerifier
+	key      []byte
+	lifetime time.Duration
+	secure   bool
+	logger   *logger.Logger
+}
+
+// Session is the content of the session cookie
+type Session struct {
+	Claims  map[string]interface{} `json:"claims"`
+	Expires int64                  `json:"exp"`
+}
+
+// state is the content of the state cookie, which carries the secrets of a login in progress from the login
+// endpoint to the callback endpoint
+type state struct {
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"exp"`
+}
+
+// New discovers the endpoints of the identity provider and creates a new Provider
+func New(ctx context.Context, cfg *config.OIDCConfig, logger *logger.Logger) (*Provider, error) {
+	provider, err := gooidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering oidc issuer %s: %w", cfg.Issuer, err)
+	}
+	var clientSecret string
+	if cfg.ClientSecret != "" || cfg.ClientSecretFile != "" {
+		clientSecret, err = secret.Resolve(cfg.ClientSecret, cfg.ClientSecretFile, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid oidc client secret: %w", err)
+		}
+	}
+	var key []byte
+	if cfg.SessionSecret != "" || cfg.SessionSecretFile != "" {
+		sessionSecret, err := secret.Resolve(cfg.SessionSecret, cfg.SessionSecretFile, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid oidc session secret: %w", err)
+		}
+		sum := sha256.Sum256([]byte(sessionSecret))
+		key = sum[:]
+	} else {
+		key, err = randomBytes(sha256.Size)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("no oidc session secret configured, sessions end on restart")
+	}
+	lifetime, err := timeunit.ParseDuration(firstof.String(cfg.SessionLifetime, DefaultSessionLifetime))
+	if err != nil {
+		return nil, fmt.Errorf("invalid oidc session lifetime: %w", err)
+	}
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	return &Provider{
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: clientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       append([]string{gooidc.ScopeOpenID}, scopes...),
+		},
+		verifier: provider.Verifier(&gooidc.Config{ClientID: cfg.ClientID}),
+		key:      key,
+		lifetime: lifetime,
+		secure:   strings.HasPrefix(cfg.RedirectURL, "https://"),
+		logger:   logger,
+	}, nil
+}
+
+// Handler serves the login, callback and logout endpoints
+func (p *Provider) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(LoginPath, p.login)
+	mux.HandleFunc(CallbackPath, p.callback)
+	mux.HandleFunc(LogoutPath, p.logout)
+	return mux
+}
+
+// Session returns the session of the request, if the session cookie is present, correctly signed, not expired and
+// carries the subject of the user
+func (p *Provider) Session(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	s := &Session{}
+	if err = p.decode(purposeSession, cookie.Value, s); err != nil {
+		return nil, ErrNoSession
+	}
+	if time.Now().Unix() >= s.Expires {
+		return nil, ErrNoSession
+	}
+	if sub, ok := s.Claims["sub"].(string); !ok || sub == "" {
+		return nil, ErrNoSession
+	}
+	return s, nil
+}
+
+// RequireLogin answers requests without a valid session. Browsers navigating to a page are sent to the login
+// endpoint, all other requests are rejected with 401 Unauthorized.
+func (p *Provider) RequireLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Unauthorised", http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, LoginPath+"?redirect="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+}
+
+// User returns the name of the logged-in user taken from the first present claim of preferred_username, email
+// and sub
+func (s *Session) User() string {
+	for _, claim := range userClaimsInOrder {
+		if v, ok := s.Claims[claim].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Satisfies reports whether the claims contain all required values. If a claim is a list, like groups, it must
+// contain the required value.
+func (s *Session) Satisfies(required map[string]string) bool {
+	for name, want := range required {
+		if !claimContains(s.Claims[name], want) {
+			return false
+		}
+	}
+	return true
+}
+
+func claimContains(claim interface{}, want string) bool {
+	switch v := claim.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, item := range v {
+			if fmt.Sprint(item) == want {
+				return true
+			}
+		}
+		return false
+	default:
+		return fmt.Sprint(v) == want
+	}
+}
+
+func (p *Provider) login(w http.ResponseWriter, r *http.Request) {
+	redirect := r.URL.Query().Get("redirect")
+	// Only local redirects are allowed, otherwise the login could be abused to send users to a foreign site
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		redirect = "/"
+	}
+	values, err := randomStrings(2)
+	if err != nil {
+		p.internalError(w, err)
+		return
+	}
+	st := state{
+		State:    values[0],
+		Verifier: oauth2.GenerateVerifier(),
+		Nonce:    values[1],
+		Redirect: redirect,
+		Expires:  time.Now().Add(stateLifetime).Unix(),
+	}
+	value, err := p.encode(purposeState, st)
+	if err != nil {
+		p.internalError(w, err)
+		return
+	}
+	p.setCookie(w, StateCookie, value, URLPrefix, int(stateLifetime.Seconds()))
+	authURL := p.oauth2.AuthCodeURL(st.State, oauth2.S256ChallengeOption(st.Verifier), gooidc.Nonce(st.Nonce))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (p *Provider) callback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(StateCookie)
+	if err != nil {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	st := state{}
+	if err = p.decode(purposeState, cookie.Value, &st); err != nil || time.Now().Unix() >= st.Expires {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	// The state cookie is used only once
+	p.setCookie(w, StateCookie, "", URLPrefix, -1)
+
+	q := r.URL.Query()
+	if q.Get("state") != st.State {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		p.logger.Infof("oidc login failed: %s %s", e, q.Get("error_description"))
+		http.Error(w, "login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	token, err := p.oauth2.Exchange(r.Context(), q.Get("code"), oauth2.VerifierOption(st.Verifier))
+	if err != nil {
+		p.logger.Infof("oidc code exchange failed: %s", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		p.logger.Infof("oidc token response without id_token")
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := p.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		p.logger.Infof("oidc id token rejected: %s", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	if idToken.Nonce != st.Nonce {
+		p.logger.Infof("oidc id token rejected: nonce mismatch")
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	s := Session{Expires: time.Now().Add(p.lifetime).Unix()}
+	if err = idToken.Claims(&s.Claims); err != nil {
+		p.internalError(w, err)
+		return
+	}
+	value, err := p.encode(purposeSession, s)
+	if err != nil {
+		p.internalError(w, err)
+		return
+	}
+	p.setCookie(w, SessionCookie, value, "/", int(p.lifetime.Seconds()))
+	p.logger.Infof("user '%s' logged in", s.User())
+	http.Redirect(w, r, st.Redirect, http.StatusFound)
+}
+
+func (p *Provider) logout(w http.ResponseWriter, r *http.Request) {
+	p.setCookie(w, SessionCookie, "", "/", -1)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// setCookie sets an HTTP only cookie. SameSite=Lax keeps the cookie on the top-level navigation back from the
+// identity provider, but not on cross-site POST requests.
+func (p *Provider) setCookie(w http.ResponseWriter, name string, value string, path string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   p.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// encode serialises v to JSON and signs it together with the purpose of the cookie with HMAC-SHA256. The content
+// isn't encrypted, the claims of the user are readable by the user.
+func (p *Provider) encode(purpose string, v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	encoded := cookieEncoding.EncodeToString(payload)
+	return encoded + "." + cookieEncoding.EncodeToString(p.sign(purpose, encoded)), nil
+}
+
+// decode verifies the signature of the cookie value for the purpose and de-serialises it into v
+func (p *Provider) decode(purpose string, value string, v interface{}) error {
+	encoded, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return ErrInvalidCookie
+	}
+	gotSig, err := cookieEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(gotSig, p.sign(purpose, encoded)) {
+		return ErrInvalidCookie
+	}
+	payload, err := cookieEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrInvalidCookie
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func (p *Provider) sign(purpose string, encoded string) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	// The purpose can't contain a dot, so the boundary between purpose and payload is unambiguous
+	mac.Write([]byte(purpose + "." + encoded))
+	return mac.Sum(nil)
+}
+
+func (p *Provider) internalError(w http.ResponseWriter, err error) {
+	p.logger.Errorf("oidc: %s", err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("error creating random bytes: %w", err)
+	}
+	return b, nil
+}
+
+func randomStrings(n int) ([]string, error) {
+	values := make([]string, n)
+	for i := range values {
+		b, err := randomBytes(32)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = cookieEncoding.EncodeToString(b)
+	}
+	return values, nil
+}
@@ -0,0 +1,212 @@
+package oidc_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/oidc"
+	"github.com/http-everything/httpe/pkg/oidc/mockidp"
+	"github.com/http-everything/httpe/pkg/share/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginFlow(t *testing.T) {
+	idp, err := mockidp.New("httpe")
+	require.NoError(t, err)
+	defer idp.Close()
+	idp.SetClaims(map[string]interface{}{
+		"sub":                "1234",
+		"preferred_username": "alice",
+		"groups":             []string{"ops", "dev"},
+	})
+
+	var provider *oidc.Provider
+	mux := http.NewServeMux()
+	mux.HandleFunc("/protected", func(w http.ResponseWriter, r *http.Request) {
+		session, err := provider.Session(r)
+		if err != nil {
+			provider.RequireLogin(w, r)
+			return
+		}
+		if !session.Satisfies(map[string]string{"groups": "ops"}) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		_, _ = io.WriteString(w, "hello "+session.User())
+	})
+	svr := httptest.NewServer(mux)
+	defer svr.Close()
+
+	provider = newProvider(t, idp, svr.URL)
+	mux.Handle(oidc.URLPrefix, provider.Handler())
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+
+	t.Run("login", func(t *testing.T) {
+		res, err := client.Get(svr.URL + "/protected")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "hello alice", string(body))
+	})
+
+	t.Run("session", func(t *testing.T) {
+		res, err := client.Get(svr.URL + "/protected")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, svr.URL+"/protected", res.Request.URL.String(), "no redirect to the login")
+	})
+
+	t.Run("post without session", func(t *testing.T) {
+		res, err := http.Post(svr.URL+"/protected", "text/plain", nil)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("tampered session", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/protected", nil)
+		for _, c := range jar.Cookies(req.URL) {
+			if c.Name == oidc.SessionCookie {
+				req.AddCookie(&http.Cookie{Name: c.Name, Value: strings.Replace(c.Value, ".", "x.", 1)})
+			}
+		}
+		_, err := provider.Session(req)
+		assert.ErrorIs(t, err, oidc.ErrNoSession)
+	})
+
+	t.Run("logout", func(t *testing.T) {
+		res, err := client.Get(svr.URL + oidc.LogoutPath)
+		require.NoError(t, err)
+		res.Body.Close()
+		for _, c := range jar.Cookies(res.Request.URL) {
+			assert.NotEqual(t, oidc.SessionCookie, c.Name)
+		}
+	})
+
+	t.Run("claims not satisfied", func(t *testing.T) {
+		idp.SetClaims(map[string]interface{}{"sub": "5678", "email": "bob@example.com", "groups": []string{"dev"}})
+		res, err := client.Get(svr.URL + "/protected")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+	})
+
+	t.Run("callback without state", func(t *testing.T) {
+		res, err := http.Get(svr.URL + oidc.CallbackPath + "?code=abc&state=xyz")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+}
+
+func TestLoginRedirectMustBeLocal(t *testing.T) {
+	idp, err := mockidp.New("httpe")
+	require.NoError(t, err)
+	defer idp.Close()
+	provider := newProvider(t, idp, "http://localhost")
+	noRedirects := &http.Client{CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	for _, redirect := range []string{"https://evil.example.com/", "//evil.example.com/", "/\\evil.example.com"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", oidc.LoginPath+"?redirect="+redirect, nil)
+		provider.Handler().ServeHTTP(rec, req)
+		require.Equal(t, http.StatusFound, rec.Code)
+
+		// Complete the login at the identity provider and the callback without following the final redirect
+		res, err := noRedirects.Get(rec.Header().Get("Location"))
+		require.NoError(t, err)
+		res.Body.Close()
+		location, err := res.Location()
+		require.NoError(t, err)
+		callback := httptest.NewRequest("GET", location.RequestURI(), nil)
+		for _, c := range rec.Result().Cookies() {
+			callback.AddCookie(c)
+		}
+		rec = httptest.NewRecorder()
+		provider.Handler().ServeHTTP(rec, callback)
+		assert.Equal(t, http.StatusFound, rec.Code)
+		assert.Equal(t, "/", rec.Header().Get("Location"), redirect)
+	}
+}
+
+func TestStateCookieIsNoSession(t *testing.T) {
+	idp, err := mockidp.New("httpe")
+	require.NoError(t, err)
+	defer idp.Close()
+	provider := newProvider(t, idp, "http://localhost")
+
+	rec := httptest.NewRecorder()
+	provider.Handler().ServeHTTP(rec, httptest.NewRequest("GET", oidc.LoginPath, nil))
+	require.Equal(t, http.StatusFound, rec.Code)
+	var state *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidc.StateCookie {
+			state = c
+		}
+	}
+	require.NotNil(t, state)
+
+	// The signed state cookie is replayed as session cookie
+	protected := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := provider.Session(r); err != nil {
+			provider.RequireLogin(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, "secret")
+	})
+	for _, method := range []string{"GET", "POST"} {
+		req := httptest.NewRequest(method, "/protected", nil)
+		req.AddCookie(&http.Cookie{Name: oidc.SessionCookie, Value: state.Value})
+		_, err = provider.Session(req)
+		assert.ErrorIs(t, err, oidc.ErrNoSession)
+		rec = httptest.NewRecorder()
+		protected.ServeHTTP(rec, req)
+		assert.Contains(t, []int{http.StatusFound, http.StatusUnauthorized}, rec.Code, method)
+		assert.NotContains(t, rec.Body.String(), "secret", method)
+	}
+}
+
+func TestSession(t *testing.T) {
+	s := oidc.Session{Claims: map[string]interface{}{
+		"sub":            "1234",
+		"email":          "alice@example.com",
+		"groups":         []interface{}{"ops", "dev"},
+		"email_verified": true,
+	}}
+	assert.Equal(t, "alice@example.com", s.User())
+	assert.True(t, s.Satisfies(nil))
+	assert.True(t, s.Satisfies(map[string]string{"groups": "dev", "email_verified": "true"}))
+	assert.False(t, s.Satisfies(map[string]string{"groups": "admin"}))
+	assert.False(t, s.Satisfies(map[string]string{"tenant": "acme"}))
+}
+
+func newProvider(t *testing.T, idp *mockidp.IdP, baseURL string) *oidc.Provider {
+	t.Helper()
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	t.Cleanup(l.Shutdown)
+	provider, err := oidc.New(context.Background(), &config.OIDCConfig{
+		Issuer:        idp.Issuer(),
+		ClientID:      idp.ClientID,
+		RedirectURL:   baseURL + oidc.CallbackPath,
+		SessionSecret: "s3cr3t",
+	}, l)
+	require.NoError(t, err)
+	return provider
+}
@@ -1,19 +1,24 @@
 package postaction
 
 import (
-	"fmt"
+	"context"
 
 	"github.com/http-everything/httpe/pkg/actions"
 	"github.com/http-everything/httpe/pkg/actions/runscript"
 	"github.com/http-everything/httpe/pkg/actions/sendemail"
 	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/metrics"
 	"github.com/http-everything/httpe/pkg/postactionresponsewriter"
 	"github.com/http-everything/httpe/pkg/requestdata"
 	"github.com/http-everything/httpe/pkg/rules"
 	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/tracing"
 )
 
-func Execute(postActionRule rules.Rule, reqData requestdata.Data, conf *config.Config, logger *logger.Logger) {
+// Execute runs the post actions of the rule. Their outcome is recorded in the metrics, if given. Each post action is
+// traced as child of the span in the context.
+func Execute(ctx context.Context, postActionRule rules.Rule, reqData requestdata.Data, conf *config.Config,
+	logger *logger.Logger, m *metrics.Metrics) {
 	if postActionRule.PostAction == nil {
 		return
 	}
@@ -21,23 +26,32 @@ func Execute(postActionRule rules.Rule, reqData requestdata.Data, conf *config.C
 	var actioner actions.Actioner
 	var rule rules.Rule
 	prw := postactionresponsewriter.New(conf, logger)
-	println("Starting postaction")
 	if postActionRule.PostAction.RunScript != "" {
-		fmt.Println("Starting postaction run.script")
-		actioner = runscript.Script{}
+		logger.Debugf("starting post action %s", rules.RunScript)
+		_, span := tracing.Start(ctx, "post action "+rules.RunScript)
+		actioner = runscript.Script{TraceParent: span.TraceParent()}
 		rule.RunScript = postActionRule.PostAction.RunScript
 		rule.Args = postActionRule.PostAction.Args
 		resp, err := actioner.Execute(rule, reqData)
+		span.RecordError(err)
+		span.End()
+		m.PostAction(postActionRule.ID(), rules.RunScript, resp, err)
 		prw.AddActionResponse(rules.RunScript, resp, err)
 	}
 
 	if postActionRule.PostAction.SendEmail != nil {
+		logger.Debugf("starting post action %s", rules.SendEmail)
+		_, span := tracing.Start(ctx, "post action "+rules.SendEmail)
 		actioner = sendemail.Email{
-			SMTPConfig: conf.SMTP,
+			SMTPConfig:  conf.SMTP,
+			TraceParent: span.TraceParent(),
 		}
 		rule.SendEmail = postActionRule.PostAction.SendEmail
 		rule.Args = postActionRule.PostAction.Args
 		resp, err := actioner.Execute(rule, reqData)
+		span.RecordError(err)
+		span.End()
+		m.PostAction(postActionRule.ID(), rules.SendEmail, resp, err)
 		prw.AddActionResponse(rules.SendEmail, resp, err)
 	}
 	prw.Write()
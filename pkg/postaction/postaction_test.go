@@ -1,8 +1,14 @@
 package postaction_test
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,6 +17,7 @@ import (
 	"github.com/http-everything/httpe/pkg/requestdata"
 	"github.com/http-everything/httpe/pkg/rules"
 	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/tracing"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -25,7 +32,7 @@ func TestRunScript(t *testing.T) {
 	l, err := logger.New("test", logFile, logger.DEBUG)
 	require.NoError(t, err)
 	conf := config.Config{S: &config.SvrConfig{DataDir: dataDir, DataRetention: "1s"}}
-	postaction.Execute(r, rd, &conf, l)
+	postaction.Execute(context.Background(), r, rd, &conf, l, nil)
 	l.Shutdown()
 	// Look for files created by asynchronous post actions in the data dir
 	time.Sleep(100 * time.Millisecond)
@@ -40,3 +47,44 @@ func TestRunScript(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotContains(t, log, "ERROR")
 }
+
+func TestTracedRunScript(t *testing.T) {
+	var mu sync.Mutex
+	var exported string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		exported += string(body)
+	}))
+	defer collector.Close()
+
+	r := rules.Rule{
+		PostAction: &rules.PostAction{RunScript: "echo $TRACEPARENT"},
+	}
+	dataDir := t.TempDir()
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "log.txt"), logger.DEBUG)
+	require.NoError(t, err)
+	conf := config.Config{S: &config.SvrConfig{DataDir: dataDir, DataRetention: "1s"}}
+	tracer := tracing.New(&config.TracingConfig{Endpoint: collector.URL}, l)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(tracing.Header, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, span := tracer.StartRequest(req, "request")
+	postaction.Execute(ctx, r, requestdata.Data{}, &conf, l, nil)
+	span.End()
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	files, err := os.ReadDir(dataDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	result, err := os.ReadFile(filepath.Join(dataDir, files[0].Name()))
+	require.NoError(t, err)
+	// The script receives the trace context of the post action span
+	assert.Contains(t, string(result), "00-4bf92f3577b34da6a3ce929d0e0e4736-")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, exported, `"name":"post action run.script"`)
+	assert.Contains(t, exported, `"name":"request"`)
+	assert.Equal(t, 2, strings.Count(exported, `"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"`))
+}
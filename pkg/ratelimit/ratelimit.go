@@ -0,0 +1,222 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/share/logger"
+)
+
+const (
+	// FileName is the name of the file in the data directory the state is persisted to
+	FileName = "ratelimit.json"
+
+	// KeyIP and KeyUser are the predefined keys requests are counted by. Any other key is a template.
+	KeyIP   = "ip"
+	KeyUser = "user"
+
+	housekeepingInterval = time.Minute
+)
+
+var rateRegex = regexp.MustCompile(`^(\d+)\s*/\s*(\d*)\s*(s|sec|min|h|hour|d|day)$`)
+
+var units = map[string]time.Duration{
+	"s":    time.Second,
+	"sec":  time.Second,
+	"min":  time.Minute,
+	"h":    time.Hour,
+	"hour": time.Hour,
+	"d":    24 * time.Hour,
+	"day":  24 * time.Hour,
+}
+
+// Limit allows Count requests per Period. Up to Burst requests may be sent at once, after a period of silence.
+type Limit struct {
+	Count  int
+	Period time.Duration
+	Burst  int
+}
+
+// ParseLimit parses a rate like "10/min" or "100/5min". Supported units are s (sec), min, h (hour) and d (day).
+// If burst is 0, the burst equals the count of the rate.
+func ParseLimit(rate string, burst int) (Limit, error) {
+	m := rateRegex.FindStringSubmatch(rate)
+	if m == nil {
+		return Limit{}, fmt.Errorf("invalid rate '%s', expected <count>/<unit> like 10/min", rate)
+	}
+	count, err := strconv.Atoi(m[1])
+	if err != nil || count < 1 {
+		return Limit{}, fmt.Errorf("invalid rate '%s', the count must be at least 1", rate)
+	}
+	factor := 1
+	if m[2] != "" {
+		factor, err = strconv.Atoi(m[2])
+		if err != nil || factor < 1 {
+			return Limit{}, fmt.Errorf("invalid rate '%s', the period must be at least 1", rate)
+		}
+	}
+	if burst < 0 {
+		return Limit{}, fmt.Errorf("invalid burst %d, must not be negative", burst)
+	}
+	if burst == 0 {
+		burst = count
+	}
+	return Limit{Count: count, Period: time.Duration(factor) * units[m[3]], Burst: burst}, nil
+}
+
+// String returns the limit as policy for the RateLimit-Policy header, e.g. 10;w=60;burst=20
+func (l Limit) String() string {
+	return fmt.Sprintf("%d;w=%d;burst=%d", l.Count, int(l.Period.Seconds()), l.Burst)
+}
+
+// perSecond is the rate the bucket is refilled with
+func (l Limit) perSecond() float64 {
+	return float64(l.Count) / l.Period.Seconds()
+}
+
+// Result is the outcome of taking a token
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, zero if the request has been allowed
+	RetryAfter time.Duration
+}
+
+// bucket is a token bucket. Instead of refilling it continuously, the tokens are calculated on every request
+// from the time passed since the last update.
+type bucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+	Full    time.Time `json:"full"`
+}
+
+// Limiter counts requests per key in token buckets. The state is kept in memory. If a file is given, the state is
+// loaded from the file on start and saved to the file regularly and on shutdown, so limits survive a restart.
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	file    string
+	logger  *logger.Logger
+}
+
+// New creates a limiter. If file is not empty, the state is persisted to the file.
+func New(file string, logger *logger.Logger) (*Limiter, error) {
+	l := &Limiter{
+		buckets: make(map[string]*bucket),
+		file:    file,
+		logger:  logger,
+	}
+	if file == "" {
+		return l, nil
+	}
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading rate limits: %w", err)
+	}
+	if err = json.Unmarshal(content, &l.buckets); err != nil {
+		return nil, fmt.Errorf("error parsing rate limits %s: %w", file, err)
+	}
+	l.expire(time.Now())
+	return l, nil
+}
+
+// Take takes a token from the bucket of the key. The request is allowed, if a token was available.
+func (l *Limiter) Take(key string, limit Limit, now time.Time) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := limit.perSecond()
+	burst := float64(limit.Burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{Tokens: burst, Updated: now}
+		l.buckets[key] = b
+	}
+	elapsed := now.Sub(b.Updated).Seconds()
+	if elapsed > 0 {
+		b.Tokens = math.Min(burst, b.Tokens+elapsed*rate)
+		b.Updated = now
+	}
+	// The limit may have been lowered by a reload
+	b.Tokens = math.Min(burst, b.Tokens)
+
+	res := Result{}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - b.Tokens) / rate)
+	}
+	res.Remaining = int(b.Tokens)
+	res.Reset = seconds((burst - b.Tokens) / rate)
+	b.Full = now.Add(res.Reset)
+	return res
+}
+
+// seconds converts to a duration rounded up to full seconds, because the headers carry seconds
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s)) * time.Second
+}
+
+// Run removes full buckets and saves the state regularly until the context is done
+func (l *Limiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(housekeepingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.expire(now)
+			if err := l.Save(); err != nil {
+				l.logger.Errorf("%s", err)
+			}
+		}
+	}
+}
+
+// expire removes buckets that are full again, they don't differ from new buckets
+func (l *Limiter) expire(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if !now.Before(b.Full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Save writes the state to the file, if the limiter is persistent
+func (l *Limiter) Save() error {
+	if l.file == "" {
+		return nil
+	}
+	l.mu.Lock()
+	content, err := json.Marshal(l.buckets)
+	l.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding rate limits: %w", err)
+	}
+	// Write to a temporary file first, so a crash doesn't leave a truncated file behind
+	tmp := l.file + ".tmp"
+	if err = os.WriteFile(tmp, content, 0600); err != nil {
+		return fmt.Errorf("error saving rate limits: %w", err)
+	}
+	if err = os.Rename(tmp, l.file); err != nil {
+		return fmt.Errorf("error saving rate limits: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package ratelimit_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimit(t *testing.T) {
+	cases := []struct {
+		rate    string
+		burst   int
+		want    ratelimit.Limit
+		wantErr string
+	}{
+		{rate: "10/min", want: ratelimit.Limit{Count: 10, Period: time.Minute, Burst: 10}},
+		{rate: "100 / 5min", burst: 20, want: ratelimit.Limit{Count: 100, Period: 5 * time.Minute, Burst: 20}},
+		{rate: "1/s", want: ratelimit.Limit{Count: 1, Period: time.Second, Burst: 1}},
+		{rate: "1000/day", want: ratelimit.Limit{Count: 1000, Period: 24 * time.Hour, Burst: 1000}},
+		{rate: "10/m", wantErr: "invalid rate '10/m', expected <count>/<unit> like 10/min"},
+		{rate: "ten/min", wantErr: "invalid rate 'ten/min'"},
+		{rate: "0/min", wantErr: "the count must be at least 1"},
+		{rate: "10/0h", wantErr: "the period must be at least 1"},
+		{rate: "10/min", burst: -1, wantErr: "invalid burst -1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.rate, func(t *testing.T) {
+			limit, err := ratelimit.ParseLimit(tc.rate, tc.burst)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, limit)
+		})
+	}
+	limit, _ := ratelimit.ParseLimit("10/min", 20)
+	assert.Equal(t, "10;w=60;burst=20", limit.String())
+}
+
+func TestTake(t *testing.T) {
+	l, err := ratelimit.New("", nil)
+	require.NoError(t, err)
+	limit := ratelimit.Limit{Count: 2, Period: time.Minute, Burst: 3}
+	now := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	// The burst is available at once
+	for i := 2; i >= 0; i-- {
+		res := l.Take("a", limit, now)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, i, res.Remaining)
+	}
+	res := l.Take("a", limit, now)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 30*time.Second, res.RetryAfter, "one token every 30 seconds")
+	assert.Equal(t, 90*time.Second, res.Reset)
+
+	assert.True(t, l.Take("b", limit, now).Allowed, "keys are independent")
+
+	res = l.Take("a", limit, now.Add(30*time.Second))
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	assert.False(t, l.Take("a", limit, now.Add(31*time.Second)).Allowed)
+
+	res = l.Take("a", limit, now.Add(time.Hour))
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 2, res.Remaining, "refilled up to the burst only")
+}
+
+func TestPersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ratelimit.FileName)
+	limit := ratelimit.Limit{Count: 1, Period: time.Hour, Burst: 1}
+
+	l, err := ratelimit.New(file, nil)
+	require.NoError(t, err)
+	assert.True(t, l.Take("a", limit, time.Now()).Allowed)
+	require.NoError(t, l.Save())
+
+	restarted, err := ratelimit.New(file, nil)
+	require.NoError(t, err)
+	assert.False(t, restarted.Take("a", limit, time.Now()).Allowed, "limit survives a restart")
+	assert.True(t, restarted.Take("b", limit, time.Now()).Allowed)
+}
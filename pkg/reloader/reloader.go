@@ -0,0 +1,168 @@
+package reloader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/share/logger"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultDebounce is the quiet period after the last change of the rules file before a reload is started.
+// Editors often write a file in several steps, and we don't want to validate half-written files.
+const DefaultDebounce = 250 * time.Millisecond
+
+// ApplyFunc receives the freshly read and validated rules
+type ApplyFunc func(rulesCfg *rules.Rules)
+
+// ValidateFunc checks the rules beyond their own validation, e.g. against the server configuration
+type ValidateFunc func(rulesCfg *rules.Rules) error
+
+// Reloader watches the rules file and re-reads it on changes or on SIGHUP. Rules are only handed over to the
+// ApplyFunc if they pass the validation, otherwise the previous rules stay active.
+type Reloader struct {
+	rulesFile  string
+	smtpConfig *config.SMTPConfig
+	logger     *logger.Logger
+	apply      ApplyFunc
+	validate   []ValidateFunc
+	debounce   time.Duration
+	files      []string
+
+	mu         sync.Mutex
+	inProgress atomic.Bool
+}
+
+// New creates a new Reloader for the given rules file
+func New(rulesFile string, smtpConfig *config.SMTPConfig, l *logger.Logger, apply ApplyFunc) *Reloader {
+	return &Reloader{
+		rulesFile:  rulesFile,
+		smtpConfig: smtpConfig,
+		logger:     l,
+		apply:      apply,
+		debounce:   DefaultDebounce,
+	}
+}
+
+// AlsoWatch adds files whose changes trigger a reload, e.g. files referenced by the rules
+func (r *Reloader) AlsoWatch(files ...string) {
+	r.files = append(r.files, files...)
+}
+
+// AlsoValidate adds checks the rules must pass before they are applied
+func (r *Reloader) AlsoValidate(validate ...ValidateFunc) {
+	r.validate = append(r.validate, validate...)
+}
+
+// Reload reads and validates the rules file. On success the rules are applied, otherwise an error is returned
+// and the currently active rules stay untouched.
+func (r *Reloader) Reload() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inProgress.Store(true)
+	defer r.inProgress.Store(false)
+
+	rulesCfg, err := rules.Read(r.rulesFile, r.logger)
+	if err != nil {
+		return err
+	}
+	err = rulesCfg.Validate(r.smtpConfig)
+	if err != nil {
+		return err
+	}
+	for _, validate := range r.validate {
+		if err = validate(rulesCfg); err != nil {
+			return err
+		}
+	}
+	r.apply(rulesCfg)
+	r.logger.Infof("rules reloaded from %s", r.rulesFile)
+	return nil
+}
+
+// InProgress returns true while the rules are being reloaded
+func (r *Reloader) InProgress() bool {
+	return r.inProgress.Load()
+}
+
+// Watch blocks until the ctx is done, reloading the rules whenever the rules file or one of the additionally
+// watched files changes or a SIGHUP is received.
+// The directory of the rules file is watched rather than the file itself, because many editors replace the file
+// on saving, which would silently end a watch on the file.
+func (r *Reloader) Watch(ctx context.Context) (err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to create file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// Absolute paths of all watched files
+	watched := make(map[string]bool)
+	for _, file := range append([]string{r.rulesFile}, r.files...) {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return fmt.Errorf("unable to resolve path of '%s': %w", file, err)
+		}
+		err = watcher.Add(filepath.Dir(abs))
+		if err != nil {
+			return fmt.Errorf("unable to watch '%s': %w", file, err)
+		}
+		watched[abs] = true
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	r.logger.Infof("watching %s for changes", strings.Join(append([]string{r.rulesFile}, r.files...), ", "))
+
+	// The timer delays the reload until the file has not been touched for the debounce period
+	timer := time.NewTimer(r.debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			r.logger.Infof("SIGHUP received")
+			r.reloadAndLog()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !watched[filepath.Clean(event.Name)] {
+				continue
+			}
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) {
+				r.logger.Debugf("watched file changed: %s", event)
+				timer.Reset(r.debounce)
+			}
+		case <-timer.C:
+			r.reloadAndLog()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			r.logger.Errorf("error watching %s: %s", r.rulesFile, err)
+		}
+	}
+}
+
+func (r *Reloader) reloadAndLog() {
+	if err := r.Reload(); err != nil {
+		r.logger.Errorf("reloading rules from %s failed, keeping the previous rules: %s", r.rulesFile, err)
+	}
+}
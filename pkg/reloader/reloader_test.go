@@ -0,0 +1,180 @@
+package reloader_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/reloader"
+	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/share/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	goodRules = `
+rules:
+  - name: Hello
+    on:
+      path: /hello
+    answer.content: hello
+`
+	changedRules = `
+rules:
+  - name: Hello
+    on:
+      path: /hello
+    answer.content: hello
+  - name: World
+    on:
+      path: /world
+    answer.content: world
+`
+	badRules = `
+rules:
+  - name: Broken
+    on:
+      path: /broken
+      methods:
+        - bad_method
+    answer.content: broken
+`
+)
+
+func TestReload(t *testing.T) {
+	rulesFile, l, logFile := setup(t)
+
+	var applied *rules.Rules
+	rl := reloader.New(rulesFile, nil, l, func(rulesCfg *rules.Rules) {
+		applied = rulesCfg
+	})
+
+	t.Run("valid rules are applied", func(t *testing.T) {
+		require.NoError(t, rl.Reload())
+		require.NotNil(t, applied)
+		assert.Len(t, *applied.Rules, 1)
+		assert.False(t, rl.InProgress())
+	})
+
+	t.Run("invalid rules are rejected", func(t *testing.T) {
+		applied = nil
+		require.NoError(t, os.WriteFile(rulesFile, []byte(badRules), 0600))
+		err := rl.Reload()
+		assert.ErrorContains(t, err, "invalid rules")
+		assert.Nil(t, applied)
+
+		log, err := os.ReadFile(logFile)
+		require.NoError(t, err)
+		assert.Contains(t, string(log), "rule 0 'Broken': rules.0.on.methods.0")
+	})
+}
+
+func TestReloadAlsoValidate(t *testing.T) {
+	rulesFile, l, _ := setup(t)
+
+	var applied *rules.Rules
+	rl := reloader.New(rulesFile, nil, l, func(rulesCfg *rules.Rules) {
+		applied = rulesCfg
+	})
+	rl.AlsoValidate(func(rulesCfg *rules.Rules) error {
+		if len(*rulesCfg.Rules) > 1 {
+			return errors.New("rule 'World' requires a client_ca_file")
+		}
+		return nil
+	})
+
+	require.NoError(t, rl.Reload())
+	require.NotNil(t, applied)
+
+	applied = nil
+	require.NoError(t, os.WriteFile(rulesFile, []byte(changedRules), 0600))
+	assert.ErrorContains(t, rl.Reload(), "requires a client_ca_file")
+	assert.Nil(t, applied)
+}
+
+func TestWatch(t *testing.T) {
+	rulesFile, l, logFile := setup(t)
+
+	var applied atomic.Int32
+	var rulesCount atomic.Int32
+	rl := reloader.New(rulesFile, nil, l, func(rulesCfg *rules.Rules) {
+		applied.Add(1)
+		rulesCount.Store(int32(len(*rulesCfg.Rules))) //nolint:gosec // disable G115
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- rl.Watch(ctx)
+	}()
+	// allow the watcher a little time to initialise
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, os.WriteFile(rulesFile, []byte(changedRules), 0600))
+	assert.Eventually(t, func() bool {
+		return applied.Load() == 1
+	}, 3*time.Second, 50*time.Millisecond, "changed rules not applied")
+	assert.Equal(t, int32(2), rulesCount.Load())
+
+	require.NoError(t, os.WriteFile(rulesFile, []byte(badRules), 0600))
+	assert.Eventually(t, func() bool {
+		log, err := os.ReadFile(logFile)
+		return err == nil && strings.Contains(string(log), "keeping the previous rules")
+	}, 3*time.Second, 50*time.Millisecond, "failed reload not logged")
+	assert.Equal(t, int32(1), applied.Load())
+	assert.Equal(t, int32(2), rulesCount.Load())
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestWatchAdditionalFiles(t *testing.T) {
+	rulesFile, l, _ := setup(t)
+	usersFile := filepath.Join(t.TempDir(), "users.htpasswd")
+	require.NoError(t, os.WriteFile(usersFile, []byte("alice:secret\n"), 0600))
+
+	var applied atomic.Int32
+	rl := reloader.New(rulesFile, nil, l, func(_ *rules.Rules) {
+		applied.Add(1)
+	})
+	rl.AlsoWatch(usersFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- rl.Watch(ctx)
+	}()
+	// allow the watcher a little time to initialise
+	time.Sleep(200 * time.Millisecond)
+
+	require.NoError(t, os.WriteFile(usersFile, []byte("alice:changed\n"), 0600))
+	assert.Eventually(t, func() bool {
+		return applied.Load() == 1
+	}, 3*time.Second, 50*time.Millisecond, "change of additional file didn't trigger a reload")
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func setup(t *testing.T) (rulesFile string, l *logger.Logger, logFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	rulesFile = filepath.Join(dir, "rules.yaml")
+	require.NoError(t, os.WriteFile(rulesFile, []byte(goodRules), 0600))
+
+	logFile = filepath.Join(t.TempDir(), "test.log")
+	l, err := logger.New("test", logFile, logger.DEBUG)
+	require.NoError(t, err)
+	t.Cleanup(l.Shutdown)
+
+	return rulesFile, l, logFile
+}
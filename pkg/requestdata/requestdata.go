@@ -7,9 +7,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/share/clientcert"
+	"github.com/http-everything/httpe/pkg/share/reqctx"
 
 	"github.com/http-everything/httpe/pkg/filetype"
 
@@ -18,35 +22,50 @@ import (
 	"github.com/lithammer/shortuuid/v4"
 )
 
-const UploadPrefix = "httpe_upload_"
+const (
+	UploadPrefix = "httpe_upload_"
+	// EnvPrefix is the prefix of the environment variables created from the request data
+	EnvPrefix = "HTTPE_"
+	// RequestIDEnvName is the environment variable passing the request ID to scripts
+	RequestIDEnvName = EnvPrefix + "REQUEST_ID"
+)
+
+var nonEnvChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// CredentialHeaders are never passed to scripts as environment variables
+var CredentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
 
 type Data struct {
-	Meta  MetaData
-	Input Input
+	Meta  MetaData `json:"meta"`
+	Input Input    `json:"input"`
 }
 
 type MetaData struct {
-	RemoteAddr string
-	UserAgent  string
-	Method     string
-	URL        string
-	Headers    map[string]string
+	RequestID  string                 `json:"request_id"`
+	RemoteAddr string                 `json:"remote_addr"`
+	UserAgent  string                 `json:"user_agent"`
+	Method     string                 `json:"method"`
+	URL        string                 `json:"url"`
+	Headers    map[string]string      `json:"headers"`
+	User       string                 `json:"user"`
+	Claims     map[string]interface{} `json:"claims"`
+	ClientCert clientcert.Cert        `json:"client_cert"`
 }
 
 type Input struct {
-	Form            Form
-	JSON            JSON
-	Params          Params
-	Uploads         []Upload
-	URLPlaceholders URLPlaceholders
+	Form            Form            `json:"form"`
+	JSON            JSON            `json:"json"`
+	Params          Params          `json:"params"`
+	Uploads         []Upload        `json:"uploads"`
+	URLPlaceholders URLPlaceholders `json:"url_placeholders"`
 }
 
 type Upload struct {
-	FieldName string
-	FileName  string
-	Size      int64
-	Type      string
-	Stored    string
+	FieldName string `json:"field_name"`
+	FileName  string `json:"file_name"`
+	Size      int64  `json:"size"`
+	Type      string `json:"type"`
+	Stored    string `json:"stored"`
 }
 
 type Form map[string]string
@@ -74,6 +93,10 @@ func Collect(r *http.Request, ruleArgs rules.Args) (d Data, err error) {
 	if err != nil {
 		return d, err
 	}
+	// Extract placeholders from URL
+	if placeholders := extractURLPlaceholders(r); placeholders != nil {
+		d.Input.URLPlaceholders = placeholders
+	}
 	if r.Header.Get("Content-Length") == "0" {
 		return d, nil
 	}
@@ -104,7 +127,16 @@ func Collect(r *http.Request, ruleArgs rules.Args) (d Data, err error) {
 		}
 	}
 
-	// Extract placeholders from URL
+	return d, nil
+}
+
+// CollectMeta collects the meta data, the query parameters and the URL placeholders of the request. Unlike Collect,
+// the body isn't read, so it stays available to the action.
+func CollectMeta(r *http.Request) (d Data, err error) {
+	d = Data{Meta: buildMetaData(r)}
+	if d.Input.Params, err = extractURLParams(r); err != nil {
+		return d, err
+	}
 	d.Input.URLPlaceholders = extractURLPlaceholders(r)
 	return d, nil
 }
@@ -115,12 +147,16 @@ func buildMetaData(r *http.Request) (meta MetaData) {
 		URL = r.URL.RequestURI()
 	}
 	meta = MetaData{
+		RequestID:  reqctx.RequestID(r),
 		RemoteAddr: r.RemoteAddr,
 		UserAgent:  r.UserAgent(),
 		Method:     r.Method,
 		URL:        URL,
 		Headers:    extractHeaders(r),
+		User:       reqctx.User(r),
+		Claims:     reqctx.Claims(r),
 	}
+	meta.ClientCert, _ = clientcert.FromRequest(r)
 
 	return meta
 }
@@ -242,6 +278,64 @@ func extractURLPlaceholders(r *http.Request) (placeholders URLPlaceholders) {
 	return mux.Vars(r)
 }
 
+// Environ returns the request data as list of environment variables in the form "key=value", ready to be passed
+// to a script. Variable names are prefixed by the source of the value, e.g. the query parameter 'name' becomes
+// HTTPE_PARAM_NAME, and uppercased. Characters not allowed in variable names are replaced by underscores.
+// JSON data is not included because it can exceed the size limits of environment variables.
+// The CredentialHeaders and the omitted headers are left out, every child process of the script would inherit them.
+func (d Data) Environ(omitHeaders ...string) (env []string) {
+	vars := map[string]string{
+		"META_METHOD":      d.Meta.Method,
+		"META_URL":         d.Meta.URL,
+		"META_REMOTE_ADDR": d.Meta.RemoteAddr,
+		"META_USER_AGENT":  d.Meta.UserAgent,
+		"META_USER":        d.Meta.User,
+	}
+	if d.Meta.ClientCert.Fingerprint != "" {
+		vars["META_CLIENT_CERT_SUBJECT"] = d.Meta.ClientCert.Subject
+		vars["META_CLIENT_CERT_FINGERPRINT"] = d.Meta.ClientCert.Fingerprint
+	}
+	add := func(prefix string, values map[string]string) {
+		for k, v := range values {
+			vars[prefix+k] = v
+		}
+	}
+	add("PARAM_", d.Input.Params)
+	add("FORM_", d.Input.Form)
+	for k, v := range d.Meta.Headers {
+		if !containsFold(CredentialHeaders, k) && !containsFold(omitHeaders, k) {
+			vars["HEADER_"+k] = v
+		}
+	}
+	add("URL_", d.Input.URLPlaceholders)
+	for _, upload := range d.Input.Uploads {
+		vars["UPLOAD_"+upload.FieldName] = upload.Stored
+		vars["UPLOAD_"+upload.FieldName+"_NAME"] = upload.FileName
+	}
+
+	env = make([]string, 0, len(vars))
+	for k, v := range vars {
+		env = append(env, EnvName(k)+"="+v)
+	}
+	// Sorting makes the order of variables with colliding names predictable
+	sort.Strings(env)
+	return env
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnvName converts a name into a valid environment variable name prefixed with EnvPrefix
+func EnvName(name string) string {
+	return EnvPrefix + nonEnvChars.ReplaceAllString(strings.ToUpper(name), "_")
+}
+
 func Mock() (d Data, err error) {
 	var jd interface{}
 	err = json.Unmarshal([]byte(`
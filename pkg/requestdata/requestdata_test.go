@@ -12,6 +12,7 @@ import (
 	"github.com/http-everything/httpe/pkg/rules"
 
 	"github.com/http-everything/httpe/pkg/requestdata"
+	"github.com/http-everything/httpe/pkg/share/clientcert"
 	"github.com/http-everything/httpe/pkg/share/extract"
 
 	"github.com/gorilla/mux"
@@ -178,3 +179,50 @@ func TestURLPlaceholders(t *testing.T) {
 
 	assert.Equal(t, "foo", reqData.Input.URLPlaceholders["id"])
 }
+
+func TestEnviron(t *testing.T) {
+	d := requestdata.Data{
+		Meta: requestdata.MetaData{
+			Method: "GET",
+			URL:    "/test?name=john",
+			Headers: map[string]string{
+				"X-My-Header":    "header",
+				"Authorization":  "Bearer s3cr3t",
+				"Cookie":         "httpe_session=s3cr3t",
+				"X-Gitlab-Token": "s3cr3t",
+			},
+			ClientCert: clientcert.Cert{
+				Subject:     "CN=build,O=httpe",
+				CommonName:  "build",
+				Fingerprint: "sha256:0123",
+			},
+		},
+		Input: requestdata.Input{
+			Params:          requestdata.Params{"name": "john"},
+			Form:            requestdata.Form{"first name": "jane", "city.name": "London"},
+			URLPlaceholders: requestdata.URLPlaceholders{"id": "42"},
+			Uploads: []requestdata.Upload{
+				{FieldName: "file", FileName: "hosts", Stored: "/tmp/httpe_upload_1"},
+			},
+		},
+	}
+
+	env := d.Environ("x-gitlab-token")
+
+	assert.Contains(t, env, "HTTPE_META_METHOD=GET")
+	assert.Contains(t, env, "HTTPE_META_URL=/test?name=john")
+	assert.Contains(t, env, "HTTPE_PARAM_NAME=john")
+	assert.Contains(t, env, "HTTPE_FORM_FIRST_NAME=jane")
+	assert.Contains(t, env, "HTTPE_FORM_CITY_NAME=London")
+	assert.Contains(t, env, "HTTPE_HEADER_X_MY_HEADER=header")
+	assert.Contains(t, env, "HTTPE_URL_ID=42")
+	assert.Contains(t, env, "HTTPE_UPLOAD_FILE=/tmp/httpe_upload_1")
+	assert.Contains(t, env, "HTTPE_UPLOAD_FILE_NAME=hosts")
+	assert.Contains(t, env, "HTTPE_META_CLIENT_CERT_SUBJECT=CN=build,O=httpe")
+	assert.Contains(t, env, "HTTPE_META_CLIENT_CERT_FINGERPRINT=sha256:0123")
+	assert.IsIncreasing(t, env)
+	for _, v := range env {
+		assert.NotContains(t, v, "s3cr3t")
+	}
+	assert.NotContains(t, env, "HTTPE_HEADER_AUTHORIZATION=Bearer s3cr3t")
+}
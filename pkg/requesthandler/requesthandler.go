@@ -1,52 +1,164 @@
 package requesthandler
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/http-everything/httpe/pkg/postaction"
 
 	"github.com/http-everything/httpe/pkg/actions/sendemail"
 	"github.com/http-everything/httpe/pkg/config"
 
+	"github.com/http-everything/httpe/pkg/accesslog"
 	"github.com/http-everything/httpe/pkg/actions"
 	"github.com/http-everything/httpe/pkg/actions/answercontent"
 	"github.com/http-everything/httpe/pkg/actions/answerfile"
 	"github.com/http-everything/httpe/pkg/actions/redirect"
 	"github.com/http-everything/httpe/pkg/actions/renderbuttons"
 	"github.com/http-everything/httpe/pkg/actions/runscript"
+	"github.com/http-everything/httpe/pkg/jobs"
+	"github.com/http-everything/httpe/pkg/metrics"
 	"github.com/http-everything/httpe/pkg/requestdata"
 	"github.com/http-everything/httpe/pkg/response"
 	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/scriptqueue"
 	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/share/reqctx"
+	"github.com/http-everything/httpe/pkg/share/statuswriter"
+	"github.com/http-everything/httpe/pkg/tracing"
+	"github.com/http-everything/httpe/pkg/validation"
 )
 
 const DefaultMaxRequestBody = "512KB"
 
-func Execute(rule rules.Rule, logger *logger.Logger, conf *config.Config) http.Handler {
+// Option configures optional dependencies of the request handler
+type Option func(o *options)
+
+type options struct {
+	queues  *scriptqueue.Queues
+	metrics *metrics.Metrics
+}
+
+// WithQueues sets the queues limiting the concurrent execution of scripts. Without, the concurrency is only limited
+// per handler.
+func WithQueues(queues *scriptqueue.Queues) Option {
+	return func(o *options) {
+		o.queues = queues
+	}
+}
+
+// WithMetrics sets the metrics requests, scripts and post actions are recorded in
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+func Execute(rule rules.Rule, logger *logger.Logger, conf *config.Config, opts ...Option) http.Handler {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.queues == nil {
+		o.queues = scriptqueue.New(0, logger)
+	}
+	limit := scriptLimit(rule.Args)
+	// The validation has been checked with the rules, an error here means e.g. the schema file has been removed since
+	var validate *rules.Validate
+	if rule.With != nil {
+		validate = rule.With.Validate
+	}
+	validator, validatorErr := validation.New(validate)
+	if validatorErr != nil {
+		logger.Errorf("rule '%s': invalid validate: %s", rule.ID(), validatorErr)
+	}
 	fn := func(w http.ResponseWriter, r *http.Request) {
+		// Every line logged for the request carries its ID, so one search finds everything that happened
+		reqLogger := reqctx.Logger(r, logger).With("rule", rule.ID()).With("action", rule.Action())
+
 		// Initialise a new http response writer.
-		respWriter := response.New(w, rule.Respond, logger)
+		respWriter := response.New(w, rule.Respond, reqLogger)
 
 		// Collect data from the request to be made available to the template engine and add to the response writer
+		_, collectSpan := tracing.Start(r.Context(), "collect request data")
 		reqData, err := requestdata.Collect(r, rule.Args)
+		collectSpan.RecordError(err)
+		collectSpan.End()
 		if err != nil {
 			respWriter.InternalServerError(err)
 			return
 		}
 		respWriter.AddRequestData(reqData)
+		var uploadSize int64
+		for _, upload := range reqData.Input.Uploads {
+			uploadSize += upload.Size
+		}
+		o.metrics.Uploaded(rule.ID(), uploadSize)
+
+		// Reject invalid input before any action runs
+		if validatorErr != nil {
+			respWriter.InternalServerError(validatorErr)
+			return
+		}
+		if validator != nil {
+			fieldErrs, err := validator.Request(reqData)
+			if err != nil {
+				respWriter.InternalServerError(err)
+				return
+			}
+			if len(fieldErrs) > 0 {
+				respWriter.UnprocessableEntity(fieldErrs)
+				return
+			}
+		}
+
+		// Take a slot before the response is started, so requests exceeding the concurrency can be rejected.
+		// Coalescing requests take the slot when they don't join another execution.
+		release := func() {}
+		if rule.Action() == rules.RunScript && limit.Mode != scriptqueue.Coalesce {
+			release, err = o.queues.Acquire(r.Context(), rule.ID(), limit)
+			if err != nil {
+				queueError(respWriter, err)
+				return
+			}
+		}
+		// The span of the action ends with its execution, for asynchronous scripts with the job
+		_, actionSpan := tracing.Start(r.Context(), "action "+rule.Action())
+		releaseOnReturn := true
+		defer func() {
+			if releaseOnReturn {
+				actionSpan.End()
+				release()
+			}
+		}()
 
 		//Create a container for the action that implements the action interface
 		var actioner actions.Actioner
+		var streamer *response.Streamer
 
 		// Hand over the request to the action specified by the rule defined by 'rule' using switch case
 		switch rule.Action() {
 		case rules.RunScript:
 			// Execute a script
-			actioner = runscript.Script{}
+			script := runscript.Script{TraceParent: actionSpan.TraceParent()}
+			if rule.Args.Stream != "" && !rule.Args.Async {
+				// Send the output to the client while the script is running
+				streamer = respWriter.Stream(rule.Args.Stream)
+				script.Stdout = streamer.Stdout()
+				script.Stderr = streamer.Stderr()
+			}
+			actioner = script
 		case rules.SendEmail:
 			// Send an email
 			actioner = sendemail.Email{
-				SMTPConfig: conf.SMTP,
+				SMTPConfig:  conf.SMTP,
+				TraceParent: actionSpan.TraceParent(),
 			}
 		case rules.AnswerContent:
 			actioner = answercontent.AnswerContent{}
@@ -61,16 +173,151 @@ func Execute(rule rules.Rule, logger *logger.Logger, conf *config.Config) http.H
 			// Do nothing, just create a response
 			actioner = answercontent.AnswerContent{}
 		}
+		execute := func() (actions.ActionResponse, error) {
+			defer actionSpan.End()
+			start := time.Now()
+			if rule.Action() != rules.RunScript {
+				actionResp, err := actioner.Execute(rule, reqData)
+				actionSpan.RecordError(err)
+				logAction(reqLogger, time.Since(start), err)
+				return actionResp, err
+			}
+			done := o.metrics.ScriptStarted(rule.ID())
+			actionResp, err := actioner.Execute(rule, reqData)
+			done(actionResp, err)
+			actionSpan.RecordError(err)
+			if err == nil {
+				actionSpan.SetAttribute("process.exit.code", actionResp.Code)
+				logAction(reqLogger.With("exit_code", actionResp.Code), time.Since(start), nil)
+			} else {
+				logAction(reqLogger, time.Since(start), err)
+			}
+			return actionResp, err
+		}
+		// Post actions outlive the request, they only take the trace from its context
+		postCtx := context.WithoutCancel(r.Context())
+		// Run scripts in the background if requested by the rule and respond with the job immediately
+		if rule.Action() == rules.RunScript && rule.Args.Async {
+			// The job holds the slot until the script has terminated
+			releaseOnReturn = false
+			job, err := jobs.New(conf, reqLogger).Start(rule.ID(), func() (actions.ActionResponse, error) {
+				defer release()
+				actionResp, err := execute()
+				// Post actions follow the completion of the job rather than the response
+				postaction.Execute(postCtx, rule, reqData, conf, reqLogger, o.metrics)
+				return actionResp, err
+			})
+			if err != nil {
+				actionSpan.RecordError(err)
+				actionSpan.End()
+				release()
+				respWriter.InternalServerErrorf("action %s: %s", rule.Action(), err)
+				return
+			}
+			respWriter.Accepted(job.URL(), job)
+			return
+		}
 		// Execute the action by calling the mandatory function Execute()
-		actionResp, err := actioner.Execute(rule, reqData)
+		var actionResp actions.ActionResponse
+		shared := false
+		if rule.Action() == rules.RunScript && limit.Mode == scriptqueue.Coalesce {
+			actionResp, shared, err = o.queues.Coalesce(r.Context(), rule.ID(), inputKey(reqData), limit, execute)
+			if errors.Is(err, scriptqueue.ErrTimeout) {
+				queueError(respWriter, err)
+				return
+			}
+		} else {
+			actionResp, err = execute()
+		}
+		if rule.Action() == rules.RunScript && err == nil {
+			accesslog.FromRequest(r).SetExitCode(actionResp.Code)
+		}
+		if streamer != nil {
+			// The response has been started already, finish it with the status of the action
+			streamer.Finish(actionResp, err)
+			go postaction.Execute(postCtx, rule, reqData, conf, reqLogger, o.metrics)
+			return
+		}
 		if err != nil {
 			respWriter.InternalServerErrorf("action %s: %s", rule.Action(), err)
 			return
 		}
 		// Hand over the action response to our HTTP response writer
+		_, renderSpan := tracing.Start(r.Context(), "render response")
 		respWriter.ActionResponse(actionResp)
-		// Execute the post action asynchronously, if there are any.
-		go postaction.Execute(rule, reqData, conf, logger)
+		renderSpan.End()
+		// Execute the post action asynchronously, if there are any. Requests that joined another execution have no
+		// post action of their own.
+		if !shared {
+			go postaction.Execute(postCtx, rule, reqData, conf, reqLogger, o.metrics)
+		}
+	}
+	if o.metrics == nil {
+		return http.HandlerFunc(fn)
+	}
+	return instrument(rule.ID(), o.metrics, http.HandlerFunc(fn))
+}
+
+// logAction logs the completion of the action with its duration in seconds
+func logAction(l *logger.Logger, duration time.Duration, err error) {
+	l = l.With("duration", duration.Round(time.Millisecond).Seconds())
+	if err != nil {
+		l.Errorf("action failed: %s", err)
+		return
+	}
+	l.Infof("action finished")
+}
+
+// instrument records the status code, the duration and the size of the request body of every request
+func instrument(rule string, m *metrics.Metrics, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := statuswriter.New(w)
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		next.ServeHTTP(sw, r)
+		m.Request(rule, sw.Code(), time.Since(start), body.n)
+	})
+}
+
+// countingReader counts the bytes read from the request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// scriptLimit returns the concurrency of a rule
+func scriptLimit(args rules.Args) scriptqueue.Limit {
+	return scriptqueue.Limit{
+		MaxConcurrency: args.MaxConcurrency,
+		Mode:           args.Queue,
+		Timeout:        time.Duration(args.QueueTimeout) * time.Second,
+	}
+}
+
+// inputKey identifies requests with identical input, that can share the execution of a script
+func inputKey(reqData requestdata.Data) string {
+	// Maps are encoded with sorted keys, so the encoding of identical input is identical
+	content, _ := json.Marshal(struct {
+		User  string            `json:"user"`
+		Input requestdata.Input `json:"input"`
+	}{reqData.Meta.User, reqData.Input})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func queueError(respWriter *response.Response, err error) {
+	if errors.Is(err, scriptqueue.ErrBusy) {
+		respWriter.Conflict()
+		return
 	}
-	return http.HandlerFunc(fn)
+	respWriter.ServiceUnavailable()
 }
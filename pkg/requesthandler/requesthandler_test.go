@@ -1,19 +1,23 @@
 package requesthandler_test
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/jobs"
 	"github.com/http-everything/httpe/pkg/share/logger"
 
 	"github.com/http-everything/httpe/pkg/requesthandler"
 	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/scriptqueue"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -60,6 +64,18 @@ func TestRequestHandler(t *testing.T) {
 			wantBody:   "test" + newline(t),
 			wantStatus: http.StatusOK,
 		},
+		{
+			name:       "Run Script streamed as text",
+			rule:       rules.Rule{RunScript: "echo test", Args: rules.Args{Stream: rules.StreamText}},
+			wantBody:   "test" + newline(t),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Run Script streamed as server-sent events",
+			rule:       rules.Rule{RunScript: "echo test", Args: rules.Args{Stream: rules.StreamSSE}},
+			wantBody:   "event: stdout\ndata: test\n\nevent: exit\ndata: 0\n\n",
+			wantStatus: http.StatusOK,
+		},
 		{
 			name: "Postaction",
 			rule: rules.Rule{
@@ -118,3 +134,152 @@ func newline(t *testing.T) string {
 	}
 	return "\n"
 }
+
+func TestRequestHandlerAsync(t *testing.T) {
+	dataDir := t.TempDir()
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	defer l.Shutdown()
+	conf := config.Config{S: &config.SvrConfig{DataDir: dataDir, DataRetention: "1d"}}
+
+	rule := rules.Rule{
+		Name:      "Async",
+		On:        &rules.On{Path: "/"},
+		RunScript: "echo test",
+		Args:      rules.Args{Async: true},
+	}
+	req, err := http.NewRequest("get", "/", nil)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	requesthandler.Execute(rule, l, &conf).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	var job jobs.Job
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	assert.Equal(t, jobs.StatusRunning, job.Status)
+	assert.Equal(t, "Async", job.Rule)
+	assert.Equal(t, job.URL(), rec.Header().Get("Location"))
+
+	store := jobs.New(&conf, l)
+	assert.Eventually(t, func() bool {
+		job, err = store.Get(job.ID)
+		return err == nil && job.Status == jobs.StatusFinished
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "test"+newline(t), job.Stdout)
+}
+
+func TestRequestHandlerValidation(t *testing.T) {
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	defer l.Shutdown()
+	conf := config.Config{S: &config.SvrConfig{DataDir: t.TempDir(), DataRetention: "1d"}}
+
+	rule := rules.Rule{
+		On:            &rules.On{Path: "/"},
+		AnswerContent: "Hello {{ .Input.Params.name }}",
+		With: &rules.With{
+			Validate: &rules.Validate{
+				Params: map[string]rules.Field{
+					"name": {Required: true, Type: rules.FieldRegex, Pattern: "[A-Za-z]+"},
+				},
+			},
+		},
+	}
+	cases := []struct {
+		name       string
+		url        string
+		wantBody   string
+		wantStatus int
+	}{
+		{
+			name:       "valid",
+			url:        "/?name=John",
+			wantBody:   "Hello John",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invalid",
+			url:        "/?name=John%3Bid",
+			wantBody:   `{"error":"invalid input","fields":[{"field":"params.name","message":"must match '[A-Za-z]+'"}]}`,
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "missing",
+			url:        "/",
+			wantBody:   `{"error":"invalid input","fields":[{"field":"params.name","message":"is required"}]}`,
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("get", tc.url, nil)
+			require.NoError(t, err)
+			rec := httptest.NewRecorder()
+			requesthandler.Execute(rule, l, &conf).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			if tc.wantStatus == http.StatusOK {
+				assert.Equal(t, tc.wantBody, rec.Body.String())
+			} else {
+				assert.JSONEq(t, tc.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequestHandlerConcurrency(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("script requires a unix shell")
+	}
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	defer l.Shutdown()
+	conf := config.Config{S: &config.SvrConfig{DataDir: t.TempDir(), DataRetention: "1d"}}
+
+	cases := []struct {
+		queue      string
+		wantStatus int
+		wantRuns   int
+	}{
+		{queue: "", wantStatus: http.StatusConflict, wantRuns: 1},
+		{queue: "wait", wantStatus: http.StatusOK, wantRuns: 2},
+		{queue: "coalesce", wantStatus: http.StatusOK, wantRuns: 1},
+	}
+	for _, tc := range cases {
+		t.Run("queue "+tc.queue, func(t *testing.T) {
+			runs := filepath.Join(t.TempDir(), "runs")
+			rule := rules.Rule{
+				Name:      "Deploy",
+				On:        &rules.On{Path: "/"},
+				RunScript: "echo run >> " + runs + "; sleep 0.3; echo deployed",
+				Args:      rules.Args{MaxConcurrency: 1, Queue: tc.queue, QueueTimeout: 5},
+			}
+			queues := scriptqueue.New(0, l)
+			h := requesthandler.Execute(rule, l, &conf, requesthandler.WithQueues(queues))
+
+			first := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				h.ServeHTTP(first, httptest.NewRequest("get", "/", nil))
+				close(done)
+			}()
+			require.Eventually(t, func() bool {
+				_, err := os.Stat(runs)
+				return err == nil
+			}, 5*time.Second, 10*time.Millisecond)
+
+			second := httptest.NewRecorder()
+			h.ServeHTTP(second, httptest.NewRequest("get", "/", nil))
+			<-done
+
+			assert.Equal(t, http.StatusOK, first.Code)
+			assert.Equal(t, "deployed\n", first.Body.String())
+			assert.Equal(t, tc.wantStatus, second.Code)
+			content, err := os.ReadFile(runs)
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantRuns, strings.Count(string(content), "run"))
+			total, _ := queues.Stats()
+			assert.Equal(t, scriptqueue.Stats{}, total, "all slots have been released")
+		})
+	}
+}
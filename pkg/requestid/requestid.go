@@ -0,0 +1,43 @@
+package requestid
+
+import (
+	"net/http"
+
+	"github.com/http-everything/httpe/pkg/share/reqctx"
+
+	"github.com/lithammer/shortuuid/v4"
+)
+
+const (
+	// Header carries the ID of a request from the client and back in the response
+	Header = "X-Request-ID"
+	// MaxLength is the maximum length of IDs accepted from clients
+	MaxLength = 128
+)
+
+// Handler assigns an ID to every request and returns it in the X-Request-ID header of the response. IDs sent by the
+// client in the same header are kept, so a call can be followed across services. Invalid IDs are replaced.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !Valid(id) {
+			id = shortuuid.New()
+		}
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, reqctx.WithRequestID(r, id))
+	})
+}
+
+// Valid reports whether the ID can be taken over from a client. IDs end up in logs, templates and environment
+// variables, so only printable ASCII characters without spaces and quotes are accepted.
+func Valid(id string) bool {
+	if id == "" || len(id) > MaxLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' || c == '"' || c == '\'' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package requestid_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/requestid"
+	"github.com/http-everything/httpe/pkg/share/reqctx"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	cases := []struct {
+		name     string
+		incoming string
+		wantKept bool
+	}{
+		{
+			name:     "No ID",
+			incoming: "",
+		},
+		{
+			name:     "ID of the client",
+			incoming: "7f3c9a2e-1b4d-4c8e-9f0a-2d6b8e1c5a7f",
+			wantKept: true,
+		},
+		{
+			name:     "ID with spaces",
+			incoming: "abc def",
+		},
+		{
+			name:     "ID with quotes",
+			incoming: `abc"def`,
+		},
+		{
+			name:     "ID too long",
+			incoming: strings.Repeat("a", requestid.MaxLength+1),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var id string
+			h := requestid.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				id = reqctx.RequestID(r)
+			}))
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/", nil)
+			if tc.incoming != "" {
+				req.Header.Set(requestid.Header, tc.incoming)
+			}
+			h.ServeHTTP(w, req)
+
+			assert.NotEmpty(t, id)
+			assert.True(t, requestid.Valid(id))
+			assert.Equal(t, id, w.Header().Get(requestid.Header))
+			if tc.wantKept {
+				assert.Equal(t, tc.incoming, id)
+			} else {
+				assert.NotEqual(t, tc.incoming, id)
+			}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package response
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/http-everything/httpe/pkg/actions"
 	"github.com/http-everything/httpe/pkg/requestdata"
@@ -21,7 +24,8 @@ const (
 	DefaultOnErrorTemplate   = "{{.Action.ErrorBody }}"
 )
 
-var DefaultHeaders map[string]string
+// DefaultHeaders are sent with every response. They are created once, because responses are written concurrently.
+var DefaultHeaders = defaultHeaders()
 
 type Response struct {
 	reqData  requestdata.Data
@@ -37,6 +41,10 @@ func New(w http.ResponseWriter, ruleResp rules.Respond, logger *logger.Logger) *
 		logger:   logger,
 		ruleResp: ruleResp,
 	}
+	return resp
+}
+
+func defaultHeaders() map[string]string {
 	csp := map[string]string{
 		"default-src": "'self'",
 		"script-src":  "'self' 'nonce-2a0f584a448239d92e65e67b37264fa8' 'unsafe-eval'",
@@ -46,12 +54,12 @@ func New(w http.ResponseWriter, ruleResp rules.Respond, logger *logger.Logger) *
 		"font-src":    "'self'",
 		"frame-src":   "'self'",
 	}
-	DefaultHeaders = make(map[string]string)
-	DefaultHeaders["Content-Security-Policy"] = cspToString(csp)
-	DefaultHeaders["Strict-Transport-Security"] = "max-age=63072000; includeSubDomains; preload"
-	DefaultHeaders["X-Frame-Options"] = "sameorigin"
-	DefaultHeaders["X-Content-Type-Options"] = "nosniff"
-	return resp
+	headers := make(map[string]string)
+	headers["Content-Security-Policy"] = cspToString(csp)
+	headers["Strict-Transport-Security"] = "max-age=63072000; includeSubDomains; preload"
+	headers["X-Frame-Options"] = "sameorigin"
+	headers["X-Content-Type-Options"] = "nosniff"
+	return headers
 }
 
 func (r *Response) AddRequestData(reqData requestdata.Data) {
@@ -65,11 +73,49 @@ func (r *Response) InternalServerError(err error) {
 	http.Error(r.w, err.Error(), http.StatusInternalServerError)
 }
 
-func (r *Response) Unauthorised() {
-	r.w.Header().Set("WWW-Authenticate", "Basic realm='Authorization required'")
+// Unauthorised responds with 401 Unauthorized and announces the given authentication schemes as challenges.
+// Without schemes, HTTP basic auth is announced.
+func (r *Response) Unauthorised(schemes ...string) {
+	if len(schemes) == 0 {
+		schemes = []string{"Basic"}
+	}
+	for _, scheme := range schemes {
+		r.w.Header().Add("WWW-Authenticate", scheme+" realm='Authorization required'")
+	}
 	http.Error(r.w, "Unauthorised", http.StatusUnauthorized)
 }
 
+// Forbidden responds with 403 Forbidden to authenticated users not allowed to access the rule
+func (r *Response) Forbidden() {
+	http.Error(r.w, "Forbidden", http.StatusForbidden)
+}
+
+// ClientCertificateRequired responds with 401 Unauthorized to requests without a verified TLS client certificate
+func (r *Response) ClientCertificateRequired() {
+	http.Error(r.w, "Client certificate required", http.StatusUnauthorized)
+}
+
+// TooManyRequests responds with 429 Too Many Requests to clients exceeding the rate limit
+func (r *Response) TooManyRequests(retryAfter time.Duration) {
+	r.w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	http.Error(r.w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// Conflict responds with 409 Conflict to requests for a script that is already running at its maximum concurrency
+func (r *Response) Conflict() {
+	http.Error(r.w, "Script is already running", http.StatusConflict)
+}
+
+// ServiceUnavailable responds with 503 Service Unavailable to requests that didn't get a free script slot in time
+func (r *Response) ServiceUnavailable() {
+	http.Error(r.w, "Timed out waiting for a free script slot", http.StatusServiceUnavailable)
+}
+
+// InvalidSignature responds with 401 Unauthorized to requests with a missing or wrong signature
+func (r *Response) InvalidSignature() {
+	http.Error(r.w, "Invalid signature", http.StatusUnauthorized)
+}
+
 func (r *Response) RequestEntityTooLarge(current int, limit int) {
 	msg := fmt.Sprintf(
 		"Request entity too large. %s sent exceeds limit of %s",
@@ -79,6 +125,37 @@ func (r *Response) RequestEntityTooLarge(current int, limit int) {
 	http.Error(r.w, msg, http.StatusRequestEntityTooLarge)
 }
 
+// Accepted responds with 202 Accepted, pointing to the location where the status of the request can be retrieved.
+// The given value is sent JSON encoded as body.
+func (r *Response) Accepted(location string, v interface{}) {
+	r.w.Header().Set("Location", location)
+	r.writeJSON(http.StatusAccepted, v)
+}
+
+// UnprocessableEntity responds with 422 Unprocessable Entity listing the fields of the request failing validation
+func (r *Response) UnprocessableEntity(fieldErrs interface{}) {
+	r.writeJSON(http.StatusUnprocessableEntity, struct {
+		Error  string      `json:"error"`
+		Fields interface{} `json:"fields"`
+	}{
+		Error:  "invalid input",
+		Fields: fieldErrs,
+	})
+}
+
+func (r *Response) writeJSON(statusCode int, v interface{}) {
+	for h, val := range DefaultHeaders {
+		r.w.Header().Set(h, val)
+	}
+	r.w.Header().Set("Content-Type", "application/json")
+	r.w.WriteHeader(statusCode)
+	encoder := json.NewEncoder(r.w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil && r.logger != nil {
+		r.logger.Errorf("unable to write response: %s", err)
+	}
+}
+
 func (r *Response) InternalServerErrorf(msg string, args ...interface{}) {
 	msg = fmt.Sprintf(msg, args...)
 	if r.logger != nil {
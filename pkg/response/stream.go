@@ -0,0 +1,201 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/http-everything/httpe/pkg/actions"
+	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/share/firstof"
+	"github.com/http-everything/httpe/pkg/templating"
+)
+
+const (
+	// DefaultSSEExitTemplate renders the data of the final 'exit' event if the rule doesn't define a template
+	DefaultSSEExitTemplate = "{{ .Action.Code }}"
+	// ExitCodeTrailer is the HTTP trailer carrying the exit code of streamed text responses
+	ExitCodeTrailer = "X-Exit-Code"
+
+	EventStdout = "stdout"
+	EventStderr = "stderr"
+	EventExit   = "exit"
+	EventError  = "error"
+)
+
+// Streamer sends the output of an action to the client while the action is still running.
+// In text mode, stdout is sent as chunked plain text and the exit code is sent as HTTP trailer.
+// In SSE mode, every line of stdout and stderr is sent as server-sent event, followed by a final exit event.
+type Streamer struct {
+	r    *Response
+	mode string
+	rc   *http.ResponseController
+
+	mu      sync.Mutex
+	partial map[string]*bytes.Buffer
+	// finished is set by Finish. Output still arriving afterwards is dropped, because the handler may have returned
+	// and the response writer must not be used anymore.
+	finished bool
+}
+
+// Stream starts a streamed response. Because the headers are sent immediately, the HTTP status is always 200.
+func (r *Response) Stream(mode string) *Streamer {
+	s := &Streamer{
+		r:       r,
+		mode:    mode,
+		rc:      http.NewResponseController(r.w),
+		partial: map[string]*bytes.Buffer{EventStdout: {}, EventStderr: {}},
+	}
+	for h, v := range DefaultHeaders {
+		r.w.Header().Set(h, v)
+	}
+	r.w.Header().Set("Cache-Control", "no-cache")
+	// Prevent reverse proxies like nginx from buffering the stream
+	r.w.Header().Set("X-Accel-Buffering", "no")
+	if mode == rules.StreamSSE {
+		r.w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		r.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		r.w.Header().Set("Trailer", ExitCodeTrailer)
+	}
+	r.w.WriteHeader(http.StatusOK)
+	s.flush()
+	return s
+}
+
+// Stdout returns the writer for the standard output of the action
+func (s *Streamer) Stdout() io.Writer {
+	return streamWriter{s: s, event: EventStdout}
+}
+
+// Stderr returns the writer for the standard error of the action
+func (s *Streamer) Stderr() io.Writer {
+	return streamWriter{s: s, event: EventStderr}
+}
+
+// Finish sends the final status frame. The on_success or on_error template of the rule is rendered with the
+// action response. If the rule doesn't define a template, SSE streams send the exit code and text streams nothing.
+// Only the first call has an effect.
+func (s *Streamer) Finish(actionResp actions.ActionResponse, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return
+	}
+	s.finished = true
+	if s.mode == rules.StreamSSE {
+		s.flushPartialLines()
+	}
+	if err != nil {
+		if s.r.logger != nil {
+			s.r.logger.Errorf("Streamed action failed: %v", err)
+		}
+		s.writeFrame(EventError, err.Error())
+		if s.mode != rules.StreamSSE {
+			s.r.w.Header().Set(ExitCodeTrailer, "-1")
+		}
+		s.flush()
+		return
+	}
+
+	var tpl string
+	if actionResp.Code != 0 {
+		tpl = s.r.ruleResp.OnError.Body
+	} else {
+		tpl = s.r.ruleResp.OnSuccess.Body
+	}
+	if s.mode == rules.StreamSSE {
+		tpl = firstof.String(tpl, DefaultSSEExitTemplate)
+	}
+	frame, err := templating.RenderActionResponse(actionResp, tpl, s.r.reqData)
+	if err != nil {
+		s.writeFrame(EventError, err.Error())
+	} else {
+		s.writeFrame(EventExit, frame)
+	}
+	if s.mode != rules.StreamSSE {
+		s.r.w.Header().Set(ExitCodeTrailer, strconv.Itoa(actionResp.Code))
+	}
+	s.flush()
+}
+
+type streamWriter struct {
+	s     *Streamer
+	event string
+}
+
+func (sw streamWriter) Write(p []byte) (n int, err error) {
+	sw.s.mu.Lock()
+	defer sw.s.mu.Unlock()
+	if sw.s.finished {
+		// Pretend success, so the output of the script is drained rather than blocking it
+		return len(p), nil
+	}
+	if sw.s.mode != rules.StreamSSE {
+		// Plain text streams carry stdout only
+		if sw.event == EventStdout {
+			if _, err = sw.s.r.w.Write(p); err != nil {
+				return 0, err
+			}
+			sw.s.flush()
+		}
+		return len(p), nil
+	}
+	// Server-sent events are line based. Complete lines are sent immediately, the rest is kept until the
+	// next write completes the line or the action finishes.
+	buf := sw.s.partial[sw.event]
+	buf.Write(p)
+	for {
+		line, err := buf.ReadString('\n')
+		if err != nil {
+			// No newline left, put back the incomplete line
+			buf.Reset()
+			buf.WriteString(line)
+			break
+		}
+		sw.s.writeEvent(sw.event, strings.TrimSuffix(line, "\n"))
+	}
+	sw.s.flush()
+	return len(p), nil
+}
+
+// writeFrame writes the final frame of the stream
+func (s *Streamer) writeFrame(event string, data string) {
+	if s.mode == rules.StreamSSE {
+		s.writeEvent(event, data)
+		return
+	}
+	if event == EventError {
+		data = "error: " + data + "\n"
+	}
+	fmt.Fprint(s.r.w, data)
+}
+
+// writeEvent writes a server-sent event. Multi-line data is split into multiple data fields.
+func (s *Streamer) writeEvent(event string, data string) {
+	var sb strings.Builder
+	sb.WriteString("event: " + event + "\n")
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		sb.WriteString("data: " + strings.TrimSuffix(line, "\r") + "\n")
+	}
+	sb.WriteString("\n")
+	fmt.Fprint(s.r.w, sb.String())
+}
+
+func (s *Streamer) flushPartialLines() {
+	for _, event := range []string{EventStdout, EventStderr} {
+		if buf := s.partial[event]; buf.Len() > 0 {
+			s.writeEvent(event, buf.String())
+			buf.Reset()
+		}
+	}
+}
+
+func (s *Streamer) flush() {
+	// Flushing is not supported by all response writers, e.g. in tests. Data is sent anyway at the end.
+	_ = s.rc.Flush()
+}
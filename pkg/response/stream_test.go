@@ -0,0 +1,115 @@
+package response_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/actions"
+	"github.com/http-everything/httpe/pkg/response"
+	"github.com/http-everything/httpe/pkg/rules"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStream(t *testing.T) {
+	cases := []struct {
+		name        string
+		mode        string
+		ruRes       rules.Respond
+		acRes       actions.ActionResponse
+		err         error
+		wantBody    string
+		wantCType   string
+		wantTrailer string
+	}{
+		{
+			name:        "text",
+			mode:        rules.StreamText,
+			acRes:       actions.ActionResponse{Code: 0},
+			wantBody:    "line 1\nline 2\nline 3",
+			wantCType:   "text/plain; charset=utf-8",
+			wantTrailer: "0",
+		},
+		{
+			name: "text with template",
+			mode: rules.StreamText,
+			ruRes: rules.Respond{
+				OnError: rules.OnError{Body: "\nfailed with {{ .Action.Code }}\n"},
+			},
+			acRes:       actions.ActionResponse{Code: 3},
+			wantBody:    "line 1\nline 2\nline 3\nfailed with 3\n",
+			wantCType:   "text/plain; charset=utf-8",
+			wantTrailer: "3",
+		},
+		{
+			name:        "text with error",
+			mode:        rules.StreamText,
+			err:         errors.New("script killed"),
+			wantBody:    "line 1\nline 2\nline 3error: script killed\n",
+			wantCType:   "text/plain; charset=utf-8",
+			wantTrailer: "-1",
+		},
+		{
+			name:  "sse",
+			mode:  rules.StreamSSE,
+			acRes: actions.ActionResponse{Code: 0},
+			wantBody: "event: stdout\ndata: line 1\n\n" +
+				"event: stderr\ndata: oops\n\n" +
+				"event: stdout\ndata: line 2\n\n" +
+				"event: stdout\ndata: line 3\n\n" +
+				"event: exit\ndata: 0\n\n",
+			wantCType: "text/event-stream",
+		},
+		{
+			name: "sse with template",
+			mode: rules.StreamSSE,
+			ruRes: rules.Respond{
+				OnSuccess: rules.OnSuccess{Body: "done\nexit code {{ .Action.Code }}"},
+			},
+			acRes: actions.ActionResponse{Code: 0},
+			wantBody: "event: stdout\ndata: line 1\n\n" +
+				"event: stderr\ndata: oops\n\n" +
+				"event: stdout\ndata: line 2\n\n" +
+				"event: stdout\ndata: line 3\n\n" +
+				"event: exit\ndata: done\ndata: exit code 0\n\n",
+			wantCType: "text/event-stream",
+		},
+		{
+			name: "sse with error",
+			mode: rules.StreamSSE,
+			err:  errors.New("script killed"),
+			wantBody: "event: stdout\ndata: line 1\n\n" +
+				"event: stderr\ndata: oops\n\n" +
+				"event: stdout\ndata: line 2\n\n" +
+				"event: stdout\ndata: line 3\n\n" +
+				"event: error\ndata: script killed\n\n",
+			wantCType: "text/event-stream",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			resp := response.New(rr, tc.ruRes, nil)
+			s := resp.Stream(tc.mode)
+
+			_, _ = io.WriteString(s.Stdout(), "line 1\nli")
+			_, _ = io.WriteString(s.Stderr(), "oops\n")
+			_, _ = io.WriteString(s.Stdout(), "ne 2\nline 3")
+			s.Finish(tc.acRes, tc.err)
+			// Output and status arriving after the stream has been finished are dropped
+			_, _ = io.WriteString(s.Stdout(), "late\n")
+			s.Finish(actions.ActionResponse{Code: 9}, nil)
+
+			res := rr.Result()
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, tc.wantBody, string(body))
+			assert.Equal(t, tc.wantCType, res.Header.Get("Content-Type"))
+			assert.Equal(t, tc.wantTrailer, res.Trailer.Get(response.ExitCodeTrailer))
+		})
+	}
+}
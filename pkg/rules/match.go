@@ -0,0 +1,170 @@
+package rules
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/http-everything/httpe/pkg/clientip"
+)
+
+// RequestMatcher checks the conditions of a rule beyond path, host and methods
+type RequestMatcher struct {
+	on       *On
+	prefixes []netip.Prefix
+}
+
+// Matcher returns the matcher for the headers, query parameters, content types and source IPs the request
+// must match. Returns nil, if the rule doesn't define any of these conditions.
+func (on *On) Matcher() (*RequestMatcher, error) {
+	if len(on.Headers) == 0 && len(on.Params) == 0 && len(on.ContentTypes) == 0 && len(on.SourceIPs) == 0 {
+		return nil, nil
+	}
+	m := &RequestMatcher{on: on}
+	for _, s := range on.SourceIPs {
+		prefix, err := clientip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		m.prefixes = append(m.prefixes, prefix)
+	}
+	for _, ct := range on.ContentTypes {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return nil, fmt.Errorf("invalid content type '%s': %w", ct, err)
+		}
+	}
+	return m, nil
+}
+
+// Match reports whether the request fulfils all conditions
+func (m *RequestMatcher) Match(r *http.Request) bool {
+	field, _ := m.Mismatch(r)
+	return field == ""
+}
+
+// Mismatch returns the first condition the request doesn't fulfil, or empty strings if it fulfils all. The field,
+// e.g. "header X-GitHub-Event", is safe to tell the client. The reason includes the expected values, so it's meant
+// for the log only.
+func (m *RequestMatcher) Mismatch(r *http.Request) (field string, reason string) {
+	for _, name := range sortedKeys(m.on.Headers) {
+		field = "header " + name
+		if reason = mismatch(field, m.on.Headers[name], r.Header.Values(name)); reason != "" {
+			return field, reason
+		}
+	}
+	query := r.URL.Query()
+	for _, name := range sortedKeys(m.on.Params) {
+		field = "query parameter " + name
+		if reason = mismatch(field, m.on.Params[name], query[name]); reason != "" {
+			return field, reason
+		}
+	}
+	if len(m.on.ContentTypes) > 0 && !m.matchesContentType(r.Header.Get("Content-Type")) {
+		return "content type", fmt.Sprintf("content type must be one of '%s'", strings.Join(m.on.ContentTypes, "', '"))
+	}
+	if len(m.prefixes) > 0 && !m.matchesSourceIP(r) {
+		return "source IP", "source IP not allowed"
+	}
+	return "", ""
+}
+
+// mismatch checks the values of a header or query parameter. An empty expected value only requires presence.
+func mismatch(field string, expected string, values []string) string {
+	if len(values) == 0 {
+		return field + " is missing"
+	}
+	if expected == "" {
+		return ""
+	}
+	for _, v := range values {
+		if v == expected {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s must be '%s'", field, expected)
+}
+
+func (m *RequestMatcher) matchesContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, ct := range m.on.ContentTypes {
+		want, _, _ := mime.ParseMediaType(ct)
+		if want == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(want, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *RequestMatcher) matchesSourceIP(r *http.Request) bool {
+	addr, ok := clientip.FromRequest(r)
+	return ok && clientip.Contains(m.prefixes, addr)
+}
+
+// coversConditions reports whether every request fulfilling the conditions of other fulfils the conditions of on
+func (on *On) coversConditions(other *On) bool {
+	for name, v := range on.Headers {
+		if ov, ok := lookupFold(other.Headers, name); !ok || (v != "" && v != ov) {
+			return false
+		}
+	}
+	for name, v := range on.Params {
+		if ov, ok := other.Params[name]; !ok || (v != "" && v != ov) {
+			return false
+		}
+	}
+	if len(on.ContentTypes) > 0 && !containsAll(on.ContentTypes, other.ContentTypes) {
+		return false
+	}
+	if len(on.SourceIPs) > 0 && !containsAll(on.SourceIPs, other.SourceIPs) {
+		return false
+	}
+	return true
+}
+
+func lookupFold(m map[string]string, key string) (string, bool) {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// containsAll reports whether all values of subset are in set. An empty subset stands for any value, so it's
+// only contained in an unrestricted set.
+func containsAll(set []string, subset []string) bool {
+	if len(subset) == 0 {
+		return false
+	}
+	for _, s := range subset {
+		found := false
+		for _, v := range set {
+			if strings.EqualFold(s, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
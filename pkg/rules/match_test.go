@@ -0,0 +1,129 @@
+package rules_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/rules"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestMatcher(t *testing.T) {
+	on := rules.On{
+		Path:         "/webhook",
+		Headers:      map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": ""},
+		Params:       map[string]string{"source": "github"},
+		ContentTypes: []string{"application/json", "text/*"},
+		SourceIPs:    []string{"192.168.0.0/16", "::1"},
+	}
+	m, err := on.Matcher()
+	require.NoError(t, err)
+
+	cases := []struct {
+		name         string
+		url          string
+		headers      map[string]string
+		remoteAddr   string
+		wantField    string
+		wantMismatch string
+	}{
+		{
+			name: "all conditions met",
+			url:  "/webhook?source=github",
+			headers: map[string]string{
+				"X-Github-Event":      "push",
+				"X-Hub-Signature-256": "sha256=abc",
+				"Content-Type":        "application/json; charset=utf-8",
+			},
+			remoteAddr: "192.168.1.10:51234",
+		},
+		{
+			name: "wildcard content type and IPv6",
+			url:  "/webhook?source=github",
+			headers: map[string]string{
+				"X-Github-Event":      "push",
+				"X-Hub-Signature-256": "",
+				"Content-Type":        "text/plain",
+			},
+			remoteAddr: "[::1]:51234",
+		},
+		{
+			name:         "header missing",
+			url:          "/webhook?source=github",
+			headers:      map[string]string{"X-Github-Event": "push"},
+			remoteAddr:   "192.168.1.10:51234",
+			wantField:    "header X-Hub-Signature-256",
+			wantMismatch: "header X-Hub-Signature-256 is missing",
+		},
+		{
+			name:         "header value differs",
+			url:          "/webhook?source=github",
+			headers:      map[string]string{"X-Github-Event": "pull_request", "X-Hub-Signature-256": "x"},
+			remoteAddr:   "192.168.1.10:51234",
+			wantField:    "header X-GitHub-Event",
+			wantMismatch: "header X-GitHub-Event must be 'push'",
+		},
+		{
+			name:         "param value differs",
+			url:          "/webhook?source=gitlab",
+			headers:      map[string]string{"X-Github-Event": "push", "X-Hub-Signature-256": "x"},
+			remoteAddr:   "192.168.1.10:51234",
+			wantField:    "query parameter source",
+			wantMismatch: "query parameter source must be 'github'",
+		},
+		{
+			name: "content type differs",
+			url:  "/webhook?source=github",
+			headers: map[string]string{
+				"X-Github-Event":      "push",
+				"X-Hub-Signature-256": "x",
+				"Content-Type":        "application/x-www-form-urlencoded",
+			},
+			remoteAddr:   "192.168.1.10:51234",
+			wantField:    "content type",
+			wantMismatch: "content type must be one of 'application/json', 'text/*'",
+		},
+		{
+			name: "source IP not allowed",
+			url:  "/webhook?source=github",
+			headers: map[string]string{
+				"X-Github-Event":      "push",
+				"X-Hub-Signature-256": "x",
+				"Content-Type":        "application/json",
+			},
+			remoteAddr:   "10.0.0.1:51234",
+			wantField:    "source IP",
+			wantMismatch: "source IP not allowed",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tc.url, nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			req.RemoteAddr = tc.remoteAddr
+			field, reason := m.Mismatch(req)
+			assert.Equal(t, tc.wantField, field)
+			assert.Equal(t, tc.wantMismatch, reason)
+			assert.Equal(t, tc.wantMismatch == "", m.Match(req))
+		})
+	}
+}
+
+func TestRequestMatcherInvalid(t *testing.T) {
+	m, err := (&rules.On{Path: "/"}).Matcher()
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	_, err = (&rules.On{Path: "/", SourceIPs: []string{"10.0.0.0/33"}}).Matcher()
+	assert.ErrorContains(t, err, "invalid network '10.0.0.0/33'")
+
+	_, err = (&rules.On{Path: "/", SourceIPs: []string{"localhost"}}).Matcher()
+	assert.ErrorContains(t, err, "invalid IP address 'localhost'")
+
+	_, err = (&rules.On{Path: "/", ContentTypes: []string{"application/json;;"}}).Matcher()
+	assert.ErrorContains(t, err, "invalid content type 'application/json;;'")
+}
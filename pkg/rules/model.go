@@ -10,6 +10,21 @@ const (
 	RedirectTemporary = "redirect.temporary"
 	ServeDirectory    = "serve.directory"
 	RenderButtons     = "render.buttons"
+	StreamText        = "text"
+	StreamSSE         = "sse"
+	FieldString       = "string"
+	FieldInt          = "int"
+	FieldBool         = "bool"
+	FieldEnum         = "enum"
+	FieldRegex        = "regex"
+	FieldEmail        = "email"
+	FieldIP           = "ip"
+	AllowUser         = "user"
+	AllowGroup        = "group"
+	HMACGitHub        = "github"
+	HMACGitLab        = "gitlab"
+	HMACStripe        = "stripe"
+	HMACGeneric       = "generic"
 )
 
 var ValidActions = []string{
@@ -46,8 +61,13 @@ type Rule struct {
 }
 
 type On struct {
-	Path    string   `yaml:"path,omitempty" json:"path,omitempty"`
-	Methods []string `yaml:"methods,omitempty" json:"methods,omitempty"`
+	Path         string            `yaml:"path,omitempty" json:"path,omitempty"`
+	Host         string            `yaml:"host,omitempty" json:"host,omitempty"`
+	Methods      []string          `yaml:"methods,omitempty" json:"methods,omitempty"`
+	Headers      map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	Params       map[string]string `yaml:"params,omitempty" json:"params,omitempty"`
+	ContentTypes []string          `yaml:"content_types,omitempty" json:"content_types,omitempty"`
+	SourceIPs    []string          `yaml:"source_ips,omitempty" json:"source_ips,omitempty"`
 }
 
 type Button struct {
@@ -66,18 +86,135 @@ type Email struct {
 }
 
 type Args struct {
-	Interpreter string `yaml:"interpreter" json:"interpreter"`
-	Timeout     int    `yaml:"timeout" json:"timeout"`
-	Cwd         string `yaml:"cwd" json:"cwd"`
-	Template    string `yaml:"template" json:"template"`
-	FileUploads bool   `yaml:"file_uploads" json:"file_uploads"`
-	Templating  bool   `yaml:"templating" json:"templating"`
+	Interpreter       string            `yaml:"interpreter" json:"interpreter"`
+	Timeout           int               `yaml:"timeout" json:"timeout"`
+	Cwd               string            `yaml:"cwd" json:"cwd"`
+	Template          string            `yaml:"template" json:"template"`
+	FileUploads       bool              `yaml:"file_uploads" json:"file_uploads"`
+	Templating        bool              `yaml:"templating" json:"templating"`
+	Async             bool              `yaml:"async" json:"async"`
+	Stream            string            `yaml:"stream" json:"stream"`
+	RequestEnv        bool              `yaml:"request_env" json:"request_env"`
+	RequestStdin      bool              `yaml:"request_stdin" json:"request_stdin"`
+	DisableTemplating bool              `yaml:"disable_templating" json:"disable_templating"`
+	AutoQuote         bool              `yaml:"auto_quote" json:"auto_quote"`
+	MaxConcurrency    int               `yaml:"max_concurrency" json:"max_concurrency"`
+	Queue             string            `yaml:"queue" json:"queue"`
+	QueueTimeout      int               `yaml:"queue_timeout" json:"queue_timeout"`
+	RunAs             string            `yaml:"run_as,omitempty" json:"run_as,omitempty"`
+	Limits            *Limits           `yaml:"limits,omitempty" json:"limits,omitempty"`
+	Sandbox           *Sandbox          `yaml:"sandbox,omitempty" json:"sandbox,omitempty"`
+	Env               map[string]string `yaml:"env,omitempty" json:"env,omitempty"`
+	EnvPassthrough    []string          `yaml:"env_passthrough,omitempty" json:"env_passthrough,omitempty"`
+	CleanEnv          bool              `yaml:"clean_env,omitempty" json:"clean_env,omitempty"`
+}
+
+// Sandbox isolates a script in Linux namespaces. The script sees a read-only root with the system directories,
+// a private /tmp and the paths of Binds given as 'path', 'source:target' or 'source:target:rw'.
+type Sandbox struct {
+	Binds     []string `yaml:"binds,omitempty" json:"binds,omitempty"`
+	NoNetwork bool     `yaml:"no_network,omitempty" json:"no_network,omitempty"`
+}
+
+// Bind is a path of the host mounted into the sandbox
+type Bind struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	Writable bool   `json:"writable"`
+}
+
+// Limits restricts the resources of a script and the processes it starts. CPU is given in seconds of CPU time,
+// Memory as size of the address space like 512MB. Cgroup is the directory of an existing cgroup v2 the script is
+// placed in.
+type Limits struct {
+	CPU       int    `yaml:"cpu,omitempty" json:"cpu,omitempty"`
+	Memory    string `yaml:"memory,omitempty" json:"memory,omitempty"`
+	OpenFiles int    `yaml:"open_files,omitempty" json:"open_files,omitempty"`
+	Processes int    `yaml:"processes,omitempty" json:"processes,omitempty"`
+	Cgroup    string `yaml:"cgroup,omitempty" json:"cgroup,omitempty"`
 }
 
 type With struct {
-	AuthBasic      []User `yaml:"auth_basic,omitempty" json:"auth_basic,omitempty"`
-	AuthHashing    string `yaml:"auth_hashing,omitempty" json:"auth_hashing,omitempty"`
-	MaxRequestBody string `yaml:"max_request_body,omitempty" json:"max_request_body,omitempty"`
+	AuthBasic      []User      `yaml:"auth_basic,omitempty" json:"auth_basic,omitempty"`
+	AuthHashing    string      `yaml:"auth_hashing,omitempty" json:"auth_hashing,omitempty"`
+	AuthBearer     *AuthTokens `yaml:"auth_bearer,omitempty" json:"auth_bearer,omitempty"`
+	AuthAPIKey     *AuthAPIKey `yaml:"auth_apikey,omitempty" json:"auth_apikey,omitempty"`
+	Allow          []string    `yaml:"allow,omitempty" json:"allow,omitempty"`
+	OIDC           *OIDC       `yaml:"oidc,omitempty" json:"oidc,omitempty"`
+	AuthMTLS       *AuthMTLS   `yaml:"auth_mtls,omitempty" json:"auth_mtls,omitempty"`
+	AllowCIDRs     []string    `yaml:"allow_cidrs,omitempty" json:"allow_cidrs,omitempty"`
+	DenyCIDRs      []string    `yaml:"deny_cidrs,omitempty" json:"deny_cidrs,omitempty"`
+	RateLimit      *RateLimit  `yaml:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+	MaxRequestBody string      `yaml:"max_request_body,omitempty" json:"max_request_body,omitempty"`
+	Validate       *Validate   `yaml:"validate,omitempty" json:"validate,omitempty"`
+	HMAC           *HMAC       `yaml:"hmac,omitempty" json:"hmac,omitempty"`
+	AccessLog      *AccessLog  `yaml:"access_log,omitempty" json:"access_log,omitempty"`
+}
+
+// AccessLog controls how requests to the rule appear in the access log. Disable omits them, for example for health
+// checks. Redact replaces the values of the named query parameters and URL placeholders, for example of tokens.
+type AccessLog struct {
+	Disable bool     `yaml:"disable,omitempty" json:"disable,omitempty"`
+	Redact  []string `yaml:"redact,omitempty" json:"redact,omitempty"`
+}
+
+type OIDC struct {
+	RequireClaims map[string]string `yaml:"require_claims,omitempty" json:"require_claims,omitempty"`
+}
+
+// AuthMTLS requires a TLS client certificate verified against the client CAs of the server. If Allow is given,
+// the common name or a subject alternative name of the certificate must be in the list.
+type AuthMTLS struct {
+	Allow []string `yaml:"allow,omitempty" json:"allow,omitempty"`
+}
+
+// RateLimit limits the requests per client. Rate is given as count per unit, e.g. 10/min. Requests are counted by
+// Key, which is either "ip", "user" or a template.
+type RateLimit struct {
+	Rate  string `yaml:"rate" json:"rate"`
+	Burst int    `yaml:"burst,omitempty" json:"burst,omitempty"`
+	Key   string `yaml:"key,omitempty" json:"key,omitempty"`
+}
+
+type AuthTokens struct {
+	TokensFile string `yaml:"tokens_file,omitempty" json:"tokens_file,omitempty"`
+	TokensEnv  string `yaml:"tokens_env,omitempty" json:"tokens_env,omitempty"`
+}
+
+type AuthAPIKey struct {
+	Header     string `yaml:"header,omitempty" json:"header,omitempty"`
+	Param      string `yaml:"param,omitempty" json:"param,omitempty"`
+	TokensFile string `yaml:"tokens_file,omitempty" json:"tokens_file,omitempty"`
+	TokensEnv  string `yaml:"tokens_env,omitempty" json:"tokens_env,omitempty"`
+}
+
+type HMAC struct {
+	Type            string `yaml:"type,omitempty" json:"type,omitempty"`
+	Secret          string `yaml:"secret,omitempty" json:"secret,omitempty"`
+	SecretFile      string `yaml:"secret_file,omitempty" json:"secret_file,omitempty"`
+	SecretEnv       string `yaml:"secret_env,omitempty" json:"secret_env,omitempty"`
+	Header          string `yaml:"header,omitempty" json:"header,omitempty"`
+	Algorithm       string `yaml:"algorithm,omitempty" json:"algorithm,omitempty"`
+	Encoding        string `yaml:"encoding,omitempty" json:"encoding,omitempty"`
+	Prefix          string `yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	TimestampHeader string `yaml:"timestamp_header,omitempty" json:"timestamp_header,omitempty"`
+	Tolerance       string `yaml:"tolerance,omitempty" json:"tolerance,omitempty"`
+}
+
+type Validate struct {
+	Params         map[string]Field       `yaml:"params,omitempty" json:"params,omitempty"`
+	Form           map[string]Field       `yaml:"form,omitempty" json:"form,omitempty"`
+	JSONSchema     map[string]interface{} `yaml:"json_schema,omitempty" json:"json_schema,omitempty"`
+	JSONSchemaFile string                 `yaml:"json_schema_file,omitempty" json:"json_schema_file,omitempty"`
+}
+
+type Field struct {
+	Required  bool     `yaml:"required,omitempty" json:"required,omitempty"`
+	Type      string   `yaml:"type,omitempty" json:"type,omitempty"`
+	Values    []string `yaml:"values,omitempty" json:"values,omitempty"`
+	Pattern   string   `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+	MinLength int      `yaml:"min_length,omitempty" json:"min_length,omitempty"`
+	MaxLength int      `yaml:"max_length,omitempty" json:"max_length,omitempty"`
 }
 
 type PostAction struct {
@@ -0,0 +1,330 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/http-everything/httpe/pkg/share/firstof"
+)
+
+const (
+	// KindPath is the kind of patterns matching URL paths, see ParsePattern
+	KindPath = "path"
+	// KindHost is the kind of patterns matching host names, see ParsePattern
+	KindHost = "host"
+
+	tailSuffix = "..."
+)
+
+// PathTypes are the named types placeholders can be constrained to, e.g. {version:semver}
+var PathTypes = map[string]string{
+	"int":    `[0-9]+`,
+	"alpha":  `[A-Za-z]+`,
+	"alnum":  `[A-Za-z0-9]+`,
+	"slug":   `[a-z0-9]+(?:-[a-z0-9]+)*`,
+	"uuid":   `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+	"semver": `v?(?:0|[1-9][0-9]*)\.(?:0|[1-9][0-9]*)\.(?:0|[1-9][0-9]*)(?:-[0-9A-Za-z.-]+)?(?:\+[0-9A-Za-z.-]+)?`,
+}
+
+var validPlaceholderName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Pattern is a parsed path or host pattern. Patterns consist of literal text and placeholders.
+// Placeholders are written in curly braces and accept
+//   - any value not containing a separator, e.g. {name}
+//   - values of a named type, e.g. {id:int}, see PathTypes
+//   - values matching a regular expression, e.g. {env:prod|staging}
+//   - the rest of the path including slashes, e.g. {file...}, only at the end of path patterns
+type Pattern struct {
+	raw    string
+	kind   string
+	tokens []token
+	// strict and loose are compiled once by ParsePattern, see regexp
+	strict *regexp.Regexp
+	loose  *regexp.Regexp
+}
+
+type token struct {
+	literal string
+	// name is empty for literal tokens
+	name    string
+	typ     string
+	pattern string
+	tail    bool
+	// re matches the whole value of the placeholder
+	re *regexp.Regexp
+}
+
+// ParsePattern parses a path pattern like /deploy/{env:prod|staging}/{version:semver} or a host pattern
+// like {tenant}.example.com
+func ParsePattern(raw string, kind string) (p Pattern, err error) {
+	p = Pattern{raw: raw, kind: kind}
+	rest := raw
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			if strings.IndexByte(rest, '}') >= 0 {
+				return Pattern{}, fmt.Errorf("unbalanced braces in '%s'", raw)
+			}
+			p.tokens = append(p.tokens, token{literal: rest})
+			break
+		}
+		if start > 0 {
+			if strings.IndexByte(rest[:start], '}') >= 0 {
+				return Pattern{}, fmt.Errorf("unbalanced braces in '%s'", raw)
+			}
+			p.tokens = append(p.tokens, token{literal: rest[:start]})
+		}
+		end := matchingBrace(rest, start)
+		if end < 0 {
+			return Pattern{}, fmt.Errorf("unbalanced braces in '%s'", raw)
+		}
+		t, err := p.parsePlaceholder(rest[start+1 : end])
+		if err != nil {
+			return Pattern{}, fmt.Errorf("invalid placeholder in '%s': %w", raw, err)
+		}
+		p.tokens = append(p.tokens, t)
+		rest = rest[end+1:]
+	}
+	for i, t := range p.tokens {
+		if t.tail && i != len(p.tokens)-1 {
+			return Pattern{}, fmt.Errorf("placeholder {%s%s} must be at the end of '%s'", t.name, tailSuffix, raw)
+		}
+	}
+	for i, t := range p.tokens {
+		if t.name != "" {
+			p.tokens[i].re = regexp.MustCompile(`^(?:` + p.placeholderPattern(t) + `)$`)
+		}
+	}
+	p.strict = p.regexp(false)
+	p.loose = p.regexp(true)
+	return p, nil
+}
+
+func matchingBrace(s string, start int) int {
+	level := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			level++
+		case '}':
+			level--
+			if level == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func (p Pattern) parsePlaceholder(def string) (t token, err error) {
+	name, pattern, hasPattern := strings.Cut(def, ":")
+	if !hasPattern && strings.HasSuffix(name, tailSuffix) {
+		if p.kind != KindPath {
+			return token{}, fmt.Errorf("{%s} is only supported in paths", def)
+		}
+		name = strings.TrimSuffix(name, tailSuffix)
+		t.tail = true
+		pattern = ".*"
+	}
+	if !validPlaceholderName.MatchString(name) {
+		return token{}, fmt.Errorf("invalid name '%s'", name)
+	}
+	t.name = name
+	if hasPattern {
+		if pattern == "" {
+			return token{}, fmt.Errorf("empty pattern of {%s}", name)
+		}
+		if typed, ok := PathTypes[pattern]; ok {
+			t.typ = pattern
+			pattern = typed
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return token{}, fmt.Errorf("{%s}: %w", name, err)
+		}
+		if re.NumSubexp() > 0 {
+			return token{}, fmt.Errorf("{%s}: capturing groups are not supported, use (?:...) instead", name)
+		}
+	}
+	t.pattern = pattern
+	return t, nil
+}
+
+// Mux returns the pattern in the syntax of gorilla/mux
+func (p Pattern) Mux() string {
+	var sb strings.Builder
+	for _, t := range p.tokens {
+		switch {
+		case t.name == "":
+			sb.WriteString(t.literal)
+		case t.pattern == "":
+			sb.WriteString("{" + t.name + "}")
+		default:
+			sb.WriteString("{" + t.name + ":" + t.pattern + "}")
+		}
+	}
+	return sb.String()
+}
+
+// Match reports whether the value, e.g. the path of a request, matches the pattern
+func (p Pattern) Match(value string) bool {
+	if p.strict == nil {
+		// The zero pattern, e.g. the host pattern of a rule applying to all hosts
+		return value == ""
+	}
+	return p.strict.MatchString(value)
+}
+
+// Mismatch explains why a value doesn't match the pattern although all literal parts of the pattern match,
+// e.g. "placeholder {env} doesn't accept 'dev', expected prod|staging". Returns an empty string, if the value
+// matches, or if it doesn't resemble the pattern at all.
+func (p Pattern) Mismatch(value string) string {
+	if p.Match(value) {
+		return ""
+	}
+	if p.loose == nil {
+		return ""
+	}
+	values := p.loose.FindStringSubmatch(value)
+	if values == nil {
+		return ""
+	}
+	i := 1
+	for _, t := range p.tokens {
+		if t.name == "" {
+			continue
+		}
+		v := values[i]
+		i++
+		if t.re.MatchString(v) {
+			continue
+		}
+		if v == "" {
+			return fmt.Sprintf("placeholder {%s} is empty", t.name)
+		}
+		return fmt.Sprintf("placeholder {%s} doesn't accept '%s', expected %s", t.name, v, firstof.String(t.typ, t.pattern))
+	}
+	return ""
+}
+
+// regexp compiles the regular expression matching the pattern. A loose regular expression accepts any value,
+// including empty values, for all placeholders.
+func (p Pattern) regexp(loose bool) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, t := range p.tokens {
+		switch {
+		case t.name == "":
+			sb.WriteString(regexp.QuoteMeta(t.literal))
+		case loose && t.tail:
+			sb.WriteString("(.*)")
+		case loose:
+			sb.WriteString("([^" + regexp.QuoteMeta(p.separator()) + "]*)")
+		default:
+			sb.WriteString("(" + p.placeholderPattern(t) + ")")
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+func (p Pattern) placeholderPattern(t token) string {
+	if t.pattern != "" {
+		return t.pattern
+	}
+	return "[^" + regexp.QuoteMeta(p.separator()) + "]+"
+}
+
+func (p Pattern) separator() string {
+	if p.kind == KindHost {
+		return "."
+	}
+	return "/"
+}
+
+// Covers reports whether all values matched by q are matched by p as well. The check compares the pattern
+// segment by segment, it is exact for literals, types and placeholders without pattern. For other
+// regular expressions, false is returned unless both are identical. So Covers might miss a coverage but
+// never reports a false one.
+func (p Pattern) Covers(q Pattern) bool {
+	ps, qs := p.segments(), q.segments()
+	for i, seg := range ps {
+		if seg.isTail() {
+			return len(qs) >= len(ps)
+		}
+		if i >= len(qs) || !seg.covers(qs[i]) {
+			return false
+		}
+	}
+	return len(ps) == len(qs)
+}
+
+type segment []token
+
+// segments splits the pattern at the separator
+func (p Pattern) segments() (segs []segment) {
+	sep := p.separator()
+	current := segment{}
+	for _, t := range p.tokens {
+		if t.name != "" {
+			current = append(current, t)
+			continue
+		}
+		parts := strings.Split(t.literal, sep)
+		for i, part := range parts {
+			if i > 0 {
+				segs = append(segs, current)
+				current = segment{}
+			}
+			if part != "" {
+				current = append(current, token{literal: part})
+			}
+		}
+	}
+	return append(segs, current)
+}
+
+func (s segment) isTail() bool {
+	return len(s) == 1 && s[0].tail
+}
+
+func (s segment) covers(o segment) bool {
+	if s.equals(o) {
+		return true
+	}
+	if len(s) != 1 || s[0].name == "" || len(o) == 0 {
+		return false
+	}
+	if s[0].pattern == "" {
+		// A placeholder without pattern accepts any non-empty segment
+		return !o.isTail()
+	}
+	if len(o) == 1 && o[0].name == "" {
+		return s[0].re.MatchString(o[0].literal)
+	}
+	return false
+}
+
+func (s segment) equals(o segment) bool {
+	if len(s) != len(o) {
+		return false
+	}
+	for i := range s {
+		if s[i].name == "" || o[i].name == "" {
+			if s[i].name != o[i].name || s[i].literal != o[i].literal {
+				return false
+			}
+			continue
+		}
+		// Placeholders with different names accept the same values
+		if s[i].pattern != o[i].pattern || s[i].tail != o[i].tail {
+			return false
+		}
+	}
+	return true
+}
+
+func (p Pattern) String() string {
+	return p.raw
+}
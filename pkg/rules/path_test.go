@@ -0,0 +1,122 @@
+package rules_test
+
+import (
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/rules"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		kind    string
+		wantMux string
+		wantErr string
+	}{
+		{pattern: "/static", kind: rules.KindPath, wantMux: "/static"},
+		{pattern: "/say/{name}/{city}", kind: rules.KindPath, wantMux: "/say/{name}/{city}"},
+		{pattern: "/deploy/{env:prod|staging}", kind: rules.KindPath, wantMux: "/deploy/{env:prod|staging}"},
+		{pattern: "/items/{id:int}", kind: rules.KindPath, wantMux: "/items/{id:[0-9]+}"},
+		{pattern: "/codes/{code:[A-Z]{3}}", kind: rules.KindPath, wantMux: "/codes/{code:[A-Z]{3}}"},
+		{pattern: "/files/{file...}", kind: rules.KindPath, wantMux: "/files/{file:.*}"},
+		{pattern: "{tenant}.example.com", kind: rules.KindHost, wantMux: "{tenant}.example.com"},
+		{pattern: "/files/{file...}/edit", kind: rules.KindPath, wantErr: "placeholder {file...} must be at the end"},
+		{pattern: "{tenant...}.example.com", kind: rules.KindHost, wantErr: "{tenant...} is only supported in paths"},
+		{pattern: "/say/{name", kind: rules.KindPath, wantErr: "unbalanced braces in '/say/{name'"},
+		{pattern: "/say/name}", kind: rules.KindPath, wantErr: "unbalanced braces in '/say/name}'"},
+		{pattern: "/say/{na me}", kind: rules.KindPath, wantErr: "invalid name 'na me'"},
+		{pattern: "/say/{name:(a|b)}", kind: rules.KindPath, wantErr: "capturing groups are not supported"},
+		{pattern: "/say/{name:[a-}", kind: rules.KindPath, wantErr: "missing closing ]"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			p, err := rules.ParsePattern(tc.pattern, tc.kind)
+			if tc.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantMux, p.Mux())
+		})
+	}
+}
+
+func TestPatternMatch(t *testing.T) {
+	cases := []struct {
+		pattern      string
+		value        string
+		wantMatch    bool
+		wantMismatch string
+	}{
+		{pattern: "/deploy/{env:prod|staging}/{version:semver}", value: "/deploy/prod/v1.2.3-rc.1", wantMatch: true},
+		{
+			pattern:      "/deploy/{env:prod|staging}/{version:semver}",
+			value:        "/deploy/production/1.0.0",
+			wantMismatch: "placeholder {env} doesn't accept 'production', expected prod|staging",
+		},
+		{
+			pattern:      "/deploy/{env:prod|staging}/{version:semver}",
+			value:        "/deploy/prod/1.0",
+			wantMismatch: "placeholder {version} doesn't accept '1.0', expected semver",
+		},
+		{pattern: "/deploy/{env:prod|staging}/{version:semver}", value: "/deploy/prod"},
+		{pattern: "/say/{name}", value: "/say/", wantMismatch: "placeholder {name} is empty"},
+		{pattern: "/say/{name}", value: "/say/john/doe"},
+		{pattern: "/files/{file...}", value: "/files/", wantMatch: true},
+		{pattern: "/files/{file...}", value: "/files/a/b", wantMatch: true},
+		{pattern: "/files/{file...}", value: "/files"},
+		{pattern: "/items/{id:uuid}", value: "/items/0b3c6a5e-1f5e-4c1a-9d2e-4b7f1a2c3d4e", wantMatch: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.pattern+" "+tc.value, func(t *testing.T) {
+			p, err := rules.ParsePattern(tc.pattern, rules.KindPath)
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantMatch, p.Match(tc.value))
+			assert.Equal(t, tc.wantMismatch, p.Mismatch(tc.value))
+		})
+	}
+}
+
+func TestPatternCovers(t *testing.T) {
+	cases := []struct {
+		p, q string
+		want bool
+	}{
+		{p: "/a", q: "/a", want: true},
+		{p: "/a", q: "/b", want: false},
+		{p: "/a/{x}", q: "/a/{y}", want: true},
+		{p: "/a/{x}", q: "/a/b", want: true},
+		{p: "/a/{x}", q: "/a/{y:int}", want: true},
+		{p: "/a/{x:int}", q: "/a/{y}", want: false},
+		{p: "/a/{x:int}", q: "/a/42", want: true},
+		{p: "/a/{x:int}", q: "/a/b", want: false},
+		{p: "/a/{x:prod|staging}", q: "/a/{y:staging|prod}", want: false},
+		{p: "/a/{x}", q: "/a/b/c", want: false},
+		{p: "/a/{x}", q: "/a/", want: false},
+		{p: "/a/{x...}", q: "/a/b/{c}/d", want: true},
+		{p: "/a/{x...}", q: "/a", want: false},
+		{p: "/a/{x}", q: "/a/{y...}", want: false},
+		{p: "/{x}/b", q: "/a/b", want: true},
+		{p: "/file-{x}", q: "/file-{y}", want: true},
+		{p: "/{x}", q: "/file-{y}", want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.p+" "+tc.q, func(t *testing.T) {
+			p, err := rules.ParsePattern(tc.p, rules.KindPath)
+			require.NoError(t, err)
+			q, err := rules.ParsePattern(tc.q, rules.KindPath)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, p.Covers(q))
+		})
+	}
+}
+
+func TestMatchesURI(t *testing.T) {
+	rule := rules.Rule{On: &rules.On{Path: "/items/{id:int}"}}
+	assert.True(t, rule.MatchesURI("/items/42?verbose=1"))
+	assert.False(t, rule.MatchesURI("/items/abc"))
+}
@@ -6,24 +6,41 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/http-everything/httpe/pkg/clientip"
 	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/ratelimit"
 
 	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/share/password"
+	"github.com/http-everything/httpe/pkg/share/secret"
+	"github.com/http-everything/httpe/pkg/share/timeunit"
+	"github.com/http-everything/httpe/pkg/share/tokens"
 
+	humanise "github.com/dustin/go-humanize" //nolint:misspell
 	"gopkg.in/yaml.v3"
 
 	"github.com/xeipuuv/gojsonschema"
 )
 
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 type Rules struct {
-	Rules  *[]Rule `yaml:"rules" json:"rules"`
+	Rules  *[]Rule             `yaml:"rules" json:"rules"`
+	Users  []User              `yaml:"users,omitempty" json:"users,omitempty"`
+	Groups map[string][]string `yaml:"groups,omitempty" json:"groups,omitempty"`
 	logger *logger.Logger
 }
 
 type Cfg struct {
-	Rules []Rule `yaml:"rules" json:"rules"`
+	Rules  []Rule              `yaml:"rules" json:"rules"`
+	Users  []User              `yaml:"users" json:"users"`
+	Groups map[string][]string `yaml:"groups" json:"groups"`
 }
 
 //go:embed schema.json
@@ -41,8 +58,19 @@ func Read(yamlFile string, logger *logger.Logger) (rules *Rules, err error) {
 	if err != nil {
 		return &Rules{}, fmt.Errorf("error parsing yaml file '%s': %w", yamlFile, err)
 	}
+	// Relative JSON schema files are relative to the rules file, not to the working directory of httpe
+	for _, rule := range cfg.Rules {
+		if rule.With != nil && rule.With.Validate != nil {
+			v := rule.With.Validate
+			if v.JSONSchemaFile != "" && !filepath.IsAbs(v.JSONSchemaFile) {
+				v.JSONSchemaFile = filepath.Join(filepath.Dir(yamlFile), v.JSONSchemaFile)
+			}
+		}
+	}
 	return &Rules{
 		Rules:  &cfg.Rules,
+		Users:  cfg.Users,
+		Groups: cfg.Groups,
 		logger: logger,
 	}, nil
 }
@@ -81,7 +109,7 @@ func (r *Rules) Validate(smtpConfig *config.SMTPConfig) (err error) {
 	// Validate the rule action. Doing it here and before the schema validation creates a more user-friendly error
 	// message. While it is possible to do the below validation with the 'oneOf' statement of JSON schema validation,
 	// the error message is confusing because only the first element of the oneOf list is named as required.
-	var hasErrors = false
+	var hasErrors = r.hasUserErrors()
 	for i, rule := range *r.Rules {
 		if rule.Action() == "" {
 			r.logger.PrintAndLogErrorf("rule %d '%s' is missing a valid action. Use one of '%s'.",
@@ -98,6 +126,88 @@ func (r *Rules) Validate(smtpConfig *config.SMTPConfig) (err error) {
 				hasErrors = true
 			}
 		}
+		if rule.Args.Async && rule.Args.Stream != "" {
+			r.logger.PrintAndLogErrorf("rule %d '%s': args async and stream are mutually exclusive", i, rule.Name)
+			hasErrors = true
+		}
+		if err := rule.Args.checkQueue(rule.Action()); err != nil {
+			r.logger.PrintAndLogErrorf("rule %d '%s': invalid args: %s", i, rule.Name, err)
+			hasErrors = true
+		}
+		if err := rule.Args.checkProcess(rule.Action()); err != nil {
+			r.logger.PrintAndLogErrorf("rule %d '%s': invalid args: %s", i, rule.Name, err)
+			hasErrors = true
+		}
+		if rule.Args.AutoQuote && rule.Args.DisableTemplating {
+			r.logger.PrintAndLogErrorf("rule %d '%s': args auto_quote and disable_templating are mutually exclusive", i, rule.Name)
+			hasErrors = true
+		}
+		if rule.On != nil && r.hasRouteErrors(i) {
+			hasErrors = true
+		}
+
+		if rule.With != nil && rule.With.Validate != nil {
+			for _, problem := range rule.With.Validate.problems() {
+				r.logger.PrintAndLogErrorf("rule %d '%s': invalid validate: %s", i, rule.Name, problem)
+				hasErrors = true
+			}
+		}
+		if rule.With != nil {
+			for _, user := range rule.With.AuthBasic {
+				if err := password.Check(user.Password); err != nil {
+					r.logger.PrintAndLogErrorf("rule %d '%s': invalid auth_basic: password of user '%s': %s",
+						i, rule.Name, user.Username, err)
+					hasErrors = true
+				}
+			}
+		}
+		if rule.With != nil {
+			for _, entry := range rule.With.Allow {
+				if _, _, err := ParseAllow(entry); err != nil {
+					r.logger.PrintAndLogErrorf("rule %d '%s': invalid allow: %s", i, rule.Name, err)
+					hasErrors = true
+				}
+			}
+			if _, err := clientip.NewFilter(rule.With.AllowCIDRs, rule.With.DenyCIDRs); err != nil {
+				r.logger.PrintAndLogErrorf("rule %d '%s': invalid allow_cidrs or deny_cidrs: %s", i, rule.Name, err)
+				hasErrors = true
+			}
+			if rl := rule.With.RateLimit; rl != nil {
+				if _, err := ratelimit.ParseLimit(rl.Rate, rl.Burst); err != nil {
+					r.logger.PrintAndLogErrorf("rule %d '%s': invalid rate_limit: %s", i, rule.Name, err)
+					hasErrors = true
+				}
+				if rl.Key != "" && rl.Key != ratelimit.KeyIP && rl.Key != ratelimit.KeyUser && !strings.Contains(rl.Key, "{{") {
+					r.logger.PrintAndLogErrorf("rule %d '%s': invalid rate_limit: key must be ip, user or a template",
+						i, rule.Name)
+					hasErrors = true
+				}
+			}
+		}
+		if rule.With != nil && rule.With.OIDC != nil && (len(rule.With.AuthBasic) > 0 || len(rule.With.Allow) > 0 ||
+			rule.With.AuthBearer != nil || rule.With.AuthAPIKey != nil) {
+			r.logger.PrintAndLogErrorf("rule %d '%s': oidc can't be combined with auth_basic, auth_bearer, auth_apikey or allow",
+				i, rule.Name)
+			hasErrors = true
+		}
+		if rule.With != nil && rule.With.AuthBearer != nil {
+			if _, err := tokens.Load(rule.With.AuthBearer.TokensFile, rule.With.AuthBearer.TokensEnv); err != nil {
+				r.logger.PrintAndLogErrorf("rule %d '%s': invalid auth_bearer: %s", i, rule.Name, err)
+				hasErrors = true
+			}
+		}
+		if rule.With != nil && rule.With.AuthAPIKey != nil {
+			if err := rule.With.AuthAPIKey.check(); err != nil {
+				r.logger.PrintAndLogErrorf("rule %d '%s': invalid auth_apikey: %s", i, rule.Name, err)
+				hasErrors = true
+			}
+		}
+		if rule.With != nil && rule.With.HMAC != nil {
+			if err := rule.With.HMAC.check(); err != nil {
+				r.logger.PrintAndLogErrorf("rule %d '%s': invalid hmac: %s", i, rule.Name, err)
+				hasErrors = true
+			}
+		}
 		if _, err := rule.PostAct(); err != nil {
 			r.logger.PrintAndLogErrorf("rule %d '%s' invalid postaction. Use one of '%s'.",
 				i,
@@ -122,13 +232,94 @@ func (r *Rules) Validate(smtpConfig *config.SMTPConfig) (err error) {
 	} else {
 		r.logger.PrintAndLogErrorf("schema validation against %s failed", SchemaURL)
 		for _, desc := range result.Errors() {
-			r.logger.PrintAndLogErrorf("%s\n", desc)
+			r.logger.PrintAndLogErrorf("%s%s\n", r.ruleOfField(desc.Field()), desc)
 		}
 		return fmt.Errorf("invalid rules: schema validation failed")
 	}
 	return nil
 }
 
+// hasUserErrors logs shared users without name, defined twice or with a malformed password hash. Group members are
+// not checked, because they may also be defined in the users file of the server configuration.
+func (r *Rules) hasUserErrors() (hasErrors bool) {
+	names := make(map[string]bool, len(r.Users))
+	for _, user := range r.Users {
+		if user.Username == "" {
+			r.logger.PrintAndLogErrorf("users: username missing")
+			hasErrors = true
+			continue
+		}
+		if names[user.Username] {
+			r.logger.PrintAndLogErrorf("users: user '%s' defined more than once", user.Username)
+			hasErrors = true
+		}
+		names[user.Username] = true
+		if err := password.Check(user.Password); err != nil {
+			r.logger.PrintAndLogErrorf("users: password of user '%s': %s", user.Username, err)
+			hasErrors = true
+		}
+	}
+	return hasErrors
+}
+
+// ParseAllow splits an entry of with.allow like 'group:ops' or 'user:alice' into kind and name
+func ParseAllow(entry string) (kind string, name string, err error) {
+	kind, name, ok := strings.Cut(entry, ":")
+	if !ok || (kind != AllowUser && kind != AllowGroup) || name == "" {
+		return "", "", fmt.Errorf("'%s' must be either user:<name> or group:<name>", entry)
+	}
+	return kind, name, nil
+}
+
+// hasRouteErrors logs invalid path and host patterns of the i-th rule and reports, if the rule is never reached
+// because a rule defined before matches the same requests
+func (r *Rules) hasRouteErrors(i int) (hasErrors bool) {
+	rule := (*r.Rules)[i]
+	if _, err := rule.PathPattern(); err != nil {
+		r.logger.PrintAndLogErrorf("rule %d '%s': invalid path: %s", i, rule.Name, err)
+		hasErrors = true
+	}
+	if _, err := rule.HostPattern(); err != nil {
+		r.logger.PrintAndLogErrorf("rule %d '%s': invalid host: %s", i, rule.Name, err)
+		hasErrors = true
+	}
+	if _, err := rule.On.Matcher(); err != nil {
+		r.logger.PrintAndLogErrorf("rule %d '%s': %s", i, rule.Name, err)
+		hasErrors = true
+	}
+	if hasErrors {
+		return true
+	}
+	for j, prev := range (*r.Rules)[:i] {
+		if prev.On == nil || !prev.covers(&rule) {
+			continue
+		}
+		if rule.covers(&prev) {
+			r.logger.PrintAndLogErrorf("rule %d '%s' conflicts with rule %d '%s', both match the same requests",
+				i, rule.Name, j, prev.Name)
+		} else {
+			r.logger.PrintAndLogErrorf("rule %d '%s' is shadowed by rule %d '%s', which matches all its requests",
+				i, rule.Name, j, prev.Name)
+		}
+		return true
+	}
+	return false
+}
+
+// ruleOfField returns a prefix naming the rule a schema validation error refers to, e.g. "rule 0 'foo': "
+// for the field "rules.0.on.path". Returns an empty string if the field isn't part of a rule.
+func (r *Rules) ruleOfField(field string) string {
+	parts := strings.SplitN(field, ".", 3)
+	if len(parts) < 2 || parts[0] != "rules" {
+		return ""
+	}
+	i, err := strconv.Atoi(parts[1])
+	if err != nil || i < 0 || i >= len(*r.Rules) {
+		return ""
+	}
+	return fmt.Sprintf("rule %d '%s': ", i, (*r.Rules)[i].Name)
+}
+
 func (rule *Rule) Action() (action string) {
 	if rule.RunScript != "" {
 		return RunScript
@@ -170,6 +361,14 @@ func (rule *Rule) PostAct() (action string, err error) {
 	return "", errors.New("invalid postaction")
 }
 
+// ID identifies the rule in script queues, rate limits and metrics. Rules without name are identified by their path.
+func (rule *Rule) ID() string {
+	if rule.Name != "" || rule.On == nil {
+		return rule.Name
+	}
+	return rule.On.Path
+}
+
 func (rule *Rule) MaxRequestBody() string {
 	if rule.With != nil {
 		return rule.With.MaxRequestBody
@@ -177,6 +376,184 @@ func (rule *Rule) MaxRequestBody() string {
 	return ""
 }
 
+// SchemaLoader returns the loader for the inline JSON schema or the JSON schema file. Returns nil if no
+// JSON schema is defined.
+func (v *Validate) SchemaLoader() (gojsonschema.JSONLoader, error) {
+	if v.JSONSchema != nil {
+		return gojsonschema.NewGoLoader(v.JSONSchema), nil
+	}
+	if v.JSONSchemaFile != "" {
+		file, err := filepath.Abs(v.JSONSchemaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving json schema file '%s': %w", v.JSONSchemaFile, err)
+		}
+		return gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(file)), nil
+	}
+	return nil, nil
+}
+
+// problems returns all mistakes of the validation definition that the JSON schema of the rules can't detect
+func (v *Validate) problems() (problems []string) {
+	for _, source := range []struct {
+		name   string
+		fields map[string]Field
+	}{{"params", v.Params}, {"form", v.Form}} {
+		for name, field := range source.fields {
+			prefix := source.name + "." + name + ": "
+			if field.Type == FieldEnum && len(field.Values) == 0 {
+				problems = append(problems, prefix+"type enum requires values")
+			}
+			if field.Type == FieldRegex {
+				if field.Pattern == "" {
+					problems = append(problems, prefix+"type regex requires a pattern")
+				} else if _, err := regexp.Compile(field.Pattern); err != nil {
+					problems = append(problems, prefix+err.Error())
+				}
+			}
+			if field.MaxLength > 0 && field.MinLength > field.MaxLength {
+				problems = append(problems, prefix+"min_length exceeds max_length")
+			}
+		}
+	}
+	if v.JSONSchema != nil && v.JSONSchemaFile != "" {
+		problems = append(problems, "json_schema and json_schema_file are mutually exclusive")
+	}
+	loader, err := v.SchemaLoader()
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else if loader != nil {
+		if _, err := gojsonschema.NewSchema(loader); err != nil {
+			problems = append(problems, "invalid json schema: "+err.Error())
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// check returns an error if the API keys can't be loaded or the location of the key is ambiguous
+func (a *AuthAPIKey) check() error {
+	if (a.Header == "") == (a.Param == "") {
+		return errors.New("either header or param must be set")
+	}
+	_, err := tokens.Load(a.TokensFile, a.TokensEnv)
+	return err
+}
+
+// check returns an error if the signature can't be verified with the configuration
+func (h *HMAC) check() error {
+	if _, err := secret.Resolve(h.Secret, h.SecretFile, h.SecretEnv); err != nil {
+		return err
+	}
+	if h.Tolerance != "" {
+		if _, err := timeunit.ParseDuration(h.Tolerance); err != nil {
+			return fmt.Errorf("invalid tolerance: %w", err)
+		}
+	}
+	if h.Type == HMACGeneric && h.Header == "" {
+		return errors.New("type generic requires a header")
+	}
+	return nil
+}
+
+// check returns an error if the concurrency settings can't be applied to the action
+func (a Args) checkQueue(action string) error {
+	if a.MaxConcurrency == 0 && a.Queue == "" && a.QueueTimeout == 0 {
+		return nil
+	}
+	if action != RunScript {
+		return fmt.Errorf("max_concurrency, queue and queue_timeout are only supported by %s", RunScript)
+	}
+	if a.MaxConcurrency == 0 && a.Queue != "coalesce" {
+		return errors.New("queue and queue_timeout require max_concurrency")
+	}
+	if a.Queue == "coalesce" && (a.Async || a.Stream != "") {
+		return errors.New("queue coalesce can't be combined with async or stream")
+	}
+	return nil
+}
+
+// checkProcess returns an error if the user, the limits, the sandbox or the environment of the script are malformed
+func (a Args) checkProcess(action string) error {
+	if a.RunAs == "" && a.Limits == nil && a.Sandbox == nil && len(a.Env) == 0 && len(a.EnvPassthrough) == 0 &&
+		!a.CleanEnv {
+		return nil
+	}
+	if action != RunScript {
+		return fmt.Errorf("run_as, limits, sandbox, env, env_passthrough and clean_env are only supported by %s",
+			RunScript)
+	}
+	for name := range a.Env {
+		if !envNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid env: '%s' is not a valid variable name", name)
+		}
+	}
+	if len(a.EnvPassthrough) > 0 && !a.CleanEnv {
+		return errors.New("env_passthrough requires clean_env")
+	}
+	if a.RunAs != "" {
+		if _, _, err := ParseRunAs(a.RunAs); err != nil {
+			return err
+		}
+	}
+	if a.Sandbox != nil {
+		for _, bind := range a.Sandbox.Binds {
+			if _, err := ParseBind(bind); err != nil {
+				return fmt.Errorf("invalid sandbox: %w", err)
+			}
+		}
+	}
+	if a.Limits == nil {
+		return nil
+	}
+	if a.Limits.Memory != "" {
+		if _, err := humanise.ParseBytes(a.Limits.Memory); err != nil {
+			return fmt.Errorf("invalid limits: memory '%s' is not a size like 512MB", a.Limits.Memory)
+		}
+	}
+	if a.Limits.Cgroup != "" && !filepath.IsAbs(a.Limits.Cgroup) {
+		return fmt.Errorf("invalid limits: cgroup '%s' is not an absolute path", a.Limits.Cgroup)
+	}
+	return nil
+}
+
+// ParseBind parses a bind of the sandbox given as 'path', 'source:target' or 'source:target:rw'. Paths must be
+// absolute. Binds are read-only unless ':rw' is appended.
+func ParseBind(bind string) (Bind, error) {
+	parts := strings.Split(bind, ":")
+	b := Bind{Source: parts[0], Target: parts[0]}
+	switch len(parts) {
+	case 1:
+	case 2:
+		b.Target = parts[1]
+	case 3:
+		b.Target = parts[1]
+		if parts[2] != "rw" && parts[2] != "ro" {
+			return Bind{}, fmt.Errorf("invalid bind '%s', mode must be ro or rw", bind)
+		}
+		b.Writable = parts[2] == "rw"
+	default:
+		return Bind{}, fmt.Errorf("invalid bind '%s', expected 'path', 'source:target' or 'source:target:rw'", bind)
+	}
+	if !filepath.IsAbs(b.Source) || !filepath.IsAbs(b.Target) {
+		return Bind{}, fmt.Errorf("invalid bind '%s', paths must be absolute", bind)
+	}
+	b.Source = filepath.Clean(b.Source)
+	b.Target = filepath.Clean(b.Target)
+	if b.Target == "/" {
+		return Bind{}, fmt.Errorf("invalid bind '%s', the root can't be replaced", bind)
+	}
+	return b, nil
+}
+
+// ParseRunAs splits the run_as argument 'user' or 'user:group'
+func ParseRunAs(runAs string) (usr string, group string, err error) {
+	usr, group, found := strings.Cut(runAs, ":")
+	if usr == "" || (found && group == "") || strings.ContainsAny(runAs, " \t") {
+		return "", "", fmt.Errorf("invalid run_as '%s', expected 'user' or 'user:group'", runAs)
+	}
+	return usr, group, nil
+}
+
 func (ruleResp *Respond) Headers(onSuccess bool) map[string]string {
 	if onSuccess {
 		return ruleResp.OnSuccess.Headers
@@ -184,14 +561,87 @@ func (ruleResp *Respond) Headers(onSuccess bool) map[string]string {
 	return ruleResp.OnError.Headers
 }
 
+// MatchesURI reports whether the path of the URI matches the path pattern of the rule, including placeholders
 func (rule *Rule) MatchesURI(URI string) bool {
 	if rule.On.Path == URI {
 		// Exact match
 		return true
 	}
-	if !strings.HasPrefix(rule.On.Path, "{") && !strings.HasSuffix(rule.On.Path, "}") {
-		// The rule is not using URL Placeholders, e.g. /foo/{key1}/{key2}/
+	p, err := rule.PathPattern()
+	if err != nil {
+		return false
+	}
+	path, _, _ := strings.Cut(URI, "?")
+	return p.Match(path)
+}
+
+// PathPattern returns the parsed path pattern of the rule
+func (rule *Rule) PathPattern() (Pattern, error) {
+	return ParsePattern(rule.On.Path, KindPath)
+}
+
+// HostPattern returns the parsed host pattern of the rule. Returns an empty pattern if the rule applies to all hosts.
+func (rule *Rule) HostPattern() (Pattern, error) {
+	if rule.On.Host == "" {
+		return Pattern{}, nil
+	}
+	return ParsePattern(rule.On.Host, KindHost)
+}
+
+// AllowsMethod reports whether the rule accepts requests with the given method
+func (rule *Rule) AllowsMethod(method string) bool {
+	if len(rule.On.Methods) == 0 {
+		return true
+	}
+	for _, m := range rule.On.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether the rule accepts all requests the other rule accepts, so the other rule is never reached
+// if it's defined after this rule
+func (rule *Rule) covers(other *Rule) bool {
+	if !rule.On.coversConditions(other.On) {
+		return false
+	}
+	if len(rule.On.Methods) > 0 {
+		if len(other.On.Methods) == 0 {
+			return false
+		}
+		for _, m := range other.On.Methods {
+			if !rule.AllowsMethod(m) {
+				return false
+			}
+		}
+	}
+	if rule.On.Host != "" {
+		host, err := rule.HostPattern()
+		if err != nil {
+			return false
+		}
+		otherHost, err := other.HostPattern()
+		if err != nil || other.On.Host == "" || !host.Covers(otherHost) {
+			return false
+		}
+	}
+	p, err := rule.PathPattern()
+	if err != nil {
+		return false
+	}
+	otherPath, err := other.PathPattern()
+	if err != nil {
 		return false
 	}
+	if p.Covers(otherPath) {
+		return true
+	}
+	if rule.Action() == ServeDirectory {
+		// Directories are served including everything below the path
+		dir, err := ParsePattern(strings.TrimSuffix(rule.On.Path, "/")+"/{path...}", KindPath)
+		return err == nil && dir.Covers(otherPath)
+	}
 	return false
 }
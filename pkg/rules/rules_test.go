@@ -106,6 +106,112 @@ func TestRulesShouldFail(t *testing.T) {
 				"body is required",
 			},
 		},
+		{
+			name: "async-and-stream",
+			wantErrors: []string{
+				"rule 0 'Async and Stream': args async and stream are mutually exclusive",
+			},
+		},
+		{
+			name: "auto-quote-without-templating",
+			wantErrors: []string{
+				"rule 0 'Auto quote without templating': args auto_quote and disable_templating are mutually exclusive",
+			},
+		},
+		{
+			name: "invalid-validate",
+			wantErrors: []string{
+				"rule 0 'Invalid validate': invalid validate: json_schema and json_schema_file are mutually exclusive",
+				"rule 0 'Invalid validate': invalid validate: params.id: error parsing regexp: missing closing ]: `[0-9`",
+				"rule 0 'Invalid validate': invalid validate: params.name: min_length exceeds max_length",
+				"rule 0 'Invalid validate': invalid validate: params.sort: type enum requires values",
+			},
+		},
+		{
+			name: "shadowed-routes",
+			wantErrors: []string{
+				"rule 1 'Numeric item' is shadowed by rule 0 'Any item', which matches all its requests",
+				"rule 3 'Status' conflicts with rule 2 'Get status', both match the same requests",
+				"rule 6 'Static file' is shadowed by rule 5 'Static', which matches all its requests",
+				"rule 7 'Broken': invalid path: unbalanced braces in '/broken/{name'",
+			},
+		},
+		{
+			name: "invalid-conditions",
+			wantErrors: []string{
+				"rule 0 'Invalid source': invalid network '10.0.0.0/33'",
+				"rule 2 'Push event' is shadowed by rule 1 'Any event', which matches all its requests",
+			},
+		},
+		{
+			name: "invalid-hmac",
+			wantErrors: []string{
+				"rule 0 'Generic without header': invalid hmac: type generic requires a header",
+				"rule 1 'Ambiguous secret': invalid hmac: " +
+					"only one of the inline secret, the secret file and the secret environment variable must be set",
+			},
+		},
+		{
+			name: "invalid-password-hash",
+			wantErrors: []string{
+				"rule 0 'Malformed hash': invalid auth_basic: password of user 'john': malformed hash",
+			},
+		},
+		{
+			name: "invalid-users",
+			wantErrors: []string{
+				"users: user 'alice' defined more than once",
+				"users: password of user 'alice': malformed hash",
+				"rule 0 'Invalid allow': invalid allow: 'ops' must be either user:<name> or group:<name>",
+			},
+		},
+		{
+			name: "invalid-cidrs",
+			wantErrors: []string{
+				"rule 0 'Internal status': invalid allow_cidrs or deny_cidrs: invalid network '10.0.0.0/33'",
+			},
+		},
+		{
+			name: "invalid-rate-limit",
+			wantErrors: []string{
+				"rule 0 'Wrong unit': invalid rate_limit: invalid rate '10/m', expected <count>/<unit> like 10/min",
+				"rule 1 'Wrong key': invalid rate_limit: key must be ip, user or a template",
+			},
+		},
+		{
+			name: "invalid-queue",
+			wantErrors: []string{
+				"rule 0 'Wait without limit': invalid args: queue and queue_timeout require max_concurrency",
+				"rule 1 'Coalesce async': invalid args: queue coalesce can't be combined with async or stream",
+				"rule 2 'Not a script': invalid args: max_concurrency, queue and queue_timeout are only supported by run.script",
+			},
+		},
+		{
+			name: "invalid-process",
+			wantErrors: []string{
+				"rule 0 'Missing group': invalid args: invalid run_as 'nobody:', expected 'user' or 'user:group'",
+				"rule 1 'Memory': invalid args: invalid limits: memory 'lots' is not a size like 512MB",
+				"rule 2 'Relative cgroup': invalid args: invalid limits: cgroup 'httpe' is not an absolute path",
+				"rule 3 'Not a script': invalid args: run_as, limits, sandbox, env, env_passthrough and clean_env are only supported by run.script",
+				"rule 4 'Relative bind': invalid args: invalid sandbox: invalid bind 'srv/data', paths must be absolute",
+				"rule 5 'Bind mode': invalid args: invalid sandbox: invalid bind '/srv/data:/data:rx', mode must be ro or rw",
+				"rule 6 'Env name': invalid args: invalid env: 'API-KEY' is not a valid variable name",
+				"rule 7 'Passthrough': invalid args: env_passthrough requires clean_env",
+			},
+		},
+		{
+			name: "oidc-combined",
+			wantErrors: []string{
+				"rule 0 'OIDC and basic auth': oidc can't be combined with auth_basic, auth_bearer, auth_apikey or allow",
+			},
+		},
+		{
+			name: "invalid-tokens",
+			wantErrors: []string{
+				"rule 0 'Missing tokens': invalid auth_bearer: environment variable HTTPE_TEST_UNSET_TOKENS is empty or not set",
+				"rule 1 'Header and param': invalid auth_apikey: either header or param must be set",
+			},
+		},
 		{
 			name: "wrong-postaction",
 			wantErrors: []string{
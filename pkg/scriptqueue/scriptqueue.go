@@ -0,0 +1,312 @@
+package scriptqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/actions"
+	"github.com/http-everything/httpe/pkg/share/logger"
+)
+
+const (
+	// Reject, Wait and Coalesce are the modes of dealing with requests exceeding the concurrency of a rule
+	Reject   = "reject"
+	Wait     = "wait"
+	Coalesce = "coalesce"
+
+	// DefaultTimeout is the time a request waits for a free slot, if the rule doesn't set a timeout
+	DefaultTimeout = 30 * time.Second
+
+	// URLPath is the path of the built-in endpoint reporting the queue of a rule, e.g. /_queues?rule=Deploy
+	URLPath = "/_queues"
+)
+
+var (
+	// ErrBusy is returned if all slots of a rule are taken and the rule rejects further requests
+	ErrBusy = errors.New("script is already running")
+	// ErrTimeout is returned if no slot became free within the timeout
+	ErrTimeout = errors.New("timed out waiting for a free slot")
+)
+
+// Limit is the concurrency of a single rule
+type Limit struct {
+	// MaxConcurrency is the number of concurrent executions of the rule, 0 for unlimited
+	MaxConcurrency int
+	// Mode is one of Reject, Wait or Coalesce. Defaults to Reject.
+	Mode string
+	// Timeout is the maximum time to wait for a free slot. Defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Stats is the number of scripts running and of requests waiting for a slot
+type Stats struct {
+	Running int `json:"running"`
+	Waiting int `json:"waiting"`
+}
+
+// Queues limits the number of scripts executed concurrently, per rule and in total
+type Queues struct {
+	mu     sync.Mutex
+	global chan struct{}
+	total  Stats
+	rules  map[string]*queue
+	// retained are the rules whose queues are kept, nil for all
+	retained map[string]bool
+	logger   *logger.Logger
+}
+
+// queue holds the slots of a single rule
+type queue struct {
+	slots   chan struct{}
+	stats   Stats
+	flights map[string]*flight
+	// removed is set, if the rule has been removed by a reload. The queue is dropped once it's unused.
+	removed bool
+}
+
+// flight is an execution other identical requests can join
+type flight struct {
+	done chan struct{}
+	resp actions.ActionResponse
+	err  error
+}
+
+// New creates queues allowing maxScripts scripts to run at the same time, 0 for unlimited
+func New(maxScripts int, logger *logger.Logger) *Queues {
+	q := &Queues{
+		rules:  make(map[string]*queue),
+		logger: logger,
+	}
+	if maxScripts > 0 {
+		q.global = make(chan struct{}, maxScripts)
+	}
+	return q
+}
+
+// queue returns the queue of the rule. The slots are recreated, if the limit has been changed by a reload.
+// Slots taken before keep being released to the previous channel.
+func (q *Queues) queue(rule string, limit Limit) *queue {
+	rq, ok := q.rules[rule]
+	if !ok {
+		rq = &queue{flights: make(map[string]*flight), removed: q.retained != nil && !q.retained[rule]}
+		q.rules[rule] = rq
+	}
+	if cap(rq.slots) != limit.MaxConcurrency {
+		rq.slots = nil
+		if limit.MaxConcurrency > 0 {
+			rq.slots = make(chan struct{}, limit.MaxConcurrency)
+		}
+	}
+	return rq
+}
+
+// dropUnused drops the queue of a removed rule, unless scripts are running, requests are waiting or executions can
+// be joined. q.mu must be held.
+func (q *Queues) dropUnused(rule string, rq *queue) {
+	if rq.removed && rq.stats == (Stats{}) && len(rq.flights) == 0 && q.rules[rule] == rq {
+		delete(q.rules, rule)
+	}
+}
+
+// Retain keeps the queues of the given rules and drops the queues of all other rules, as soon as they are unused.
+// It's called with the IDs of the rules loaded by a reload.
+func (q *Queues) Retain(rules []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.retained = make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		q.retained[rule] = true
+	}
+	for rule, rq := range q.rules {
+		rq.removed = !q.retained[rule]
+		q.dropUnused(rule, rq)
+	}
+}
+
+// Acquire takes a slot of the rule and of the global limit. If the rule has no free slot, ErrBusy is returned
+// in Reject mode, otherwise Acquire waits until the timeout of the limit. A full global limit is always waited for.
+// The returned function must be called once the script has terminated.
+func (q *Queues) Acquire(ctx context.Context, rule string, limit Limit) (release func(), err error) {
+	if limit.Timeout <= 0 {
+		limit.Timeout = DefaultTimeout
+	}
+	q.mu.Lock()
+	rq := q.queue(rule, limit)
+	slots := rq.slots
+	q.mu.Unlock()
+	defer func() {
+		if err != nil {
+			q.mu.Lock()
+			q.dropUnused(rule, rq)
+			q.mu.Unlock()
+		}
+	}()
+
+	timer := time.NewTimer(limit.Timeout)
+	defer timer.Stop()
+	if slots != nil && !q.take(ctx, timer, rule, rq, slots, limit.Mode == Reject || limit.Mode == "") {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if limit.Mode == Reject || limit.Mode == "" {
+			return nil, ErrBusy
+		}
+		return nil, ErrTimeout
+	}
+	if q.global != nil && !q.take(ctx, timer, rule, rq, q.global, false) {
+		if slots != nil {
+			<-slots
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, ErrTimeout
+	}
+
+	q.mu.Lock()
+	rq.stats.Running++
+	q.total.Running++
+	q.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			rq.stats.Running--
+			q.total.Running--
+			q.dropUnused(rule, rq)
+			q.mu.Unlock()
+			if q.global != nil {
+				<-q.global
+			}
+			if slots != nil {
+				<-slots
+			}
+		})
+	}, nil
+}
+
+// take takes a slot from the channel. Unless noWait is set, it waits for a slot until the timer fires or the
+// context is done, counting the request as waiting.
+func (q *Queues) take(ctx context.Context, timer *time.Timer, rule string, rq *queue, slots chan struct{},
+	noWait bool) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if noWait {
+		return false
+	}
+
+	q.mu.Lock()
+	rq.stats.Waiting++
+	q.total.Waiting++
+	waiting := rq.stats.Waiting
+	q.mu.Unlock()
+	q.logger.Infof("rule '%s' has no free slot, %d request(s) waiting", rule, waiting)
+	defer func() {
+		q.mu.Lock()
+		rq.stats.Waiting--
+		q.total.Waiting--
+		q.mu.Unlock()
+	}()
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Coalesce executes fn once a slot is free. Requests with the same key join an execution already running rather
+// than starting another one and all receive the response of the single execution. Requests with different keys wait
+// for a slot like in Wait mode. shared reports whether the response has been produced for another request.
+// If the request leading an execution gives up waiting for a slot, the joined requests don't fail with its context
+// error, one of them leads a new execution instead.
+func (q *Queues) Coalesce(ctx context.Context, rule string, key string, limit Limit,
+	fn func() (actions.ActionResponse, error)) (resp actions.ActionResponse, shared bool, err error) {
+	for {
+		q.mu.Lock()
+		rq := q.queue(rule, limit)
+		f, ok := rq.flights[key]
+		if !ok {
+			f = &flight{done: make(chan struct{})}
+			rq.flights[key] = f
+			q.mu.Unlock()
+			return q.lead(ctx, rule, key, rq, f, limit, fn)
+		}
+		q.mu.Unlock()
+		select {
+		case <-f.done:
+			if errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded) {
+				continue
+			}
+			return f.resp, true, f.err
+		case <-ctx.Done():
+			return resp, false, ctx.Err()
+		}
+	}
+}
+
+// lead executes fn for the flight and all requests joining it
+func (q *Queues) lead(ctx context.Context, rule string, key string, rq *queue, f *flight, limit Limit,
+	fn func() (actions.ActionResponse, error)) (resp actions.ActionResponse, shared bool, err error) {
+	defer func() {
+		q.mu.Lock()
+		delete(rq.flights, key)
+		q.dropUnused(rule, rq)
+		q.mu.Unlock()
+		close(f.done)
+	}()
+	// Different input waits for a slot like in Wait mode
+	release, err := q.Acquire(ctx, rule, Limit{MaxConcurrency: limit.MaxConcurrency, Mode: Wait, Timeout: limit.Timeout})
+	if err != nil {
+		f.err = err
+		return resp, false, err
+	}
+	defer release()
+	f.resp, f.err = fn()
+	return f.resp, false, f.err
+}
+
+// Stats returns the number of running scripts and waiting requests in total and per rule
+func (q *Queues) Stats() (total Stats, rules map[string]Stats) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rules = make(map[string]Stats, len(q.rules))
+	for name, rq := range q.rules {
+		rules[name] = rq.stats
+	}
+	return q.total, rules
+}
+
+// RuleStats returns the number of running scripts and waiting requests of the rule
+func (q *Queues) RuleStats(rule string) Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if rq, ok := q.rules[rule]; ok {
+		return rq.stats
+	}
+	return Stats{}
+}
+
+// StatsHandler returns a handler responding with the JSON representation of the stats of the rule
+func (q *Queues) StatsHandler(rule string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(struct {
+			Rule string `json:"rule"`
+			Stats
+		}{Rule: rule, Stats: q.RuleStats(rule)})
+	})
+}
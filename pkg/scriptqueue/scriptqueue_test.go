@@ -0,0 +1,203 @@
+package scriptqueue_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/actions"
+	"github.com/http-everything/httpe/pkg/scriptqueue"
+	"github.com/http-everything/httpe/pkg/share/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newQueues(t *testing.T, maxScripts int) *scriptqueue.Queues {
+	t.Helper()
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	return scriptqueue.New(maxScripts, l)
+}
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	cases := []struct {
+		name       string
+		maxScripts int
+		limit      scriptqueue.Limit
+		wantErr    error
+	}{
+		{name: "reject", limit: scriptqueue.Limit{MaxConcurrency: 1}, wantErr: scriptqueue.ErrBusy},
+		{name: "wait", limit: scriptqueue.Limit{MaxConcurrency: 1, Mode: scriptqueue.Wait, Timeout: 50 * time.Millisecond},
+			wantErr: scriptqueue.ErrTimeout},
+		{name: "global", maxScripts: 1, limit: scriptqueue.Limit{Mode: scriptqueue.Reject, Timeout: 50 * time.Millisecond},
+			wantErr: scriptqueue.ErrTimeout},
+		{name: "unlimited", limit: scriptqueue.Limit{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := newQueues(t, tc.maxScripts)
+			release, err := q.Acquire(ctx, "deploy", tc.limit)
+			require.NoError(t, err)
+
+			another, err := q.Acquire(ctx, "deploy", tc.limit)
+			assert.Equal(t, tc.wantErr, err)
+			if err == nil {
+				another()
+			}
+			total, _ := q.Stats()
+			assert.Equal(t, scriptqueue.Stats{Running: 1}, total)
+
+			release()
+			release()
+			second, err := q.Acquire(ctx, "deploy", tc.limit)
+			require.NoError(t, err, "the slot has been released exactly once")
+			second()
+		})
+	}
+}
+
+func TestAcquireWaits(t *testing.T) {
+	q := newQueues(t, 0)
+	limit := scriptqueue.Limit{MaxConcurrency: 1, Mode: scriptqueue.Wait, Timeout: 5 * time.Second}
+	release, err := q.Acquire(context.Background(), "deploy", limit)
+	require.NoError(t, err)
+
+	acquired := make(chan error)
+	go func() {
+		next, err := q.Acquire(context.Background(), "deploy", limit)
+		if err == nil {
+			next()
+		}
+		acquired <- err
+	}()
+	require.Eventually(t, func() bool {
+		_, rules := q.Stats()
+		return rules["deploy"] == scriptqueue.Stats{Running: 1, Waiting: 1}
+	}, time.Second, 10*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	q.StatsHandler("deploy").ServeHTTP(w, httptest.NewRequest("GET", scriptqueue.URLPath+"?rule=deploy", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"rule":"deploy","running":1,"waiting":1}`, w.Body.String())
+	assert.Equal(t, scriptqueue.Stats{}, q.RuleStats("unknown"))
+
+	_, err = q.Acquire(context.Background(), "other", limit)
+	assert.NoError(t, err, "rules are independent")
+
+	release()
+	assert.NoError(t, <-acquired)
+}
+
+func TestCoalesce(t *testing.T) {
+	q := newQueues(t, 0)
+	limit := scriptqueue.Limit{MaxConcurrency: 1, Mode: scriptqueue.Coalesce, Timeout: 5 * time.Second}
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	calls := 0
+	fn := func() (actions.ActionResponse, error) {
+		calls++
+		close(started)
+		<-finish
+		return actions.ActionResponse{SuccessBody: "deployed"}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]bool, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i > 0 {
+				<-started
+			}
+			resp, shared, err := q.Coalesce(context.Background(), "deploy", "same input", limit, fn)
+			assert.NoError(t, err)
+			assert.Equal(t, "deployed", resp.SuccessBody)
+			results[i] = shared
+		}(i)
+	}
+	<-started
+	// Give the followers time to join
+	time.Sleep(50 * time.Millisecond)
+	close(finish)
+	wg.Wait()
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, []bool{false, true, true}, results)
+}
+
+// A request joining an execution doesn't fail, if the request leading it gives up waiting for a slot
+func TestCoalesceLeaderCanceled(t *testing.T) {
+	q := newQueues(t, 0)
+	limit := scriptqueue.Limit{MaxConcurrency: 1, Mode: scriptqueue.Coalesce, Timeout: 5 * time.Second}
+	release, err := q.Acquire(context.Background(), "deploy", limit)
+	require.NoError(t, err)
+	fn := func() (actions.ActionResponse, error) {
+		return actions.ActionResponse{SuccessBody: "deployed"}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, _, err := q.Coalesce(ctx, "deploy", "same input", limit, fn)
+		leader <- err
+	}()
+	require.Eventually(t, func() bool {
+		return q.RuleStats("deploy").Waiting == 1
+	}, time.Second, 10*time.Millisecond)
+
+	type result struct {
+		resp   actions.ActionResponse
+		shared bool
+		err    error
+	}
+	joined := make(chan result)
+	go func() {
+		resp, shared, err := q.Coalesce(context.Background(), "deploy", "same input", limit, fn)
+		joined <- result{resp, shared, err}
+	}()
+	// Give the request time to join
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-leader, context.Canceled)
+
+	require.Eventually(t, func() bool {
+		return q.RuleStats("deploy").Waiting == 1
+	}, time.Second, 10*time.Millisecond, "the joined request waits for a slot itself")
+	release()
+	res := <-joined
+	assert.NoError(t, res.err)
+	assert.False(t, res.shared)
+	assert.Equal(t, "deployed", res.resp.SuccessBody)
+}
+
+func TestRetain(t *testing.T) {
+	q := newQueues(t, 0)
+	limit := scriptqueue.Limit{MaxConcurrency: 1}
+	ctx := context.Background()
+	idle, err := q.Acquire(ctx, "idle", limit)
+	require.NoError(t, err)
+	idle()
+	running, err := q.Acquire(ctx, "running", limit)
+	require.NoError(t, err)
+	kept, err := q.Acquire(ctx, "kept", limit)
+	require.NoError(t, err)
+	defer kept()
+
+	q.Retain([]string{"kept"})
+	_, rules := q.Stats()
+	assert.NotContains(t, rules, "idle")
+	assert.Contains(t, rules, "running", "the queue is reported until the script has terminated")
+
+	running()
+	// A request routed before the reload may still take a slot of a removed rule
+	late, err := q.Acquire(ctx, "late", limit)
+	require.NoError(t, err)
+	late()
+	_, rules = q.Stats()
+	assert.Equal(t, map[string]scriptqueue.Stats{"kept": {Running: 1}}, rules)
+}
@@ -3,26 +3,43 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/http-everything/httpe/pkg/assetshandler"
 
+	"github.com/http-everything/httpe/pkg/accesslog"
 	"github.com/http-everything/httpe/pkg/actions/servedirectory"
+	"github.com/http-everything/httpe/pkg/auth"
+	"github.com/http-everything/httpe/pkg/clientip"
 	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/health"
+	"github.com/http-everything/httpe/pkg/jobs"
+	"github.com/http-everything/httpe/pkg/metrics"
 	"github.com/http-everything/httpe/pkg/middleware"
+	"github.com/http-everything/httpe/pkg/oidc"
+	"github.com/http-everything/httpe/pkg/ratelimit"
 	"github.com/http-everything/httpe/pkg/requesthandler"
+	"github.com/http-everything/httpe/pkg/requestid"
 	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/scriptqueue"
+	"github.com/http-everything/httpe/pkg/share/clientcert"
+	"github.com/http-everything/httpe/pkg/share/endpointauth"
 	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/share/version"
+	"github.com/http-everything/httpe/pkg/tracing"
 
 	"github.com/gorilla/mux"
-
-	"github.com/gorilla/handlers"
 )
 
 // Server is the core HTTP server for the HTTPE server
@@ -32,15 +49,60 @@ type Server struct {
 
 	Handler http.Handler
 
+	routing         atomic.Pointer[routing]
 	srv             *http.Server
 	logger          *logger.Logger
 	accessLogWriter io.Writer
+	accessLogFormat accesslog.Format
+	users           auth.Directory
+	oidc            *oidc.Provider
+	clientCAs       *x509.CertPool
+	proxies         *clientip.Proxies
+	ips             *clientip.Filter
+	limits          *ratelimit.Limiter
+	queues          *scriptqueue.Queues
+	metrics         *metrics.Metrics
+	metricsAuth     endpointauth.Auth
+	tracer          *tracing.Tracer
+	readyChecks     []health.Check
+	infoAuth        *endpointauth.Auth
+	started         time.Time
+}
+
+// routing couples a router with the rules it has been built from
+type routing struct {
+	router *mux.Router
+	rules  *[]rules.Rule
+}
+
+// Option configures optional dependencies of the server
+type Option func(s *Server)
+
+// WithUsers sets the directory of users and groups shared by all rules
+func WithUsers(users auth.Directory) Option {
+	return func(s *Server) {
+		s.users = users
+	}
+}
+
+// WithReadyChecks adds checks to the readiness endpoint, on top of the checks of the data_dir and the SMTP server
+func WithReadyChecks(checks ...health.Check) Option {
+	return func(s *Server) {
+		s.readyChecks = append(s.readyChecks, checks...)
+	}
+}
+
+// WithOIDC sets the OpenID Connect provider and enables its login, callback and logout endpoints
+func WithOIDC(provider *oidc.Provider) Option {
+	return func(s *Server) {
+		s.oidc = provider
+	}
 }
 
 // New creates a new Server. It will also create a new baseLogger which will be used to fork
 // the loggers used by other packages.
-func New(cfg *config.Config, rules *[]rules.Rule, baseLogger *logger.Logger, accessLogWriter io.Writer) (
-	svr *Server, err error) {
+func New(cfg *config.Config, rules *[]rules.Rule, baseLogger *logger.Logger, accessLogWriter io.Writer,
+	opts ...Option) (svr *Server, err error) {
 	l := baseLogger.Fork("server")
 
 	svr = &Server{
@@ -48,6 +110,62 @@ func New(cfg *config.Config, rules *[]rules.Rule, baseLogger *logger.Logger, acc
 		logger:          l,
 		accessLogWriter: accessLogWriter,
 		rules:           rules,
+		started:         time.Now(),
+	}
+	for _, opt := range opts {
+		opt(svr)
+	}
+	svr.accessLogFormat, err = accesslog.NewFormat(cfg.S.AccessLogFormat, cfg.S.AccessLogTemplate)
+	if err != nil {
+		return nil, err
+	}
+	svr.proxies, err = clientip.NewProxies(cfg.S.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+	svr.ips, err = clientip.NewFilter(cfg.S.AllowCIDRs, cfg.S.DenyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow_cidrs or deny_cidrs: %w", err)
+	}
+	limitsFile := ""
+	if cfg.S.PersistRateLimits {
+		limitsFile = filepath.Join(cfg.S.DataDir, ratelimit.FileName)
+	}
+	svr.limits, err = ratelimit.New(limitsFile, l)
+	if err != nil {
+		return nil, err
+	}
+	// The queues outlive reloads, so scripts started before a reload still count
+	svr.queues = scriptqueue.New(cfg.S.MaxScripts, l)
+	if cfg.Metrics != nil {
+		// Metrics are collected across reloads, like the queues
+		svr.metrics = metrics.New(svr.queues)
+		svr.metricsAuth, err = endpointauth.New(cfg.Metrics)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metrics config: %w", err)
+		}
+	}
+	if cfg.Tracing != nil {
+		svr.tracer = tracing.New(cfg.Tracing, l)
+	}
+	if cfg.Info != nil {
+		auth, err := endpointauth.New(cfg.Info)
+		if err != nil {
+			return nil, fmt.Errorf("invalid info config: %w", err)
+		}
+		svr.infoAuth = &auth
+	}
+	if cfg.S.DataDir != "" {
+		svr.readyChecks = append(svr.readyChecks, health.Writable("data_dir", cfg.S.DataDir))
+	}
+	if cfg.SMTP != nil && cfg.SMTP.Server != "" {
+		svr.readyChecks = append(svr.readyChecks, health.SMTP(cfg.SMTP.Server, cfg.SMTP.Port))
+	}
+	if cfg.S.ClientCAFile != "" {
+		svr.clientCAs, err = clientcert.LoadPool(cfg.S.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client CAs: %w", err)
+		}
 	}
 	return svr, nil
 }
@@ -55,31 +173,23 @@ func New(cfg *config.Config, rules *[]rules.Rule, baseLogger *logger.Logger, acc
 // Setup creates the routes and sets up the http.Server
 func (s *Server) Setup() {
 	s.logger.Infof("setting up")
-	r := mux.NewRouter()
-	for _, rule := range *s.rules {
-		h := requesthandler.Execute(rule, s.logger, s.cfg)
-		m := middleware.New(rule, s.logger)
-		if len(rule.On.Methods) == 0 {
-			r.Handle(rule.On.Path, m.Collection(h))
-		} else {
-			for _, method := range rule.On.Methods {
-				r.Handle(rule.On.Path, m.Collection(h)).Methods(method)
-			}
-		}
-		if rule.Action() == rules.ServeDirectory {
-			r.PathPrefix(rule.On.Path).Handler(m.Collection(servedirectory.Handle(rule.On.Path, rule.ServeDirectory)))
-		}
-	}
-	r.PathPrefix("/_assets").Handler(http.HandlerFunc(assetshandler.AssetsHandler)).Methods("get")
-	r.Path("/favicon.ico").Handler(http.HandlerFunc(assetshandler.AssetsHandler)).Methods("get")
-	r.PathPrefix("/").Handler(http.HandlerFunc(s.catchAllHandler))
+	s.routing.Store(&routing{router: s.newRouter(s.rules), rules: s.rules})
+
+	// Dispatch every request to the router active at the time the request arrives. In-flight requests keep
+	// the router, and therefore the rules, they have been started with, even if a reload swaps the router.
+	r := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.routing.Load().router.ServeHTTP(w, req)
+	})
 
 	if s.accessLogWriter != nil {
-		accessLogHandler := handlers.CombinedLoggingHandler(s.accessLogWriter, r)
-		s.Handler = accessLogHandler
+		s.Handler = accesslog.Handler(s.accessLogWriter, s.accessLogFormat, r)
 	} else {
 		s.Handler = r
 	}
+	// Resolve the client IP before anything else looks at the remote address
+	s.Handler = s.proxies.Handler(s.Handler)
+	// Assign the request ID first, so every log line of the request can carry it
+	s.Handler = requestid.Handler(s.Handler)
 
 	var tlscfg *tls.Config
 	if s.cfg.S.KeyFile != "" && s.cfg.S.CertFile != "" {
@@ -87,6 +197,11 @@ func (s *Server) Setup() {
 			MinVersion:       tls.VersionTLS12,
 			CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
 		}
+		if s.clientCAs != nil {
+			// Client certificates are optional on the TLS level, rules requiring one reject requests without
+			tlscfg.ClientCAs = s.clientCAs
+			tlscfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
 	}
 
 	s.srv = &http.Server{
@@ -98,10 +213,118 @@ func (s *Server) Setup() {
 	}
 }
 
+// Reload replaces the rules of a running server. A new router is built from the given rules and swapped in
+// atomically, so requests already being processed are not affected.
+func (s *Server) Reload(ruleSet *[]rules.Rule) {
+	s.logger.Infof("reloading %d rules", len(*ruleSet))
+	s.routing.Store(&routing{router: s.newRouter(ruleSet), rules: ruleSet})
+	ids := make([]string, 0, len(*ruleSet))
+	for _, rule := range *ruleSet {
+		ids = append(ids, rule.ID())
+	}
+	// Queues of removed rules are no longer reported, once their scripts have terminated
+	s.queues.Retain(ids)
+}
+
+// Rules returns the rules currently served
+func (s *Server) Rules() *[]rules.Rule {
+	return s.routing.Load().rules
+}
+
+// newRouter creates a router with the routes of the given rules and the built-in routes
+func (s *Server) newRouter(ruleSet *[]rules.Rule) *mux.Router {
+	r := mux.NewRouter()
+	var compiled []compiledRule
+	for _, rule := range *ruleSet {
+		path, err := rule.PathPattern()
+		if err != nil {
+			s.logger.Errorf("skipping rule '%s': %s", rule.Name, err)
+			continue
+		}
+		host, err := rule.HostPattern()
+		if err != nil {
+			s.logger.Errorf("skipping rule '%s': %s", rule.Name, err)
+			continue
+		}
+		matcher, err := rule.On.Matcher()
+		if err != nil {
+			s.logger.Errorf("skipping rule '%s': %s", rule.Name, err)
+			continue
+		}
+		compiled = append(compiled, compiledRule{rule: rule, path: path, host: host, matcher: matcher})
+		// route creates a new route restricted to the host and the conditions of the rule, if any
+		route := func() *mux.Route {
+			rt := r.NewRoute()
+			if rule.On.Host != "" {
+				rt = rt.Host(host.Mux())
+			}
+			if matcher != nil {
+				rt = rt.MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+					return matcher.Match(req)
+				})
+			}
+			return rt
+		}
+		h := requesthandler.Execute(rule, s.logger, s.cfg, requesthandler.WithQueues(s.queues),
+			requesthandler.WithMetrics(s.metrics))
+		m := s.middleware(rule)
+		// The rule is known to the access log before the middleware, so rejected requests are redacted, too
+		redact := accesslog.Settings(rule).Redact
+		handler := accesslog.RuleHandler(rule, s.tracer.Handler(rule.ID(), redact, m.Collection, h))
+		if len(rule.On.Methods) == 0 {
+			route().Path(path.Mux()).Handler(handler)
+		} else {
+			for _, method := range rule.On.Methods {
+				route().Path(path.Mux()).Handler(handler).Methods(method)
+			}
+		}
+		if rule.Action() == rules.ServeDirectory {
+			route().PathPrefix(rule.On.Path).Handler(accesslog.RuleHandler(rule, s.tracer.Handler(rule.ID(),
+				redact, m.Collection, servedirectory.Handle(rule.On.Path, rule.ServeDirectory))))
+		}
+	}
+	if s.oidc != nil {
+		r.PathPrefix(oidc.URLPrefix).Handler(s.oidc.Handler()).Methods("get")
+	}
+	if s.metrics != nil {
+		r.Path(metrics.URLPath).Handler(s.metrics.Handler(s.metricsAuth, s.logger)).Methods("get")
+	}
+	// Rules may still define their own health check at the same path, they take precedence
+	r.Path(health.HealthPath).Handler(health.Handler()).Methods("get")
+	r.Path(health.ReadyPath).Handler(health.ReadyHandler(s.readyChecks, health.CacheTTL, s.logger)).Methods("get")
+	if s.infoAuth != nil {
+		r.Path(health.InfoPath).Handler(s.infoAuth.Protect(health.InfoHandler(s.info), s.logger)).Methods("get")
+	}
+	r.Path(jobs.URLPrefix + "{id}").Handler(http.HandlerFunc(s.jobHandler)).Methods("get")
+	r.Path(scriptqueue.URLPath).Handler(http.HandlerFunc(s.queueHandler)).Methods("get")
+	r.PathPrefix("/_assets").Handler(http.HandlerFunc(assetshandler.AssetsHandler)).Methods("get")
+	r.Path("/favicon.ico").Handler(http.HandlerFunc(assetshandler.AssetsHandler)).Methods("get")
+	r.PathPrefix("/").Handler(s.catchAllHandler(compiled))
+
+	return r
+}
+
+// info describes the server for the info endpoint
+func (s *Server) info() health.Info {
+	return health.Info{
+		Version:   version.HTTPEServerVersion,
+		Started:   s.started,
+		Rules:     len(*s.Rules()),
+		RulesFile: s.cfg.S.RulesFile,
+		Config:    s.cfg.Source(),
+	}
+}
+
+func (s *Server) middleware(rule rules.Rule) middleware.Middleware {
+	return middleware.New(rule, s.logger, middleware.WithUsers(s.users), middleware.WithOIDC(s.oidc),
+		middleware.WithIPFilter(s.ips), middleware.WithRateLimiter(s.limits))
+}
+
 // Serve starts a go routine with http.Server in http or https mode depending on the config settings.
 // Will block waiting for ctrl+c or ctx done if requested by the withWait param.
 func (s *Server) Serve(ctx context.Context, withWait bool) (err error) {
 	stop := make(chan error)
+	go s.limits.Run(ctx)
 	go func(stop chan error) {
 		if s.cfg.S.KeyFile != "" && s.cfg.S.CertFile != "" {
 			s.logger.Infof("listening on https://%s", s.cfg.S.Address)
@@ -126,13 +349,109 @@ func (s *Server) Serve(ctx context.Context, withWait bool) (err error) {
 	return nil
 }
 
-// catchAllHandler returns unauthorised for all unknown routes
-func (s *Server) catchAllHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotFound)
-	_, err := w.Write([]byte(r.RequestURI + " not found\n"))
+// compiledRule holds the patterns and the matcher of a rule, so they are compiled once per router rather than
+// on every request
+type compiledRule struct {
+	rule    rules.Rule
+	path    rules.Pattern
+	host    rules.Pattern
+	matcher *rules.RequestMatcher
+}
+
+// catchAllHandler answers all requests not matching any route. If the path and the conditions of a rule match,
+// but the method doesn't, 405 Method Not Allowed is returned. If the request resembles a rule, the reason why it
+// doesn't match, e.g. a placeholder not accepting the value or a header not matching, is added to the 404 Not Found
+// response. Expected header and query parameter values are only logged.
+func (s *Server) catchAllHandler(compiled []compiledRule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		// reason is sent to the client, details are logged only, they may disclose expected header values
+		var reason, details string
+		for _, c := range compiled {
+			if c.rule.On.Host != "" && !c.host.Match(hostWithoutPort(r.Host)) {
+				continue
+			}
+			if !c.path.Match(r.URL.Path) {
+				if reason == "" {
+					reason = c.path.Mismatch(r.URL.Path)
+					details = reason
+				}
+				continue
+			}
+			if c.matcher != nil && !c.matcher.Match(r) {
+				if reason == "" {
+					field, why := c.matcher.Mismatch(r)
+					reason, details = field+" doesn't match", why
+				}
+				continue
+			}
+			allowed = append(allowed, c.rule.On.Methods...)
+		}
+
+		var msg string
+		if len(allowed) > 0 {
+			for i, m := range allowed {
+				allowed[i] = strings.ToUpper(m)
+			}
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			msg = fmt.Sprintf("method %s not allowed for %s\n", r.Method, r.RequestURI)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			msg = r.RequestURI + " not found\n"
+			if reason != "" {
+				s.logger.Infof("%s %s doesn't match: %s", r.Method, r.RequestURI, details)
+				msg = r.RequestURI + " not found: " + reason + "\n"
+			}
+		}
+		_, err := w.Write([]byte(msg))
+		if err != nil {
+			s.logger.Errorf("unable to write response: %s", err)
+		}
+	})
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// jobHandler reports the status of an asynchronous job. Access to the job is protected by the authentication of the
+// rule that has started the job, so a job is only visible to those allowed to start it. Neither the signature of the
+// rule is checked, a status request has no signed body, nor does polling count against its rate limit.
+func (s *Server) jobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := jobs.New(s.cfg, s.logger).Get(mux.Vars(r)["id"])
 	if err != nil {
-		s.logger.Errorf("unable to write response: %s", err)
+		if !errors.Is(err, jobs.ErrNotFound) && !errors.Is(err, jobs.ErrInvalidID) {
+			s.logger.Errorf("unable to read job: %s", err)
+		}
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	for _, rule := range *s.Rules() {
+		if rule.ID() == job.Rule {
+			s.middleware(rule).Authentication(jobs.StatusHandler(job)).ServeHTTP(w, r)
+			return
+		}
 	}
+	// The rule has been removed or renamed since the job was started
+	s.logger.Infof("rule '%s' of job %s no longer exists", job.Rule, job.ID)
+	http.Error(w, "job not found", http.StatusNotFound)
+}
+
+// queueHandler reports the number of running scripts and waiting requests of a rule. Like the job status, the queue
+// is protected by the middleware of the rule, so it's only visible to those allowed to run the script.
+func (s *Server) queueHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("rule")
+	for _, rule := range *s.Rules() {
+		if rule.ID() == name && rule.Action() == rules.RunScript {
+			s.middleware(rule).Collection(s.queues.StatsHandler(rule.ID())).ServeHTTP(w, r)
+			return
+		}
+	}
+	http.Error(w, "queue not found", http.StatusNotFound)
 }
 
 // Shutdown performs a clean shutdown of the http.Server
@@ -143,6 +462,12 @@ func (s *Server) Shutdown() {
 	defer cancel()
 
 	_ = s.srv.Shutdown(shutdownCtx)
+	if err := s.limits.Save(); err != nil {
+		s.logger.Errorf("%s", err)
+	}
+	if err := s.tracer.Shutdown(shutdownCtx); err != nil {
+		s.logger.Errorf("error exporting the remaining spans: %s", err)
+	}
 }
 
 // WaitUntilDone waits until ctrl+c, ctx done or stopped
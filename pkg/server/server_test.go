@@ -7,6 +7,11 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,7 +22,9 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/health"
 	"github.com/http-everything/httpe/pkg/server"
+	"github.com/http-everything/httpe/pkg/share/clientcert/testca"
 	"github.com/http-everything/httpe/pkg/share/logger"
 )
 
@@ -114,6 +121,75 @@ func TestShouldConnect(t *testing.T) {
 	assert.Equal(t, "hello world", string(body))
 }
 
+func TestShouldAuthenticateClientCertificates(t *testing.T) {
+	ca, err := testca.New()
+	require.NoError(t, err)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.PEM(), 0600))
+	build, _, err := ca.Issue("build")
+	require.NoError(t, err)
+	other, _, err := ca.Issue("other")
+	require.NoError(t, err)
+
+	cfg, testLogger := makeTestConfig(t)
+	cfg.S.CertFile = "../../testdata/certs/testcert.pem"
+	cfg.S.KeyFile = "../../testdata/certs/testkey.pem"
+	cfg.S.ClientCAFile = caFile
+	ru := &[]rules.Rule{
+		{
+			On:            &rules.On{Path: "/deploy"},
+			AnswerContent: "deployed",
+			With:          &rules.With{AuthMTLS: &rules.AuthMTLS{Allow: []string{"build"}}},
+		},
+		{
+			On:            &rules.On{Path: "/public"},
+			AnswerContent: "public",
+		},
+	}
+	accessLog := &bytes.Buffer{}
+	svr, err := server.New(cfg, ru, testLogger, accessLog)
+	require.NoError(t, err)
+	svr.Setup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, svr.Serve(ctx, false))
+	// allow the TLS server a little time to initialise
+	time.Sleep(200 * time.Millisecond)
+
+	cases := []struct {
+		name     string
+		path     string
+		cert     *tls.Certificate
+		wantCode int
+	}{
+		{name: "no certificate", path: "/deploy", wantCode: http.StatusUnauthorized},
+		{name: "allowed certificate", path: "/deploy", cert: &build, wantCode: http.StatusOK},
+		{name: "certificate not allowed", path: "/deploy", cert: &other, wantCode: http.StatusForbidden},
+		{name: "certificate optional", path: "/public", wantCode: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tlsCfg := &tls.Config{
+				//nolint:gosec
+				InsecureSkipVerify: true,
+			}
+			if tc.cert != nil {
+				tlsCfg.Certificates = []tls.Certificate{*tc.cert}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+			res, err := client.Get("https://127.0.0.1:3000" + tc.path)
+			require.NoError(t, err)
+			res.Body.Close()
+			assert.Equal(t, tc.wantCode, res.StatusCode)
+		})
+	}
+	svr.Shutdown()
+
+	assert.Contains(t, accessLog.String(), `- build [`)
+	assert.Contains(t, accessLog.String(), `"GET /deploy HTTP/1.1" 200 8 "" "Go-http-client/1.1" "CN=build,O=httpe" "sha256:`)
+}
+
 func makeTestConfig(t *testing.T) (cfg *config.Config, l *logger.Logger) {
 	t.Helper()
 
@@ -126,3 +202,627 @@ func makeTestConfig(t *testing.T) (cfg *config.Config, l *logger.Logger) {
 	}
 	return cfg, l
 }
+
+func TestShouldReloadRules(t *testing.T) {
+	cfg, testLogger := makeTestConfig(t)
+	ru := &[]rules.Rule{
+		{
+			On:            &rules.On{Path: "/old"},
+			AnswerContent: "old",
+		},
+	}
+
+	svr, err := server.New(cfg, ru, testLogger, nil)
+	require.NoError(t, err)
+
+	svr.Setup()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		svr.Handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	assert.Equal(t, "old", get("/old").Body.String())
+
+	svr.Reload(&[]rules.Rule{
+		{
+			On:            &rules.On{Path: "/new"},
+			AnswerContent: "new",
+		},
+	})
+
+	assert.Equal(t, http.StatusNotFound, get("/old").Code)
+	assert.Equal(t, "new", get("/new").Body.String())
+	assert.Len(t, *svr.Rules(), 1)
+}
+
+func TestShouldReportJobStatus(t *testing.T) {
+	cfg, testLogger := makeTestConfig(t)
+	cfg.S.DataDir = t.TempDir()
+	cfg.S.DataRetention = "1d"
+	ru := &[]rules.Rule{
+		{
+			Name:      "Async",
+			On:        &rules.On{Path: "/async"},
+			RunScript: "echo async",
+			Args:      rules.Args{Async: true},
+			With: &rules.With{
+				AuthBasic: []rules.User{{Username: "john", Password: "secret"}},
+			},
+		},
+	}
+
+	svr, err := server.New(cfg, ru, testLogger, nil)
+	require.NoError(t, err)
+	svr.Setup()
+
+	req := httptest.NewRequest("GET", "/async", nil)
+	req.SetBasicAuth("john", "secret")
+	w := httptest.NewRecorder()
+	svr.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	location := w.Header().Get("Location")
+	require.NotEmpty(t, location)
+
+	t.Run("job requires the auth of the rule", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		svr.Handler.ServeHTTP(w, httptest.NewRequest("GET", location, nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("job status", func(t *testing.T) {
+		assert.Eventually(t, func() bool {
+			req := httptest.NewRequest("GET", location, nil)
+			req.SetBasicAuth("john", "secret")
+			w := httptest.NewRecorder()
+			svr.Handler.ServeHTTP(w, req)
+			return w.Code == http.StatusOK && strings.Contains(w.Body.String(), `"status": "finished"`)
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("unknown job", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		svr.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/_jobs/unknown", nil))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+// The status of a job is protected by the authentication of the rule only. A poll has no signed body and doesn't
+// count against the rate limit.
+func TestShouldReportJobOfSignedRule(t *testing.T) {
+	cfg, testLogger := makeTestConfig(t)
+	cfg.S.DataDir = t.TempDir()
+	cfg.S.DataRetention = "1d"
+	ru := &[]rules.Rule{
+		{
+			On:        &rules.On{Path: "/hook", Methods: []string{"POST"}},
+			RunScript: "echo hook",
+			Args:      rules.Args{Async: true},
+			With: &rules.With{
+				AuthBasic: []rules.User{{Username: "john", Password: "secret"}},
+				HMAC:      &rules.HMAC{Type: rules.HMACGitHub, Secret: "It's a Secret to Everybody"},
+				RateLimit: &rules.RateLimit{Rate: "1/h"},
+			},
+		},
+	}
+
+	svr, err := server.New(cfg, ru, testLogger, nil)
+	require.NoError(t, err)
+	svr.Setup()
+
+	req := httptest.NewRequest("POST", "/hook", strings.NewReader("Hello, World!"))
+	req.SetBasicAuth("john", "secret")
+	req.Header.Set("X-Hub-Signature-256", "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17")
+	w := httptest.NewRecorder()
+	svr.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	location := w.Header().Get("Location")
+	require.NotEmpty(t, location)
+
+	w = httptest.NewRecorder()
+	svr.Handler.ServeHTTP(w, httptest.NewRequest("GET", location, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Eventually(t, func() bool {
+		req := httptest.NewRequest("GET", location, nil)
+		req.SetBasicAuth("john", "secret")
+		w := httptest.NewRecorder()
+		svr.Handler.ServeHTTP(w, req)
+		return w.Code == http.StatusOK && strings.Contains(w.Body.String(), `"status": "finished"`)
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestShouldReportQueue(t *testing.T) {
+	cfg, testLogger := makeTestConfig(t)
+	ru := &[]rules.Rule{
+		{
+			Name:      "Deploy",
+			On:        &rules.On{Path: "/deploy"},
+			RunScript: "echo deploy",
+			Args:      rules.Args{MaxConcurrency: 1},
+			With: &rules.With{
+				AuthBasic: []rules.User{{Username: "john", Password: "secret"}},
+			},
+		},
+		{
+			Name:          "Hello",
+			On:            &rules.On{Path: "/hello"},
+			AnswerContent: "hello",
+		},
+	}
+
+	svr, err := server.New(cfg, ru, testLogger, nil)
+	require.NoError(t, err)
+	svr.Setup()
+
+	cases := []struct {
+		name       string
+		url        string
+		auth       bool
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "queue", url: "/_queues?rule=Deploy", auth: true, wantStatus: http.StatusOK,
+			wantBody: `{"rule":"Deploy","running":0,"waiting":0}`},
+		{name: "queue requires the auth of the rule", url: "/_queues?rule=Deploy", wantStatus: http.StatusUnauthorized},
+		{name: "rule without script", url: "/_queues?rule=Hello", wantStatus: http.StatusNotFound},
+		{name: "unknown rule", url: "/_queues?rule=Unknown", wantStatus: http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tc.url, nil)
+			if tc.auth {
+				req.SetBasicAuth("john", "secret")
+			}
+			w := httptest.NewRecorder()
+			svr.Handler.ServeHTTP(w, req)
+			assert.Equal(t, tc.wantStatus, w.Code)
+			if tc.wantBody != "" {
+				assert.JSONEq(t, tc.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestShouldRouteByPattern(t *testing.T) {
+	cfg, testLogger := makeTestConfig(t)
+	ru := &[]rules.Rule{
+		{
+			On:            &rules.On{Path: "/deploy/{env:prod|staging}/{version:semver}", Methods: []string{"post"}},
+			AnswerContent: "deploy {{ .Input.URLPlaceholders.version }} to {{ .Input.URLPlaceholders.env }}",
+		},
+		{
+			On:            &rules.On{Path: "/files/{file...}"},
+			AnswerContent: "file {{ .Input.URLPlaceholders.file }}",
+		},
+		{
+			On:            &rules.On{Path: "/tenant", Host: "{tenant}.example.com"},
+			AnswerContent: "tenant {{ .Input.URLPlaceholders.tenant }}",
+		},
+	}
+
+	svr, err := server.New(cfg, ru, testLogger, nil)
+	require.NoError(t, err)
+	svr.Setup()
+
+	cases := []struct {
+		name       string
+		method     string
+		url        string
+		wantStatus int
+		wantBody   string
+		wantAllow  string
+	}{
+		{
+			name:       "typed placeholders",
+			method:     "POST",
+			url:        "/deploy/prod/1.2.3",
+			wantStatus: http.StatusOK,
+			wantBody:   "deploy 1.2.3 to prod",
+		},
+		{
+			name:       "placeholder doesn't match the regex",
+			method:     "POST",
+			url:        "/deploy/dev/1.2.3",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "/deploy/dev/1.2.3 not found: placeholder {env} doesn't accept 'dev', expected prod|staging\n",
+		},
+		{
+			name:       "placeholder doesn't match the type",
+			method:     "POST",
+			url:        "/deploy/prod/latest",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "/deploy/prod/latest not found: placeholder {version} doesn't accept 'latest', expected semver\n",
+		},
+		{
+			name:       "method not allowed",
+			method:     "GET",
+			url:        "/deploy/prod/1.2.3",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBody:   "method GET not allowed for /deploy/prod/1.2.3\n",
+			wantAllow:  "POST",
+		},
+		{
+			name:       "wildcard tail",
+			method:     "GET",
+			url:        "/files/a/b/c.txt",
+			wantStatus: http.StatusOK,
+			wantBody:   "file a/b/c.txt",
+		},
+		{
+			name:       "host",
+			method:     "GET",
+			url:        "http://acme.example.com:3000/tenant",
+			wantStatus: http.StatusOK,
+			wantBody:   "tenant acme",
+		},
+		{
+			name:       "other host",
+			method:     "GET",
+			url:        "http://example.org/tenant",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "http://example.org/tenant not found\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			svr.Handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.url, nil))
+			assert.Equal(t, tc.wantStatus, w.Code)
+			assert.Equal(t, tc.wantBody, w.Body.String())
+			assert.Equal(t, tc.wantAllow, w.Header().Get("Allow"))
+		})
+	}
+}
+
+func TestShouldResolveClientIPBehindProxy(t *testing.T) {
+	cfg, testLogger := makeTestConfig(t)
+	cfg.S.TrustedProxies = []string{"10.0.0.1"}
+	cfg.S.DenyCIDRs = []string{"203.0.113.0/24"}
+	ru := &[]rules.Rule{
+		{
+			On:            &rules.On{Path: "/internal", SourceIPs: []string{"192.168.0.0/16"}},
+			AnswerContent: "internal {{ .Meta.RemoteAddr }}",
+		},
+		{
+			On:            &rules.On{Path: "/office"},
+			AnswerContent: "office {{ .Meta.RemoteAddr }}",
+			With:          &rules.With{AllowCIDRs: []string{"198.51.100.0/24"}},
+		},
+	}
+	accessLog := &bytes.Buffer{}
+	svr, err := server.New(cfg, ru, testLogger, accessLog)
+	require.NoError(t, err)
+	svr.Setup()
+
+	cases := []struct {
+		name          string
+		path          string
+		remoteAddr    string
+		forwardedFor  string
+		wantStatus    int
+		wantBody      string
+		wantAccessLog string
+	}{
+		{name: "client behind proxy", path: "/office", remoteAddr: "10.0.0.1:4711", forwardedFor: "198.51.100.7",
+			wantStatus: http.StatusOK, wantBody: "office 198.51.100.7", wantAccessLog: "198.51.100.7 - - ["},
+		{name: "rule allow list", path: "/office", remoteAddr: "10.0.0.1:4711", forwardedFor: "192.168.1.1",
+			wantStatus: http.StatusForbidden, wantAccessLog: "192.168.1.1 - - ["},
+		{name: "routing by client IP", path: "/internal", remoteAddr: "10.0.0.1:4711", forwardedFor: "192.168.1.1",
+			wantStatus: http.StatusOK, wantBody: "internal 192.168.1.1"},
+		{name: "only the closest hop counts", path: "/internal", remoteAddr: "10.0.0.1:4711", forwardedFor: "203.0.113.1, 192.168.1.1",
+			wantStatus: http.StatusOK, wantBody: "internal 192.168.1.1"},
+		{name: "globally denied", path: "/office", remoteAddr: "10.0.0.1:4711", forwardedFor: "203.0.113.1",
+			wantStatus: http.StatusForbidden},
+		{name: "untrusted proxy", path: "/office", remoteAddr: "192.0.2.1:4711", forwardedFor: "198.51.100.7",
+			wantStatus: http.StatusForbidden, wantAccessLog: "192.0.2.1 - - ["},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			accessLog.Reset()
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tc.path, nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			svr.Handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.wantStatus, w.Code)
+			if tc.wantBody != "" {
+				assert.Equal(t, tc.wantBody, w.Body.String())
+			}
+			assert.True(t, strings.HasPrefix(accessLog.String(), tc.wantAccessLog), accessLog.String())
+		})
+	}
+}
+
+func TestShouldRouteByConditions(t *testing.T) {
+	cfg, testLogger := makeTestConfig(t)
+	ru := &[]rules.Rule{
+		{
+			On: &rules.On{
+				Path:    "/webhook",
+				Methods: []string{"post"},
+				Headers: map[string]string{"X-GitHub-Event": "push"},
+			},
+			AnswerContent: "push",
+		},
+		{
+			On: &rules.On{
+				Path:    "/webhook",
+				Methods: []string{"post"},
+				Headers: map[string]string{"X-GitHub-Event": "pull_request"},
+			},
+			AnswerContent: "pull request",
+		},
+	}
+
+	svr, err := server.New(cfg, ru, testLogger, nil)
+	require.NoError(t, err)
+	svr.Setup()
+
+	cases := []struct {
+		name       string
+		method     string
+		event      string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "push", method: "POST", event: "push", wantStatus: http.StatusOK, wantBody: "push"},
+		{name: "pull request", method: "POST", event: "pull_request", wantStatus: http.StatusOK, wantBody: "pull request"},
+		{
+			name:       "unknown event",
+			method:     "POST",
+			event:      "issues",
+			wantStatus: http.StatusNotFound,
+			wantBody:   "/webhook not found: header X-GitHub-Event doesn't match\n",
+		},
+		{
+			name:       "wrong method",
+			method:     "GET",
+			event:      "push",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBody:   "method GET not allowed for /webhook\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/webhook", nil)
+			req.Header.Set("X-GitHub-Event", tc.event)
+			w := httptest.NewRecorder()
+			svr.Handler.ServeHTTP(w, req)
+			assert.Equal(t, tc.wantStatus, w.Code)
+			assert.Equal(t, tc.wantBody, w.Body.String())
+		})
+	}
+}
+
+func TestShouldServeMetrics(t *testing.T) {
+	cfg, testLogger := makeTestConfig(t)
+	cfg.Metrics = &config.EndpointAuthConfig{Token: "token"}
+	ru := &[]rules.Rule{
+		{
+			Name:      "Script",
+			On:        &rules.On{Path: "/script"},
+			RunScript: "echo hello",
+		},
+	}
+	svr, err := server.New(cfg, ru, testLogger, nil)
+	require.NoError(t, err)
+	svr.Setup()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/script", strings.NewReader("name=john"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	svr.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	svr.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/_metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/_metrics", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	svr.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `httpe_requests_total{rule="Script",code="200"} 1`)
+	assert.Contains(t, w.Body.String(), `httpe_script_exits_total{rule="Script",code="0"} 1`)
+	assert.Contains(t, w.Body.String(), `httpe_request_body_bytes_sum{rule="Script"} 9`)
+	assert.Contains(t, w.Body.String(), `httpe_scripts_in_flight{rule="Script"} 0`)
+}
+
+func TestShouldExportTraces(t *testing.T) {
+	var mu sync.Mutex
+	spans := make(map[string]string)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, m := range regexp.MustCompile(`"spanId":"(\w+)",(?:"parentSpanId":"\w+",)?"name":"([^"]+)"`).
+			FindAllStringSubmatch(string(body), -1) {
+			spans[m[2]] = m[1]
+		}
+	}))
+	defer collector.Close()
+
+	cfg, testLogger := makeTestConfig(t)
+	cfg.Tracing = &config.TracingConfig{Endpoint: collector.URL}
+	ru := &[]rules.Rule{
+		{
+			Name:      "Script",
+			On:        &rules.On{Path: "/script"},
+			RunScript: "echo $TRACEPARENT",
+		},
+	}
+	svr, err := server.New(cfg, ru, testLogger, nil)
+	require.NoError(t, err)
+	svr.Setup()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/script", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	svr.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	svr.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range []string{"rule Script", "middleware", "collect request data", "action run.script",
+		"render response"} {
+		assert.Contains(t, spans, name)
+	}
+	// The script continues the trace as child of the action span
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+spans["action run.script"]+"-01",
+		strings.TrimSpace(w.Body.String()))
+}
+
+func TestShouldLogRequestID(t *testing.T) {
+	cfg, _ := makeTestConfig(t)
+	cfg.S.DataDir = t.TempDir()
+	logFile := filepath.Join(t.TempDir(), "server.log")
+	testLogger, err := logger.NewWithFormat("test", logFile, logger.DEBUG, logger.JSON)
+	require.NoError(t, err)
+	ru := &[]rules.Rule{
+		{
+			Name:      "Script",
+			On:        &rules.On{Path: "/script"},
+			RunScript: `echo "{{ .Meta.RequestID }} $HTTPE_REQUEST_ID"`,
+		},
+	}
+	svr, err := server.New(cfg, ru, testLogger, nil)
+	require.NoError(t, err)
+	svr.Setup()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/script", nil)
+	req.Header.Set("X-Request-ID", "abc123")
+	svr.Handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "abc123", w.Header().Get("X-Request-ID"))
+	assert.Equal(t, "abc123 abc123\n", w.Body.String())
+
+	log, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Regexp(t, `"msg":"action finished","request_id":"abc123","remote_ip":"192.0.2.1",`+
+		`"rule":"Script","action":"run.script","exit_code":0,"duration":[0-9.]+}`, string(log))
+
+	// Requests without ID get one assigned
+	w = httptest.NewRecorder()
+	svr.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/script", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	id := w.Header().Get("X-Request-ID")
+	require.NotEmpty(t, id)
+	assert.Equal(t, id+" "+id+"\n", w.Body.String())
+}
+
+func TestShouldWriteJSONAccessLog(t *testing.T) {
+	cfg, testLogger := makeTestConfig(t)
+	cfg.S.DataDir = t.TempDir()
+	cfg.S.AccessLogFormat = "json"
+	ru := &[]rules.Rule{
+		{
+			Name:      "Hook",
+			On:        &rules.On{Path: "/hook/{token}"},
+			RunScript: "exit 3",
+			With: &rules.With{
+				AuthBasic: []rules.User{{Username: "john", Password: "secret"}},
+				AccessLog: &rules.AccessLog{Redact: []string{"token", "sig"}},
+			},
+		},
+		{
+			Name:          "Health",
+			On:            &rules.On{Path: "/health"},
+			AnswerContent: "ok",
+			With:          &rules.With{AccessLog: &rules.AccessLog{Disable: true}},
+		},
+	}
+	accessLog := &bytes.Buffer{}
+	svr, err := server.New(cfg, ru, testLogger, accessLog)
+	require.NoError(t, err)
+	svr.Setup()
+
+	req := httptest.NewRequest("GET", "/hook/s3cr3t?sig=abc&page=2", nil)
+	req.Header.Set("X-Request-ID", "abc123")
+	req.SetBasicAuth("john", "secret")
+	svr.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Regexp(t, `^\{"time":"[^"]+","remote_ip":"192.0.2.1","user":"john","method":"GET",`+
+		`"uri":"/hook/REDACTED\?sig=REDACTED&page=2","proto":"HTTP/1.1","status":[0-9]+,"size":[0-9]+,`+
+		`"duration":[0-9.e-]+,"request_id":"abc123","rule":"Hook","action":"run.script","exit_code":3\}\n$`,
+		accessLog.String())
+
+	// Rejected requests are redacted, too
+	accessLog.Reset()
+	svr.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hook/s3cr3t", nil))
+	assert.Contains(t, accessLog.String(), `"uri":"/hook/REDACTED","proto":"HTTP/1.1","status":401,`)
+	assert.NotContains(t, accessLog.String(), "s3cr3t")
+
+	accessLog.Reset()
+	svr.Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	assert.Empty(t, accessLog.String())
+}
+
+func TestShouldServeHealthReadyAndInfo(t *testing.T) {
+	cfg, testLogger := makeTestConfig(t)
+	cfg.S.DataDir = t.TempDir()
+	cfg.S.RulesFile = "/etc/httpe/rules.yaml"
+	cfg.Info = &config.EndpointAuthConfig{Token: "token"}
+	ru := &[]rules.Rule{
+		{
+			On:            &rules.On{Path: "/hello"},
+			AnswerContent: "hello",
+		},
+	}
+	reloading := false
+	svr, err := server.New(cfg, ru, testLogger, nil, server.WithReadyChecks(health.Reload(func() bool {
+		return reloading
+	})))
+	require.NoError(t, err)
+	svr.Setup()
+
+	cases := []struct {
+		name       string
+		path       string
+		token      string
+		reloading  bool
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "health", path: "/_health", wantStatus: http.StatusOK, wantBody: `{"status":"ok"}`},
+		{name: "ready", path: "/_ready", wantStatus: http.StatusOK,
+			wantBody: `{"status":"ready","checks":{"data_dir":"ok","reload":"ok"}}`},
+		{name: "reloading", path: "/_ready", reloading: true, wantStatus: http.StatusServiceUnavailable,
+			wantBody: `{"status":"not ready","checks":{"data_dir":"ok","reload":"failed"}}`},
+		{name: "info without token", path: "/_info", wantStatus: http.StatusUnauthorized},
+		{name: "info", path: "/_info", token: "token", wantStatus: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			reloading = tc.reloading
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tc.path, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			svr.Handler.ServeHTTP(w, req)
+			assert.Equal(t, tc.wantStatus, w.Code)
+			if tc.wantBody != "" {
+				assert.JSONEq(t, tc.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/_info", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	svr.Handler.ServeHTTP(w, req)
+	assert.Regexp(t, `^\{"version":"[^"]+","started":"[^"]+","uptime":"0s","rules":1,`+
+		`"rules_file":"/etc/httpe/rules.yaml","config":""\}\n$`, w.Body.String())
+
+	// data_dir can't be written to once it's gone
+	require.NoError(t, os.Remove(cfg.S.DataDir))
+	w = httptest.NewRecorder()
+	svr.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/_ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), `"data_dir":"failed"`)
+}
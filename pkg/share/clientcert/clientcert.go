@@ -0,0 +1,94 @@
+package clientcert
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Cert describes the verified TLS client certificate of a request
+type Cert struct {
+	Subject     string   `json:"subject"`
+	CommonName  string   `json:"common_name"`
+	DNSNames    []string `json:"dns_names"`
+	Emails      []string `json:"emails"`
+	URIs        []string `json:"uris"`
+	Fingerprint string   `json:"fingerprint"`
+}
+
+// FromRequest returns the client certificate of the request, if the client has presented one that has been
+// verified against the client CAs. Unverified certificates are ignored.
+func FromRequest(r *http.Request) (Cert, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Cert{}, false
+	}
+	c := r.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(c.Raw)
+	cert := Cert{
+		Subject:     c.Subject.String(),
+		CommonName:  c.Subject.CommonName,
+		DNSNames:    c.DNSNames,
+		Emails:      c.EmailAddresses,
+		Fingerprint: "sha256:" + hex.EncodeToString(sum[:]),
+	}
+	for _, uri := range c.URIs {
+		cert.URIs = append(cert.URIs, uri.String())
+	}
+	return cert, true
+}
+
+// Names returns the common name followed by all subject alternative names
+func (c Cert) Names() (names []string) {
+	if c.CommonName != "" {
+		names = append(names, c.CommonName)
+	}
+	names = append(names, c.DNSNames...)
+	names = append(names, c.Emails...)
+	return append(names, c.URIs...)
+}
+
+// Matches reports whether the common name or one of the subject alternative names is in the allow list.
+// A leading "*." in the allow list matches exactly one label, e.g. "*.ci.example.com" matches
+// "runner1.ci.example.com". An empty allow list matches every certificate.
+func (c Cert) Matches(allow []string) bool {
+	if len(allow) == 0 {
+		return true
+	}
+	for _, name := range c.Names() {
+		for _, pattern := range allow {
+			if matchName(pattern, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchName(pattern string, name string) bool {
+	if strings.EqualFold(pattern, name) {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(pattern, "*.")
+	if !ok {
+		return false
+	}
+	label, rest, ok := strings.Cut(name, ".")
+	return ok && label != "" && strings.EqualFold(rest, suffix)
+}
+
+// LoadPool reads the PEM encoded CA certificates used to verify client certificates
+func LoadPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM encoded certificates found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,78 @@
+package clientcert_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/share/clientcert"
+	"github.com/http-everything/httpe/pkg/share/clientcert/testca"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromRequest(t *testing.T) {
+	ca, err := testca.New()
+	require.NoError(t, err)
+	_, chain, err := ca.Issue("build", "runner1.ci.example.com")
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	_, ok := clientcert.FromRequest(req)
+	assert.False(t, ok, "plain http")
+
+	req.TLS = &tls.ConnectionState{PeerCertificates: chain[:1]}
+	_, ok = clientcert.FromRequest(req)
+	assert.False(t, ok, "certificate not verified")
+
+	req.TLS = &tls.ConnectionState{PeerCertificates: chain[:1], VerifiedChains: [][]*x509.Certificate{chain}}
+	cert, ok := clientcert.FromRequest(req)
+	require.True(t, ok)
+	assert.Equal(t, "CN=build,O=httpe", cert.Subject)
+	assert.Equal(t, "build", cert.CommonName)
+	assert.Equal(t, []string{"build", "runner1.ci.example.com"}, cert.Names())
+	assert.True(t, strings.HasPrefix(cert.Fingerprint, "sha256:"))
+	assert.Len(t, cert.Fingerprint, len("sha256:")+64)
+}
+
+func TestMatches(t *testing.T) {
+	cert := clientcert.Cert{CommonName: "build", DNSNames: []string{"runner1.ci.example.com"}}
+	cases := []struct {
+		name  string
+		allow []string
+		want  bool
+	}{
+		{name: "no allow list", want: true},
+		{name: "common name", allow: []string{"deploy", "build"}, want: true},
+		{name: "dns name", allow: []string{"RUNNER1.ci.example.com"}, want: true},
+		{name: "wildcard", allow: []string{"*.ci.example.com"}, want: true},
+		{name: "wildcard matches one label only", allow: []string{"*.example.com"}},
+		{name: "no match", allow: []string{"deploy"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, cert.Matches(tc.allow))
+		})
+	}
+}
+
+func TestLoadPool(t *testing.T) {
+	ca, err := testca.New()
+	require.NoError(t, err)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.PEM(), 0600))
+	pool, err := clientcert.LoadPool(caFile)
+	require.NoError(t, err)
+	assert.NotNil(t, pool)
+
+	noPEM := filepath.Join(dir, "empty.pem")
+	require.NoError(t, os.WriteFile(noPEM, []byte("no certificate"), 0600))
+	_, err = clientcert.LoadPool(noPEM)
+	assert.ErrorContains(t, err, "no PEM encoded certificates found")
+}
@@ -0,0 +1,79 @@
+package endpointauth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/share/password"
+	"github.com/http-everything/httpe/pkg/share/secret"
+)
+
+// ErrCredentialsMissing is returned by New if the config neither sets a token nor a password
+var ErrCredentialsMissing = errors.New("a token or a username and password is required")
+
+// Auth protects built-in endpoints, like the metrics and the info endpoint, from being read by anyone. Clients
+// authenticate by the bearer token or by HTTP basic auth with the username and password.
+type Auth struct {
+	Token    string
+	Username string
+	// Password is either clear text or a hash supported by users files
+	Password string
+}
+
+// New resolves the secrets of the config
+func New(cfg *config.EndpointAuthConfig) (auth Auth, err error) {
+	if cfg.Token != "" || cfg.TokenFile != "" {
+		if auth.Token, err = secret.Resolve(cfg.Token, cfg.TokenFile, ""); err != nil {
+			return auth, err
+		}
+	}
+	if cfg.Password != "" || cfg.PasswordFile != "" {
+		if auth.Password, err = secret.Resolve(cfg.Password, cfg.PasswordFile, ""); err != nil {
+			return auth, err
+		}
+		if err = password.Check(auth.Password); err != nil {
+			return auth, err
+		}
+		auth.Username = cfg.Username
+	}
+	if auth.Token == "" && auth.Password == "" {
+		return auth, ErrCredentialsMissing
+	}
+	return auth, nil
+}
+
+// Protect passes requests with valid credentials to next, others are rejected with 401 Unauthorized
+func (a Auth) Protect(next http.Handler, logger *logger.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, err := a.Verify(r)
+		if err != nil {
+			logger.Errorf("error verifying credentials for %s: %s", r.URL.Path, err)
+		}
+		if !ok {
+			w.Header().Add("WWW-Authenticate", "Basic realm='Authorization required'")
+			w.Header().Add("WWW-Authenticate", "Bearer realm='Authorization required'")
+			http.Error(w, "Unauthorised", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Verify reports whether the request carries valid credentials
+func (a Auth) Verify(r *http.Request) (bool, error) {
+	if a.Token != "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			return subtle.ConstantTimeCompare([]byte(a.Token), []byte(token)) == 1, nil
+		}
+	}
+	if a.Password != "" {
+		if user, pass, ok := r.BasicAuth(); ok && user == a.Username {
+			return password.Verify(a.Password, pass, password.Plain)
+		}
+	}
+	return false, nil
+}
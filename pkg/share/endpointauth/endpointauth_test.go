@@ -0,0 +1,101 @@
+package endpointauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/share/endpointauth"
+	"github.com/http-everything/httpe/pkg/share/logger"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuth(t *testing.T) {
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	cases := []struct {
+		name     string
+		cfg      config.EndpointAuthConfig
+		setup    func(r *http.Request)
+		wantCode int
+		wantErr  string
+	}{
+		{
+			name:     "Token",
+			cfg:      config.EndpointAuthConfig{Token: "token"},
+			setup:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") },
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Wrong token",
+			cfg:      config.EndpointAuthConfig{Token: "token"},
+			setup:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "Password",
+			cfg:      config.EndpointAuthConfig{Username: "prometheus", Password: "secret"},
+			setup:    func(r *http.Request) { r.SetBasicAuth("prometheus", "secret") },
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Hashed password",
+			cfg:      config.EndpointAuthConfig{Username: "prometheus", Password: string(hash)},
+			setup:    func(r *http.Request) { r.SetBasicAuth("prometheus", "secret") },
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Wrong user",
+			cfg:      config.EndpointAuthConfig{Username: "prometheus", Password: "secret"},
+			setup:    func(r *http.Request) { r.SetBasicAuth("grafana", "secret") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "Basic auth with token only",
+			cfg:      config.EndpointAuthConfig{Token: "token"},
+			setup:    func(r *http.Request) { r.SetBasicAuth("", "token") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "No credentials",
+			cfg:      config.EndpointAuthConfig{Token: "token"},
+			setup:    func(r *http.Request) {},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "No auth configured",
+			cfg:     config.EndpointAuthConfig{},
+			wantErr: endpointauth.ErrCredentialsMissing.Error(),
+		},
+		{
+			name:    "Missing token file",
+			cfg:     config.EndpointAuthConfig{TokenFile: filepath.Join(t.TempDir(), "token")},
+			wantErr: "error reading secret file",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			auth, err := endpointauth.New(&tc.cfg)
+			if tc.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/_metrics", nil)
+			tc.setup(req)
+			auth.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("metrics"))
+			}), l).ServeHTTP(w, req)
+			assert.Equal(t, tc.wantCode, w.Code)
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package escape
+
+import (
+	"strings"
+)
+
+// Shell quotes a string for POSIX shells like sh, bash or zsh. The string is enclosed in single quotes, inside
+// of which no character has a special meaning. Single quotes of the string close the quoted part,
+// are added escaped and reopen it.
+func Shell(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// PowerShell quotes a string for PowerShell. The string is enclosed in single quotes, so no variables or
+// sub-expressions are expanded. PowerShell treats typographic single quotes like ASCII single quotes,
+// all of them are escaped by doubling.
+func PowerShell(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('\'')
+	for _, r := range s {
+		switch r {
+		case '\'', '‘', '’', '‚', '‛':
+			sb.WriteRune(r)
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
+
+// Cmd escapes a string for cmd.exe batch files. Characters with a special meaning are escaped with a caret,
+// percent signs are doubled. Line breaks would terminate the command, so they are removed.
+func Cmd(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\r', '\n':
+			continue
+		case '%':
+			sb.WriteRune(r)
+		case '^', '&', '|', '<', '>', '(', ')', '"', '!':
+			sb.WriteByte('^')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
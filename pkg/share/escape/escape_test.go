@@ -0,0 +1,60 @@
+package escape_test
+
+import (
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/share/escape"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscape(t *testing.T) {
+	cases := []struct {
+		name  string
+		fn    func(string) string
+		input string
+		wants string
+	}{
+		{
+			name:  "shell",
+			fn:    escape.Shell,
+			input: "John",
+			wants: "'John'",
+		},
+		{
+			name:  "shell empty",
+			fn:    escape.Shell,
+			input: "",
+			wants: "''",
+		},
+		{
+			name:  "shell injection",
+			fn:    escape.Shell,
+			input: "'; rm -rf / #$(id)`id`",
+			wants: `''\''; rm -rf / #$(id)` + "`id`'",
+		},
+		{
+			name:  "powershell",
+			fn:    escape.PowerShell,
+			input: "$env:PATH; it's",
+			wants: "'$env:PATH; it''s'",
+		},
+		{
+			name:  "powershell typographic quotes",
+			fn:    escape.PowerShell,
+			input: "’; calc; ‘",
+			wants: "'’’; calc; ‘‘'",
+		},
+		{
+			name:  "cmd",
+			fn:    escape.Cmd,
+			input: "a & calc | \"%PATH%\"!\r\nb",
+			wants: "a ^& calc ^| ^\"%%PATH%%^\"^!b",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wants, tc.fn(tc.input))
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package logger
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type LogLevel int
@@ -18,6 +22,20 @@ const (
 	ERROR                  = "error"
 )
 
+type LogFormat int
+
+const (
+	FormatText   LogFormat = 0
+	FormatJSON   LogFormat = 1
+	FormatLogfmt LogFormat = 2
+	TEXT                   = "text"
+	JSON                   = "json"
+	LOGFMT                 = "logfmt"
+)
+
+// timeFormat is the format of the timestamps of structured log lines
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
 // ParseLogLevel parses the string representation of a log level and returns the corresponding LogLevel enum value.
 // It uses a map to map the string value to its corresponding LogLevel value.
 // If the given string value is found in the map, it returns the corresponding LogLevel value.
@@ -50,6 +68,20 @@ func LogLevelStr(level LogLevel) (levelStr string) {
 	return "unknown"
 }
 
+// ParseLogFormat parses the string representation of a log format. An empty string selects the text format.
+func ParseLogFormat(str string) (LogFormat, error) {
+	var m = map[string]LogFormat{
+		"":     FormatText,
+		TEXT:   FormatText,
+		JSON:   FormatJSON,
+		LOGFMT: FormatLogfmt,
+	}
+	if result, ok := m[str]; ok {
+		return result, nil
+	}
+	return FormatText, fmt.Errorf("invalid log format: %q", str)
+}
+
 type LogOutput struct {
 	File     *os.File
 	filePath string
@@ -86,13 +118,31 @@ type Logger struct {
 	logger *log.Logger
 	output LogOutput
 	level  LogLevel
+	format LogFormat
+	fields []field
+}
+
+// field is a key value pair added to every line of a logger
+type field struct {
+	key   string
+	value interface{}
 }
 
 func New(prefix string, filePath string, level string) (l *Logger, err error) {
+	return NewWithFormat(prefix, filePath, level, TEXT)
+}
+
+// NewWithFormat creates a logger writing lines in the given format. Text lines are meant to be read by humans, JSON
+// and logfmt lines by log processors.
+func NewWithFormat(prefix string, filePath string, level string, format string) (l *Logger, err error) {
 	logLevel, err := ParseLogLevel(level)
 	if err != nil {
 		return nil, err
 	}
+	logFormat, err := ParseLogFormat(format)
+	if err != nil {
+		return nil, err
+	}
 
 	logOutput := NewLogOutput(filePath)
 	err = logOutput.Start()
@@ -105,6 +155,7 @@ func New(prefix string, filePath string, level string) (l *Logger, err error) {
 	}
 
 	l = NewLogger(prefix, logOutput, logLevel)
+	l.setFormat(logFormat)
 	return l, nil
 }
 
@@ -118,6 +169,14 @@ func NewLogger(prefix string, output LogOutput, level LogLevel) *Logger {
 	return l
 }
 
+// setFormat sets the format of the lines. Structured lines carry their own timestamp.
+func (l *Logger) setFormat(format LogFormat) {
+	l.format = format
+	if format != FormatText {
+		l.logger.SetFlags(0)
+	}
+}
+
 func (l *Logger) Errorf(f string, args ...interface{}) {
 	l.Logf(LogLevelError, f, args...)
 }
@@ -136,19 +195,108 @@ func (l *Logger) Debugf(f string, args ...interface{}) {
 }
 
 func (l *Logger) Logf(severity LogLevel, f string, args ...interface{}) {
-	if l.level >= severity {
-		if l.prefix == "-" {
-			l.logger.Printf(LogLevelStr(severity)+": "+f, args...)
-		} else {
-			l.logger.Printf(LogLevelStr(severity)+": "+l.prefix+": "+f, args...)
+	if l.level < severity {
+		return
+	}
+	msg := fmt.Sprintf(f, args...)
+	switch l.format {
+	case FormatJSON:
+		l.logger.Print(l.jsonLine(severity, msg))
+	case FormatLogfmt:
+		l.logger.Print(l.logfmtLine(severity, msg))
+	default:
+		line := LogLevelStr(severity) + ": " + msg
+		if l.prefix != "-" {
+			line = LogLevelStr(severity) + ": " + l.prefix + ": " + msg
+		}
+		// Fields are appended in logfmt, so text lines can be searched by them, too
+		var b strings.Builder
+		b.WriteString(line)
+		for _, fld := range l.fields {
+			b.WriteByte(' ')
+			appendLogfmt(&b, fld.key, fld.value)
 		}
+		l.logger.Print(b.String())
+	}
+}
+
+func (l *Logger) jsonLine(severity LogLevel, msg string) string {
+	var b strings.Builder
+	b.WriteString(`{"time":`)
+	appendJSON(&b, time.Now().Format(timeFormat))
+	b.WriteString(`,"level":`)
+	appendJSON(&b, strings.ToLower(LogLevelStr(severity)))
+	if l.prefix != "-" {
+		b.WriteString(`,"logger":`)
+		appendJSON(&b, l.prefix)
+	}
+	b.WriteString(`,"msg":`)
+	appendJSON(&b, msg)
+	for _, fld := range l.fields {
+		b.WriteByte(',')
+		appendJSON(&b, fld.key)
+		b.WriteByte(':')
+		appendJSON(&b, fld.value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (l *Logger) logfmtLine(severity LogLevel, msg string) string {
+	var b strings.Builder
+	appendLogfmt(&b, "time", time.Now().Format(timeFormat))
+	b.WriteByte(' ')
+	appendLogfmt(&b, "level", strings.ToLower(LogLevelStr(severity)))
+	if l.prefix != "-" {
+		b.WriteByte(' ')
+		appendLogfmt(&b, "logger", l.prefix)
+	}
+	b.WriteByte(' ')
+	appendLogfmt(&b, "msg", msg)
+	for _, fld := range l.fields {
+		b.WriteByte(' ')
+		appendLogfmt(&b, fld.key, fld.value)
 	}
+	return b.String()
+}
+
+// appendJSON appends the JSON encoding of value. Values that can't be encoded are written as string.
+func appendJSON(b *strings.Builder, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	enc, err := json.Marshal(value)
+	if err != nil {
+		enc, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(enc)
+}
+
+// appendLogfmt appends key=value. Values containing spaces, quotes or equal signs are quoted.
+func appendLogfmt(b *strings.Builder, key string, value interface{}) {
+	b.WriteString(key)
+	b.WriteByte('=')
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n\\") {
+		s = strconv.Quote(s)
+	}
+	b.WriteString(s)
+}
+
+// With returns a copy of the logger adding the key value pair to every line. Loggers for a request use it to make
+// all lines of the request findable by its ID.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	ll := *l
+	ll.fields = append(append(make([]field, 0, len(l.fields)+1), l.fields...), field{key: key, value: value})
+	return &ll
 }
 
 func (l *Logger) Fork(prefix string, args ...interface{}) *Logger {
 	// slip the parent prefix at the front
 	args = append([]interface{}{l.prefix}, args...)
 	ll := NewLogger(fmt.Sprintf("%s: "+prefix, args...), l.output, l.level)
+	ll.setFormat(l.format)
+	ll.fields = l.fields
 	return ll
 }
 
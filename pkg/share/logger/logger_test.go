@@ -47,3 +47,50 @@ func TestLoggerInfoError(t *testing.T) {
 	assert.Empty(t, string(lf))
 	l.Shutdown()
 }
+
+func TestLoggerFormats(t *testing.T) {
+	cases := []struct {
+		format  string
+		want    string
+		wantErr string
+	}{
+		{
+			format: logger.TEXT,
+			want: `^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} INFO: test: rule: script "deploy" started ` +
+				`request_id=abc123 user="john doe" exit_code=0\n$`,
+		},
+		{
+			format: logger.JSON,
+			want: `^\{"time":"[0-9T:.+\-Z]+","level":"info","logger":"test: rule","msg":"script \\"deploy\\" started",` +
+				`"request_id":"abc123","user":"john doe","exit_code":0\}\n$`,
+		},
+		{
+			format: logger.LOGFMT,
+			want: `^time=[0-9T:.+\-Z]+ level=info logger="test: rule" msg="script \\"deploy\\" started" ` +
+				`request_id=abc123 user="john doe" exit_code=0\n$`,
+		},
+		{
+			format:  "xml",
+			wantErr: `invalid log format: "xml"`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.format, func(t *testing.T) {
+			logFile := t.TempDir() + "/httpe.log"
+			l, err := logger.NewWithFormat("test", logFile, logger.INFO, tc.format)
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer l.Shutdown()
+			reqLogger := l.Fork("rule").With("request_id", "abc123").With("user", "john doe")
+			reqLogger.With("exit_code", 0).Infof("script %q started", "deploy")
+			reqLogger.Debugf("not logged")
+
+			lf, err := os.ReadFile(logFile)
+			require.NoError(t, err)
+			assert.Regexp(t, tc.want, string(lf))
+		})
+	}
+}
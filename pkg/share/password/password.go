@@ -0,0 +1,245 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	Plain    = ""
+	SHA256   = "sha256"
+	SHA512   = "sha512"
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+	Scrypt   = "scrypt"
+
+	// Default is the algorithm used to create new hashes
+	Default = Argon2id
+
+	saltLength = 16
+	keyLength  = 32
+
+	// Parameters recommended by OWASP for new hashes
+	argon2Memory  = 64 * 1024
+	argon2Time    = 3
+	argon2Threads = 4
+	scryptLogN    = 15
+	scryptR       = 8
+	scryptP       = 1
+	bcryptCost    = 12
+
+	// Limits of the memory parameter of argon2id hashes in KiB. Argon2 requires at least 8 KiB per thread, the
+	// maximum keeps a crafted hash from exhausting the memory of the server.
+	argon2MinMemoryPerThread = 8
+	argon2MaxMemory          = 4 * 1024 * 1024
+	// Limits of scrypt hashes. The product of r and p must stay below 2^30, the memory of 128*r*2^ln bytes is capped
+	// like the one of argon2id.
+	scryptMaxLogN   = 30
+	scryptMaxRP     = 1 << 30
+	scryptMaxMemory = 1 << 30
+)
+
+var (
+	ErrUnknownAlgorithm = errors.New("unknown hashing algorithm")
+	ErrMalformedHash    = errors.New("malformed hash")
+
+	b64 = base64.RawStdEncoding
+)
+
+// Detect returns the algorithm of a hash in modular crypt format by its prefix, e.g. $2b$ for bcrypt or
+// $argon2id$ for argon2id. Returns an empty string for hashes without a known prefix, like hex encoded SHA
+// hashes and clear text passwords.
+func Detect(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return Bcrypt
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return Argon2id
+	case strings.HasPrefix(hash, "$scrypt$"):
+		return Scrypt
+	default:
+		return ""
+	}
+}
+
+// Verify reports whether the password matches the hash. The algorithm is detected from the hash. Hashes without
+// a known prefix are hashed with the fallback algorithm, which is one of Plain, SHA256 or SHA512.
+// All comparisons take constant time.
+func Verify(hash string, password string, fallback string) (bool, error) {
+	algorithm := Detect(hash)
+	if algorithm == "" {
+		algorithm = fallback
+	}
+	switch algorithm {
+	case Plain:
+		return equal([]byte(hash), []byte(password)), nil
+	case SHA256:
+		sum := sha256.Sum256([]byte(password))
+		return equal([]byte(strings.ToLower(hash)), []byte(hex.EncodeToString(sum[:]))), nil
+	case SHA512:
+		sum := sha512.Sum512([]byte(password))
+		return equal([]byte(strings.ToLower(hash)), []byte(hex.EncodeToString(sum[:]))), nil
+	case Bcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case Argon2id:
+		p, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+		key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key))) //nolint:gosec // disable G115
+		return equal(key, p.key), nil
+	case Scrypt:
+		p, err := parseScrypt(hash)
+		if err != nil {
+			return false, err
+		}
+		key, err := scrypt.Key([]byte(password), p.salt, 1<<p.logN, p.r, p.p, len(p.key))
+		if err != nil {
+			return false, err
+		}
+		return equal(key, p.key), nil
+	default:
+		return false, ErrUnknownAlgorithm
+	}
+}
+
+// Check returns an error if a hash with a known prefix is malformed
+func Check(hash string) error {
+	var err error
+	switch Detect(hash) {
+	case Bcrypt:
+		_, err = bcrypt.Cost([]byte(hash))
+	case Argon2id:
+		_, err = parseArgon2id(hash)
+	case Scrypt:
+		_, err = parseScrypt(hash)
+	}
+	return err
+}
+
+// Hash creates a salted hash of the password in modular crypt format using one of Bcrypt, Argon2id or Scrypt
+func Hash(password string, algorithm string) (string, error) {
+	switch algorithm {
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		return string(hash), err
+	case Argon2id:
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, keyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads, b64.EncodeToString(salt), b64.EncodeToString(key),
+		), nil
+	case Scrypt:
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+		key, err := scrypt.Key([]byte(password), salt, 1<<scryptLogN, scryptR, scryptP, keyLength)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+			scryptLogN, scryptR, scryptP, b64.EncodeToString(salt), b64.EncodeToString(key),
+		), nil
+	default:
+		return "", ErrUnknownAlgorithm
+	}
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2id parses hashes like $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func parseArgon2id(hash string) (p argon2Params, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, ErrMalformedHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, ErrMalformedHash
+	}
+	if version != argon2.Version {
+		return p, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, ErrMalformedHash
+	}
+	if p.time < 1 || p.threads < 1 || p.memory < argon2MinMemoryPerThread*uint32(p.threads) || p.memory > argon2MaxMemory {
+		return p, ErrMalformedHash
+	}
+	if p.salt, err = b64.DecodeString(parts[4]); err != nil {
+		return p, ErrMalformedHash
+	}
+	if p.key, err = b64.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return p, ErrMalformedHash
+	}
+	return p, nil
+}
+
+type scryptParams struct {
+	logN int
+	r    int
+	p    int
+	salt []byte
+	key  []byte
+}
+
+// parseScrypt parses hashes like $scrypt$ln=15,r=8,p=1$<salt>$<key>
+func parseScrypt(hash string) (p scryptParams, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		return p, ErrMalformedHash
+	}
+	if _, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.logN, &p.r, &p.p); err != nil {
+		return p, ErrMalformedHash
+	}
+	if p.logN < 1 || p.logN > scryptMaxLogN || p.r < 1 || p.p < 1 || p.r >= scryptMaxRP || p.p >= scryptMaxRP {
+		return p, ErrMalformedHash
+	}
+	if int64(p.r)*int64(p.p) >= scryptMaxRP || 128*int64(p.r)<<p.logN > scryptMaxMemory {
+		return p, ErrMalformedHash
+	}
+	if p.salt, err = b64.DecodeString(parts[3]); err != nil {
+		return p, ErrMalformedHash
+	}
+	if p.key, err = b64.DecodeString(parts[4]); err != nil || len(p.key) == 0 {
+		return p, ErrMalformedHash
+	}
+	return p, nil
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("error creating salt: %w", err)
+	}
+	return salt, nil
+}
+
+func equal(a []byte, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
@@ -0,0 +1,104 @@
+package password_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/share/password"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	bcryptHash   = "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW" // U*U
+	argon2idHash = "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$TJqEe8os/EHZfL3Vapc59ET5wfcEzIeGVsEYtgkuoKw"
+	scryptHash   = "$scrypt$ln=4,r=8,p=1$c2FsdHNhbHRzYWx0c2FsdA$5f/Vi+XRWGUNGScbsma6KJ4zLFIke/NJsrvr7lQLAyA"
+	sha256Hash   = "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"
+)
+
+// argon2idParams returns argon2idHash with other parameters
+func argon2idParams(params string) string {
+	return strings.Replace(argon2idHash, "m=1024,t=1,p=1", params, 1)
+}
+
+// scryptParams returns scryptHash with other parameters
+func scryptParams(params string) string {
+	return strings.Replace(scryptHash, "ln=4,r=8,p=1", params, 1)
+}
+
+func TestVerify(t *testing.T) {
+	cases := []struct {
+		name     string
+		hash     string
+		password string
+		fallback string
+		want     bool
+		wantErr  error
+	}{
+		{name: "plain", hash: "password", password: "password", want: true},
+		{name: "plain wrong", hash: "password", password: "Password"},
+		{name: "sha256", hash: sha256Hash, password: "password", fallback: password.SHA256, want: true},
+		{name: "sha256 wrong", hash: sha256Hash, password: "wrong", fallback: password.SHA256},
+		{name: "bcrypt", hash: bcryptHash, password: "U*U", want: true},
+		{name: "bcrypt wrong", hash: bcryptHash, password: "U*V"},
+		{name: "bcrypt ignores fallback", hash: bcryptHash, password: "U*U", fallback: password.SHA512, want: true},
+		{name: "argon2id", hash: argon2idHash, password: "password", want: true},
+		{name: "argon2id wrong", hash: argon2idHash, password: "wrong"},
+		{name: "scrypt", hash: scryptHash, password: "password", want: true},
+		{name: "scrypt wrong", hash: scryptHash, password: "wrong"},
+		{name: "malformed", hash: "$argon2id$v=19$m=1024", password: "password", wantErr: password.ErrMalformedHash},
+		{name: "argon2id time 0", hash: argon2idParams("m=1024,t=0,p=1"), password: "password", wantErr: password.ErrMalformedHash},
+		{name: "argon2id threads 0", hash: argon2idParams("m=1024,t=1,p=0"), password: "password", wantErr: password.ErrMalformedHash},
+		{name: "argon2id memory too low", hash: argon2idParams("m=31,t=1,p=4"), password: "password", wantErr: password.ErrMalformedHash},
+		{name: "argon2id memory too high", hash: argon2idParams("m=4194305,t=1,p=1"), password: "password", wantErr: password.ErrMalformedHash},
+		{name: "argon2id threads overflow", hash: argon2idParams("m=1024,t=1,p=256"), password: "password", wantErr: password.ErrMalformedHash},
+		{name: "scrypt ln 0", hash: scryptParams("ln=0,r=8,p=1"), password: "password", wantErr: password.ErrMalformedHash},
+		{name: "scrypt ln too high", hash: scryptParams("ln=31,r=1,p=1"), password: "password", wantErr: password.ErrMalformedHash},
+		{name: "scrypt r 0", hash: scryptParams("ln=4,r=0,p=1"), password: "password", wantErr: password.ErrMalformedHash},
+		{name: "scrypt p 0", hash: scryptParams("ln=4,r=8,p=0"), password: "password", wantErr: password.ErrMalformedHash},
+		{name: "scrypt r*p too high", hash: scryptParams("ln=1,r=32768,p=32768"), password: "password", wantErr: password.ErrMalformedHash},
+		{name: "scrypt memory too high", hash: scryptParams("ln=24,r=1,p=1"), password: "password", wantErr: password.ErrMalformedHash},
+		{name: "unknown algorithm", hash: "password", password: "password", fallback: "md5", wantErr: password.ErrUnknownAlgorithm},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, err := password.Verify(tc.hash, tc.password, tc.fallback)
+			assert.ErrorIs(t, err, tc.wantErr)
+			assert.Equal(t, tc.want, ok)
+		})
+	}
+}
+
+func TestHash(t *testing.T) {
+	for _, algorithm := range []string{password.Bcrypt, password.Argon2id, password.Scrypt} {
+		t.Run(algorithm, func(t *testing.T) {
+			hash, err := password.Hash("s3cr3t", algorithm)
+			require.NoError(t, err)
+			assert.Equal(t, algorithm, password.Detect(hash))
+			assert.NoError(t, password.Check(hash))
+
+			ok, err := password.Verify(hash, "s3cr3t", "")
+			require.NoError(t, err)
+			assert.True(t, ok)
+
+			again, err := password.Hash("s3cr3t", algorithm)
+			require.NoError(t, err)
+			assert.NotEqual(t, hash, again, "hashes must be salted")
+		})
+	}
+	_, err := password.Hash("s3cr3t", password.SHA256)
+	assert.ErrorIs(t, err, password.ErrUnknownAlgorithm)
+}
+
+func TestCheck(t *testing.T) {
+	assert.NoError(t, password.Check("clear text"))
+	assert.NoError(t, password.Check(argon2idHash))
+	assert.Error(t, password.Check("$2b$99$invalid"))
+	assert.Error(t, password.Check("$scrypt$ln=99,r=8,p=1$c2FsdA$a2V5"))
+	assert.ErrorIs(t, password.Check(argon2idParams("m=4294967295,t=1,p=1")), password.ErrMalformedHash)
+	assert.NoError(t, password.Check(scryptParams("ln=20,r=8,p=1")), "128*8*2^20 bytes are 1 GiB")
+	assert.ErrorIs(t, password.Check(scryptParams("ln=20,r=9,p=1")), password.ErrMalformedHash)
+	assert.ErrorIs(t, password.Check(scryptParams("ln=4,r=0,p=1")), password.ErrMalformedHash)
+	assert.EqualError(t, password.Check("$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5"), "unsupported argon2 version 16")
+}
@@ -0,0 +1,63 @@
+package reqctx
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/http-everything/httpe/pkg/share/logger"
+)
+
+type key int
+
+const (
+	userKey key = iota
+	claimsKey
+	requestIDKey
+)
+
+// WithUser returns a copy of the request carrying the name of the authenticated user
+func WithUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey, user))
+}
+
+// User returns the name of the authenticated user or an empty string for anonymous requests
+func User(r *http.Request) string {
+	user, _ := r.Context().Value(userKey).(string)
+	return user
+}
+
+// WithClaims returns a copy of the request carrying the claims of the OpenID Connect session
+func WithClaims(r *http.Request, claims map[string]interface{}) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
+}
+
+// Claims returns the claims of the OpenID Connect session or nil
+func Claims(r *http.Request) map[string]interface{} {
+	claims, _ := r.Context().Value(claimsKey).(map[string]interface{})
+	return claims
+}
+
+// WithRequestID returns a copy of the request carrying the ID of the request
+func WithRequestID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+}
+
+// RequestID returns the ID of the request or an empty string, if none has been assigned
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// Logger returns a copy of the logger adding the request ID, the client IP and the authenticated user to every line
+func Logger(r *http.Request, l *logger.Logger) *logger.Logger {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	l = l.With("request_id", RequestID(r)).With("remote_ip", remoteIP)
+	if user := User(r); user != "" {
+		l = l.With("user", user)
+	}
+	return l
+}
@@ -0,0 +1,34 @@
+package reqctx_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/share/reqctx"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUser(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, "", reqctx.User(r))
+
+	r = reqctx.WithUser(r, "alice")
+	assert.Equal(t, "alice", reqctx.User(r))
+}
+
+func TestClaims(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.Nil(t, reqctx.Claims(r))
+
+	r = reqctx.WithClaims(r, map[string]interface{}{"sub": "1234"})
+	assert.Equal(t, map[string]interface{}{"sub": "1234"}, reqctx.Claims(r))
+}
+
+func TestRequestID(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, "", reqctx.RequestID(r))
+
+	r = reqctx.WithRequestID(r, "abc123")
+	assert.Equal(t, "abc123", reqctx.RequestID(r))
+}
@@ -0,0 +1,46 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrAmbiguous = errors.New("only one of the inline secret, the secret file and the secret environment variable must be set")
+
+// Resolve returns a secret given either inline, as path of a file containing the secret or as name of an
+// environment variable. Whitespace around secrets read from files is removed, so files may end with a newline.
+// An error is returned, if more than one or none of the sources is given or if the source is empty.
+func Resolve(inline string, file string, env string) (string, error) {
+	sources := 0
+	for _, s := range []string{inline, file, env} {
+		if s != "" {
+			sources++
+		}
+	}
+	switch {
+	case sources > 1:
+		return "", ErrAmbiguous
+	case inline != "":
+		return inline, nil
+	case file != "":
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("error reading secret file: %w", err)
+		}
+		s := strings.TrimSpace(string(content))
+		if s == "" {
+			return "", fmt.Errorf("secret file %s is empty", file)
+		}
+		return s, nil
+	case env != "":
+		s := os.Getenv(env)
+		if s == "" {
+			return "", fmt.Errorf("environment variable %s is empty or not set", env)
+		}
+		return s, nil
+	default:
+		return "", errors.New("secret is missing")
+	}
+}
@@ -0,0 +1,48 @@
+package secret_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/share/secret"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0600))
+	emptyFile := filepath.Join(t.TempDir(), "empty")
+	require.NoError(t, os.WriteFile(emptyFile, []byte("\n"), 0600))
+	t.Setenv("HTTPE_TEST_SECRET", "from-env")
+
+	cases := []struct {
+		name    string
+		inline  string
+		file    string
+		env     string
+		want    string
+		wantErr string
+	}{
+		{name: "inline", inline: "inline", want: "inline"},
+		{name: "file", file: file, want: "from-file"},
+		{name: "env", env: "HTTPE_TEST_SECRET", want: "from-env"},
+		{name: "ambiguous", inline: "inline", env: "HTTPE_TEST_SECRET", wantErr: secret.ErrAmbiguous.Error()},
+		{name: "missing", wantErr: "secret is missing"},
+		{name: "empty file", file: emptyFile, wantErr: "secret file " + emptyFile + " is empty"},
+		{name: "unset env", env: "HTTPE_TEST_UNSET", wantErr: "environment variable HTTPE_TEST_UNSET is empty or not set"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := secret.Resolve(tc.inline, tc.file, tc.env)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, s)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package statuswriter
+
+import "net/http"
+
+// Writer remembers the status code of a response. Unwrap keeps flushing streamed responses working.
+type Writer struct {
+	http.ResponseWriter
+	code int
+}
+
+func New(w http.ResponseWriter) *Writer {
+	return &Writer{ResponseWriter: w}
+}
+
+func (w *Writer) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Code returns the status code of the response, 200 if nothing has been written yet
+func (w *Writer) Code() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
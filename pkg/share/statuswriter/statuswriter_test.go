@@ -0,0 +1,32 @@
+package statuswriter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/share/statuswriter"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCode(t *testing.T) {
+	w := statuswriter.New(httptest.NewRecorder())
+	assert.Equal(t, http.StatusOK, w.Code())
+
+	w.WriteHeader(http.StatusNotFound)
+	w.WriteHeader(http.StatusOK)
+	assert.Equal(t, http.StatusNotFound, w.Code())
+
+	w = statuswriter.New(httptest.NewRecorder())
+	_, _ = w.Write([]byte("body"))
+	w.WriteHeader(http.StatusInternalServerError)
+	assert.Equal(t, http.StatusOK, w.Code())
+}
+
+func TestFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := statuswriter.New(rec)
+	assert.NoError(t, http.NewResponseController(w).Flush())
+	assert.True(t, rec.Flushed)
+}
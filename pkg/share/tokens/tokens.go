@@ -0,0 +1,179 @@
+package tokens
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/share/secret"
+)
+
+const (
+	SHA256 = "sha256"
+	SHA512 = "sha512"
+
+	// DateFormat is the short form of expiry dates. The given day is the last day the token is valid, it expires at
+	// midnight UTC at the end of the day.
+	DateFormat = "2006-01-02"
+)
+
+// Token is an access token stored as hash. The token itself is never kept.
+type Token struct {
+	User      string
+	Algorithm string
+	Hash      []byte
+	Expires   *time.Time
+}
+
+// List is a list of tokens read from a tokens file or environment variable
+type List []Token
+
+// Load reads the token list either from a file or from an environment variable.
+// Each entry consists of the user name, the hash of the token and an optional expiry separated by whitespace, e.g.
+//
+//	deploy sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08 2030-12-31
+//
+// Entries are separated by newlines or commas. Empty lines and lines starting with # are ignored.
+// The expiry is either a date or an RFC 3339 timestamp.
+func Load(file string, env string) (List, error) {
+	content, err := secret.Resolve("", file, env)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(content)
+}
+
+// Cache keeps the lists read from token files until a file is modified, so the file isn't read and parsed on every
+// request. Lists from environment variables aren't cached.
+type Cache struct {
+	mu    sync.Mutex
+	files map[string]cachedFile
+}
+
+type cachedFile struct {
+	modTime time.Time
+	size    int64
+	list    List
+}
+
+// Load returns the cached list of the file, if the file hasn't been modified since it was read. Otherwise, it reads
+// the list like the package level Load.
+func (c *Cache) Load(file string, env string) (List, error) {
+	if file == "" || env != "" {
+		return Load(file, env)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return Load(file, env)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.files[file]; ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.list, nil
+	}
+	list, err := Load(file, env)
+	if err != nil {
+		return nil, err
+	}
+	if c.files == nil {
+		c.files = make(map[string]cachedFile)
+	}
+	c.files[file] = cachedFile{modTime: info.ModTime(), size: info.Size(), list: list}
+	return list, nil
+}
+
+// Parse parses the content of a token list, see Load for the format
+func Parse(content string) (List, error) {
+	list := List{}
+	entries := strings.FieldsFunc(content, func(r rune) bool { return r == '\n' || r == ',' })
+	for i, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		token, err := parseEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		list = append(list, token)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no tokens found")
+	}
+	return list, nil
+}
+
+func parseEntry(entry string) (token Token, err error) {
+	fields := strings.Fields(entry)
+	if len(fields) < 2 || len(fields) > 3 {
+		return Token{}, fmt.Errorf("expected '<user> <algorithm>:<hash> [<expires>]'")
+	}
+	token.User = fields[0]
+	algorithm, hash, ok := strings.Cut(fields[1], ":")
+	if !ok {
+		return Token{}, fmt.Errorf("hash of user '%s' is missing the algorithm prefix", token.User)
+	}
+	token.Algorithm = algorithm
+	token.Hash, err = hex.DecodeString(hash)
+	if err != nil {
+		return Token{}, fmt.Errorf("hash of user '%s' is not hex encoded", token.User)
+	}
+	switch {
+	case algorithm == SHA256 && len(token.Hash) == sha256.Size:
+	case algorithm == SHA512 && len(token.Hash) == sha512.Size:
+	case algorithm != SHA256 && algorithm != SHA512:
+		return Token{}, fmt.Errorf("unsupported hash algorithm '%s' of user '%s'", algorithm, token.User)
+	default:
+		return Token{}, fmt.Errorf("invalid %s hash of user '%s'", algorithm, token.User)
+	}
+	if len(fields) == 3 {
+		expires, err := parseExpiry(fields[2])
+		if err != nil {
+			return Token{}, fmt.Errorf("invalid expiry of user '%s': %w", token.User, err)
+		}
+		token.Expires = &expires
+	}
+	return token, nil
+}
+
+func parseExpiry(s string) (time.Time, error) {
+	if t, err := time.Parse(DateFormat, s); err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Lookup returns the user of the given token. Expired tokens are not found.
+// All entries are compared in constant time, so the time taken doesn't reveal how much of a hash matched.
+func (l List) Lookup(token string, now time.Time) (user string, ok bool) {
+	if token == "" {
+		return "", false
+	}
+	sum256 := sha256.Sum256([]byte(token))
+	sum512 := sha512.Sum512([]byte(token))
+	for _, t := range l {
+		var sum []byte
+		switch t.Algorithm {
+		case SHA256:
+			sum = sum256[:]
+		case SHA512:
+			sum = sum512[:]
+		}
+		if subtle.ConstantTimeCompare(sum, t.Hash) != 1 {
+			continue
+		}
+		if t.Expires != nil && !now.Before(*t.Expires) {
+			continue
+		}
+		if !ok {
+			user, ok = t.User, true
+		}
+	}
+	return user, ok
+}
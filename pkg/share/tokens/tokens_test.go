@@ -0,0 +1,138 @@
+package tokens_test
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/share/tokens"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	list, err := tokens.Parse(
+		"# comment\n" +
+			"alice " + hash256("secret-token") + "\n" +
+			"\n" +
+			"bob " + hash512("other-token") + " 2030-01-01\n" +
+			"carol " + hash256("expired-token") + " 2020-01-01T12:00:00Z",
+	)
+	require.NoError(t, err)
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name     string
+		token    string
+		now      time.Time
+		wantUser string
+		wantOk   bool
+	}{
+		{name: "sha256", token: "secret-token", now: now, wantUser: "alice", wantOk: true},
+		{name: "sha512 with expiry", token: "other-token", now: now, wantUser: "bob", wantOk: true},
+		{name: "valid on the day of expiry", token: "other-token", now: time.Date(2030, 1, 1, 23, 59, 59, 0, time.UTC),
+			wantUser: "bob", wantOk: true},
+		{name: "expired at midnight", token: "other-token", now: time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{name: "expired", token: "expired-token", now: now},
+		{name: "unknown", token: "unknown", now: now},
+		{name: "empty", token: "", now: now},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			user, ok := list.Lookup(tc.token, tc.now)
+			assert.Equal(t, tc.wantOk, ok)
+			assert.Equal(t, tc.wantUser, user)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "empty", content: "# nothing\n", wantErr: "no tokens found"},
+		{name: "missing hash", content: "alice", wantErr: "entry 1: expected '<user> <algorithm>:<hash> [<expires>]'"},
+		{name: "missing algorithm", content: "alice abcd", wantErr: "entry 1: hash of user 'alice' is missing the algorithm prefix"},
+		{name: "not hex", content: "alice sha256:xyz", wantErr: "entry 1: hash of user 'alice' is not hex encoded"},
+		{name: "unknown algorithm", content: "alice md5:abcd", wantErr: "entry 1: unsupported hash algorithm 'md5' of user 'alice'"},
+		{name: "wrong length", content: "alice sha512:abcd", wantErr: "entry 1: invalid sha512 hash of user 'alice'"},
+		{
+			name:    "invalid expiry",
+			content: "alice " + hash256("a") + ",bob " + hash256("b") + " tomorrow",
+			wantErr: "entry 2: invalid expiry of user 'bob'",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tokens.Parse(tc.content)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(file, []byte("alice "+hash256("from-file")+"\n"), 0600))
+	t.Setenv("HTTPE_TEST_TOKENS", "bob "+hash256("from-env")+",carol "+hash256("also-from-env"))
+
+	list, err := tokens.Load(file, "")
+	require.NoError(t, err)
+	user, ok := list.Lookup("from-file", time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, "alice", user)
+
+	list, err = tokens.Load("", "HTTPE_TEST_TOKENS")
+	require.NoError(t, err)
+	user, ok = list.Lookup("also-from-env", time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, "carol", user)
+}
+
+func TestCache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(file, []byte("alice "+hash256("first")+"\n"), 0600))
+	var cache tokens.Cache
+
+	list, err := cache.Load(file, "")
+	require.NoError(t, err)
+	_, ok := list.Lookup("first", time.Now())
+	assert.True(t, ok)
+
+	// An unmodified file isn't read again
+	again, err := cache.Load(file, "")
+	require.NoError(t, err)
+	assert.Same(t, &list[0], &again[0])
+
+	require.NoError(t, os.WriteFile(file, []byte("bob "+hash256("second")+"\n"), 0600))
+	modified := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(file, modified, modified))
+	list, err = cache.Load(file, "")
+	require.NoError(t, err)
+	_, ok = list.Lookup("first", time.Now())
+	assert.False(t, ok, "the token has been revoked")
+	user, ok := list.Lookup("second", time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, "bob", user)
+
+	require.NoError(t, os.Remove(file))
+	_, err = cache.Load(file, "")
+	assert.Error(t, err)
+}
+
+func hash256(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func hash512(token string) string {
+	sum := sha512.Sum512([]byte(token))
+	return "sha512:" + hex.EncodeToString(sum[:])
+}
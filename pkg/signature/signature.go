@@ -0,0 +1,186 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" // #nosec G505 -- required by webhooks still signing with sha1
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/share/firstof"
+	"github.com/http-everything/httpe/pkg/share/secret"
+	"github.com/http-everything/httpe/pkg/share/timeunit"
+)
+
+const (
+	DefaultTolerance = "5min"
+
+	GitHubHeader = "X-Hub-Signature-256"
+	GitLabHeader = "X-Gitlab-Token"
+	StripeHeader = "Stripe-Signature"
+)
+
+// ErrInvalid is wrapped by all errors caused by a missing or wrong signature. Other errors indicate a problem
+// of the configuration, e.g. an unreadable secret file.
+var ErrInvalid = errors.New("invalid signature")
+
+// Verify checks the signature of a request over its raw body
+func Verify(cfg *rules.HMAC, r *http.Request, body []byte, now time.Time) error {
+	key, err := secret.Resolve(cfg.Secret, cfg.SecretFile, cfg.SecretEnv)
+	if err != nil {
+		return fmt.Errorf("error resolving hmac secret: %w", err)
+	}
+	switch cfg.Type {
+	case rules.HMACGitHub:
+		return verifyHMAC(r.Header.Get(GitHubHeader), "sha256=", sha256.New, hex.DecodeString, key, body)
+	case rules.HMACGitLab:
+		token := r.Header.Get(GitLabHeader)
+		if token == "" {
+			return fmt.Errorf("%w: header %s missing", ErrInvalid, GitLabHeader)
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+			return fmt.Errorf("%w: token mismatch", ErrInvalid)
+		}
+		return nil
+	case rules.HMACStripe:
+		return verifyStripe(cfg, r.Header.Get(StripeHeader), key, body, now)
+	case rules.HMACGeneric:
+		return verifyGeneric(cfg, r, key, body, now)
+	default:
+		return fmt.Errorf("unknown hmac type '%s'", cfg.Type)
+	}
+}
+
+// Header returns the name of the header carrying the signature or the token
+func Header(cfg *rules.HMAC) string {
+	switch cfg.Type {
+	case rules.HMACGitHub:
+		return GitHubHeader
+	case rules.HMACGitLab:
+		return GitLabHeader
+	case rules.HMACStripe:
+		return StripeHeader
+	default:
+		return cfg.Header
+	}
+}
+
+// verifyStripe verifies signatures in the format of Stripe, "t=<timestamp>,v1=<signature>[,v1=<signature>]".
+// The signature is calculated over "<timestamp>.<body>".
+func verifyStripe(cfg *rules.HMAC, header string, key string, body []byte, now time.Time) error {
+	if header == "" {
+		return fmt.Errorf("%w: header %s missing", ErrInvalid, StripeHeader)
+	}
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			timestamp = v
+		case "v1":
+			signatures = append(signatures, v)
+		}
+	}
+	if err := checkTimestamp(cfg, timestamp, now); err != nil {
+		return err
+	}
+	payload := append([]byte(timestamp+"."), body...)
+	for _, sig := range signatures {
+		if err := verifyHMAC(sig, "", sha256.New, hex.DecodeString, key, payload); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no matching v1 signature", ErrInvalid)
+}
+
+func verifyGeneric(cfg *rules.HMAC, r *http.Request, key string, body []byte, now time.Time) error {
+	var newHash func() hash.Hash
+	switch firstof.String(cfg.Algorithm, "sha256") {
+	case "sha1":
+		newHash = sha1.New
+	case "sha256":
+		newHash = sha256.New
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return fmt.Errorf("unknown hmac algorithm '%s'", cfg.Algorithm)
+	}
+	decode := hex.DecodeString
+	if cfg.Encoding == "base64" {
+		decode = base64.StdEncoding.DecodeString
+	}
+	payload := body
+	if cfg.TimestampHeader != "" {
+		timestamp := r.Header.Get(cfg.TimestampHeader)
+		if err := checkTimestamp(cfg, timestamp, now); err != nil {
+			return err
+		}
+		payload = append([]byte(timestamp+"."), body...)
+	}
+	sig := r.Header.Get(cfg.Header)
+	if sig == "" {
+		return fmt.Errorf("%w: header %s missing", ErrInvalid, cfg.Header)
+	}
+	return verifyHMAC(sig, cfg.Prefix, newHash, decode, key, payload)
+}
+
+func verifyHMAC(sig string, prefix string, newHash func() hash.Hash, decode func(string) ([]byte, error),
+	key string, payload []byte) error {
+	if sig == "" {
+		return fmt.Errorf("%w: signature missing", ErrInvalid)
+	}
+	encoded, ok := strings.CutPrefix(sig, prefix)
+	if !ok {
+		return fmt.Errorf("%w: prefix %s missing", ErrInvalid, prefix)
+	}
+	got, err := decode(encoded)
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrInvalid)
+	}
+	mac := hmac.New(newHash, []byte(key))
+	mac.Write(payload)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return fmt.Errorf("%w: signature mismatch", ErrInvalid)
+	}
+	return nil
+}
+
+// checkTimestamp rejects unix timestamps deviating from now by more than the tolerance, so captured requests
+// can't be replayed later
+func checkTimestamp(cfg *rules.HMAC, timestamp string, now time.Time) error {
+	if timestamp == "" {
+		return fmt.Errorf("%w: timestamp missing", ErrInvalid)
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed timestamp", ErrInvalid)
+	}
+	tol, err := tolerance(cfg)
+	if err != nil {
+		return err
+	}
+	age := now.Sub(time.Unix(sec, 0))
+	if age > tol || age < -tol {
+		return fmt.Errorf("%w: timestamp outside of tolerance %s", ErrInvalid, firstof.String(cfg.Tolerance, DefaultTolerance))
+	}
+	return nil
+}
+
+func tolerance(cfg *rules.HMAC) (time.Duration, error) {
+	tol, err := timeunit.ParseDuration(firstof.String(cfg.Tolerance, DefaultTolerance))
+	if err != nil {
+		return 0, fmt.Errorf("invalid tolerance: %w", err)
+	}
+	return tol, nil
+}
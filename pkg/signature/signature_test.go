@@ -0,0 +1,169 @@
+package signature_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1" // #nosec G505
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/signature"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testSecret = "It's a Secret to Everybody"
+	testBody   = "Hello, World!"
+)
+
+func sign(newHash func() hash.Hash, payload string) []byte {
+	mac := hmac.New(newHash, []byte(testSecret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	old := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+	stripeSig := hex.EncodeToString(sign(sha256.New, ts+"."+testBody))
+
+	cases := []struct {
+		name    string
+		cfg     rules.HMAC
+		headers map[string]string
+		wantErr string
+	}{
+		{
+			name: "github",
+			cfg:  rules.HMAC{Type: rules.HMACGitHub},
+			headers: map[string]string{
+				// Example taken from the GitHub documentation
+				"X-Hub-Signature-256": "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17",
+			},
+		},
+		{
+			name:    "github missing",
+			cfg:     rules.HMAC{Type: rules.HMACGitHub},
+			wantErr: "invalid signature: signature missing",
+		},
+		{
+			name:    "github wrong",
+			cfg:     rules.HMAC{Type: rules.HMACGitHub},
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=" + hex.EncodeToString(sign(sha256.New, "other"))},
+			wantErr: "invalid signature: signature mismatch",
+		},
+		{
+			name:    "github without prefix",
+			cfg:     rules.HMAC{Type: rules.HMACGitHub},
+			headers: map[string]string{"X-Hub-Signature-256": hex.EncodeToString(sign(sha256.New, testBody))},
+			wantErr: "invalid signature: prefix sha256= missing",
+		},
+		{
+			name:    "gitlab",
+			cfg:     rules.HMAC{Type: rules.HMACGitLab},
+			headers: map[string]string{"X-Gitlab-Token": testSecret},
+		},
+		{
+			name:    "gitlab wrong",
+			cfg:     rules.HMAC{Type: rules.HMACGitLab},
+			headers: map[string]string{"X-Gitlab-Token": "guess"},
+			wantErr: "invalid signature: token mismatch",
+		},
+		{
+			name:    "stripe",
+			cfg:     rules.HMAC{Type: rules.HMACStripe},
+			headers: map[string]string{"Stripe-Signature": "t=" + ts + ",v1=0000,v1=" + stripeSig + ",v0=0000"},
+		},
+		{
+			name: "stripe replayed",
+			cfg:  rules.HMAC{Type: rules.HMACStripe},
+			headers: map[string]string{
+				"Stripe-Signature": "t=" + old + ",v1=" + hex.EncodeToString(sign(sha256.New, old+"."+testBody)),
+			},
+			wantErr: "invalid signature: timestamp outside of tolerance 5min",
+		},
+		{
+			name: "stripe with custom tolerance",
+			cfg:  rules.HMAC{Type: rules.HMACStripe, Tolerance: "1h"},
+			headers: map[string]string{
+				"Stripe-Signature": "t=" + old + ",v1=" + hex.EncodeToString(sign(sha256.New, old+"."+testBody)),
+			},
+		},
+		{
+			name:    "stripe signature of other timestamp",
+			cfg:     rules.HMAC{Type: rules.HMACStripe},
+			headers: map[string]string{"Stripe-Signature": "t=" + ts + ",v1=" + hex.EncodeToString(sign(sha256.New, testBody))},
+			wantErr: "invalid signature: no matching v1 signature",
+		},
+		{
+			name:    "generic",
+			cfg:     rules.HMAC{Type: rules.HMACGeneric, Header: "X-Signature"},
+			headers: map[string]string{"X-Signature": hex.EncodeToString(sign(sha256.New, testBody))},
+		},
+		{
+			name: "generic sha1 base64 with prefix",
+			cfg: rules.HMAC{
+				Type:      rules.HMACGeneric,
+				Header:    "X-Signature",
+				Algorithm: "sha1",
+				Encoding:  "base64",
+				Prefix:    "sha1=",
+			},
+			headers: map[string]string{"X-Signature": "sha1=" + base64.StdEncoding.EncodeToString(sign(sha1.New, testBody))},
+		},
+		{
+			name: "generic with timestamp",
+			cfg:  rules.HMAC{Type: rules.HMACGeneric, Header: "X-Signature", TimestampHeader: "X-Timestamp"},
+			headers: map[string]string{
+				"X-Signature": hex.EncodeToString(sign(sha256.New, ts+"."+testBody)),
+				"X-Timestamp": ts,
+			},
+		},
+		{
+			name:    "generic without timestamp",
+			cfg:     rules.HMAC{Type: rules.HMACGeneric, Header: "X-Signature", TimestampHeader: "X-Timestamp"},
+			headers: map[string]string{"X-Signature": hex.EncodeToString(sign(sha256.New, "."+testBody))},
+			wantErr: "invalid signature: timestamp missing",
+		},
+		{
+			name:    "generic malformed",
+			cfg:     rules.HMAC{Type: rules.HMACGeneric, Header: "X-Signature"},
+			headers: map[string]string{"X-Signature": "not hex"},
+			wantErr: "invalid signature: malformed signature",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.Secret = testSecret
+			req := httptest.NewRequest("POST", "/", bytes.NewBufferString(testBody))
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			err := signature.Verify(&tc.cfg, req, []byte(testBody), now)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.ErrorIs(t, err, signature.ErrInvalid)
+			assert.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestVerifyWithoutSecret(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", nil)
+	err := signature.Verify(&rules.HMAC{Type: rules.HMACGitHub, SecretEnv: "HTTPE_TEST_UNSET"}, req, nil, time.Now())
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, signature.ErrInvalid)
+}
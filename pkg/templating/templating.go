@@ -2,12 +2,25 @@ package templating
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
 	"reflect"
 	"strings"
 	"text/template"
+	"text/template/parse"
 
 	"github.com/http-everything/httpe/pkg/actions"
 	"github.com/http-everything/httpe/pkg/requestdata"
+	"github.com/http-everything/httpe/pkg/share/escape"
+)
+
+const (
+	ShellQuote      = "ShellQuote"
+	PowerShellQuote = "PowerShellQuote"
+	CmdEscape       = "CmdEscape"
 )
 
 type templateData struct {
@@ -49,6 +62,37 @@ var TplFuncs = template.FuncMap{
 		}
 		return curVal
 	},
+	ShellQuote:      stringFunc(escape.Shell),
+	PowerShellQuote: stringFunc(escape.PowerShell),
+	CmdEscape:       stringFunc(escape.Cmd),
+	"URLQuery":      stringFunc(url.QueryEscape),
+	"URLPath":       stringFunc(url.PathEscape),
+	"HTMLEscape":    stringFunc(html.EscapeString),
+	"Base64": stringFunc(func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}),
+	"JSON": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	},
+}
+
+// stringFunc turns a string function into a template function accepting any value. This way, values of JSON
+// input, which can be numbers or booleans, can be escaped too. Missing values are treated as empty string.
+func stringFunc(fn func(string) string) func(interface{}) string {
+	return func(v interface{}) string {
+		switch val := v.(type) {
+		case nil:
+			return fn("")
+		case string:
+			return fn(val)
+		default:
+			return fn(fmt.Sprint(val))
+		}
+	}
 }
 
 func RenderActionResponse(actionResp actions.ActionResponse, tpl string, reqData requestdata.Data) (response string, err error) {
@@ -86,6 +130,34 @@ func RenderString(input string, reqData requestdata.Data) (output string, err er
 	return bu.String(), nil
 }
 
+// RenderStringAutoQuoted renders the input like RenderString, but the output of every action, e.g.
+// {{ .Input.Params.name }}, is piped through the given quote function first. Actions already ending with
+// one of the escaping functions are left untouched.
+func RenderStringAutoQuoted(input string, reqData requestdata.Data, quoteFunc string) (output string, err error) {
+	if _, ok := TplFuncs[quoteFunc]; !ok {
+		return "", fmt.Errorf("unknown quote function '%s'", quoteFunc)
+	}
+	te, err := newTpl(input, "quoted_string")
+	if err != nil {
+		return "", err
+	}
+	for _, t := range te.Templates() {
+		if t.Tree != nil {
+			appendQuoteFunc(t.Tree.Root, quoteFunc)
+		}
+	}
+	tplData := templateData{
+		Meta:  reqData.Meta,
+		Input: reqData.Input,
+	}
+	var bu bytes.Buffer
+	err = te.Execute(&bu, tplData)
+	if err != nil {
+		return "", err
+	}
+	return bu.String(), nil
+}
+
 func RenderStringMap(input map[string]string, reqData requestdata.Data) (output map[string]string, err error) {
 	output = make(map[string]string)
 	for k, v := range input {
@@ -99,3 +171,48 @@ func RenderStringMap(input map[string]string, reqData requestdata.Data) (output
 func newTpl(input string, name string) (*template.Template, error) {
 	return template.New(name).Funcs(TplFuncs).Option("missingkey=zero").Parse(input)
 }
+
+// appendQuoteFunc walks the parse tree and appends the quote function to the pipeline of all actions printing
+// a value. Variable declarations and control structures like if or range don't print their pipelines.
+func appendQuoteFunc(node parse.Node, quoteFunc string) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			appendQuoteFunc(child, quoteFunc)
+		}
+	case *parse.IfNode:
+		appendQuoteFunc(n.List, quoteFunc)
+		appendQuoteFunc(n.ElseList, quoteFunc)
+	case *parse.RangeNode:
+		appendQuoteFunc(n.List, quoteFunc)
+		appendQuoteFunc(n.ElseList, quoteFunc)
+	case *parse.WithNode:
+		appendQuoteFunc(n.List, quoteFunc)
+		appendQuoteFunc(n.ElseList, quoteFunc)
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 || endsWithEscaping(n.Pipe) {
+			return
+		}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      n.Pos,
+			Args:     []parse.Node{parse.NewIdentifier(quoteFunc).SetPos(n.Pos)},
+		})
+	}
+}
+
+func endsWithEscaping(pipe *parse.PipeNode) bool {
+	last := pipe.Cmds[len(pipe.Cmds)-1]
+	ident, ok := last.Args[0].(*parse.IdentifierNode)
+	if !ok {
+		return false
+	}
+	switch ident.Ident {
+	case ShellQuote, PowerShellQuote, CmdEscape:
+		return true
+	}
+	return false
+}
@@ -136,3 +136,108 @@ func TestRenderStringMap(t *testing.T) {
 	}
 	assert.Equal(t, want, output)
 }
+
+func TestEscapingFunctions(t *testing.T) {
+	cases := []struct {
+		template string
+		want     string
+	}{
+		{
+			template: `{{ "it's" | ShellQuote }}`,
+			want:     `'it'\''s'`,
+		},
+		{
+			template: `{{ "it's $HOME" | PowerShellQuote }}`,
+			want:     `'it''s $HOME'`,
+		},
+		{
+			template: `{{ "a & b" | CmdEscape }}`,
+			want:     `a ^& b`,
+		},
+		{
+			template: `{{ "a b&c" | URLQuery }}`,
+			want:     `a+b%26c`,
+		},
+		{
+			template: `{{ "a b/c" | URLPath }}`,
+			want:     `a%20b%2Fc`,
+		},
+		{
+			template: `{{ "say \"hi\"" | JSON }}`,
+			want:     `"say \"hi\""`,
+		},
+		{
+			template: `{{ .Input.JSON.nested | JSON }}`,
+			want:     `{"nkey1":"nvalue1"}`,
+		},
+		{
+			template: `{{ "<b>" | HTMLEscape }}`,
+			want:     `&lt;b&gt;`,
+		},
+		{
+			template: `{{ "hello" | Base64 }}`,
+			want:     `aGVsbG8=`,
+		},
+		{
+			template: `{{ .Input.JSON.nonexistent | ShellQuote }}`,
+			want:     `''`,
+		},
+	}
+	reqData, err := requestdata.Mock()
+	require.NoError(t, err)
+
+	for _, tc := range cases {
+		t.Run(tc.template, func(t *testing.T) {
+			output, err := templating.RenderString(tc.template, reqData)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, output)
+		})
+	}
+}
+
+func TestRenderStringAutoQuoted(t *testing.T) {
+	cases := []struct {
+		template  string
+		quoteFunc string
+		want      string
+	}{
+		{
+			template:  "echo {{ .Input.Form.Field1 }}",
+			quoteFunc: templating.ShellQuote,
+			want:      "echo 'Field Value 1'",
+		},
+		{
+			template:  "echo {{ .Input.Form.Field1 | ToUpper }}",
+			quoteFunc: templating.PowerShellQuote,
+			want:      "echo 'FIELD VALUE 1'",
+		},
+		{
+			template:  "echo {{ .Input.Form.Field1 | ShellQuote }}",
+			quoteFunc: templating.ShellQuote,
+			want:      "echo 'Field Value 1'",
+		},
+		{
+			template:  `{{ $v := .Input.Form.Field1 }}{{ if $v }}echo {{ $v }}{{ else }}echo none{{ end }}`,
+			quoteFunc: templating.ShellQuote,
+			want:      "echo 'Field Value 1'",
+		},
+		{
+			template:  `{{ range $k, $v := .Input.JSON.nested }}{{ $k }}={{ $v }}{{ end }}`,
+			quoteFunc: templating.ShellQuote,
+			want:      "'nkey1'='nvalue1'",
+		},
+	}
+	reqData, err := requestdata.Mock()
+	require.NoError(t, err)
+
+	for _, tc := range cases {
+		t.Run(tc.template, func(t *testing.T) {
+			output, err := templating.RenderStringAutoQuoted(tc.template, reqData, tc.quoteFunc)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, output)
+		})
+	}
+
+	_, err = templating.RenderStringAutoQuoted("{{ .Meta.URL }}", reqData, "Nonexistent")
+	assert.EqualError(t, err, "unknown quote function 'Nonexistent'")
+}
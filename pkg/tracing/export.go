@@ -0,0 +1,226 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/share/firstof"
+	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/share/version"
+)
+
+const (
+	// TracesPath is appended to endpoints given without path
+	TracesPath = "/v1/traces"
+
+	flushInterval = 5 * time.Second
+	maxBatch      = 512
+	maxQueue      = 4096
+	exportTimeout = 10 * time.Second
+	// statusError is the OTLP status code of failed spans
+	statusError = 2
+)
+
+// exporter sends finished spans in batches to an OTLP/HTTP collector, encoded as JSON
+type exporter struct {
+	endpoint string
+	service  string
+	headers  map[string]string
+	client   *http.Client
+	logger   *logger.Logger
+	queue    chan *Span
+	done     chan struct{}
+}
+
+func newExporter(cfg *config.TracingConfig, logger *logger.Logger) *exporter {
+	return &exporter{
+		endpoint: Endpoint(cfg.Endpoint),
+		service:  firstof.String(cfg.ServiceName, DefaultServiceName),
+		headers:  cfg.Headers,
+		client:   &http.Client{Timeout: exportTimeout},
+		logger:   logger,
+		queue:    make(chan *Span, maxQueue),
+		done:     make(chan struct{}),
+	}
+}
+
+// Endpoint returns the URL spans are posted to. Endpoints without path get the default path of OTLP/HTTP.
+func Endpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Path != "" && u.Path != "/") {
+		return endpoint
+	}
+	u.Path = TracesPath
+	return u.String()
+}
+
+// add queues the span for the export. If the collector can't keep up, spans are dropped rather than slowing down
+// requests.
+func (e *exporter) add(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.logger.Errorf("tracing queue full, dropping span '%s'", s.name)
+	}
+}
+
+// run exports the queued spans when a batch is full, periodically and when the queue is closed
+func (e *exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s, ok := <-e.queue:
+			if !ok {
+				e.export(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= maxBatch {
+				e.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.export(batch)
+			batch = nil
+		}
+	}
+}
+
+func (e *exporter) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		e.logger.Errorf("error encoding spans: %s", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		e.logger.Errorf("error exporting spans: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.logger.Errorf("error exporting %d spans: %s", len(batch), err)
+		return
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		e.logger.Errorf("error exporting %d spans: collector responded %s", len(batch), resp.Status)
+	}
+}
+
+// The types below are the JSON encoding of the OTLP ExportTraceServiceRequest
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (e *exporter) request(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.sc.traceID[:]),
+			SpanID:            hex.EncodeToString(s.sc.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			span.Attributes = append(span.Attributes, keyValue(a.key, a.value))
+		}
+		if s.errMsg != "" {
+			span.Status = otlpStatus{Code: statusError, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+		spans = append(spans, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{keyValue("service.name", e.service)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "httpe", Version: version.HTTPEServerVersion},
+			Spans: spans,
+		}},
+	}}}
+}
+
+// keyValue encodes an attribute. 64-bit integers are strings in the JSON encoding of OTLP.
+func keyValue(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value = map[string]interface{}{"stringValue": v}
+	case int:
+		kv.Value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		kv.Value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case bool:
+		kv.Value = map[string]interface{}{"boolValue": v}
+	default:
+		kv.Value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return kv
+}
@@ -0,0 +1,283 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/http-everything/httpe/pkg/accesslog"
+	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/share/statuswriter"
+)
+
+const (
+	// Header is the W3C trace context header of incoming requests and outgoing emails
+	Header = "traceparent"
+	// EnvName is the environment variable passing the trace context to scripts
+	EnvName = "TRACEPARENT"
+	// DefaultServiceName is reported as service.name, if the config doesn't set one
+	DefaultServiceName = "httpe"
+)
+
+// SpanKind tells whether a span represents a request received by httpe or work done internally.
+// The values are the ones of the OTLP protocol.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+)
+
+type ctxKey struct{}
+
+// spanContext identifies a span within a trace
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// traceParent formats the span context as W3C traceparent
+func (sc spanContext) traceParent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", sc.traceID, sc.spanID, flags)
+}
+
+// parseTraceParent parses a W3C traceparent. Only version 00 is supported, invalid values are ignored.
+func parseTraceParent(s string) (sc spanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || sc.traceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// Span is a unit of work of a trace. All methods may be called on a nil *Span, so code doesn't need to know whether
+// tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	sc       spanContext
+	parentID [8]byte
+	name     string
+	kind     SpanKind
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []attribute
+	errMsg string
+	ended  bool
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// recording reports whether the span collects attributes. Spans of traces the client has decided not to sample are
+// neither recorded nor exported, they only pass on the trace context.
+func (s *Span) recording() bool {
+	return s != nil && s.sc.sampled
+}
+
+// SetAttribute adds an attribute to the span. Values are exported as string, int or bool.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if !s.recording() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+// RecordError marks the span as failed, if err is not nil
+func (s *Span) RecordError(err error) {
+	if !s.recording() || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and hands it over for the export. Further calls are ignored.
+func (s *Span) End() {
+	if !s.recording() {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// TraceParent returns the W3C traceparent of the span, an empty string for a nil span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return s.sc.traceParent()
+}
+
+// Tracer creates the root spans of requests and exports finished spans to an OTLP collector
+type Tracer struct {
+	exporter *exporter
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New creates a tracer exporting spans to the endpoint of the config. Shutdown must be called to export the last
+// spans.
+func New(cfg *config.TracingConfig, logger *logger.Logger) *Tracer {
+	t := &Tracer{exporter: newExporter(cfg, logger)}
+	go t.exporter.run()
+	return t
+}
+
+// newSpan creates a span. Without parent, the span starts a new trace.
+func (t *Tracer) newSpan(name string, kind SpanKind, parent *spanContext) *Span {
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent != nil {
+		s.sc.traceID = parent.traceID
+		s.sc.sampled = parent.sampled
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.sc.traceID[:])
+		s.sc.sampled = true
+	}
+	_, _ = rand.Read(s.sc.spanID[:])
+	return s
+}
+
+// enqueue hands over a finished span to the exporter. Spans ending after the shutdown are dropped.
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if !t.closed {
+		t.exporter.add(s)
+	}
+}
+
+// StartRequest starts the span of a request received by httpe. If the request carries a valid traceparent header,
+// the span continues the trace of the client, including its decision whether the trace is sampled.
+func (t *Tracer) StartRequest(r *http.Request, name string) (context.Context, *Span) {
+	return t.startRequest(r, name, r.URL.Path)
+}
+
+// startRequest starts the span of a request, recording the path as given
+func (t *Tracer) startRequest(r *http.Request, name string, path string) (context.Context, *Span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+	var parent *spanContext
+	if sc, ok := parseTraceParent(r.Header.Get(Header)); ok {
+		parent = &sc
+	}
+	s := t.newSpan(name, KindServer, parent)
+	s.SetAttribute("http.request.method", r.Method)
+	s.SetAttribute("url.path", path)
+	return ContextWithSpan(r.Context(), s), s
+}
+
+// Handler traces the requests to a rule with a span for the request and a span for its middleware. The middleware
+// span ends when the request reaches the handler, so spans of the handler are children of the request span.
+// The values of the URL placeholders listed in redact are replaced in the recorded path, like in the access log.
+func (t *Tracer) Handler(name string, redact []string, middleware func(http.Handler) http.Handler,
+	next http.Handler) http.Handler {
+	if t == nil {
+		return middleware(next)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if len(redact) > 0 {
+			path = accesslog.RedactPath(r, redact)
+		}
+		ctx, span := t.startRequest(r, "rule "+name, path)
+		defer span.End()
+		mwCtx, mwSpan := Start(ctx, "middleware")
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mwSpan.End()
+			// Keep the values added by the middleware, like the authenticated user
+			next.ServeHTTP(w, r.WithContext(ContextWithSpan(r.Context(), span)))
+		})
+		sw := statuswriter.New(w)
+		middleware(inner).ServeHTTP(sw, r.WithContext(mwCtx))
+		mwSpan.End()
+		span.SetAttribute("http.response.status_code", sw.Code())
+		if sw.Code() >= http.StatusInternalServerError {
+			span.RecordError(fmt.Errorf("status %d", sw.Code()))
+		}
+	})
+}
+
+// Shutdown exports the remaining spans. Spans ending later are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.exporter.queue)
+	}
+	t.mu.Unlock()
+	select {
+	case <-t.exporter.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Start starts a child of the span in the context. Without a span in the context, tracing is disabled and a nil
+// span is returned.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, KindInternal, &parent.sc)
+	return ContextWithSpan(ctx, s), s
+}
+
+// ContextWithSpan returns a copy of the context carrying the span
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, ctxKey{}, s)
+}
+
+// SpanFromContext returns the span of the context or nil
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(ctxKey{}).(*Span)
+	return s
+}
+
+// TraceParent returns the W3C traceparent of the span in the context, an empty string if there is none
+func TraceParent(ctx context.Context) string {
+	return SpanFromContext(ctx).TraceParent()
+}
@@ -0,0 +1,248 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/http-everything/httpe/pkg/config"
+	"github.com/http-everything/httpe/pkg/share/logger"
+	"github.com/http-everything/httpe/pkg/tracing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const clientTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// collector is a stand-in for an OTLP collector receiving spans encoded as JSON
+type collector struct {
+	*httptest.Server
+	mu      sync.Mutex
+	spans   map[string]span
+	headers http.Header
+}
+
+type span struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+func (s span) attribute(key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{spans: make(map[string]span)}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Key string `json:"key"`
+					} `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []span `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if r.URL.Path != tracing.TracesPath || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.headers = r.Header
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					c.spans[s.Name] = s
+				}
+			}
+		}
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// span returns the span with the given name
+func (c *collector) span(t *testing.T, name string) span {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.spans[name]
+	require.True(t, ok, "span '%s' not exported", name)
+	return s
+}
+
+func newTracer(t *testing.T, c *collector) *tracing.Tracer {
+	l, err := logger.New("test", filepath.Join(t.TempDir(), "test.log"), logger.DEBUG)
+	require.NoError(t, err)
+	return tracing.New(&config.TracingConfig{
+		Endpoint: c.URL,
+		Headers:  map[string]string{"x-api-key": "secret"},
+	}, l)
+}
+
+func TestHandler(t *testing.T) {
+	c := newCollector(t)
+	tracer := newTracer(t, c)
+
+	var traceParent string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, s := tracing.Start(r.Context(), "action")
+		traceParent = s.TraceParent()
+		s.RecordError(errors.New("script failed"))
+		s.End()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	middleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				http.Error(w, "Unauthorised", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	h := tracer.Handler("deploy", nil, middleware, next)
+
+	req := httptest.NewRequest("POST", "/deploy", nil)
+	req.Header.Set(tracing.Header, clientTraceParent)
+	req.Header.Set("Authorization", "Bearer token")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	root := c.span(t, "rule deploy")
+	mw := c.span(t, "middleware")
+	action := c.span(t, "action")
+	// The trace of the client is continued
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentSpanID)
+	assert.Equal(t, int(tracing.KindServer), root.Kind)
+	assert.Equal(t, "POST", root.attribute("http.request.method"))
+	assert.Equal(t, "500", root.attribute("http.response.status_code"))
+	assert.Equal(t, 2, root.Status.Code)
+	assert.Equal(t, root.SpanID, mw.ParentSpanID)
+	// The action is a child of the request, not of the middleware
+	assert.Equal(t, root.SpanID, action.ParentSpanID)
+	assert.Equal(t, root.TraceID, action.TraceID)
+	assert.Equal(t, "script failed", action.Status.Message)
+	assert.Equal(t, "00-"+action.TraceID+"-"+action.SpanID+"-01", traceParent)
+	assert.Equal(t, "secret", c.headers.Get("X-Api-Key"))
+}
+
+func TestHandlerRejected(t *testing.T) {
+	c := newCollector(t)
+	tracer := newTracer(t, c)
+	h := tracer.Handler("deploy", nil, func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Unauthorised", http.StatusUnauthorized)
+		})
+	}, http.NotFoundHandler())
+
+	req := httptest.NewRequest("GET", "/deploy", nil)
+	req.Header.Set(tracing.Header, "invalid")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	root := c.span(t, "rule deploy")
+	assert.Empty(t, root.ParentSpanID)
+	assert.Equal(t, "401", root.attribute("http.response.status_code"))
+	assert.Equal(t, 0, root.Status.Code)
+	assert.Equal(t, root.SpanID, c.span(t, "middleware").ParentSpanID)
+}
+
+func TestHandlerRedacts(t *testing.T) {
+	c := newCollector(t)
+	tracer := newTracer(t, c)
+	router := mux.NewRouter()
+	router.Path("/hook/{token}/{env}").Handler(tracer.Handler("hook", []string{"token"},
+		func(next http.Handler) http.Handler { return next }, http.NotFoundHandler()))
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/hook/s3cr3t/prod", nil))
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	assert.Equal(t, "/hook/REDACTED/prod", c.span(t, "rule hook").attribute("url.path"))
+}
+
+func TestNotSampled(t *testing.T) {
+	c := newCollector(t)
+	tracer := newTracer(t, c)
+	var traceParent string
+	h := tracer.Handler("deploy", nil, func(next http.Handler) http.Handler { return next },
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, child := tracing.Start(r.Context(), "child")
+			child.SetAttribute("key", "value")
+			child.RecordError(errors.New("script failed"))
+			traceParent = child.TraceParent()
+			child.End()
+		}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(tracing.Header, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	// The decision of the client is passed on, but nothing is exported
+	assert.Regexp(t, "^00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-00$", traceParent)
+	assert.Empty(t, c.spans)
+}
+
+func TestDisabled(t *testing.T) {
+	var tracer *tracing.Tracer
+	req := httptest.NewRequest("GET", "/", nil)
+	ctx, s := tracer.StartRequest(req, "request")
+	assert.Nil(t, s)
+	ctx, child := tracing.Start(ctx, "child")
+	assert.Nil(t, child)
+	assert.NotPanics(t, func() {
+		child.SetAttribute("key", "value")
+		child.RecordError(errors.New("error"))
+		child.End()
+	})
+	assert.Empty(t, tracing.TraceParent(ctx))
+	assert.NoError(t, tracer.Shutdown(context.Background()))
+
+	called := false
+	h := tracer.Handler("rule", nil, func(next http.Handler) http.Handler { return next },
+		http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true }))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, called)
+}
+
+func TestEndpoint(t *testing.T) {
+	assert.Equal(t, "http://localhost:4318/v1/traces", tracing.Endpoint("http://localhost:4318"))
+	assert.Equal(t, "http://localhost:4318/v1/traces", tracing.Endpoint("http://localhost:4318/"))
+	assert.Equal(t, "https://otel.example.com/otlp/v1/traces",
+		tracing.Endpoint("https://otel.example.com/otlp/v1/traces"))
+}
@@ -0,0 +1,154 @@
+package userstore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/share/password"
+)
+
+// Store holds the users and groups shared by all rules. Users and groups are defined in the rules file, in an
+// htpasswd compatible users file and in a groups file. Loading replaces all users and groups at once, so
+// concurrent requests either see the previous or the new state.
+type Store struct {
+	usersFile  string
+	groupsFile string
+
+	dir atomic.Pointer[directory]
+}
+
+type directory struct {
+	users  map[string]string
+	groups map[string]map[string]bool
+}
+
+func New(usersFile string, groupsFile string) *Store {
+	s := &Store{
+		usersFile:  usersFile,
+		groupsFile: groupsFile,
+	}
+	s.dir.Store(&directory{})
+	return s
+}
+
+// Files returns the users and groups files to be watched for changes
+func (s *Store) Files() (files []string) {
+	for _, f := range []string{s.usersFile, s.groupsFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// Load merges the users and groups of the rules file with those of the users and groups files. On error, the
+// previously loaded users and groups stay active.
+func (s *Store) Load(users []rules.User, groups map[string][]string) error {
+	d := &directory{
+		users:  make(map[string]string, len(users)),
+		groups: make(map[string]map[string]bool, len(groups)),
+	}
+	for _, user := range users {
+		d.users[user.Username] = user.Password
+	}
+	for group, members := range groups {
+		d.addMembers(group, members)
+	}
+
+	if s.usersFile != "" {
+		err := readLines(s.usersFile, func(line string) error {
+			username, hash, ok := strings.Cut(line, ":")
+			if !ok || username == "" {
+				return fmt.Errorf("expected '<username>:<password hash>'")
+			}
+			if _, exists := d.users[username]; exists {
+				return fmt.Errorf("user '%s' is also defined in the rules file", username)
+			}
+			if err := checkHash(hash); err != nil {
+				return fmt.Errorf("password of user '%s': %w", username, err)
+			}
+			d.users[username] = hash
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if s.groupsFile != "" {
+		err := readLines(s.groupsFile, func(line string) error {
+			group, members, ok := strings.Cut(line, ":")
+			if !ok || strings.TrimSpace(group) == "" {
+				return fmt.Errorf("expected '<group>: <user> <user> ...'")
+			}
+			d.addMembers(strings.TrimSpace(group), strings.Fields(members))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	s.dir.Store(d)
+	return nil
+}
+
+// Verify reports whether the user exists and the password matches
+func (s *Store) Verify(username string, pw string) (bool, error) {
+	hash, ok := s.dir.Load().users[username]
+	if !ok {
+		return false, nil
+	}
+	return password.Verify(hash, pw, password.Plain)
+}
+
+// IsMember reports whether the user belongs to the group
+func (s *Store) IsMember(username string, group string) bool {
+	return s.dir.Load().groups[group][username]
+}
+
+func (d *directory) addMembers(group string, members []string) {
+	if d.groups[group] == nil {
+		d.groups[group] = make(map[string]bool, len(members))
+	}
+	for _, member := range members {
+		d.groups[group][member] = true
+	}
+}
+
+// checkHash rejects hashes created by htpasswd with algorithms other than bcrypt, like MD5 ($apr1$) or SHA-1
+// ({SHA}), which would otherwise be taken for clear text passwords
+func checkHash(hash string) error {
+	if password.Detect(hash) == "" && (strings.HasPrefix(hash, "$") || strings.HasPrefix(hash, "{")) {
+		return fmt.Errorf("unsupported hash algorithm, use bcrypt (htpasswd -B)")
+	}
+	return password.Check(hash)
+}
+
+// readLines calls fn for each line of the file, skipping empty lines and comments
+func readLines(file string, fn func(line string) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s line %d: %w", file, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", file, err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package userstore_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/userstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const bcryptHash = "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW" // U*U
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	usersFile := filepath.Join(dir, "users.htpasswd")
+	groupsFile := filepath.Join(dir, "groups")
+	require.NoError(t, os.WriteFile(usersFile, []byte("# htpasswd -B\nbob:"+bcryptHash+"\n\ncarol:plain\n"), 0600))
+	require.NoError(t, os.WriteFile(groupsFile, []byte("ops: bob carol\ndev: carol\n"), 0600))
+
+	s := userstore.New(usersFile, groupsFile)
+	assert.Equal(t, []string{usersFile, groupsFile}, s.Files())
+	err := s.Load(
+		[]rules.User{{Username: "alice", Password: "secret"}},
+		map[string][]string{"ops": {"alice"}},
+	)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		username string
+		password string
+		want     bool
+	}{
+		{name: "rules file user", username: "alice", password: "secret", want: true},
+		{name: "htpasswd bcrypt", username: "bob", password: "U*U", want: true},
+		{name: "htpasswd plain", username: "carol", password: "plain", want: true},
+		{name: "wrong password", username: "bob", password: "wrong"},
+		{name: "unknown user", username: "dave", password: "secret"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, err := s.Verify(tc.username, tc.password)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, ok)
+		})
+	}
+
+	assert.True(t, s.IsMember("alice", "ops"), "groups of the rules file and the groups file are merged")
+	assert.True(t, s.IsMember("bob", "ops"))
+	assert.False(t, s.IsMember("bob", "dev"))
+	assert.False(t, s.IsMember("bob", "unknown"))
+
+	t.Run("reload", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(groupsFile, []byte("ops: carol\n"), 0600))
+		require.NoError(t, s.Load(nil, nil))
+		assert.False(t, s.IsMember("bob", "ops"))
+		ok, _ := s.Verify("alice", "secret")
+		assert.False(t, ok, "user removed from rules file")
+	})
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		users   string
+		wantErr string
+	}{
+		{name: "missing colon", users: "alice", wantErr: "line 1: expected '<username>:<password hash>'"},
+		{name: "md5", users: "alice:$apr1$abc$def", wantErr: "line 1: password of user 'alice': unsupported hash algorithm"},
+		{name: "sha1", users: "\nalice:{SHA}abc=", wantErr: "line 2: password of user 'alice': unsupported hash algorithm"},
+		{name: "duplicate", users: "bob:x", wantErr: "line 1: user 'bob' is also defined in the rules file"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			usersFile := filepath.Join(t.TempDir(), "users")
+			require.NoError(t, os.WriteFile(usersFile, []byte(tc.users), 0600))
+			s := userstore.New(usersFile, "")
+			err := s.Load([]rules.User{{Username: "bob", Password: "y"}}, nil)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+
+			ok, _ := s.Verify("bob", "y")
+			assert.False(t, ok, "nothing loaded on error")
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package validation
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/http-everything/httpe/pkg/requestdata"
+	"github.com/http-everything/httpe/pkg/rules"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// FieldError describes why the input of a single field is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors is the list of all invalid fields of a request
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Field+": "+fe.Message)
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// Validator validates the input of requests against the validate definition of a rule. The JSON schema and the
+// patterns of regex fields are compiled once, when the validator is created.
+type Validator struct {
+	params map[string]compiledField
+	form   map[string]compiledField
+	schema *gojsonschema.Schema
+}
+
+// compiledField is a field definition with its pattern compiled
+type compiledField struct {
+	rules.Field
+	re *regexp.Regexp
+}
+
+// New compiles the validate definition. Returns nil if v is nil. An error is returned if a pattern or the JSON
+// schema is invalid or the JSON schema file can't be read.
+func New(v *rules.Validate) (*Validator, error) {
+	if v == nil {
+		return nil, nil
+	}
+	params, err := compileFields("params", v.Params)
+	if err != nil {
+		return nil, err
+	}
+	form, err := compileFields("form", v.Form)
+	if err != nil {
+		return nil, err
+	}
+	validator := &Validator{params: params, form: form}
+	loader, err := v.SchemaLoader()
+	if err != nil {
+		return nil, err
+	}
+	if loader != nil {
+		if validator.schema, err = gojsonschema.NewSchema(loader); err != nil {
+			return nil, fmt.Errorf("invalid json schema: %w", err)
+		}
+	}
+	return validator, nil
+}
+
+func compileFields(source string, defs map[string]rules.Field) (map[string]compiledField, error) {
+	fields := make(map[string]compiledField, len(defs))
+	for name, def := range defs {
+		f := compiledField{Field: def}
+		if def.Type == rules.FieldRegex {
+			re, err := regexp.Compile(`^(?:` + def.Pattern + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern of %s.%s: %w", source, name, err)
+			}
+			f.re = re
+		}
+		fields[name] = f
+	}
+	return fields, nil
+}
+
+// Request validates the input of a request. Invalid input is reported by the returned field errors, which are
+// empty if the input is valid. A nil validator accepts every request.
+func (v *Validator) Request(reqData requestdata.Data) (fieldErrs Errors, err error) {
+	if v == nil {
+		return nil, nil
+	}
+	fieldErrs = append(fieldErrs, fields("params", v.params, reqData.Input.Params)...)
+	fieldErrs = append(fieldErrs, fields("form", v.form, reqData.Input.Form)...)
+	if v.schema == nil {
+		return fieldErrs, nil
+	}
+	result, err := v.schema.Validate(gojsonschema.NewGoLoader(reqData.Input.JSON))
+	if err != nil {
+		return nil, fmt.Errorf("json schema validation failed: %w", err)
+	}
+	for _, desc := range result.Errors() {
+		field := "json"
+		if desc.Field() != gojsonschema.STRING_CONTEXT_ROOT {
+			field += "." + desc.Field()
+		}
+		fieldErrs = append(fieldErrs, FieldError{Field: field, Message: desc.Description()})
+	}
+	return fieldErrs, nil
+}
+
+func fields(source string, expected map[string]compiledField, values map[string]string) (fieldErrs Errors) {
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if msg := value(expected[name], values[name]); msg != "" {
+			fieldErrs = append(fieldErrs, FieldError{Field: source + "." + name, Message: msg})
+		}
+	}
+	return fieldErrs
+}
+
+// value checks a single value against the field definition. Empty values are treated like missing values.
+// Returns a message describing why the value is invalid or an empty string if the value is valid.
+func value(field compiledField, value string) (msg string) {
+	if value == "" {
+		if field.Required {
+			return "is required"
+		}
+		return ""
+	}
+	length := utf8.RuneCountInString(value)
+	if field.MinLength > 0 && length < field.MinLength {
+		return fmt.Sprintf("must be at least %d characters long", field.MinLength)
+	}
+	if field.MaxLength > 0 && length > field.MaxLength {
+		return fmt.Sprintf("must be at most %d characters long", field.MaxLength)
+	}
+
+	switch field.Type {
+	case rules.FieldInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return "must be an integer"
+		}
+	case rules.FieldBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "must be a boolean"
+		}
+	case rules.FieldEnum:
+		for _, v := range field.Values {
+			if v == value {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of '%s'", strings.Join(field.Values, "', '"))
+	case rules.FieldRegex:
+		if !field.re.MatchString(value) {
+			return fmt.Sprintf("must match '%s'", field.Pattern)
+		}
+	case rules.FieldEmail:
+		addr, err := mail.ParseAddress(value)
+		if err != nil || addr.Address != value {
+			return "must be an email address"
+		}
+	case rules.FieldIP:
+		if net.ParseIP(value) == nil {
+			return "must be an IP address"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,191 @@
+package validation_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/http-everything/httpe/pkg/requestdata"
+	"github.com/http-everything/httpe/pkg/rules"
+	"github.com/http-everything/httpe/pkg/validation"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValue(t *testing.T) {
+	cases := []struct {
+		name    string
+		field   rules.Field
+		value   string
+		wantMsg string
+	}{
+		{name: "optional missing", field: rules.Field{Type: rules.FieldInt}},
+		{name: "required missing", field: rules.Field{Required: true}, wantMsg: "is required"},
+		{name: "string", field: rules.Field{}, value: "anything"},
+		{name: "too short", field: rules.Field{MinLength: 3}, value: "ab", wantMsg: "must be at least 3 characters long"},
+		{name: "too long", field: rules.Field{MaxLength: 3}, value: "äöüß", wantMsg: "must be at most 3 characters long"},
+		{name: "length ok", field: rules.Field{MinLength: 3, MaxLength: 4}, value: "äöüß"},
+		{name: "int", field: rules.Field{Type: rules.FieldInt}, value: "-42"},
+		{name: "not int", field: rules.Field{Type: rules.FieldInt}, value: "4.2", wantMsg: "must be an integer"},
+		{name: "bool", field: rules.Field{Type: rules.FieldBool}, value: "true"},
+		{name: "not bool", field: rules.Field{Type: rules.FieldBool}, value: "yes", wantMsg: "must be a boolean"},
+		{name: "enum", field: rules.Field{Type: rules.FieldEnum, Values: []string{"a", "b"}}, value: "b"},
+		{
+			name:    "not enum",
+			field:   rules.Field{Type: rules.FieldEnum, Values: []string{"a", "b"}},
+			value:   "c",
+			wantMsg: "must be one of 'a', 'b'",
+		},
+		{name: "regex", field: rules.Field{Type: rules.FieldRegex, Pattern: "[a-z]+"}, value: "abc"},
+		{
+			name:    "regex matches partially",
+			field:   rules.Field{Type: rules.FieldRegex, Pattern: "[a-z]+"},
+			value:   "abc; id",
+			wantMsg: "must match '[a-z]+'",
+		},
+		{name: "email", field: rules.Field{Type: rules.FieldEmail}, value: "john@example.com"},
+		{
+			name:    "email with name",
+			field:   rules.Field{Type: rules.FieldEmail},
+			value:   "John <john@example.com>",
+			wantMsg: "must be an email address",
+		},
+		{name: "ipv4", field: rules.Field{Type: rules.FieldIP}, value: "192.168.1.1"},
+		{name: "ipv6", field: rules.Field{Type: rules.FieldIP}, value: "::1"},
+		{name: "not ip", field: rules.Field{Type: rules.FieldIP}, value: "localhost", wantMsg: "must be an IP address"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := validation.New(&rules.Validate{Params: map[string]rules.Field{"f": tc.field}})
+			require.NoError(t, err)
+			fieldErrs, err := v.Request(requestdata.Data{Input: requestdata.Input{Params: requestdata.Params{"f": tc.value}}})
+			require.NoError(t, err)
+			if tc.wantMsg == "" {
+				assert.Empty(t, fieldErrs)
+			} else {
+				assert.Equal(t, validation.Errors{{Field: "params.f", Message: tc.wantMsg}}, fieldErrs)
+			}
+		})
+	}
+}
+
+func TestRequest(t *testing.T) {
+	schema := map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"name"},
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{"type": "string"},
+			"age":  map[string]interface{}{"type": "integer"},
+		},
+	}
+	schemaFile := filepath.Join(t.TempDir(), "schema.json")
+	require.NoError(t, os.WriteFile(schemaFile, []byte(`{"type":"object","required":["name"]}`), 0600))
+
+	cases := []struct {
+		name     string
+		validate rules.Validate
+		input    requestdata.Input
+		want     validation.Errors
+	}{
+		{
+			name: "valid",
+			validate: rules.Validate{
+				Params: map[string]rules.Field{"id": {Required: true, Type: rules.FieldInt}},
+				Form:   map[string]rules.Field{"mail": {Type: rules.FieldEmail}},
+			},
+			input: requestdata.Input{Params: requestdata.Params{"id": "1"}},
+		},
+		{
+			name: "invalid fields",
+			validate: rules.Validate{
+				Params: map[string]rules.Field{
+					"id":   {Required: true, Type: rules.FieldInt},
+					"sort": {Type: rules.FieldEnum, Values: []string{"asc", "desc"}},
+				},
+				Form: map[string]rules.Field{"mail": {Required: true, Type: rules.FieldEmail}},
+			},
+			input: requestdata.Input{
+				Params: requestdata.Params{"id": "x", "sort": "up"},
+				Form:   requestdata.Form{"other": "value"},
+			},
+			want: validation.Errors{
+				{Field: "params.id", Message: "must be an integer"},
+				{Field: "params.sort", Message: "must be one of 'asc', 'desc'"},
+				{Field: "form.mail", Message: "is required"},
+			},
+		},
+		{
+			name:     "json schema",
+			validate: rules.Validate{JSONSchema: schema},
+			input:    requestdata.Input{JSON: map[string]interface{}{"name": "John", "age": 42.0}},
+		},
+		{
+			name:     "json schema invalid",
+			validate: rules.Validate{JSONSchema: schema},
+			input:    requestdata.Input{JSON: map[string]interface{}{"age": "old"}},
+			want: validation.Errors{
+				{Field: "json", Message: "name is required"},
+				{Field: "json.age", Message: "Invalid type. Expected: integer, given: string"},
+			},
+		},
+		{
+			name:     "json schema without body",
+			validate: rules.Validate{JSONSchema: schema},
+			want: validation.Errors{
+				{Field: "json", Message: "Invalid type. Expected: object, given: null"},
+			},
+		},
+		{
+			name:     "json schema file",
+			validate: rules.Validate{JSONSchemaFile: schemaFile},
+			input:    requestdata.Input{JSON: map[string]interface{}{}},
+			want: validation.Errors{
+				{Field: "json", Message: "name is required"},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := validation.New(&tc.validate)
+			require.NoError(t, err)
+			fieldErrs, err := v.Request(requestdata.Data{Input: tc.input})
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, fieldErrs)
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		name     string
+		validate *rules.Validate
+		wantErr  string
+	}{
+		{name: "nil"},
+		{
+			name:     "schema file missing",
+			validate: &rules.Validate{JSONSchemaFile: filepath.Join(t.TempDir(), "missing.json")},
+			wantErr:  "invalid json schema",
+		},
+		{
+			name:     "invalid pattern",
+			validate: &rules.Validate{Form: map[string]rules.Field{"id": {Type: rules.FieldRegex, Pattern: "[a-z"}}},
+			wantErr:  "invalid pattern of form.id",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := validation.New(tc.validate)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			// A nil validator accepts every request
+			fieldErrs, err := v.Request(requestdata.Data{})
+			assert.NoError(t, err)
+			assert.Empty(t, fieldErrs)
+		})
+	}
+}